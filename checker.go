@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -18,9 +19,10 @@ const (
 )
 
 var (
-	validMethods     = map[ValidationMethod]bool{HTTP01: true, DNS01: true, TLSALPN01: true}
-	errNotApplicable = errors.New("Checker not applicable for this domain and method")
-	checkers         []checker
+	validMethods      = map[ValidationMethod]bool{HTTP01: true, DNS01: true, TLSALPN01: true}
+	errNotApplicable  = errors.New("Checker not applicable for this domain and method")
+	checkers          []checker
+	multiNameCheckers []multiNameChecker
 )
 
 func init() {
@@ -39,26 +41,68 @@ func init() {
 			ofac,
 		},
 
+		zoneChecker{}, // depends on valid*Checker
+
 		asyncCheckerBlock{
-			caaChecker{},             // depends on valid*Checker
-			&rateLimitChecker{},      // depends on valid*Checker
-			dnsAChecker{},            // depends on valid*Checker
-			txtRecordChecker{},       // depends on valid*Checker
-			txtDoubledLabelChecker{}, // depends on valid*Checker
+			caaChecker{},                    // depends on valid*Checker
+			caaUnsupportedProviderChecker{}, // depends on valid*Checker
+			cdnCAAChecker{},                 // depends on valid*Checker
+			wildcardCNAMEBaseChecker{},      // depends on valid*Checker
+			&rateLimitChecker{},             // depends on valid*Checker
+			certificateExpiryChecker{},      // depends on valid*Checker
+			renewalInfoChecker{},            // depends on valid*Checker
+			dnsAChecker{},                   // depends on valid*Checker
+			clientSubnetChecker{},           // depends on valid*Checker
+			resolverInterceptionChecker{},   // depends on valid*Checker
+			glueChecker{},                   // depends on valid*Checker
+			lameNameserverChecker{},         // depends on valid*Checker
+			dnssecChainChecker{},            // depends on valid*Checker
+			dnssecSignatureChecker{},        // depends on valid*Checker
+			flappingDNSChecker{},            // depends on valid*Checker
+			parkingNameserverChecker{},      // depends on valid*Checker
+			apexFlatteningChecker{},         // depends on valid*Checker
+			anycastChecker{},                // depends on valid*Checker
+			highTTLChecker{},                // depends on valid*Checker
+			zeroTTLChecker{},                // depends on valid*Checker
+			addressTTLMismatchChecker{},     // depends on valid*Checker
+			ipv4OnlyChecker{},               // depends on valid*Checker
+			dnameChecker{},                  // depends on valid*Checker
+			txtRecordChecker{},              // depends on valid*Checker
+			txtDoubledLabelChecker{},        // depends on valid*Checker
+			txtStaleRecordChecker{},         // depends on valid*Checker
+			txtChallengeFormatChecker{},     // depends on valid*Checker
+			txtMultipleRecordsChecker{},     // depends on valid*Checker
+			wildcardTXTNameChecker{},        // depends on valid*Checker
+			wildcardShadowChecker{},         // depends on valid*Checker
 		},
 
 		asyncCheckerBlock{
 			httpAccessibilityChecker{}, // depends on dnsAChecker
+			multiPerspectiveChecker{},  // depends on dnsAChecker
 			cloudflareChecker{},        // depends on dnsAChecker to some extent
+			managedPlatformChecker{},   // depends on dnsAChecker
+			tlsALPNChecker{},           // depends on dnsAChecker
+			wwwCounterpartChecker{},    // depends on dnsAChecker
 			&acmeStagingChecker{},      // Gets the final word
 		},
 	}
+
+	// These are run after every name has been individually checked by the above
+	multiNameCheckers = []multiNameChecker{
+		caaWildcardDivergenceChecker{},
+		partialResolutionChecker{},
+	}
 }
 
 type checker interface {
 	Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error)
 }
 
+// multiNameChecker is a checker which considers all of the names that are to be issued together.
+type multiNameChecker interface {
+	CheckNames(ctx *scanContext, domains []string, method ValidationMethod) ([]Problem, error)
+}
+
 // asyncCheckerBlock represents a checker which is composed of other checkers that can be run simultaneously.
 type asyncCheckerBlock []checker
 
@@ -75,16 +119,7 @@ func (c asyncCheckerBlock) Check(ctx *scanContext, domain string, method Validat
 
 	for _, task := range c {
 		go func(task checker, ctx *scanContext, domain string, method ValidationMethod) {
-			defer func() {
-				if r := recover(); r != nil {
-					resultCh <- asyncResult{nil, fmt.Errorf("Check %T paniced: %v", task, r)}
-				}
-			}()
-			t := reflect.TypeOf(task)
-			debug("[%s] async: + %v\n", id, t)
-			start := time.Now()
-			probs, err := task.Check(ctx, domain, method)
-			debug("[%s] async: - %v in %v\n", id, t, time.Since(start))
+			probs, err := runChecker(ctx, task, domain, method, "["+id+"] async")
 			resultCh <- asyncResult{probs, err}
 		}(task, ctx, domain, method)
 	}
@@ -105,3 +140,118 @@ func (c asyncCheckerBlock) Check(ctx *scanContext, domain string, method Validat
 	debug("[%s] Exiting async gracefully\n", id)
 	return probs, nil
 }
+
+// runChecker runs a single checker, tracing its execution to the debug log
+// and to any event hook configured on the scan context.
+// If the checker panics, the panic is reported as a problem so that the remaining
+// checkers may continue.
+func runChecker(ctx *scanContext, c checker, domain string, method ValidationMethod, prefix string) (probs []Problem, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			debug("%s: %v paniced: %v\n", prefix, reflect.TypeOf(c), r)
+			ctx.recordCheckerError(checkerName(c), domain, fmt.Errorf("panic: %v", r))
+			probs, err = []Problem{checkerPanicked(c, r)}, nil
+		}
+	}()
+
+	t := reflect.TypeOf(c)
+	// Blocks are only containers, their members report for themselves
+	_, isBlock := c.(asyncCheckerBlock)
+
+	if !isBlock && ctx.skips(c) {
+		debug("%s: skipping %v\n", prefix, t)
+		return nil, errNotApplicable
+	}
+
+	debug("%s: + %v\n", prefix, t)
+	if !isBlock {
+		ctx.emit(ScanEvent{Type: ScanEventStart, Checker: checkerName(c), Domain: domain, Method: method})
+	}
+
+	// Checkers (but not blocks, whose members are timed individually) are abandoned at the
+	// scan's deadline, and aren't started after it
+	var finished bool
+	start := time.Now()
+	if isBlock {
+		probs, err = c.Check(ctx, domain, method)
+		finished = true
+	} else if ctx.Context().Err() == nil {
+		probs, finished, err = ctx.runBeforeDeadline(func() ([]Problem, error) {
+			return c.Check(ctx, domain, method)
+		})
+	}
+	took := time.Since(start)
+
+	if !finished {
+		debug("%s: %v did not finish before the deadline\n", prefix, t)
+		ctx.recordUnfinished(checkerName(c), domain)
+		probs, err = nil, ctx.Context().Err()
+	}
+
+	debug("%s: - %v in %v\n", prefix, t, took)
+	if !isBlock {
+		ctx.emit(ScanEvent{
+			Type:     ScanEventFinish,
+			Checker:  checkerName(c),
+			Domain:   domain,
+			Method:   method,
+			Duration: took,
+			Problems: len(probs),
+			Error:    err,
+		})
+	}
+
+	if !finished {
+		return nil, errNotApplicable
+	}
+
+	// A failing checker is reported, and any problems it found are kept, but the scan continues
+	if err != nil && err != errNotApplicable && !isBlock {
+		debug("%s: %v failed: %v\n", prefix, t, err)
+		ctx.recordCheckerError(checkerName(c), domain, err)
+		probs, err = append(probs, checkerFailed(c, err)), nil
+	}
+
+	return probs, err
+}
+
+// checkerName is the name used to identify a checker (or multiNameChecker) in scan events.
+func checkerName(c interface{}) string {
+	t := reflect.TypeOf(c)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// CheckerNames lists the names of every checker, which may be provided to Options.SkipCheckers.
+func CheckerNames() []string {
+	var names []string
+	var add func(cs []checker)
+	add = func(cs []checker) {
+		for _, c := range cs {
+			if block, ok := c.(asyncCheckerBlock); ok {
+				add(block)
+				continue
+			}
+			names = append(names, checkerName(c))
+		}
+	}
+	add(checkers)
+	for _, c := range multiNameCheckers {
+		names = append(names, checkerName(c))
+	}
+	return names
+}
+
+func checkerFailed(c interface{}, err error) Problem {
+	return internalProblem(fmt.Sprintf("The %s check failed and was skipped: %v", checkerName(c), err), SeverityError)
+}
+
+func checkerPanicked(c checker, r interface{}) Problem {
+	msg := strings.Join(strings.Fields(fmt.Sprintf("%v", r)), " ")
+	if runes := []rune(msg); len(runes) > 200 {
+		msg = string(runes[:200]) + "..."
+	}
+	return internalProblem(fmt.Sprintf("The %s check failed unexpectedly and was skipped: %s", checkerName(c), msg), SeverityError)
+}
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"errors"
+	"strings"
+	"unicode/utf8"
 )
 
 type checkerFail struct{}
@@ -24,6 +26,12 @@ func (c checkerSucceedWithProblem) Check(ctx *scanContext, domain string, method
 	return []Problem{{Name: "Empty"}}, nil
 }
 
+type checkerSucceedWithDebugProblem struct{}
+
+func (c checkerSucceedWithDebugProblem) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	return []Problem{debugProblem("Debug", "", "")}, nil
+}
+
 type checkerPanic struct{}
 
 func (c checkerPanic) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
@@ -45,19 +53,54 @@ func TestAsyncCheckerBlock_Check(t *testing.T) {
 		t.Fatalf("expected 2 problems, got: %d", len(probs))
 	}
 
-	// check fail condition
+	// check that a failing checker is reported without failing the block
 	a = asyncCheckerBlock{
 		checkerFail{},
+		checkerSucceedWithProblem{},
 	}
-	if _, err := a.Check(nil, "", ""); err == nil {
-		t.Fatal("expected error, got none")
+	probs, err = a.Check(nil, "", "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(probs) != 2 {
+		t.Fatalf("expected the failure and the other checker's problem, got: %v", probs)
 	}
 
 	// check panic recovery
 	a = asyncCheckerBlock{
 		checkerPanic{},
+		checkerSucceedEmpty{},
+	}
+	probs, err = a.Check(nil, "", "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(probs) != 1 || probs[0].Name != "InternalProblem" || probs[0].Severity != SeverityError {
+		t.Fatalf("expected panic to be reported as a problem, got: %v", probs)
+	}
+}
+
+func TestRunChecker_Skip(t *testing.T) {
+	ctx := newScanContextFromOptions(Options{SkipCheckers: []string{"CheckerSucceedWithProblem"}})
+	if _, err := runChecker(ctx, checkerSucceedWithProblem{}, "example.org", HTTP01, ""); err != errNotApplicable {
+		t.Fatalf("expected the skipped checker to be not applicable, got: %v", err)
+	}
+	if probs, _ := runChecker(ctx, checkerFail{}, "example.org", HTTP01, ""); len(probs) != 1 {
+		t.Fatal("expected other checkers to still run")
 	}
-	if _, err := a.Check(nil, "", ""); err == nil {
-		t.Fatal("expected error, got none")
+
+	names := map[string]bool{}
+	for _, name := range CheckerNames() {
+		names[name] = true
+	}
+	if !names["httpAccessibilityChecker"] || !names["partialResolutionChecker"] || names["asyncCheckerBlock"] {
+		t.Fatalf("expected every checker to be listed, got: %v", CheckerNames())
+	}
+}
+
+func TestCheckerPanicked_Truncate(t *testing.T) {
+	prob := checkerPanicked(checkerPanic{}, strings.Repeat("é", 300))
+	if !utf8.ValidString(prob.Detail) || !strings.Contains(prob.Detail, strings.Repeat("é", 200)+"...") {
+		t.Fatalf("expected the panic to be truncated to 200 characters, got: %q", prob.Detail)
 	}
 }
@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/letsdebug/letsdebug"
 )
@@ -13,27 +16,241 @@ func main() {
 	var domain string
 	var validationMethod string
 	var showDebug bool
+	var httpPort int
+	var httpControlProbe bool
+	var httpHeadProbe bool
+	var httpVirtualHostProbe bool
+	var httpUserAgentProbe bool
+	var httpPathProbe bool
+	var httpRepeatProbe bool
+	var httpStrictTLS bool
+	var httpMaxRedirects int
+	var vantagePointProxies string
+	var neutralVantage bool
+	var addressOverride string
+	var httpProxy string
+	var caaIssuers string
+	var renewalInfo bool
+	var acmeDirectory string
+	var certificateSerial string
+	var skipCheckers string
+	var challengeToken string
+	var accountThumbprint string
+	var listCheckers bool
+	var scanTimeout time.Duration
+	var format string
 
-	flag.StringVar(&domain, "domain", "example.org", "What domain to check")
-	flag.StringVar(&validationMethod, "method", "http-01", "Which validation method to assume (http-01,dns-01)")
+	flag.StringVar(&domain, "domain", "example.org", "What domain to check (or a comma-separated list of domains to be issued together)")
+	flag.StringVar(&validationMethod, "method", "http-01",
+		"Which validation method to assume (http-01,dns-01,tls-alpn-01), a comma-separated list of them, or \"all\"")
 	flag.BoolVar(&showDebug, "debug", false, "Whether to show debug problems")
+	flag.IntVar(&httpPort, "http-port", 80, "Which port to use for the HTTP check (debugging only, Let's Encrypt always uses 80)")
+	flag.BoolVar(&httpControlProbe, "http-control-probe", false,
+		"Whether to compare the HTTP check to a request for an unrelated path, to detect interception of the ACME path")
+	flag.BoolVar(&httpHeadProbe, "http-head-probe", false,
+		"Whether to repeat the HTTP check using the HEAD method, to detect method-sensitive proxies")
+	flag.BoolVar(&httpVirtualHostProbe, "http-vhost-probe", false,
+		"Whether to repeat the HTTP check with an unrelated Host header, to detect servers with only a default virtual host")
+	flag.BoolVar(&httpUserAgentProbe, "http-ua-probe", false,
+		"Whether to repeat a failed HTTP check with a browser User-Agent, to detect bot protection")
+	flag.BoolVar(&httpPathProbe, "http-path-probe", false,
+		"Whether to repeat the HTTP check with a trailing slash and a query string, to detect fragile rewrite rules")
+	flag.BoolVar(&httpRepeatProbe, "http-repeat-probe", false,
+		"Whether to repeat the HTTP check to the same server, to detect inconsistent load-balanced backends")
+	flag.BoolVar(&httpStrictTLS, "http-strict-tls", false,
+		"Whether to treat certificate errors on HTTPS redirects as fatal (Let's Encrypt doesn't verify them)")
+	flag.IntVar(&httpMaxRedirects, "http-max-redirects", 10, "The maximum number of redirects to follow during the HTTP check")
+	flag.StringVar(&vantagePointProxies, "vantage-point-proxies", "",
+		"Comma-separated list of HTTP or SOCKS5 proxy URLs to repeat the HTTP check from")
+	flag.BoolVar(&neutralVantage, "neutral-vantage", false,
+		"Declare that this runs from a network unrelated to the domain's servers, so source-address-based blocks would be seen")
+	flag.StringVar(&httpProxy, "http-proxy", "", "An HTTP or SOCKS5 proxy URL to make the HTTP check through")
+	flag.StringVar(&caaIssuers, "caa-issuers", "",
+		"Comma-separated list of CAA issuer domains to accept in addition to letsencrypt.org")
+	flag.StringVar(&addressOverride, "address-override", "",
+		"Comma-separated list of IP addresses to check instead of the domain's A and AAAA records")
+	flag.BoolVar(&renewalInfo, "renewal-info", false,
+		"Whether to look up the ACME Renewal Information (suggested renewal window) of the latest certificate")
+	flag.StringVar(&acmeDirectory, "acme-directory", letsdebug.ACMEDirectoryProduction,
+		"The ACME directory URL to look up Renewal Information from")
+	flag.StringVar(&certificateSerial, "certificate-serial", "",
+		"The hexadecimal serial number of the certificate to look up Renewal Information for, instead of the latest")
+	flag.StringVar(&challengeToken, "http-challenge-token", "",
+		"A real http-01 challenge token to request, whose key authorization is verified (requires -account-thumbprint)")
+	flag.StringVar(&accountThumbprint, "account-thumbprint", "", "The base64url-encoded thumbprint of the ACME account key")
+	flag.StringVar(&skipCheckers, "skip-checkers", "", "Comma-separated list of checkers not to run (see -list-checkers)")
+	flag.DurationVar(&scanTimeout, "scan-timeout", 0, "The maximum time the whole scan may take (e.g. 30s), after which partial results are shown")
+	flag.BoolVar(&listCheckers, "list-checkers", false, "List the names of every checker and exit")
+	flag.StringVar(&format, "format", "text",
+		"How to print the problems: text, plain (grouped by severity), markdown, or api (the JSON schema of the letsdebug.net API)")
 	flag.Parse()
 
-	probs, err := letsdebug.Check(domain, letsdebug.ValidationMethod(validationMethod))
+	renderers := map[string]letsdebug.Renderer{
+		"text":     nil,
+		"plain":    letsdebug.PlaintextRenderer{},
+		"markdown": letsdebug.MarkdownRenderer{},
+		"api":      letsdebug.APIRenderer{},
+	}
+	renderer, ok := renderers[format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid format: %s", format)
+		os.Exit(1)
+	}
+
+	if listCheckers {
+		for _, name := range letsdebug.CheckerNames() {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	var vantagePoints []letsdebug.VantagePoint
+	for _, proxyURL := range strings.Split(vantagePointProxies, ",") {
+		if proxyURL = strings.TrimSpace(proxyURL); proxyURL == "" {
+			continue
+		}
+		vp, err := letsdebug.NewProxyVantagePoint(proxyURL, proxyURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid vantage point: %s", err)
+			os.Exit(1)
+		}
+		vantagePoints = append(vantagePoints, vp)
+	}
+
+	var addrs []net.IP
+	for _, addr := range strings.Split(addressOverride, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "Invalid override address: %s", addr)
+			os.Exit(1)
+		}
+		addrs = append(addrs, ip)
+	}
+
+	var proxyURL *url.URL
+	if httpProxy != "" {
+		u, err := url.Parse(httpProxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid proxy: %s", err)
+			os.Exit(1)
+		}
+		proxyURL = u
+	}
+
+	var additionalIssuers []string
+	for _, issuer := range strings.Split(caaIssuers, ",") {
+		if issuer = strings.TrimSpace(issuer); issuer != "" {
+			additionalIssuers = append(additionalIssuers, issuer)
+		}
+	}
+
+	opts := letsdebug.Options{
+		HTTPPort:             httpPort,
+		HTTPChallengeToken:   challengeToken,
+		AccountThumbprint:    accountThumbprint,
+		HTTPControlProbe:     httpControlProbe,
+		HTTPHeadProbe:        httpHeadProbe,
+		HTTPVirtualHostProbe: httpVirtualHostProbe,
+		HTTPUserAgentProbe:   httpUserAgentProbe,
+		HTTPPathProbe:        httpPathProbe,
+		HTTPRepeatProbe:      httpRepeatProbe,
+		HTTPStrictTLS:        httpStrictTLS,
+		HTTPMaxRedirects:     httpMaxRedirects,
+		VantagePoints:        vantagePoints,
+		NeutralVantage:       neutralVantage,
+		AddressOverride:      addrs,
+		HTTPProxy:            proxyURL,
+		AdditionalCAAIssuers: additionalIssuers,
+		RenewalInfo:          renewalInfo,
+		ACMEDirectory:        acmeDirectory,
+		CertificateSerial:    certificateSerial,
+		SkipCheckers:         strings.Split(skipCheckers, ","),
+		ScanTimeout:          scanTimeout,
+		SortProblems:         true,
+		IncludeDebug:         showDebug,
+	}
+
+	if validationMethod == "all" || strings.Contains(validationMethod, ",") {
+		checkMethods(strings.Split(domain, ","), validationMethod, opts, renderer)
+		return
+	}
+
+	var probs []letsdebug.Problem
+	var err error
+	if domains := strings.Split(domain, ","); len(domains) > 1 {
+		probs, err = letsdebug.CheckMultipleWithOptions(domains, letsdebug.ValidationMethod(validationMethod), opts)
+	} else {
+		probs, err = letsdebug.CheckWithOptions(domain, letsdebug.ValidationMethod(validationMethod), opts)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "A fatal error was experienced: %s", err)
 		os.Exit(1)
 	}
 
+	if renderer != nil {
+		if err := renderer.Render(os.Stdout, probs); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print the problems: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(probs) == 0 {
 		fmt.Println("All OK!")
 		return
 	}
 
-	for _, prob := range probs {
-		if prob.Severity == letsdebug.SeverityDebug && !showDebug {
-			continue
+	printProblems(probs)
+
+	fmt.Printf("VERDICT: %s\n", letsdebug.OverallVerdict(probs))
+}
+
+// checkMethods scans the domains for each of the validation methods, and prints a verdict for each.
+// If a renderer is given, the problems of every method are rendered together instead.
+func checkMethods(domains []string, validationMethod string, opts letsdebug.Options, renderer letsdebug.Renderer) {
+	var methods []letsdebug.ValidationMethod
+	if validationMethod != "all" {
+		for _, method := range strings.Split(validationMethod, ",") {
+			methods = append(methods, letsdebug.ValidationMethod(strings.TrimSpace(method)))
+		}
+	} else {
+		methods = []letsdebug.ValidationMethod{letsdebug.HTTP01, letsdebug.DNS01, letsdebug.TLSALPN01}
+	}
+
+	results, err := letsdebug.ScanMethods(domains, methods, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "A fatal error was experienced: %s", err)
+		os.Exit(1)
+	}
+
+	if renderer != nil {
+		var probs []letsdebug.Problem
+		for _, method := range methods {
+			probs = append(probs, results[method].Problems...)
+		}
+		if err := renderer.Render(os.Stdout, probs); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print the problems: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, method := range methods {
+		if probs := results[method].Problems; len(probs) > 0 {
+			fmt.Printf("%s:\n", method)
+			printProblems(probs)
 		}
+	}
+	for _, method := range methods {
+		fmt.Printf("VERDICT (%s): %s\n", method, letsdebug.OverallVerdict(results[method].Problems))
+	}
+}
+
+func printProblems(probs []letsdebug.Problem) {
+	for _, prob := range probs {
 		fmt.Printf("%s\nPROBLEM:\n  %s\n\nSEVERITY:\n  %s\n\nEXPLANATION:\n  %s\n\nDETAIL:\n  %s\n%s\n",
 			strings.Repeat("-", 50), prob.Name, prob.Severity, prob.Explanation, prob.Detail, strings.Repeat("-", 50))
 	}
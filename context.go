@@ -1,35 +1,118 @@
 package letsdebug
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 type lookupResult struct {
 	RRs   []dns.RR
-	Error error
+	Rcode int
+	// Authority is the authority section of the response, e.g. the SOA record of a negative answer
+	Authority []dns.RR
+	Error     error
 }
 
 type scanContext struct {
 	rrs      map[string]map[uint16]lookupResult
-	rrsMutex sync.Mutex
+	rrsMutex *sync.Mutex
 
 	httpRequestPath    string
 	httpExpectResponse string
+	// keyAuthorization, if set, is the expected response to a real challenge token at httpRequestPath
+	keyAuthorization     string
+	httpPort             int
+	httpControlProbe     bool
+	httpHeadProbe        bool
+	httpVirtualHostProbe bool
+	httpUserAgentProbe   bool
+	httpPathProbe        bool
+	httpRepeatProbe      bool
+	httpStrictTLS        bool
+	httpMaxRedirects     int
+	httpProxy            *url.URL
+	// httpTransport is made by HTTPTransport on first use, and may be shared with other scans
+	httpTransport      *http.Transport
+	httpTransportMutex sync.Mutex
+
+	// tlsALPNPort is the port that tls-alpn-01 validation connects to, which is always 443 outside of tests
+	tlsALPNPort int
+	// httpsPort is the port that the server's certificate is inspected on, which is always 443 outside of tests
+	httpsPort int
+
+	vantagePoints []VantagePoint
+	// neutralVantage is set when the scan is known to run from a network unrelated to the servers
+	neutralVantage bool
+
+	// skipCheckers are the lowercased names of checkers which should not be run
+	skipCheckers map[string]bool
+
+	// names are all of the names being checked together, when checking multiple names
+	names []string
+
+	// caaIssuers are the CAA issuer domains which permit issuance, always including letsencrypt.org
+	caaIssuers []string
+
+	// addressOverride replaces the A and AAAA records of the domains being checked
+	addressOverride []net.IP
+
+	// ctLogs is nil when Certificate Transparency lookups are disabled
+	ctLogs *ctClient
+
+	// renewalInfo enables ACME Renewal Information lookups against acmeDirectory, for the
+	// certificate with certificateSerial or otherwise the most recent one in CT logs
+	renewalInfo       bool
+	acmeDirectory     string
+	certificateSerial string
+
+	eventHook func(ScanEvent)
+
+	// deadline, if set, is done once the scan has run out of time. unfinished lists the checkers
+	// which were abandoned or not started because of it.
+	deadline        context.Context
+	unfinished      []string
+	unfinishedMutex sync.Mutex
+
+	checkerErrors      []CheckerError
+	checkerErrorsMutex sync.Mutex
 }
 
 func newScanContext() *scanContext {
-	return &scanContext{
-		rrs:             map[string]map[uint16]lookupResult{},
-		httpRequestPath: "letsdebug-test",
+	sc := &scanContext{
+		rrs:              map[string]map[uint16]lookupResult{},
+		rrsMutex:         &sync.Mutex{},
+		httpRequestPath:  "letsdebug-test",
+		httpPort:         80,
+		tlsALPNPort:      443,
+		httpsPort:        443,
+		httpMaxRedirects: 10, // boulder: va.go fetchHTTP
+		caaIssuers:       []string{"letsencrypt.org"},
+		skipCheckers:     map[string]bool{},
+		acmeDirectory:    ACMEDirectoryProduction,
+	}
+	if os.Getenv("LETSDEBUG_DISABLE_CERTWATCH") == "" {
+		sc.ctLogs = defaultCTClient
 	}
+	return sc
 }
 
 func (sc *scanContext) Lookup(name string, rrType uint16) ([]dns.RR, error) {
+	result := sc.LookupWithRcode(name, rrType)
+	return result.RRs, result.Error
+}
+
+// LookupWithRcode is like Lookup, but also provides the response code (e.g. to distinguish NXDOMAIN)
+func (sc *scanContext) LookupWithRcode(name string, rrType uint16) lookupResult {
 	sc.rrsMutex.Lock()
 	rrMap, ok := sc.rrs[name]
 	if !ok {
@@ -40,19 +123,162 @@ func (sc *scanContext) Lookup(name string, rrType uint16) ([]dns.RR, error) {
 	sc.rrsMutex.Unlock()
 
 	if ok {
-		return result.RRs, result.Error
+		return result
 	}
 
-	resolved, err := lookup(name, rrType)
+	result = lookup(name, rrType)
 
-	sc.rrsMutex.Lock()
-	rrMap[rrType] = lookupResult{
-		RRs:   resolved,
-		Error: err,
+	// Identifying the refusing servers involves further queries, so it is left until a problem is
+	// reported for the lookup
+	if refused, ok := result.Error.(*dnsRefusedError); ok {
+		refused.findServers = func() []string { return refusingServers(sc, name, rrType) }
 	}
+
+	sc.rrsMutex.Lock()
+	rrMap[rrType] = result
 	sc.rrsMutex.Unlock()
 
-	return resolved, err
+	return result
+}
+
+// share makes sc use, and add to, the DNS lookup cache of other, so that separate scans don't repeat
+// each other's lookups, and make their HTTP requests with the same transport.
+func (sc *scanContext) share(other *scanContext) {
+	sc.rrs, sc.rrsMutex = other.rrs, other.rrsMutex
+	transport := other.HTTPTransport()
+	sc.httpTransportMutex.Lock()
+	sc.httpTransport = transport
+	sc.httpTransportMutex.Unlock()
+}
+
+// HTTPTransport returns the transport which the scan's HTTP requests to the domain are made with,
+// which is configured by httpStrictTLS and httpProxy as they are when it is first used.
+func (sc *scanContext) HTTPTransport() *http.Transport {
+	sc.httpTransportMutex.Lock()
+	defer sc.httpTransportMutex.Unlock()
+	if sc.httpTransport == nil {
+		sc.httpTransport = newDialingHTTPTransport(sc.httpStrictTLS, sc.httpProxy)
+	}
+	return sc.httpTransport
+}
+
+// overrideAddresses replaces any A and AAAA records for name with addressOverride.
+func (sc *scanContext) overrideAddresses(name string) {
+	var a, aaaa []dns.RR
+	for _, ip := range sc.addressOverride {
+		if v4 := ip.To4(); v4 != nil {
+			a = append(a, &dns.A{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET}, A: v4})
+		} else {
+			aaaa = append(aaaa, &dns.AAAA{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: ip})
+		}
+	}
+
+	sc.rrsMutex.Lock()
+	defer sc.rrsMutex.Unlock()
+	rrMap, ok := sc.rrs[name]
+	if !ok {
+		rrMap = map[uint16]lookupResult{}
+		sc.rrs[name] = rrMap
+	}
+	rrMap[dns.TypeA] = lookupResult{RRs: a, Rcode: dns.RcodeSuccess}
+	rrMap[dns.TypeAAAA] = lookupResult{RRs: aaaa, Rcode: dns.RcodeSuccess}
+}
+
+// LookupBefore is like LookupWithRcode, but gives up once deadline has passed, returning false.
+// The lookup itself cannot be cancelled, but its result will still be cached once it completes.
+func (sc *scanContext) LookupBefore(name string, rrType uint16, deadline time.Time) (lookupResult, bool) {
+	done := make(chan lookupResult, 1)
+	go func() {
+		done <- sc.LookupWithRcode(name, rrType)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result, true
+	case <-timer.C:
+		return lookupResult{}, false
+	}
+}
+
+// emit delivers a scan event to the configured hook, if any.
+func (sc *scanContext) emit(event ScanEvent) {
+	if sc == nil || sc.eventHook == nil {
+		return
+	}
+	sc.eventHook(event)
+}
+
+// recordCheckerError records the failure of a checker in the scan's metadata
+func (sc *scanContext) recordCheckerError(checker, domain string, err error) {
+	if sc == nil {
+		return
+	}
+	sc.checkerErrorsMutex.Lock()
+	defer sc.checkerErrorsMutex.Unlock()
+	sc.checkerErrors = append(sc.checkerErrors, CheckerError{Checker: checker, Domain: domain, Error: err})
+}
+
+// Context returns a context which is done once the scan's deadline has passed, for operations
+// (such as HTTP requests) which can be cancelled.
+func (sc *scanContext) Context() context.Context {
+	if sc == nil || sc.deadline == nil {
+		return context.Background()
+	}
+	return sc.deadline
+}
+
+// recordUnfinished records a checker which did not finish before the scan's deadline
+func (sc *scanContext) recordUnfinished(checker, domain string) {
+	if sc == nil {
+		return
+	}
+	sc.unfinishedMutex.Lock()
+	defer sc.unfinishedMutex.Unlock()
+	sc.unfinished = append(sc.unfinished, fmt.Sprintf("%s (%s)", checker, domain))
+}
+
+// runBeforeDeadline runs check, but stops waiting for it once the scan's deadline has passed,
+// in which case finished is false. A panic in check is re-raised in the calling goroutine.
+func (sc *scanContext) runBeforeDeadline(check func() ([]Problem, error)) (probs []Problem, finished bool, err error) {
+	if sc == nil || sc.deadline == nil {
+		probs, err = check()
+		return probs, true, err
+	}
+
+	type result struct {
+		probs    []Problem
+		err      error
+		panicked bool
+		panicVal interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{panicked: true, panicVal: r}
+			}
+		}()
+		probs, err := check()
+		done <- result{probs: probs, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.panicked {
+			panic(r.panicVal)
+		}
+		return r.probs, true, r.err
+	case <-sc.deadline.Done():
+		return nil, false, nil
+	}
+}
+
+// skips reports whether the checker (or multiNameChecker) c was configured to be skipped
+func (sc *scanContext) skips(c interface{}) bool {
+	return sc != nil && sc.skipCheckers[strings.ToLower(checkerName(c))]
 }
 
 // Only slightly random - it will use AAAA over A if possible.
@@ -0,0 +1,170 @@
+package letsdebug
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weppos/publicsuffix-go/net/publicsuffix"
+)
+
+const (
+	// ctLookback is how far back CertificatesForDomain looks. Let's Encrypt certificates are
+	// valid for 90 days, so look back a little further so that recently expired ones are found too.
+	ctLookback = 120 * 24 * time.Hour
+	// ctCacheTTL is how long the results of a query are re-used, across scans
+	ctCacheTTL = 10 * time.Minute
+	// ctMinInterval is the minimum time between queries to the underlying source
+	ctMinInterval = 500 * time.Millisecond
+	// ctMaxAttempts is how many times a failed query is attempted before giving up
+	ctMaxAttempts = 3
+)
+
+// defaultCTClient is shared by every scan, so that concurrent and repeated scans of the same
+// Registered Domain don't each query crt.sh.
+var defaultCTClient = newCTClient(certwatchSource{})
+
+// ctClient wraps a ctLogSource with caching, rate limiting and retries, and is shared by all
+// of the checkers which need Certificate Transparency data.
+type ctClient struct {
+	source ctLogSource
+
+	mu       sync.Mutex
+	cache    map[string]*ctCacheEntry
+	nextSlot time.Time
+}
+
+type ctCacheEntry struct {
+	done    chan struct{}
+	certs   crtList
+	err     error
+	fetched time.Time
+}
+
+func newCTClient(source ctLogSource) *ctClient {
+	return &ctClient{
+		source: source,
+		cache:  map[string]*ctCacheEntry{},
+	}
+}
+
+// FindCertificates returns the Let's Encrypt certificates which contain the Registered Domain
+// `registeredDomain` and were issued after `since`. Concurrent callers share a single query.
+func (c *ctClient) FindCertificates(ctx context.Context, registeredDomain string, since time.Time) (crtList, error) {
+	// Round the window so that checkers asking for the same period share the query
+	windowStart := since.Truncate(time.Hour)
+	key := registeredDomain + "|" + windowStart.Format(time.RFC3339)
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	if ok && entry.fetched.IsZero() {
+		// A query is in flight, wait for it below
+	} else if !ok || entry.err != nil || time.Since(entry.fetched) > ctCacheTTL {
+		for k, e := range c.cache {
+			if !e.fetched.IsZero() && time.Since(e.fetched) > ctCacheTTL {
+				delete(c.cache, k)
+			}
+		}
+		entry = &ctCacheEntry{done: make(chan struct{})}
+		c.cache[key] = entry
+		c.mu.Unlock()
+
+		entry.certs, entry.err = c.query(ctx, registeredDomain, windowStart)
+
+		c.mu.Lock()
+		entry.fetched = time.Now()
+		close(entry.done)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	certs := crtList{}
+	for k, cert := range entry.certs {
+		if !cert.NotBefore.Before(since) {
+			certs[k] = cert
+		}
+	}
+	return certs, nil
+}
+
+// CertificatesForDomain returns the recently issued certificates which are valid for `name`,
+// either by exact name or by wildcard.
+func (c *ctClient) CertificatesForDomain(ctx context.Context, name string) (crtList, error) {
+	name = strings.ToLower(name)
+	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(name, "*."))
+
+	all, err := c.FindCertificates(ctx, registeredDomain, time.Now().Add(-ctLookback))
+	if err != nil {
+		return nil, err
+	}
+
+	var wildcardName string
+	if labels := strings.SplitN(strings.TrimPrefix(name, "*."), ".", 2); len(labels) == 2 {
+		wildcardName = "*." + labels[1]
+	}
+
+	certs := crtList{}
+	for k, cert := range all {
+		for _, san := range cert.DNSNames {
+			san = strings.ToLower(san)
+			if san == name || (!strings.HasPrefix(name, "*.") && san == wildcardName) {
+				certs[k] = cert
+				break
+			}
+		}
+	}
+	return certs, nil
+}
+
+// query makes a rate limited query to the underlying source, retrying with a backoff on failure.
+func (c *ctClient) query(ctx context.Context, registeredDomain string, since time.Time) (crtList, error) {
+	var err error
+	for attempt := 1; attempt <= ctMaxAttempts; attempt++ {
+		if err = c.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		var certs crtList
+		if certs, err = c.source.FindCertificates(ctx, registeredDomain, since); err == nil {
+			return certs, nil
+		}
+		debug("CT log query for %s failed (attempt %d): %v\n", registeredDomain, attempt, err)
+
+		if attempt < ctMaxAttempts {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+	}
+	return nil, err
+}
+
+// wait blocks until the next query to the underlying source is permitted.
+func (c *ctClient) wait(ctx context.Context) error {
+	c.mu.Lock()
+	now := time.Now()
+	slot := c.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	c.nextSlot = slot.Add(ctMinInterval)
+	c.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(slot)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
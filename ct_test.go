@@ -0,0 +1,62 @@
+package letsdebug
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyCTLogSource fails the first query, then returns its certificates
+type flakyCTLogSource struct {
+	mu      sync.Mutex
+	queries int
+	certs   crtList
+}
+
+func (s *flakyCTLogSource) FindCertificates(ctx context.Context, registeredDomain string, since time.Time) (crtList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	if s.queries == 1 {
+		return nil, errors.New("connection reset")
+	}
+	return s.certs, nil
+}
+
+func TestCTClient_FindCertificates(t *testing.T) {
+	now := time.Now()
+	src := &flakyCTLogSource{certs: crtList{
+		"1": makeTestCertificate(t, 1, now.Add(-100*24*time.Hour), now.Add(-10*24*time.Hour), "example.org"),
+		"2": makeTestCertificate(t, 2, now.Add(-2*24*time.Hour), now.Add(88*24*time.Hour), "*.example.org"),
+		"3": makeTestCertificate(t, 3, now.Add(-24*time.Hour), now.Add(89*24*time.Hour), "other.example.org"),
+	}}
+	cl := newCTClient(src)
+
+	// Concurrent callers share the query, which is retried after the first failure
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs, err := cl.CertificatesForDomain(context.Background(), "www.example.org")
+			if err != nil || len(certs) != 1 || certs["2"] == nil {
+				t.Errorf("expected only the wildcard certificate, got: %v (%v)", certs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if src.queries != 2 {
+		t.Fatalf("expected a single retried query, got %d queries", src.queries)
+	}
+
+	// Other windows are queried separately, and filtered to the requested start
+	certs, err := cl.FindCertificates(context.Background(), "example.org", now.Add(-7*24*time.Hour))
+	if err != nil || len(certs) != 2 {
+		t.Fatalf("expected two certificates from the last week, got: %v (%v)", certs, err)
+	}
+	if src.queries != 3 {
+		t.Fatalf("expected one more query for the new window, got %d queries", src.queries)
+	}
+}
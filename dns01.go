@@ -3,9 +3,11 @@ package letsdebug
 import (
 	"crypto/rand"
 	"fmt"
+	"net"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/weppos/publicsuffix-go/publicsuffix"
@@ -29,12 +31,748 @@ func (c wildcardDNS01OnlyChecker) Check(ctx *scanContext, domain string, method
 func wildcardHTTP01(domain string, method ValidationMethod) Problem {
 	return Problem{
 		Name:        "MethodNotSuitable",
+		Code:        ProblemCodeMethodNotSuitable,
 		Explanation: fmt.Sprintf("A wildcard domain like %s can only be issued using a dns-01 validation method.", domain),
 		Detail:      fmt.Sprintf("Invalid method: %s", method),
 		Severity:    SeverityFatal,
 	}
 }
 
+// zoneChecker ensures that the Registered Domain exists in the DNS at all, before the
+// checkers which lookup specific record types are run.
+type zoneChecker struct{}
+
+func (c zoneChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	// Private suffixes (e.g. github.io) are ignored, as they are often a single zone
+	registeredDomain, err := publicsuffix.DomainFromListWithOptions(publicsuffix.DefaultList, domain,
+		&publicsuffix.FindOptions{IgnorePrivate: true})
+	if err != nil || registeredDomain == "" {
+		return nil, errNotApplicable
+	}
+
+	result := ctx.LookupWithRcode(registeredDomain, dns.TypeSOA)
+	if result.Error != nil {
+		// Resolution errors will be reported by the record-specific checkers
+		return nil, nil
+	}
+
+	if result.Rcode == dns.RcodeNameError {
+		// A subdomain which still resolves indicates an inconsistent zone, rather than a missing one
+		if domain != registeredDomain {
+			for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME} {
+				if sub := ctx.LookupWithRcode(domain, rrType); sub.Error == nil && len(sub.RRs) > 0 {
+					return []Problem{brokenParentZone(domain, registeredDomain)}, nil
+				}
+			}
+		}
+		return []Problem{zoneNotFound(domain, registeredDomain)}, nil
+	}
+
+	names := []string{registeredDomain}
+	if domain != registeredDomain {
+		names = append(names, domain)
+	}
+
+	var probs []Problem
+	for _, name := range names {
+		result := ctx.LookupWithRcode(name, dns.TypeSOA)
+		if result.Error != nil {
+			continue
+		}
+		var sb []string
+		for _, rr := range result.RRs {
+			sb = append(sb, rr.String())
+		}
+		if len(sb) == 0 {
+			sb = append(sb, "No SOA record present: "+dns.RcodeToString[result.Rcode])
+		}
+		probs = append(probs, debugProblem(ProblemCodeSOA, "SOA record(s) found for "+name, strings.Join(sb, "\n")))
+	}
+
+	return probs, nil
+}
+
+func zoneNotFound(domain, registeredDomain string) Problem {
+	return Problem{
+		Name: "ZoneNotFound",
+		Code: ProblemCodeZoneNotFound,
+		Explanation: fmt.Sprintf(`The domain %s does not exist in the DNS, as the Registered Domain %s could not be found (NXDOMAIN). `+
+			`This usually means that the domain has not been registered, has expired, or that its nameservers have `+
+			`not been set up with the domain registrar. No DNS records for %s can be resolved until this is fixed.`,
+			domain, registeredDomain, domain),
+		Detail:   fmt.Sprintf("SOA lookup for %s returned NXDOMAIN", registeredDomain),
+		Severity: SeverityFatal,
+	}
+}
+
+func brokenParentZone(domain, registeredDomain string) Problem {
+	return Problem{
+		Name: "BrokenParentZone",
+		Code: ProblemCodeBrokenParentZone,
+		Explanation: fmt.Sprintf(`%s resolves, but its Registered Domain %s does not exist in the DNS (NXDOMAIN). This usually `+
+			`indicates a broken or partially set up zone or delegation, for example nameservers which only serve some of `+
+			`the records of the zone. Let's Encrypt may see inconsistent results when resolving %s (and when looking up `+
+			`CAA records on %s), so the zone for %s should be fixed.`, domain, registeredDomain, domain, registeredDomain, registeredDomain),
+		Detail:   fmt.Sprintf("SOA lookup for %s returned NXDOMAIN", registeredDomain),
+		Severity: SeverityError,
+	}
+}
+
+// glueChecker inspects the delegation of the zone from its parent zone, and ensures that any
+// nameservers which are inside of the zone itself (in-bailiwick) have glue records.
+type glueChecker struct{}
+
+func (c glueChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	zone, _, err := findAuthoritativeServers(ctx, domain)
+	if err != nil {
+		// Resolution errors will be reported by the record-specific checkers
+		return nil, nil
+	}
+
+	parts := strings.SplitN(zone, ".", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, errNotApplicable
+	}
+
+	_, parentServers, err := findAuthoritativeServers(ctx, parts[1])
+	if err != nil {
+		return nil, nil
+	}
+
+	var resp *dns.Msg
+	for _, server := range parentServers {
+		if resp, err = lookupDelegation(net.JoinHostPort(server.String(), "53"), zone); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return []Problem{debugProblem(ProblemCodeDelegationLookup, "Could not query the parent zone for the delegation of "+zone,
+			err.Error())}, nil
+	}
+
+	if missing := missingGlue(zone, resp); len(missing) > 0 {
+		return []Problem{missingGlueRecords(zone, parts[1], missing)}, nil
+	}
+
+	return nil, nil
+}
+
+// missingGlue returns the in-bailiwick nameservers in a referral for zone which have no A or AAAA glue.
+func missingGlue(zone string, resp *dns.Msg) []string {
+	glue := map[string]bool{}
+	for _, rr := range resp.Extra {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			glue[normalizeFqdn(rr.Header().Name)] = true
+		}
+	}
+
+	var missing []string
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		ns, ok := rr.(*dns.NS)
+		if !ok || normalizeFqdn(ns.Hdr.Name) != zone {
+			continue
+		}
+		name := normalizeFqdn(ns.Ns)
+		if name != zone && !strings.HasSuffix(name, "."+zone) {
+			continue
+		}
+		if !glue[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func missingGlueRecords(zone, parent string, nameservers []string) Problem {
+	return Problem{
+		Name: "MissingGlueRecords",
+		Code: ProblemCodeMissingGlueRecords,
+		Explanation: fmt.Sprintf(`The nameservers %s are inside of the zone %s which they serve, but the parent zone %s `+
+			`does not provide glue (A/AAAA) records for them. Without glue, resolvers cannot find the addresses of these `+
+			`nameservers, which is a common cause of intermittent DNS resolution failures for Let's Encrypt. Glue records `+
+			`are usually set up at the domain registrar, in the section for registering "child" or "host" nameservers.`,
+			strings.Join(nameservers, ", "), zone, parent),
+		Detail:   fmt.Sprintf("Nameservers without glue: %s", strings.Join(nameservers, ", ")),
+		Severity: SeverityError,
+	}
+}
+
+// dnssecChainChecker ensures that, where the parent zone publishes DS records for the zone, the
+// zone's nameservers serve a DNSKEY which matches one of them. Otherwise, validating resolvers
+// (including Let's Encrypt's) treat every answer from the zone as bogus.
+type dnssecChainChecker struct{}
+
+func (c dnssecChainChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	// The zone can't be found via its NS records, because they won't validate if the chain is
+	// broken, so the deepest ancestor with DS records in its parent is checked instead
+	var zone string
+	var dsRRs []dns.RR
+	for name := strings.TrimPrefix(domain, "*."); strings.Contains(name, "."); name = strings.SplitN(name, ".", 2)[1] {
+		// A DS lookup below the zone cut is answered by the zone itself, and so fails if it is broken
+		rrs, err := ctx.Lookup(name, dns.TypeDS)
+		if err != nil {
+			continue
+		}
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.DS); ok {
+				dsRRs = append(dsRRs, rr)
+			}
+		}
+		if len(dsRRs) > 0 {
+			zone = name
+			break
+		}
+	}
+	if zone == "" {
+		return nil, errNotApplicable
+	}
+
+	parent := strings.SplitN(zone, ".", 2)[1]
+	_, parentServers, err := findAuthoritativeServers(ctx, parent)
+	if err != nil {
+		return nil, nil
+	}
+	var servers []net.IP
+	for _, addrs := range delegatedServers(ctx, parentServers, parent, zone) {
+		servers = append(servers, addrs...)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeDNSKEY)
+	m.RecursionDesired = false
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	var resp *dns.Msg
+	for _, server := range servers {
+		if resp, err = exchangeDirect(m, net.JoinHostPort(server.String(), "53")); err == nil && resp.Rcode == dns.RcodeSuccess {
+			break
+		}
+		resp = nil
+	}
+	if resp == nil {
+		return []Problem{debugProblem(ProblemCodeDelegationLookup, "Could not query the nameservers of "+zone+" for its DNSKEY records",
+			fmt.Sprintf("Nameservers: %v", servers))}, nil
+	}
+
+	if prob := dnssecChainProblem(zone, dsRRs, resp.Answer); prob != nil {
+		return []Problem{*prob}, nil
+	}
+	return nil, nil
+}
+
+// dnssecChainProblem returns a problem if none of the DS records of zone correspond to one of its
+// DNSKEY records (by key tag, algorithm and digest).
+func dnssecChainProblem(zone string, dsRRs, keyRRs []dns.RR) *Problem {
+	var keys []*dns.DNSKEY
+	for _, rr := range keyRRs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		prob := dnssecMissingDnskey(zone, dsRRs)
+		return &prob
+	}
+
+	for _, rr := range dsRRs {
+		ds := rr.(*dns.DS)
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if computed := key.ToDS(ds.DigestType); computed != nil && strings.EqualFold(computed.Digest, ds.Digest) {
+				return nil
+			}
+		}
+	}
+	prob := dnssecDsMismatch(zone, dsRRs, keys)
+	return &prob
+}
+
+func dnssecMissingDnskey(zone string, dsRRs []dns.RR) Problem {
+	return Problem{
+		Name: "DnssecMissingDnskey",
+		Code: ProblemCodeDnssecMissingDnskey,
+		Explanation: fmt.Sprintf(`The parent zone publishes DS records for %s, meaning that it is signed with DNSSEC, `+
+			`but the nameservers of %s do not serve any DNSKEY records. Validating resolvers, including Let's Encrypt's, `+
+			`will fail (SERVFAIL) every lookup in the zone. This usually happens after changing DNS provider or turning `+
+			`off DNSSEC without removing the DS records at the domain registrar. Either remove the DS records at the `+
+			`registrar, or enable DNSSEC signing at the DNS provider and publish the matching DS records.`, zone, zone),
+		Detail:   dnssecRecordsDetail(dsRRs, nil),
+		Severity: SeverityFatal,
+	}
+}
+
+func dnssecDsMismatch(zone string, dsRRs []dns.RR, keys []*dns.DNSKEY) Problem {
+	return Problem{
+		Name: "DnssecDsMismatch",
+		Code: ProblemCodeDnssecDsMismatch,
+		Explanation: fmt.Sprintf(`The DS records which the parent zone publishes for %s do not match any of the DNSKEY `+
+			`records served by the nameservers of %s, so the DNSSEC chain of trust is broken. Validating resolvers, `+
+			`including Let's Encrypt's, will fail (SERVFAIL) every lookup in the zone. This usually happens after a key `+
+			`rollover or change of DNS provider, when the DS records at the domain registrar were not updated. Replace `+
+			`the DS records at the registrar with ones generated from the current DNSKEY, or remove them to disable DNSSEC.`,
+			zone, zone),
+		Detail:   dnssecRecordsDetail(dsRRs, keys),
+		Severity: SeverityFatal,
+	}
+}
+
+func dnssecRecordsDetail(dsRRs []dns.RR, keys []*dns.DNSKEY) string {
+	var lines []string
+	for _, rr := range dsRRs {
+		lines = append(lines, rr.String())
+	}
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("DNSKEY with key tag %d, algorithm %s, flags %d",
+			key.KeyTag(), dns.AlgorithmToString[key.Algorithm], key.Flags))
+	}
+	if len(keys) == 0 {
+		lines = append(lines, "No DNSKEY records were served")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dnssecSignatureChecker queries the nameservers of the zone directly for the RRsets used during
+// validation, with DNSSEC records requested, and ensures that none of their signatures (RRSIG) are
+// outside of their validity period. Validating resolvers treat such RRsets as bogus.
+type dnssecSignatureChecker struct{}
+
+func (c dnssecSignatureChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	name := strings.TrimPrefix(domain, "*.")
+
+	var servers []net.IP
+	for _, addrs := range zoneServers(ctx, name) {
+		servers = append(servers, addrs...)
+	}
+	if len(servers) == 0 {
+		// Resolution errors will be reported by the record-specific checkers
+		return nil, nil
+	}
+
+	var probs []Problem
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), rrType)
+		m.RecursionDesired = false
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		for _, server := range servers {
+			resp, err := exchangeDirect(m, net.JoinHostPort(server.String(), "53"))
+			if err != nil || resp.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			for _, sig := range invalidSignatures(resp.Answer, time.Now()) {
+				probs = append(probs, dnssecExpiredSignature(name, sig))
+			}
+			break
+		}
+	}
+	return probs, nil
+}
+
+// invalidSignatures returns, for each RRset in rrs which is signed but has no RRSIG valid at now,
+// one of its signatures. Signatures are grouped by the type they cover and by signer, because during
+// a key rollover an RRset is normally signed both by a current and by an outgoing key.
+func invalidSignatures(rrs []dns.RR, now time.Time) []*dns.RRSIG {
+	type rrset struct {
+		typeCovered uint16
+		signer      string
+	}
+	var order []rrset
+	sigs := map[rrset][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		key := rrset{sig.TypeCovered, strings.ToLower(dns.Fqdn(sig.SignerName))}
+		if _, seen := sigs[key]; !seen {
+			order = append(order, key)
+		}
+		sigs[key] = append(sigs[key], sig)
+	}
+
+	var invalid []*dns.RRSIG
+	for _, key := range order {
+		valid := false
+		for _, sig := range sigs[key] {
+			if sig.ValidityPeriod(now) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			invalid = append(invalid, sigs[key][0])
+		}
+	}
+	return invalid
+}
+
+func dnssecExpiredSignature(domain string, sig *dns.RRSIG) Problem {
+	return Problem{
+		Name: "DnssecExpiredSignature",
+		Code: ProblemCodeDnssecExpiredSignature,
+		Explanation: fmt.Sprintf(`The DNSSEC signature (RRSIG) covering the %s records of %s is outside of its validity `+
+			`period, so validating resolvers, including Let's Encrypt's, will treat the records as bogus and fail `+
+			`(SERVFAIL) the lookup. This usually means that the DNS server has stopped re-signing the zone, e.g. because `+
+			`an automated signing job has failed or the signing key is no longer available. Re-sign the zone, or disable `+
+			`DNSSEC by removing the DS records at the domain registrar.`, dns.TypeToString[sig.TypeCovered], domain),
+		Detail: fmt.Sprintf("%s\nValid from %s until %s",
+			sig.String(), dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration)),
+		Severity: SeverityFatal,
+	}
+}
+
+// flappingDNSQueries is the number of times that each nameserver is asked the same question
+const flappingDNSQueries = 3
+
+// flappingDNSChecker asks each nameserver of the zone the same questions (A, AAAA and CAA) several
+// times, and ensures that the answers are consistent. Otherwise, Let's Encrypt may intermittently see
+// different records from those which were checked.
+type flappingDNSChecker struct{}
+
+func (c flappingDNSChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	name := strings.TrimPrefix(domain, "*.")
+
+	servers := zoneServers(ctx, name)
+	if len(servers) == 0 {
+		// Resolution errors will be reported by the record-specific checkers
+		return nil, nil
+	}
+
+	var probs []Problem
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), rrType)
+		m.RecursionDesired = false
+
+		// The answers of each nameserver, which are queried in parallel
+		byServer := map[string][]serverAnswer{}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for host, addrs := range servers {
+			for _, addr := range addrs {
+				wg.Add(1)
+				go func(label, server string) {
+					defer wg.Done()
+					for i := 0; i < flappingDNSQueries && ctx.Context().Err() == nil; i++ {
+						resp, err := exchangeDirect(m, server)
+						if err != nil {
+							return
+						}
+						mu.Lock()
+						byServer[label] = append(byServer[label], serverAnswer{
+							Key:       answerSetKey(resp),
+							Populated: resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0,
+						})
+						mu.Unlock()
+					}
+				}(fmt.Sprintf("%s (%s)", host, addr), net.JoinHostPort(addr.String(), "53"))
+			}
+		}
+		wg.Wait()
+		if ctx.Context().Err() != nil {
+			return probs, nil
+		}
+
+		if inconsistentAnswers(byServer) {
+			// Each distinct answer set, and the nameservers which gave it
+			answers := map[string][]string{}
+			for label, serverAnswers := range byServer {
+				for _, answer := range serverAnswers {
+					answers[answer.Key] = appendUnique(answers[answer.Key], label)
+				}
+			}
+			probs = append(probs, flappingDNS(name, dns.TypeToString[rrType], answers))
+		}
+	}
+	return probs, nil
+}
+
+// serverAnswer is one answer of a nameserver to a query, as described by answerSetKey.
+type serverAnswer struct {
+	Key string
+	// Populated is set if the answer contained records.
+	Populated bool
+}
+
+// inconsistentAnswers returns whether the answers of each nameserver to the same query contradict each
+// other: when some answers contain records and others don't, or when every nameserver always gives the
+// same answer but they don't agree on it. A nameserver which returns a varying selection of records is
+// not inconsistent by itself, since DNS providers (such as Route 53 multivalue answers, or NS1) answer
+// with a random subset of a larger set of records.
+func inconsistentAnswers(byServer map[string][]serverAnswer) bool {
+	populated, empty := map[string]bool{}, map[string]bool{}
+	stable := true
+	for _, answers := range byServer {
+		for _, answer := range answers {
+			if answer.Populated {
+				populated[answer.Key] = true
+			} else {
+				empty[answer.Key] = true
+			}
+			if answer.Key != answers[0].Key {
+				stable = false
+			}
+		}
+	}
+	if len(populated) > 0 && len(empty) > 0 || len(empty) > 1 {
+		return true
+	}
+	return stable && len(populated) > 1
+}
+
+// answerSetKey describes the response code and answer records of resp, ignoring their order and TTLs,
+// so that round-robin rotation and cache ageing aren't mistaken for a different answer.
+func answerSetKey(resp *dns.Msg) string {
+	var rrs []string
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, rr.String())
+	}
+	sort.Strings(rrs)
+	if len(rrs) == 0 {
+		rrs = []string{"(no records)"}
+	}
+	return fmt.Sprintf("%s: %s", dns.RcodeToString[resp.Rcode], strings.Join(rrs, ", "))
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func flappingDNS(domain, rrType string, answers map[string][]string) Problem {
+	var detail []string
+	for answer, servers := range answers {
+		detail = append(detail, fmt.Sprintf("%s\n  from %s", answer, strings.Join(servers, ", ")))
+	}
+	sort.Strings(detail)
+	return Problem{
+		Name: "FlappingDns",
+		Code: ProblemCodeFlappingDns,
+		Explanation: fmt.Sprintf(`Identical queries for the %s records of %s, sent directly to the nameservers of the zone, `+
+			`received different sets of records (regardless of their order). This means that the nameservers are `+
+			`inconsistent, e.g. because they are out of sync or a load balancer in front of them is misconfigured, so `+
+			`Let's Encrypt may intermittently see different records to the ones which you expect.`, rrType, domain),
+		Detail:   strings.Join(detail, "\n"),
+		Severity: SeverityWarning,
+	}
+}
+
+// lameNameserverChecker resolves each nameserver in the NS set of the zone and asks it directly for the
+// zone's SOA record, and reports the nameservers which don't resolve or don't answer authoritatively.
+// Resolvers pick nameservers at random, so even one of them being broken makes lookups fail intermittently.
+type lameNameserverChecker struct{}
+
+func (c lameNameserverChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	zone, nameservers := zoneNameservers(ctx, strings.TrimPrefix(domain, "*."))
+	if len(nameservers) == 0 {
+		// Resolution errors will be reported by the record-specific checkers
+		return nil, nil
+	}
+
+	var broken []string
+	for _, ns := range nameservers {
+		var addrs []net.IP
+		rrs, _ := ctx.Lookup(ns, dns.TypeA)
+		for _, rr := range rrs {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, a.A)
+			}
+		}
+		if len(addrs) == 0 {
+			if rrs, _ := ctx.Lookup(ns, dns.TypeAAAA); len(rrs) == 0 {
+				broken = append(broken, fmt.Sprintf("%s: does not resolve to any address", ns))
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if err := probeNameserver(net.JoinHostPort(addr.String(), "53"), zone); err != nil {
+				broken = append(broken, fmt.Sprintf("%s (%s): %v", ns, addr, err))
+			}
+		}
+	}
+
+	if len(broken) > 0 {
+		return []Problem{lameNameserver(zone, nameservers, broken)}, nil
+	}
+	return nil, nil
+}
+
+// zoneNameservers finds the zone which is authoritative for name, by climbing the domain tree until a
+// name with NS records is found, and returns the names of its nameservers.
+func zoneNameservers(ctx *scanContext, name string) (string, []string) {
+	for zone := name; strings.Contains(zone, "."); zone = strings.SplitN(zone, ".", 2)[1] {
+		rrs, err := ctx.Lookup(zone, dns.TypeNS)
+		if err != nil {
+			return zone, nil
+		}
+		var nameservers []string
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && normalizeFqdn(ns.Hdr.Name) == zone {
+				nameservers = append(nameservers, normalizeFqdn(ns.Ns))
+			}
+		}
+		if len(nameservers) > 0 {
+			sort.Strings(nameservers)
+			return zone, nameservers
+		}
+	}
+	return name, nil
+}
+
+// probeNameserver asks server for the SOA record of zone, without recursion, and returns an error
+// unless it answers authoritatively.
+func probeNameserver(server, zone string) error {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	m.RecursionDesired = false
+	resp, err := exchangeDirect(m, server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("answered with %s", dns.RcodeToString[resp.Rcode])
+	}
+	if !resp.Authoritative {
+		return fmt.Errorf("answered without authority, so it is not serving the zone")
+	}
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.SOA); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("answered without the SOA record of the zone")
+}
+
+func lameNameserver(zone string, nameservers, broken []string) Problem {
+	return Problem{
+		Name: "LameNameserver",
+		Code: ProblemCodeLameNameserver,
+		Explanation: fmt.Sprintf(`Some of the nameservers of %s could not be resolved, or did not answer authoritatively for `+
+			`the zone when asked for its SOA record directly. Resolvers (including Let's Encrypt's) choose between the `+
+			`nameservers at random, so lookups in the zone will sometimes fail. Fix the broken nameservers, or remove them `+
+			`from the NS records of the zone and from the delegation at the domain registrar.`, zone),
+		Detail:   fmt.Sprintf("Nameservers: %s\n%s", strings.Join(nameservers, ", "), strings.Join(broken, "\n")),
+		Severity: SeverityWarning,
+	}
+}
+
+// parkingNameservers are the nameserver domains of domain parking and marketplace services,
+// which do not allow custom records to be created. To recognise another, add it here.
+var parkingNameservers = []string{
+	"sedoparking.com",
+	"parkingcrew.net",
+	"bodis.com",
+	"above.com",
+	"dan.com",
+	"afternic.com",
+	"uniregistrymarket.link",
+	"parklogic.com",
+	"namebrightdns.com",
+}
+
+// parkingNameserverChecker ensures that the Registered Domain is not still delegated to a
+// parking service's nameservers, which is often the case for a newly registered domain.
+type parkingNameserverChecker struct{}
+
+func (c parkingNameserverChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	registeredDomain, err := publicsuffix.DomainFromListWithOptions(publicsuffix.DefaultList, domain,
+		&publicsuffix.FindOptions{IgnorePrivate: true})
+	if err != nil || registeredDomain == "" {
+		return nil, errNotApplicable
+	}
+
+	rrs, err := ctx.Lookup(registeredDomain, dns.TypeNS)
+	if err != nil {
+		return nil, nil
+	}
+
+	var parked []string
+	for _, rr := range rrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name := normalizeFqdn(ns.Ns)
+		for _, parking := range parkingNameservers {
+			if name == parking || strings.HasSuffix(name, "."+parking) {
+				parked = append(parked, name)
+				break
+			}
+		}
+	}
+
+	if len(parked) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "ParkingNameservers",
+		Code: ProblemCodeParkingNameservers,
+		Explanation: fmt.Sprintf(`The domain %s is delegated to the nameservers of a domain parking service, which do not `+
+			`serve any records that you have created. If you intend to use this domain, change its nameservers with your `+
+			`registrar to those of the DNS provider where you manage its records.`, registeredDomain),
+		Detail:   fmt.Sprintf("Parking nameservers: %s", strings.Join(parked, ", ")),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// dnameChecker reports any DNAME records at or above the domain, up to the Registered Domain,
+// since they redirect the names that Let's Encrypt looks up (including _acme-challenge).
+type dnameChecker struct{}
+
+func (c dnameChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	registeredDomain, err := publicsuffix.DomainFromListWithOptions(publicsuffix.DefaultList, domain,
+		&publicsuffix.FindOptions{IgnorePrivate: true})
+	if err != nil || registeredDomain == "" {
+		return nil, errNotApplicable
+	}
+
+	var found []string
+	for name := domain; ; name = strings.SplitN(name, ".", 2)[1] {
+		rrs, _ := ctx.Lookup(name, dns.TypeDNAME)
+		for _, rr := range rrs {
+			if dname, ok := rr.(*dns.DNAME); ok && normalizeFqdn(dname.Hdr.Name) == name {
+				found = append(found, dname.String())
+			}
+		}
+		if name == registeredDomain {
+			break
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "DnameRedirection",
+		Code: ProblemCodeDnameRedirection,
+		Explanation: fmt.Sprintf(`There are DNAME records at or above %s, which redirect every name below them to another `+
+			`part of the DNS. Names such as _acme-challenge.%s (used for DNS validation) and any CAA records will be looked `+
+			`up in the target of the DNAME instead, so records must be created there rather than in this zone.`, domain, domain),
+		Detail:   strings.Join(found, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
 // txtRecordChecker ensures there is no resolution errors with the _acme-challenge txt record
 type txtRecordChecker struct{}
 
@@ -56,6 +794,7 @@ func (c txtRecordChecker) Check(ctx *scanContext, domain string, method Validati
 func txtRecordError(domain string, err error) Problem {
 	return Problem{
 		Name: "TXTRecordError",
+		Code: ProblemCodeTXTRecordError,
 		Explanation: fmt.Sprintf(`An error occurred while attempting to lookup the TXT record on _acme-challenge.%s . `+
 			`Any resolver errors that the Let's Encrypt CA encounters on this record will cause certificate issuance to fail.`, domain),
 		Detail:   err.Error(),
@@ -63,6 +802,287 @@ func txtRecordError(domain string, err error) Problem {
 	}
 }
 
+// wildcardTXTNameChecker reports TXT records published at _acme-challenge.*.<domain> when a wildcard
+// is requested with dns-01, since the challenge for *.<domain> must be published at _acme-challenge.<domain>.
+// Whether _acme-challenge.<domain> itself can be resolved is checked by txtRecordChecker.
+type wildcardTXTNameChecker struct{}
+
+func (c wildcardTXTNameChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != DNS01 || !strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	base := strings.TrimPrefix(domain, "*.")
+
+	// Wildcard records can't synthesize answers for this name, so any TXT records must exist literally
+	wrongName := "_acme-challenge." + domain
+	rrs, err := ctx.Lookup(wrongName, dns.TypeTXT)
+	if err != nil {
+		return nil, nil
+	}
+
+	var found []string
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			found = append(found, txt.String())
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "WildcardChallengeWrongName",
+		Code: ProblemCodeWildcardChallengeWrongName,
+		Explanation: fmt.Sprintf(`There are TXT record(s) at %s. For a wildcard name like %s, the dns-01 challenge must be `+
+			`published at _acme-challenge.%s (without the "*."), which is where Let's Encrypt will look for it. The same `+
+			`name is used for %s itself, so both challenges may need to be present there at the same time. Check the `+
+			`configuration of your ACME client or DNS plugin.`, wrongName, domain, base, base),
+		Detail:   strings.Join(found, "\n"),
+		Severity: SeverityWarning,
+	}}, nil
+}
+
+// wildcardShadowChecker reports a wildcard CNAME or TXT record directly under the domain, when
+// _acme-challenge.<domain> doesn't exist itself and so is answered by the wildcard: TXT queries for it
+// then follow the wildcard CNAME, or receive the wildcard's TXT records.
+type wildcardShadowChecker struct{}
+
+func (c wildcardShadowChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != DNS01 {
+		return nil, errNotApplicable
+	}
+
+	domain = strings.TrimPrefix(domain, "*.")
+
+	// A random name can only be answered by a wildcard
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	randomName := fmt.Sprintf("_letsdebug-%x.%s", nonce, domain)
+
+	var found []string
+	seen := map[string]bool{}
+	for _, rrType := range []uint16{dns.TypeCNAME, dns.TypeTXT} {
+		rrs, err := ctx.Lookup(randomName, rrType)
+		if err != nil || len(rrs) == 0 {
+			continue
+		}
+		// If the challenge name exists itself, its answer isn't the wildcard's
+		challengeRRs, _ := ctx.Lookup("_acme-challenge."+domain, rrType)
+		if strings.Join(describeWithoutOwner(challengeRRs), "\n") != strings.Join(describeWithoutOwner(rrs), "\n") {
+			return nil, nil
+		}
+		for _, desc := range describeWithoutOwner(rrs) {
+			if !seen[desc] {
+				seen[desc] = true
+				found = append(found, desc)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "WildcardShadowsChallenge",
+		Code: ProblemCodeWildcardShadowsChallenge,
+		Explanation: fmt.Sprintf(`There is a wildcard record at *.%s, which also answers queries for _acme-challenge.%s `+
+			`whenever that name does not exist itself, as is currently the case (e.g. because the challenge has not been `+
+			`published yet, or is published in a different zone). Let's Encrypt's TXT query will then follow the wildcard `+
+			`CNAME, or receive the wildcard's TXT records. Make sure that the challenge TXT record is published at exactly `+
+			`_acme-challenge.%s, in the zone that serves it.`, domain, domain, domain),
+		Detail:   fmt.Sprintf("A query for %s (which does not exist) was answered with:\n%s", randomName, strings.Join(found, "\n")),
+		Severity: SeverityWarning,
+	}}, nil
+}
+
+// describeWithoutOwner describes each of rrs without its owner name, so that the answers for different
+// names can be compared, in sorted order.
+func describeWithoutOwner(rrs []dns.RR) []string {
+	var descs []string
+	for _, rr := range rrs {
+		descs = append(descs, fmt.Sprintf("%s %s", dns.TypeToString[rr.Header().Rrtype],
+			strings.TrimPrefix(rr.String(), rr.Header().String())))
+	}
+	sort.Strings(descs)
+	return descs
+}
+
+// txtStaleRecordChecker reports any TXT records which are present at _acme-challenge, since Let's Encrypt
+// does not need them to exist ahead of time, and leftovers indicate that a client is not cleaning up.
+type txtStaleRecordChecker struct{}
+
+func (c txtStaleRecordChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	rrs, err := ctx.Lookup("_acme-challenge."+domain, dns.TypeTXT)
+	if err != nil {
+		// Reported by txtRecordChecker
+		return nil, nil
+	}
+
+	var found []string
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			found = append(found, txt.String())
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "TXTStaleChallengeRecords",
+		Code: ProblemCodeTXTStaleChallengeRecords,
+		Explanation: fmt.Sprintf(`There are %d TXT record(s) present at _acme-challenge.%s. If a DNS-01 validation is not `+
+			`currently in progress, these are probably leftovers from previous attempts, which indicates that your ACME client `+
+			`or DNS plugin is not removing them after validation. Stale records do not prevent issuance, but removing them `+
+			`avoids confusion and keeps DNS responses small.`, len(found), domain),
+		Detail:   strings.Join(found, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// challengeTXTLength is the length of a dns-01 TXT value: the unpadded base64url encoding of a SHA-256 digest
+const challengeTXTLength = 43
+
+// txtChallengeFormatChecker reports TXT records at _acme-challenge (after following any CNAMEs) whose
+// values can't be a dns-01 challenge response, which usually means that a DNS provider or plugin has
+// mangled them.
+type txtChallengeFormatChecker struct{}
+
+func (c txtChallengeFormatChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != DNS01 {
+		return nil, errNotApplicable
+	}
+
+	domain = strings.TrimPrefix(domain, "*.")
+
+	rrs, err := ctx.Lookup("_acme-challenge."+domain, dns.TypeTXT)
+	if err != nil {
+		// Reported by txtRecordChecker
+		return nil, nil
+	}
+
+	var malformed []string
+	var wellFormed int
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		if reason := malformedChallengeTXT(txt.Txt); reason != "" {
+			malformed = append(malformed, fmt.Sprintf("%s (%s)", txt.String(), reason))
+		} else {
+			wellFormed++
+		}
+	}
+
+	if len(malformed) == 0 {
+		return nil, nil
+	}
+
+	// Let's Encrypt only needs one record to match, so malformed records beside a well-formed one
+	// (e.g. left over from an earlier attempt) don't prevent validation.
+	severity := SeverityError
+	if wellFormed > 0 {
+		severity = SeverityWarning
+	}
+
+	return []Problem{{
+		Name: "MalformedChallengeTxt",
+		Code: ProblemCodeMalformedChallengeTxt,
+		Explanation: fmt.Sprintf(`Some of the TXT records at _acme-challenge.%s are not in the format of a dns-01 challenge `+
+			`response, which is a single %d character base64url value. Let's Encrypt will not accept these values. If your `+
+			`ACME client created them, check whether your DNS provider or plugin is adding quotes or otherwise altering them.`,
+			domain, challengeTXTLength),
+		Detail:   strings.Join(malformed, "\n"),
+		Severity: severity,
+	}}, nil
+}
+
+// malformedChallengeTXT returns why the strings of a TXT record can't be a dns-01 challenge response,
+// or an empty string if they can.
+func malformedChallengeTXT(strs []string) string {
+	value := strings.Join(strs, "")
+	switch {
+	case strings.ContainsAny(value, `"'`):
+		return "contains quotes"
+	case strings.TrimSpace(value) != value:
+		return "contains surrounding whitespace"
+	case strings.HasSuffix(value, "="):
+		return "contains base64 padding"
+	}
+	for _, r := range value {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Sprintf("contains %q, which is not a base64url character", r)
+		}
+	}
+	if len(value) != challengeTXTLength {
+		if len(strs) > 1 {
+			return fmt.Sprintf("is split into %d strings which total %d characters", len(strs), len(value))
+		}
+		return fmt.Sprintf("is %d characters long", len(value))
+	}
+	return ""
+}
+
+// txtMultipleRecordsChecker reports when _acme-challenge has more distinct TXT records than the
+// request needs. A long value is one record made of several character-strings (which Let's Encrypt
+// concatenates), but several records are each compared to the challenge separately.
+type txtMultipleRecordsChecker struct{}
+
+func (c txtMultipleRecordsChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != DNS01 {
+		return nil, errNotApplicable
+	}
+
+	base := strings.TrimPrefix(domain, "*.")
+
+	rrs, err := ctx.Lookup("_acme-challenge."+base, dns.TypeTXT)
+	if err != nil {
+		// Reported by txtRecordChecker
+		return nil, nil
+	}
+
+	var records []string
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		record := txt.String()
+		if len(txt.Txt) > 1 {
+			record += fmt.Sprintf(" (one record of %d strings)", len(txt.Txt))
+		}
+		records = append(records, record)
+	}
+
+	// A name and its wildcard share _acme-challenge, so a challenge for each is expected
+	expected := 1
+	for _, name := range ctx.names {
+		if name != domain && strings.TrimPrefix(name, "*.") == base {
+			expected = 2
+			break
+		}
+	}
+	if len(records) <= expected {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "MultipleChallengeTxtRecords",
+		Code: ProblemCodeMultipleChallengeTxtRecords,
+		Explanation: fmt.Sprintf(`There are %d separate TXT records at _acme-challenge.%s. Let's Encrypt compares each `+
+			`record to the challenge on its own, so a value that was intended to be split across several strings of one `+
+			`record will not match if it was published as several records instead. If these are leftovers from previous `+
+			`attempts, conflicting values may also confuse your ACME client or DNS plugin.`, len(records), base),
+		Detail:   strings.Join(records, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
 // txtDoubledLabelChecker ensures that a record for _acme-challenge.example.org.example.org
 // wasn't accidentally created
 type txtDoubledLabelChecker struct{}
@@ -143,6 +1163,7 @@ func (c txtDoubledLabelChecker) Check(ctx *scanContext, domain string, method Va
 	if len(found) > 0 {
 		return []Problem{{
 			Name: "TXTDoubleLabel",
+			Code: ProblemCodeTXTDoubleLabel,
 			Explanation: "Some DNS records were found that indicate TXT records may have been incorrectly manually entered into " +
 				`DNS editor interfaces. The correct way to enter these records is to either remove the domain from the label (so ` +
 				`enter "_acme-challenge.www.example.org" as "_acme-challenge.www") or include a period (.) at the ` +
@@ -2,40 +2,313 @@ package letsdebug
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/miekg/unbound"
+	"golang.org/x/net/idna"
 )
 
 var (
 	reservedNets []*net.IPNet
+
+	// sensitiveNets are the ranges of cloud metadata services and link-local addresses, which must
+	// never be probed, so that letsdebug can't be used to reach the internal endpoints of the
+	// network it runs in
+	sensitiveNets  []sensitiveNet
+	sensitiveCIDRs = []struct {
+		CIDR        string
+		Description string
+	}{
+		{"169.254.169.254/32", "the cloud instance metadata service (AWS, GCP, Azure and others)"},
+		{"169.254.0.0/16", "IPv4 link-local"},
+		{"fd00:ec2::254/128", "the AWS instance metadata service over IPv6"},
+		{"fe80::/10", "IPv6 link-local"},
+		{"100.100.100.200/32", "the Alibaba Cloud metadata service"},
+		{"192.0.0.192/32", "the Oracle Cloud metadata service"},
+	}
+
+	// publicResolver is a well-known public recursive resolver, whose answers are compared with
+	// those of the resolver used by scans
+	publicResolver = "8.8.8.8:53"
+
+	// localAddresses are the addresses of this host's own network interfaces
+	localAddresses     []net.IP
+	localAddressesOnce sync.Once
 )
 
-func lookup(name string, rrType uint16) ([]dns.RR, error) {
+func lookup(name string, rrType uint16) lookupResult {
 	ub := unbound.New()
 	defer ub.Destroy()
 
 	if err := setUnboundConfig(ub); err != nil {
-		return nil, fmt.Errorf("Failed to configure Unbound resolver: %v", err)
+		return lookupResult{Error: fmt.Errorf("Failed to configure Unbound resolver: %v", err)}
 	}
 
 	result, err := ub.Resolve(name, rrType, dns.ClassINET)
 	if err != nil {
-		return nil, err
+		return lookupResult{Error: err}
 	}
 
 	if result.Bogus {
-		return nil, fmt.Errorf("DNS response for %s had fatal DNSSEC issues: %v", name, result.WhyBogus)
+		return lookupResult{Rcode: result.Rcode, Error: fmt.Errorf("DNS response for %s had fatal DNSSEC issues: %v", name, result.WhyBogus)}
 	}
 
-	if result.Rcode == dns.RcodeServerFailure || result.Rcode == dns.RcodeRefused {
-		return nil, fmt.Errorf("DNS response for %s/%s did not have an acceptable response code: %s",
-			name, dns.TypeToString[rrType], dns.RcodeToString[result.Rcode])
+	if result.Rcode == dns.RcodeRefused {
+		return lookupResult{Rcode: result.Rcode, Error: &dnsRefusedError{Name: name, RRType: dns.TypeToString[rrType]}}
 	}
 
-	return result.Rr, nil
+	if result.Rcode == dns.RcodeServerFailure {
+		return lookupResult{Rcode: result.Rcode, Error: fmt.Errorf("DNS response for %s/%s did not have an acceptable response code: %s",
+			name, dns.TypeToString[rrType], dns.RcodeToString[result.Rcode])}
+	}
+
+	var authority []dns.RR
+	if result.AnswerPacket != nil {
+		authority = result.AnswerPacket.Ns
+	}
+	return lookupResult{RRs: result.Rr, Rcode: result.Rcode, Authority: authority}
+}
+
+// dnsRefusedError is the error of a lookup which was answered with REFUSED.
+type dnsRefusedError struct {
+	Name   string
+	RRType string
+
+	// findServers, if set, identifies the nameservers which refused the query
+	findServers func() []string
+	serversOnce sync.Once
+	servers     []string
+}
+
+func (e *dnsRefusedError) Error() string {
+	return fmt.Sprintf("DNS response for %s/%s did not have an acceptable response code: %s",
+		e.Name, e.RRType, dns.RcodeToString[dns.RcodeRefused])
+}
+
+// Servers returns the nameservers which refused the query, if they could be identified. They are
+// only looked for the first time that they are needed.
+func (e *dnsRefusedError) Servers() []string {
+	e.serversOnce.Do(func() {
+		if e.findServers != nil {
+			e.servers = e.findServers()
+		}
+	})
+	return e.servers
+}
+
+// refusingServers finds the nameservers which refuse to answer a query for name, by querying
+// each of the nameservers of its zone (see zoneServers) directly, until the scan is cancelled.
+func refusingServers(ctx *scanContext, name string, rrType uint16) []string {
+	var refused []string
+	for host, addrs := range zoneServers(ctx, name) {
+		for _, addr := range addrs {
+			if ctx.Context().Err() != nil {
+				break
+			}
+			if refusesQuery(net.JoinHostPort(addr.String(), "53"), name, rrType) {
+				refused = append(refused, fmt.Sprintf("%s (%s)", host, addr))
+			}
+		}
+	}
+	sort.Strings(refused)
+	return refused
+}
+
+// zoneServers finds the nameservers of the zone containing name, without relying on lookups of
+// that zone itself, which may be failing. The closest ancestor zone that can be resolved is asked
+// for the delegation of name, and if there is none, the ancestor's own nameservers are returned.
+func zoneServers(ctx *scanContext, name string) map[string][]net.IP {
+	var zone string
+	var parentServers []net.IP
+	for ancestor := strings.TrimPrefix(name, "*."); ; {
+		parts := strings.SplitN(ancestor, ".", 2)
+		if len(parts) < 2 || parts[1] == "" {
+			return nil
+		}
+		ancestor = parts[1]
+		var err error
+		if zone, parentServers, err = findAuthoritativeServers(ctx, ancestor); err == nil {
+			break
+		}
+	}
+
+	servers := delegatedServers(ctx, parentServers, zone, name)
+	if len(servers) == 0 {
+		servers[zone] = parentServers
+	}
+	return servers
+}
+
+// delegatedServers asks the nameservers of the zone parent for the delegation of name, and returns
+// the addresses of each delegated nameserver, from glue or otherwise by lookup. If parent does not
+// delegate name to other nameservers, nothing is returned.
+func delegatedServers(ctx *scanContext, parentServers []net.IP, parent, name string) map[string][]net.IP {
+	servers := map[string][]net.IP{}
+	for _, server := range parentServers {
+		resp, err := lookupDelegation(net.JoinHostPort(server.String(), "53"), name)
+		if err != nil {
+			continue
+		}
+		glue := map[string][]net.IP{}
+		for _, rr := range resp.Extra {
+			if a, ok := rr.(*dns.A); ok {
+				glue[normalizeFqdn(a.Hdr.Name)] = append(glue[normalizeFqdn(a.Hdr.Name)], a.A)
+			}
+		}
+		for _, rr := range resp.Ns {
+			ns, ok := rr.(*dns.NS)
+			if !ok || normalizeFqdn(ns.Hdr.Name) == parent {
+				continue
+			}
+			host := normalizeFqdn(ns.Ns)
+			addrs := glue[host]
+			if len(addrs) == 0 {
+				nsRRs, _ := ctx.Lookup(host, dns.TypeA)
+				for _, nsRR := range nsRRs {
+					if a, ok := nsRR.(*dns.A); ok {
+						addrs = append(addrs, a.A)
+					}
+				}
+			}
+			servers[host] = addrs
+		}
+		break
+	}
+	return servers
+}
+
+// refusesQuery reports whether server answers a non-recursive query for name with REFUSED.
+func refusesQuery(server string, name string, rrType uint16) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), rrType)
+	m.RecursionDesired = false
+	resp, err := exchangeDirect(m, server)
+	return err == nil && resp.Rcode == dns.RcodeRefused
+}
+
+// findAuthoritativeServers finds the zone which is authoritative for name, by climbing the
+// domain tree until a name with NS records is found, and returns the addresses of its nameservers.
+func findAuthoritativeServers(ctx *scanContext, name string) (string, []net.IP, error) {
+	zone := strings.TrimPrefix(name, "*.")
+	for {
+		rrs, err := ctx.Lookup(zone, dns.TypeNS)
+		if err != nil {
+			return zone, nil, err
+		}
+
+		var addrs []net.IP
+		for _, rr := range rrs {
+			ns, ok := rr.(*dns.NS)
+			if !ok || normalizeFqdn(ns.Hdr.Name) != zone {
+				continue
+			}
+			nsRRs, _ := ctx.Lookup(normalizeFqdn(ns.Ns), dns.TypeA)
+			for _, nsRR := range nsRRs {
+				if a, ok := nsRR.(*dns.A); ok {
+					addrs = append(addrs, a.A)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return zone, addrs, nil
+		}
+
+		parts := strings.SplitN(zone, ".", 2)
+		if len(parts) < 2 || parts[1] == "" {
+			return zone, nil, fmt.Errorf("No authoritative nameservers could be found for %s", name)
+		}
+		zone = parts[1]
+	}
+}
+
+// lookupWithClientSubnet sends a non-recursive query directly to server, including an EDNS Client
+// Subnet option (RFC 7871), so that geo-aware nameservers may answer as though the query
+// originated from that subnet. If subnet is nil, the option is left out.
+func lookupWithClientSubnet(server string, name string, rrType uint16, subnet *net.IPNet) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), rrType)
+	m.RecursionDesired = false
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	if subnet != nil {
+		family, ip := uint16(1), subnet.IP.To4()
+		if ip == nil {
+			family, ip = 2, subnet.IP.To16()
+		}
+		ones, _ := subnet.Mask.Size()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: uint8(ones),
+			Address:       ip,
+		})
+	}
+	m.Extra = append(m.Extra, opt)
+
+	resp, err := exchangeDirect(m, server)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DNS response for %s/%s from %s did not have an acceptable response code: %s",
+			name, dns.TypeToString[rrType], server, dns.RcodeToString[resp.Rcode])
+	}
+	return resp.Answer, nil
+}
+
+// lookupPublicResolver sends a recursive query to publicResolver, bypassing the resolver used by scans.
+func lookupPublicResolver(name string, rrType uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), rrType)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, err := exchangeDirect(m, publicResolver)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("DNS response for %s/%s from %s did not have an acceptable response code: %s",
+			name, dns.TypeToString[rrType], publicResolver, dns.RcodeToString[resp.Rcode])
+	}
+	return resp.Answer, nil
+}
+
+// lookupDelegation asks a nameserver for the parent zone for the delegation of zone, without
+// recursion, so that the referral (NS records and glue) can be inspected.
+func lookupDelegation(server string, zone string) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeNS)
+	m.RecursionDesired = false
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	return exchangeDirect(m, server)
+}
+
+// exchangeDirect sends a query to a specific server, retrying over TCP if the response was truncated.
+func exchangeDirect(m *dns.Msg, server string) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := c.Exchange(m, server)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(m, server)
+	}
+	return resp, err
+}
+
+// toASCIIDomain converts an internationalized domain name to its A-label (punycode) form,
+// which is what must be used for lookups. Names which cannot be converted are left as-is,
+// to be rejected by validDomainChecker.
+func toASCIIDomain(name string) string {
+	if asASCII, err := idna.ToASCII(name); err == nil {
+		return asASCII
+	}
+	return name
 }
 
 func normalizeFqdn(name string) string {
@@ -53,6 +326,76 @@ func isAddressReserved(ip net.IP) bool {
 	return false
 }
 
+// sensitiveAddressReason describes the sensitive range that ip belongs to, or returns an empty string.
+func sensitiveAddressReason(ip net.IP) string {
+	for _, sensitive := range sensitiveNets {
+		if sensitive.Net.Contains(ip) {
+			return sensitive.Description
+		}
+	}
+	return ""
+}
+
+type sensitiveNet struct {
+	Net         *net.IPNet
+	Description string
+}
+
+// isSelfAddress returns whether ip is a loopback address, or an address of this host itself,
+// in which case an HTTP request to it would reach the host running letsdebug rather than the
+// domain's server.
+func isSelfAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	localAddressesOnce.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				localAddresses = append(localAddresses, ipNet.IP)
+			}
+		}
+	})
+	for _, local := range localAddresses {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleAddresses returns up to n of ips, chosen at random if there are more than n.
+func sampleAddresses(ips []net.IP, n int) []net.IP {
+	if len(ips) <= n {
+		return ips
+	}
+	sampled := make([]net.IP, 0, n)
+	for _, i := range rand.Perm(len(ips))[:n] {
+		sampled = append(sampled, ips[i])
+	}
+	return sampled
+}
+
+// ipv6TransitionReason explains why an IPv6 address is an IPv4-mapped address or
+// belongs to an IPv6 transition mechanism, or returns an empty string otherwise.
+func ipv6TransitionReason(ip net.IP) string {
+	if len(ip) != net.IPv6len {
+		return ""
+	}
+	switch {
+	case ip.To4() != nil:
+		return "it is an IPv4-mapped IPv6 address, which only has meaning within a host's own network stack"
+	case ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0 && ip[3] == 0:
+		return "it is a Teredo (2001::/32) tunnel address, which is not reachable by Let's Encrypt"
+	case ip[0] == 0x20 && ip[1] == 0x02:
+		return "it is a 6to4 (2002::/16) relay address, which is not reachable by Let's Encrypt"
+	}
+	return ""
+}
+
 func init() {
 	reservedNets = []*net.IPNet{}
 	reservedCIDRs := []string{
@@ -73,6 +416,14 @@ func init() {
 		}
 		reservedNets = append(reservedNets, n)
 	}
+
+	for _, sensitive := range sensitiveCIDRs {
+		_, n, err := net.ParseCIDR(sensitive.CIDR)
+		if err != nil {
+			panic(err)
+		}
+		sensitiveNets = append(sensitiveNets, sensitiveNet{Net: n, Description: sensitive.Description})
+	}
 }
 
 func setUnboundConfig(ub *unbound.Unbound) error {
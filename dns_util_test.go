@@ -0,0 +1,467 @@
+package letsdebug
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestIPv6TransitionReason(t *testing.T) {
+	tests := map[string]bool{
+		"::ffff:192.0.2.1":     true,
+		"2001:0:4136:e378::1":  true,
+		"2002:c000:0201::1":    true,
+		"2001:db8::1":          false,
+		"2606:4700:4700::1111": false,
+		"192.0.2.1":            false,
+	}
+	for addr, expected := range tests {
+		ip := net.ParseIP(addr)
+		if ip.To4() != nil && addr == "192.0.2.1" {
+			ip = ip.To4()
+		}
+		if got := ipv6TransitionReason(ip) != ""; got != expected {
+			t.Errorf("%s: expected %t, got %t", addr, expected, got)
+		}
+	}
+}
+
+func TestZoneChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeSOA: {Rcode: dns.RcodeNameError}}
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{
+		dns.TypeA:     {Rcode: dns.RcodeNameError},
+		dns.TypeAAAA:  {Rcode: dns.RcodeNameError},
+		dns.TypeCNAME: {Rcode: dns.RcodeNameError},
+	}
+
+	probs, err := zoneChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Name != "ZoneNotFound" {
+		t.Fatalf("expected ZoneNotFound, got: %v", probs)
+	}
+
+	// The subdomain resolving despite the missing apex indicates a broken zone
+	a, _ := dns.NewRR("www.example.org. 60 IN A 192.0.2.1")
+	ctx.rrs["www.example.org"][dns.TypeA] = lookupResult{RRs: []dns.RR{a}}
+	probs, _ = zoneChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeBrokenParentZone || hasFatalProblem(probs) {
+		t.Fatalf("expected BrokenParentZone, got: %v", probs)
+	}
+
+	soa, _ := dns.NewRR("example.org. 60 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 60")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeSOA: {RRs: []dns.RR{soa}}}
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeSOA: {}}
+
+	probs, _ = zoneChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if hasFatalProblem(probs) || len(probs) != 2 {
+		t.Fatalf("expected only debug problems, got: %v", probs)
+	}
+}
+
+func TestLookupWithClientSubnet(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		addr := "192.0.2.1"
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.Address.Equal(net.ParseIP("66.133.109.0")) {
+					addr = "192.0.2.2"
+				}
+			}
+		}
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + addr)
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	rrs, err := lookupWithClientSubnet(pc.LocalAddr().String(), "example.org", dns.TypeA, clientSubnetProbe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || !rrs[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("expected the client subnet answer, got: %v", rrs)
+	}
+}
+
+func TestResolverInterceptionChecker(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	defer func(orig string) { publicResolver = orig }(publicResolver)
+	publicResolver = pc.LocalAddr().String()
+
+	for _, test := range []struct {
+		addr  string
+		nprob int
+		code  ProblemCode
+	}{
+		{"192.0.2.1", 0, ""},
+		// The authoritative nameservers can't be found, so the mismatch can't be confirmed
+		{"198.51.100.1", 1, ProblemCodeResolverComparisonInconclusive},
+	} {
+		ctx := newScanContext()
+		rr, _ := dns.NewRR("example.org. 60 IN A " + test.addr)
+		ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{rr}}, dns.TypeNS: {}}
+		ctx.rrs["org"] = map[uint16]lookupResult{dns.TypeNS: {}}
+
+		probs, _ := (resolverInterceptionChecker{}).Check(ctx, "example.org", HTTP01)
+		if len(probs) != test.nprob || (test.nprob > 0 && probs[0].Code != test.code) {
+			t.Fatalf("%s: unexpected problems: %v", test.addr, probs)
+		}
+	}
+}
+
+func TestMissingGlue(t *testing.T) {
+	resp := new(dns.Msg)
+	for _, s := range []string{
+		"example.org. 3600 IN NS ns1.example.org.",
+		"example.org. 3600 IN NS ns2.example.org.",
+		"example.org. 3600 IN NS ns.example.net.",
+	} {
+		rr, _ := dns.NewRR(s)
+		resp.Ns = append(resp.Ns, rr)
+	}
+	rr, _ := dns.NewRR("ns1.example.org. 3600 IN A 192.0.2.1")
+	resp.Extra = append(resp.Extra, rr)
+
+	missing := missingGlue("example.org", resp)
+	if len(missing) != 1 || missing[0] != "ns2.example.org" {
+		t.Fatalf("expected only ns2.example.org to be missing glue, got: %v", missing)
+	}
+}
+
+func TestParkingNameserverChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	ns1, _ := dns.NewRR("example.org. 3600 IN NS ns1.sedoparking.com.")
+	ns2, _ := dns.NewRR("example.org. 3600 IN NS ns2.sedoparking.com.")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeNS: {RRs: []dns.RR{ns1, ns2}}}
+
+	probs, err := parkingNameserverChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeParkingNameservers {
+		t.Fatalf("expected ParkingNameservers, got: %v", probs)
+	}
+}
+
+func TestDnameChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	dname, _ := dns.NewRR("sub.example.org. 3600 IN DNAME sub.example.net.")
+	ctx.rrs["www.sub.example.org"] = map[uint16]lookupResult{dns.TypeDNAME: {}}
+	ctx.rrs["sub.example.org"] = map[uint16]lookupResult{dns.TypeDNAME: {RRs: []dns.RR{dname}}}
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeDNAME: {}}
+
+	probs, err := dnameChecker{}.Check(ctx, "www.sub.example.org", DNS01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeDnameRedirection || probs[0].Detail != dname.String() {
+		t.Fatalf("expected DnameRedirection, got: %v", probs)
+	}
+}
+
+func TestWildcardTXTNameChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	txt, _ := dns.NewRR(`_acme-challenge.\*.example.org. 60 IN TXT "token"`)
+	ctx.rrs["_acme-challenge.*.example.org"] = map[uint16]lookupResult{dns.TypeTXT: {RRs: []dns.RR{txt}}}
+
+	probs, err := wildcardTXTNameChecker{}.Check(ctx, "*.example.org", DNS01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeWildcardChallengeWrongName {
+		t.Fatalf("expected WildcardChallengeWrongName, got: %v", probs)
+	}
+
+	if _, err := (wildcardTXTNameChecker{}).Check(ctx, "example.org", DNS01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable to non-wildcards, got: %v", err)
+	}
+}
+
+func TestMalformedChallengeTXT(t *testing.T) {
+	tests := []struct {
+		strs     []string
+		expected bool
+	}{
+		{[]string{"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"}, false},
+		{[]string{"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0="}, true},
+		{[]string{`"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"`}, true},
+		{[]string{"LoqXcYV8q5ONbJQxbmR7SC", "TNo3tiAXDfowyjxAjEuX0"}, false},
+		{[]string{"LoqXcYV8q5ONbJQxbmR7SC", "TNo3tiAXDfowyjxAjEu"}, true},
+		{[]string{"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjE+X0"}, true},
+	}
+	for _, tc := range tests {
+		if got := malformedChallengeTXT(tc.strs) != ""; got != tc.expected {
+			t.Errorf("%q: expected malformed=%v, got %v", tc.strs, tc.expected, got)
+		}
+	}
+}
+
+func TestTxtChallengeFormatChecker_Check(t *testing.T) {
+	valid, _ := dns.NewRR(`_acme-challenge.example.org. 60 IN TXT "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"`)
+	stale, _ := dns.NewRR(`_acme-challenge.example.org. 60 IN TXT "not-a-challenge"`)
+
+	tests := []struct {
+		rrs      []dns.RR
+		severity SeverityLevel
+	}{
+		{[]dns.RR{stale}, SeverityError},
+		{[]dns.RR{valid, stale}, SeverityWarning},
+	}
+	for _, tc := range tests {
+		ctx := newScanContext()
+		ctx.rrs["_acme-challenge.example.org"] = map[uint16]lookupResult{dns.TypeTXT: {RRs: tc.rrs}}
+
+		probs, err := txtChallengeFormatChecker{}.Check(ctx, "example.org", DNS01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(probs) != 1 || probs[0].Code != ProblemCodeMalformedChallengeTxt || probs[0].Severity != tc.severity {
+			t.Errorf("%v: expected MalformedChallengeTxt at %s, got: %v", tc.rrs, tc.severity, probs)
+		}
+	}
+}
+
+func TestTxtMultipleRecordsChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	txt1, _ := dns.NewRR(`_acme-challenge.example.org. 60 IN TXT "LoqXcYV8q5ONbJQxbmR7SC"`)
+	txt2, _ := dns.NewRR(`_acme-challenge.example.org. 60 IN TXT "TNo3tiAXDfowyjxAjEuX0"`)
+	ctx.rrs["_acme-challenge.example.org"] = map[uint16]lookupResult{dns.TypeTXT: {RRs: []dns.RR{txt1, txt2}}}
+
+	probs, err := txtMultipleRecordsChecker{}.Check(ctx, "example.org", DNS01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeMultipleChallengeTxtRecords {
+		t.Fatalf("expected MultipleChallengeTxtRecords, got: %v", probs)
+	}
+
+	// Two records are expected when the wildcard is requested too
+	ctx.names = []string{"example.org", "*.example.org"}
+	if probs, _ = (txtMultipleRecordsChecker{}).Check(ctx, "example.org", DNS01); len(probs) != 0 {
+		t.Fatalf("expected no problems, got: %v", probs)
+	}
+}
+
+func TestIsSelfAddress(t *testing.T) {
+	for ip, expected := range map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"0.0.0.0":     true,
+		"192.0.2.1":   false,
+		"2001:db8::1": false,
+	} {
+		if got := isSelfAddress(net.ParseIP(ip)); got != expected {
+			t.Errorf("%s: expected %v, got %v", ip, expected, got)
+		}
+	}
+}
+
+func TestSampleAddresses(t *testing.T) {
+	var ips []net.IP
+	for i := 1; i <= 20; i++ {
+		ips = append(ips, net.IPv4(192, 0, 2, byte(i)))
+	}
+
+	sampled := sampleAddresses(ips, manyAddressesThreshold)
+	if len(sampled) != manyAddressesThreshold {
+		t.Fatalf("expected %d addresses, got: %v", manyAddressesThreshold, sampled)
+	}
+	seen := map[string]bool{}
+	for _, ip := range sampled {
+		if seen[ip.String()] {
+			t.Fatalf("expected distinct addresses, got: %v", sampled)
+		}
+		seen[ip.String()] = true
+	}
+
+	if sampled = sampleAddresses(ips[:3], manyAddressesThreshold); len(sampled) != 3 {
+		t.Fatalf("expected every address, got: %v", sampled)
+	}
+}
+
+func TestDNSRefused(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	if !refusesQuery(pc.LocalAddr().String(), "example.org", dns.TypeA) {
+		t.Fatal("expected the query to be refused")
+	}
+
+	prob := dnsLookupFailed("example.org", "A", &dnsRefusedError{Name: "example.org", RRType: "A",
+		findServers: func() []string { return []string{"ns1.example.org (192.0.2.53)"} }})
+	if prob.Code != ProblemCodeDnsRefused || !strings.Contains(prob.Detail, "ns1.example.org (192.0.2.53)") {
+		t.Fatalf("unexpected problem: %v", prob)
+	}
+	if prob := dnsLookupFailed("example.org", "A", errors.New("SERVFAIL")); prob.Code != ProblemCodeDNSLookupFailed {
+		t.Fatalf("unexpected problem: %v", prob)
+	}
+}
+
+func TestDNSSECChainProblem(t *testing.T) {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 60},
+		Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	if _, err := key.Generate(256); err != nil {
+		t.Fatal(err)
+	}
+	other := *key
+	if _, err := other.Generate(256); err != nil {
+		t.Fatal(err)
+	}
+	ds := key.ToDS(dns.SHA256)
+
+	if prob := dnssecChainProblem("example.org", []dns.RR{ds}, []dns.RR{&other, key}); prob != nil {
+		t.Fatalf("expected no problem, got: %v", prob)
+	}
+	if prob := dnssecChainProblem("example.org", []dns.RR{ds}, []dns.RR{&other}); prob == nil || prob.Code != ProblemCodeDnssecDsMismatch {
+		t.Fatalf("expected a DS mismatch, got: %v", prob)
+	}
+	if prob := dnssecChainProblem("example.org", []dns.RR{ds}, nil); prob == nil || prob.Code != ProblemCodeDnssecMissingDnskey {
+		t.Fatalf("expected a missing DNSKEY, got: %v", prob)
+	}
+}
+
+func TestDNSSECChainChecker_Unsigned(t *testing.T) {
+	ctx := newScanContext()
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeDS: {}}
+	if _, err := (dnssecChainChecker{}).Check(ctx, "example.org", HTTP01); err != errNotApplicable {
+		t.Fatalf("expected the check not to apply, got: %v", err)
+	}
+}
+
+func TestInvalidSignatures(t *testing.T) {
+	now := time.Now()
+	sig := func(typeCovered uint16, inception, expiration time.Time) dns.RR {
+		return &dns.RRSIG{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+			TypeCovered: typeCovered, Algorithm: dns.ECDSAP256SHA256, SignerName: "example.org.",
+			Inception: uint32(inception.Unix()), Expiration: uint32(expiration.Unix())}
+	}
+	a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+
+	// The A RRset is still signed by a current key during a rollover, the AAAA RRset isn't
+	rrs := []dns.RR{a, sig(dns.TypeA, now.Add(-time.Hour), now.Add(time.Hour)),
+		sig(dns.TypeA, now.Add(-2*time.Hour), now.Add(-time.Hour)), sig(dns.TypeAAAA, now.Add(time.Hour), now.Add(2*time.Hour)),
+		sig(dns.TypeAAAA, now.Add(-2*time.Hour), now.Add(-time.Hour))}
+	if invalid := invalidSignatures(rrs, now); len(invalid) != 1 || invalid[0].TypeCovered != dns.TypeAAAA {
+		t.Fatalf("expected only the AAAA signatures to be invalid, got: %v", invalid)
+	}
+}
+
+func TestAnswerSetKey(t *testing.T) {
+	response := func(records ...string) *dns.Msg {
+		m := new(dns.Msg)
+		for _, s := range records {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+
+	first := answerSetKey(response("example.org. 60 IN A 192.0.2.1", "example.org. 60 IN A 192.0.2.2"))
+	rotated := answerSetKey(response("example.org. 30 IN A 192.0.2.2", "example.org. 30 IN A 192.0.2.1"))
+	if first != rotated {
+		t.Fatalf("expected round-robin rotation to be ignored: %q != %q", first, rotated)
+	}
+	if other := answerSetKey(response("example.org. 60 IN A 192.0.2.1")); other == first {
+		t.Fatalf("expected a different answer set to be distinguished: %q", other)
+	}
+}
+
+func TestInconsistentAnswers(t *testing.T) {
+	one, two := serverAnswer{Key: "NOERROR: one", Populated: true}, serverAnswer{Key: "NOERROR: two", Populated: true}
+	empty := serverAnswer{Key: "NOERROR: (no records)"}
+
+	for _, tc := range []struct {
+		byServer     map[string][]serverAnswer
+		inconsistent bool
+	}{
+		{map[string][]serverAnswer{"ns1": {one, one}, "ns2": {one, one}}, false},
+		// The nameservers are out of sync
+		{map[string][]serverAnswer{"ns1": {one, one}, "ns2": {two, two}}, true},
+		// Random subsets of a larger set of records
+		{map[string][]serverAnswer{"ns1": {one, two}, "ns2": {two, one}}, false},
+		{map[string][]serverAnswer{"ns1": {one, empty}, "ns2": {one, one}}, true},
+	} {
+		if got := inconsistentAnswers(tc.byServer); got != tc.inconsistent {
+			t.Errorf("%v: expected inconsistent=%t, got %t", tc.byServer, tc.inconsistent, got)
+		}
+	}
+}
+
+func TestProbeNameserver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		if r.Question[0].Name != "example.org." {
+			m.SetRcode(r, dns.RcodeRefused)
+		} else {
+			m.SetReply(r)
+			m.Authoritative = true
+			soa, _ := dns.NewRR("example.org. 60 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 60")
+			m.Answer = append(m.Answer, soa)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	if err := probeNameserver(pc.LocalAddr().String(), "example.org"); err != nil {
+		t.Fatalf("expected an authoritative answer, got: %v", err)
+	}
+	if err := probeNameserver(pc.LocalAddr().String(), "example.net"); err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Fatalf("expected the zone to be refused, got: %v", err)
+	}
+
+	ctx := newScanContext()
+	ns, _ := dns.NewRR("example.org. 60 IN NS ns1.example.org.")
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeNS: {}}
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeNS: {RRs: []dns.RR{ns}}}
+	if zone, nameservers := zoneNameservers(ctx, "www.example.org"); zone != "example.org" || len(nameservers) != 1 {
+		t.Fatalf("expected the nameservers of example.org, got: %s %v", zone, nameservers)
+	}
+
+	ctx.rrs["ns1.example.org"] = map[uint16]lookupResult{dns.TypeA: {}, dns.TypeAAAA: {}}
+	probs, _ := (lameNameserverChecker{}).Check(ctx, "www.example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeLameNameserver ||
+		!strings.Contains(probs[0].Detail, "ns1.example.org: does not resolve to any address") {
+		t.Fatalf("expected the unresolvable nameserver to be reported, got: %v", probs)
+	}
+}
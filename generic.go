@@ -4,8 +4,11 @@ import (
 	"context"
 	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -49,6 +52,7 @@ func notValidMethod(method ValidationMethod) Problem {
 	}
 	return Problem{
 		Name:        "InvalidMethod",
+		Code:        ProblemCodeInvalidMethod,
 		Explanation: fmt.Sprintf(`"%s" is not a supported validation method.`, method),
 		Detail:      fmt.Sprintf("Supported methods: %s", strings.Join(supportedMethods, ", ")),
 		Severity:    SeverityFatal,
@@ -63,6 +67,12 @@ func (c validDomainChecker) Check(ctx *scanContext, domain string, method Valida
 
 	domain = strings.TrimPrefix(domain, "*.")
 
+	// Before the character check, which an IPv6 literal would fail confusingly
+	if ip := ipLiteral(domain); ip != nil {
+		probs = append(probs, ipAddressNotSupported(domain, ip))
+		return probs, nil
+	}
+
 	for _, ch := range []byte(domain) {
 		if !(('a' <= ch && ch <= 'z') ||
 			('A' <= ch && ch <= 'A') ||
@@ -78,14 +88,15 @@ func (c validDomainChecker) Check(ctx *scanContext, domain string, method Valida
 		return probs, nil
 	}
 
-	if ip := net.ParseIP(domain); ip != nil {
-		probs = append(probs, invalidDomain(domain, "Domain is an IP address"))
+	// Reserved TLDs get a crisp answer, rather than the confusing lookup failures that would follow
+	if tld, reason := nonIssuableTLDOf(domain); tld != "" {
+		probs = append(probs, nonIssuableTLD(domain, tld, reason))
 		return probs, nil
 	}
 
 	rule := psl.DefaultList.Find(domain, &psl.FindOptions{IgnorePrivate: true, DefaultRule: nil})
 	if rule == nil {
-		probs = append(probs, invalidDomain(domain, "Domain doesn't end in a public TLD"))
+		probs = append(probs, invalidDomain(domain, "Domain doesn't end in a public TLD"), unlistedTLD(domain))
 		return probs, nil
 	}
 
@@ -93,42 +104,260 @@ func (c validDomainChecker) Check(ctx *scanContext, domain string, method Valida
 		probs = append(probs, invalidDomain(domain, "Domain is a TLD"))
 		return probs, nil
 	} else {
-		probs = append(probs, debugProblem("PublicSuffix", "The IANA public suffix is the TLD of the Registered Domain",
+		probs = append(probs, debugProblem(ProblemCodePublicSuffix, "The IANA public suffix is the TLD of the Registered Domain",
 			fmt.Sprintf("The TLD for %s is: %s", domain, r)))
 	}
 
+	probs = append(probs, domainBoundary(domain, rule.Decompose(domain)[1]))
+
+	// The CAA search is bounded by the full list, including its private section
+	if fullRule := psl.DefaultList.Find(domain, &psl.FindOptions{DefaultRule: nil}); fullRule != nil &&
+		(fullRule.Private || fullRule.Type != psl.NormalType) {
+		probs = append(probs, unusualPublicSuffix(domain, fullRule))
+	}
+
+	if brand, reason := brandImpersonation(domain); brand != "" {
+		probs = append(probs, highRiskName(domain, brand, reason))
+	}
+
 	return probs, nil
 }
 
+var (
+	// impersonatedBrands are the brands most often imitated by phishing domains, which Let's Encrypt's
+	// high-risk policy is likely to look for
+	impersonatedBrands = []string{"paypal", "apple", "icloud", "google", "microsoft", "office365", "outlook",
+		"amazon", "facebook", "instagram", "whatsapp", "netflix", "chase", "wellsfargo", "bankofamerica"}
+	// phishingKeywords are the words which phishing domains combine with a brand
+	phishingKeywords = []string{"login", "signin", "secure", "account", "verify", "support", "update", "billing",
+		"security", "unlock", "recovery"}
+)
+
+// brandImpersonation conservatively detects domains which look like they impersonate a well-known brand:
+// either a brand's own domain embedded in the subdomain of another domain (e.g. paypal.com.example.org), or
+// a Registered Domain which combines a brand with a phishing keyword (e.g. paypal-secure-login.com). It
+// returns the brand and the reason, or empty strings.
+func brandImpersonation(domain string) (string, string) {
+	registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return "", ""
+	}
+	registeredLabel := strings.SplitN(registeredDomain, ".", 2)[0]
+	for _, brand := range impersonatedBrands {
+		if registeredLabel == brand {
+			// The brand's own domain
+			return "", ""
+		}
+	}
+
+	subdomainLabels := strings.Split(strings.TrimSuffix(strings.TrimSuffix(domain, registeredDomain), "."), ".")
+	for i := 0; i+1 < len(subdomainLabels); i++ {
+		for _, brand := range impersonatedBrands {
+			if tld := subdomainLabels[i+1]; subdomainLabels[i] == brand && (tld == "com" || tld == "net" || tld == "org") {
+				return brand, fmt.Sprintf("%s.%s is embedded in the subdomain of %s", brand, tld, registeredDomain)
+			}
+		}
+	}
+
+	parts := strings.Split(registeredLabel, "-")
+	for _, brand := range impersonatedBrands {
+		hasBrand, hasKeyword := false, ""
+		for _, part := range parts {
+			if part == brand {
+				hasBrand = true
+			}
+			for _, keyword := range phishingKeywords {
+				if part == keyword {
+					hasKeyword = keyword
+				}
+			}
+		}
+		if hasBrand && hasKeyword != "" {
+			return brand, fmt.Sprintf("The Registered Domain %s combines %q with %q", registeredDomain, brand, hasKeyword)
+		}
+	}
+
+	return "", ""
+}
+
+func highRiskName(domain, brand, reason string) Problem {
+	return Problem{
+		Name: "HighRiskName",
+		Code: ProblemCodeHighRiskName,
+		Explanation: fmt.Sprintf(`%s looks like it may be imitating %s. Let's Encrypt refuses to issue for some names which `+
+			`it considers high-risk (such as names which imitate well-known brands), under a policy whose details are not `+
+			`public. If issuance is refused with a "policy forbids issuing for name" error, this is the likely reason, and `+
+			`there is no way to override it other than using a different name.`, domain, brand),
+		Detail:   reason,
+		Severity: SeverityDebug,
+	}
+}
+
+// nonIssuableTLDs are the special-use and private-use TLDs which will never be in the Public Suffix
+// List, so that Let's Encrypt can't issue for them, and the reason that they are reserved. To recognise
+// another, add it here.
+var nonIssuableTLDs = map[string]string{
+	"home.arpa": "reserved for home networks (RFC 8375)",
+	"local":     "reserved for multicast DNS (RFC 6762)",
+	"internal":  "reserved by ICANN for private use",
+	"localhost": "reserved for the local host (RFC 6761)",
+	"test":      "reserved for testing (RFC 6761)",
+	"example":   "reserved for documentation (RFC 6761)",
+	"invalid":   "reserved as always invalid (RFC 6761)",
+	"onion":     "reserved for Tor onion services (RFC 7686)",
+	"lan":       "commonly used on private networks",
+	"home":      "commonly used on private networks",
+	"corp":      "commonly used on private networks",
+}
+
+// nonIssuableTLDOf returns the reserved TLD (see nonIssuableTLDs) which domain is under, and the
+// reason that it is reserved, or empty strings.
+func nonIssuableTLDOf(domain string) (string, string) {
+	domain = normalizeFqdn(domain)
+	for tld, reason := range nonIssuableTLDs {
+		if domain == tld || strings.HasSuffix(domain, "."+tld) {
+			return tld, reason
+		}
+	}
+	return "", ""
+}
+
+func nonIssuableTLD(domain, tld, reason string) Problem {
+	return Problem{
+		Name: "NonIssuableTld",
+		Code: ProblemCodeNonIssuableTld,
+		Explanation: fmt.Sprintf(`%s is under the .%s TLD, which is %s. Such names are not public, so no public `+
+			`certificate authority, including Let's Encrypt, can issue certificates for them. Use a domain that you have `+
+			`registered under a public TLD instead (e.g. a subdomain such as internal.example.com), or a private CA.`,
+			domain, tld, reason),
+		Detail:   fmt.Sprintf("TLD: %s (%s)", tld, reason),
+		Severity: SeverityFatal,
+	}
+}
+
+// unlistedTLD explains how the suffix of a domain whose TLD matches no rule of the Public Suffix List
+// is determined by software which falls back to the default rule ("*"), rather than by an ICANN entry.
+func unlistedTLD(domain string) Problem {
+	suffix := psl.DefaultRule.Decompose(domain)[1]
+	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
+
+	detail := []string{
+		fmt.Sprintf("Suffix under the default rule: %s", suffix),
+		fmt.Sprintf("Registered Domain under the default rule: %s", registeredDomain),
+	}
+
+	return debugProblem(ProblemCodeUnlistedTLD,
+		fmt.Sprintf(`The TLD of %s is not in the ICANN section of the Public Suffix List, so its suffix could only be `+
+			`determined by the default rule, which treats the rightmost label as the suffix. This is how internal, `+
+			`private-use and very new TLDs are treated, and the Registered Domain and the search for CAA records would `+
+			`not match those of a public name. Let's Encrypt only issues certificates for names under public TLDs.`, domain),
+		strings.Join(detail, "\n"))
+}
+
+// domainBoundary explains where letsdebug considers the boundaries of the domain to be. The TLD comes
+// from the ICANN section of the Public Suffix List, whereas both the Registered Domain (for rate limits)
+// and the search for CAA records take private suffixes (e.g. github.io) into account.
+func domainBoundary(domain, icannSuffix string) Problem {
+	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+
+	detail := []string{
+		fmt.Sprintf("Public suffix: %s", icannSuffix),
+		fmt.Sprintf("Registered Domain (used for rate limits): %s", registeredDomain),
+		fmt.Sprintf("Public suffix including private suffixes (CAA records are searched for up to): %s", suffix),
+	}
+
+	return debugProblem(ProblemCodeDomainBoundary,
+		fmt.Sprintf("The public suffix and Registered Domain that %s is treated as belonging to", domain),
+		strings.Join(detail, "\n"))
+}
+
+// unusualPublicSuffix notes that the public suffix of the domain comes from the private section of the
+// Public Suffix List, or from a wildcard or exception rule, which bounds the search for CAA records in a
+// way that users of hosting platforms may not expect.
+func unusualPublicSuffix(domain string, rule *psl.Rule) Problem {
+	section := "ICANN"
+	if rule.Private {
+		section = "private"
+	}
+	ruleType := "normal"
+	switch rule.Type {
+	case psl.WildcardType:
+		ruleType = "wildcard"
+	case psl.ExceptionType:
+		ruleType = "exception"
+	}
+	suffix := rule.Decompose(domain)[1]
+
+	return Problem{
+		Name: "UnusualPublicSuffix",
+		Code: ProblemCodeUnusualPublicSuffix,
+		Explanation: fmt.Sprintf(`The public suffix of %s is %s, which was matched by a %s rule in the %s section of the `+
+			`Public Suffix List. The search for CAA records stops at %s, so CAA records above it (as well as those of `+
+			`other sites sharing the suffix) do not apply to %s. This is usual for subdomains of hosting platforms.`,
+			domain, suffix, ruleType, section, suffix, domain),
+		Detail:   fmt.Sprintf("Rule: %s (%s section, %s rule)", rule.Value, section, ruleType),
+		Severity: SeverityDebug,
+	}
+}
+
+// caaLookupTimeout bounds the total time spent looking up CAA records up the domain tree
+var caaLookupTimeout = 30 * time.Second
+
+// caaMaxDepth bounds the number of levels of the domain tree which are searched for CAA records
+const caaMaxDepth = 32
+
 // caaChecker ensures that any caa record on the domain, or up the domain tree, allow issuance for letsencrypt.org
 type caaChecker struct{}
 
 func (c caaChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
-	var probs []Problem
-
 	wildcard := false
 	if strings.HasPrefix(domain, "*.") {
 		wildcard = true
 		domain = domain[2:]
 	}
 
-	rrs, err := ctx.Lookup(domain, dns.TypeCAA)
+	return c.check(ctx, domain, wildcard, method, time.Now().Add(caaLookupTimeout), 0)
+}
+
+func (c caaChecker) check(ctx *scanContext, domain string, wildcard bool, method ValidationMethod,
+	deadline time.Time, depth int) ([]Problem, error) {
+	var probs []Problem
+
+	if depth >= caaMaxDepth {
+		probs = append(probs, debugProblem(ProblemCodeCAADepth,
+			fmt.Sprintf("Stopped looking for CAA records after %d levels of the domain tree", caaMaxDepth), domain))
+		return probs, nil
+	}
+
+	result, ok := ctx.LookupBefore(domain, dns.TypeCAA, deadline)
+	if !ok {
+		probs = append(probs, caaLookupTimeoutExceeded(domain))
+		return probs, nil
+	}
+	rrs, err := result.RRs, result.Error
 	if err != nil {
+		// A failure at this level will prevent issuance, but keep climbing the tree, so that
+		// any problems with the records that do resolve are still reported
 		probs = append(probs, dnsLookupFailed(domain, "CAA", err))
-		return probs, nil
+		rrs = nil
+	}
+
+	// Only a CAA RRset stops the climb (e.g. not a CNAME which was returned alongside it)
+	var caaRRs []*dns.CAA
+	for _, rr := range rrs {
+		if caaRr, ok := rr.(*dns.CAA); ok {
+			caaRRs = append(caaRRs, caaRr)
+		}
 	}
 
 	// check any found caa records
-	if len(rrs) > 0 {
+	if len(caaRRs) > 0 {
 		var issue []*dns.CAA
 		var issuewild []*dns.CAA
 		var criticalUnknown []*dns.CAA
 
-		for _, rr := range rrs {
-			caaRr, ok := rr.(*dns.CAA)
-			if !ok {
-				continue
-			}
+		for _, caaRr := range caaRRs {
 
 			switch caaRr.Tag {
 			case "issue":
@@ -138,87 +367,1172 @@ func (c caaChecker) Check(ctx *scanContext, domain string, method ValidationMeth
 			case "iodef":
 				break
 			default:
-				if caaRr.Flag == 1 {
+				// The issuer critical flag is the high bit (128), but a flag of 1 has long been
+				// treated as critical here too, as it was mistakenly described before RFC 8659
+				if caaRr.Flag&128 != 0 || caaRr.Flag == 1 {
 					criticalUnknown = append(criticalUnknown, caaRr)
 				}
 			}
 		}
 
-		probs = append(probs, debugProblem("CAA",
-			"CAA records control authorization for certificate authorities to issue certificates for a domain",
-			collateRecords(append(issue, issuewild...))))
+		probs = append(probs, debugProblem(ProblemCodeCAA,
+			fmt.Sprintf("CAA records control authorization for certificate authorities to issue certificates for a domain. "+
+				"The records at %s are the closest to the domain, so only they apply (any records on parent domains are ignored)", domain),
+			collateRecords(caaRRs)))
+
+		var corrupted []string
+		for _, r := range append(issue, issuewild...) {
+			if reason := caaQuotingIssue(r.Value); reason != "" {
+				corrupted = append(corrupted, fmt.Sprintf("%s (%s)", r.String(), reason))
+			}
+		}
+		if len(corrupted) > 0 {
+			probs = append(probs, caaQuotingIssueProblem(domain, corrupted))
+		}
+
+		for _, set := range [][]*dns.CAA{issue, issuewild} {
+			if conflicting := contradictoryCAA(set); len(conflicting) > 0 {
+				probs = append(probs, contradictoryCAAProblem(domain, conflicting))
+			}
+		}
+
+		records := issue
+		if wildcard && len(issuewild) > 0 {
+			records = issuewild
+		}
+
+		// A restrictive (or critical) issuewild record may look like it applies to every request
+		if !wildcard && len(issuewild) > 0 && !caaPermitsLetsEncrypt(issuewild, ctx.caaIssuers) {
+			probs = append(probs, debugProblem(ProblemCodeCAAIssuewildScope,
+				fmt.Sprintf(`The "issuewild" CAA records on %s do not permit Let's Encrypt, but they only apply to wildcard `+
+					`names (e.g. *.%s). They have no effect on issuance for %s itself, even if they are marked as critical; `+
+					`only the "issue" records apply to it.`, domain, domain, domain),
+				collateRecords(issuewild)))
+		}
 
 		if len(criticalUnknown) > 0 {
-			probs = append(probs, caaCriticalUnknown(domain, wildcard, criticalUnknown))
+			// Show any records permitting Let's Encrypt, since the critical record overrides them
+			var nullified []*dns.CAA
+			for _, r := range records {
+				if isCAAIssuer(extractIssuerDomain(r.Value), ctx.caaIssuers) {
+					nullified = append(nullified, r)
+				}
+			}
+			probs = append(probs, caaCriticalUnknown(domain, wildcard, criticalUnknown, nullified))
+			return probs, nil
+		}
+
+		// Without any issue (or, for a wildcard, issuewild) property, issuance is unrestricted, even if
+		// a parent domain has restrictive records, since those are never reached
+		if len(records) == 0 {
+			probs = append(probs, caaUnrestricted(domain, wildcard, caaRRs))
+			return probs, nil
+		}
+
+		if !caaPermitsLetsEncrypt(records, ctx.caaIssuers) {
+			if caaPermitsAfterNormalizing(records, ctx.caaIssuers) {
+				prob := caaIssuanceNotAllowed(domain, wildcard, records)
+				prob.Explanation += ` A record does name "letsencrypt.org", but only once its extra quotes or escape ` +
+					`characters are removed (see CaaQuotingIssue): Let's Encrypt compares the issuer literally, so that ` +
+					`record must be re-entered without them.`
+				probs = append(probs, prob)
+			} else if malformed, bare := findMalformedCAAIssuer(records); malformed != nil {
+				probs = append(probs, malformedCAAIssuer(domain, wildcard, malformed, bare))
+			} else if typo := findCAAIssuerTypo(records); typo != nil {
+				probs = append(probs, caaLikelyTypo(domain, wildcard, typo))
+			} else if mistake, issuer := findCAAIssuerSuffixMistake(records); mistake != nil {
+				probs = append(probs, caaIssuerSuffixMistake(domain, wildcard, mistake, issuer))
+			} else {
+				probs = append(probs, caaIssuanceNotAllowed(domain, wildcard, records))
+			}
+			return probs, nil
+		}
+
+		if issuers := caaPermittedIssuers(records); len(issuers) > 1 {
+			probs = append(probs, debugProblem(ProblemCodeCAAPermittedIssuers,
+				fmt.Sprintf("The CAA records on %s (wildcard=%t) permit issuance by each of these certificate authorities", domain, wildcard),
+				strings.Join(issuers, "\n")))
+		}
+
+		// Let's Encrypt is named, but the parameters may still restrict issuance
+		permitted := caaPermittedForMethod(records, method, ctx.caaIssuers)
+		if len(permitted) == 0 {
+			probs = append(probs, caaValidationMethodNotAllowed(domain, wildcard, method, records, ctx.caaIssuers))
 			return probs, nil
 		}
 
-		if len(issue) == 0 && !wildcard {
-			return probs, nil
-		}
+		for _, r := range permitted {
+			if _, params, _ := ParseCAAValue(r.Value); params["accounturi"] == "" {
+				return probs, nil
+			}
+		}
+		probs = append(probs, caaAccountURIRestricted(domain, wildcard, permitted))
+		return probs, nil
+	}
+
+	// recurse up to the public suffix domain until a caa record is found
+	// a.b.c.com -> b.c.com -> c.com until
+	if ps, _ := publicsuffix.PublicSuffix(domain); domain != ps && ps != "" {
+		splitDomain := strings.SplitN(domain, ".", 2)
+
+		parentProbs, err := c.check(ctx, splitDomain[1], wildcard, method, deadline, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("error checking caa record on domain: %s, %v", splitDomain[1], err)
+		}
+
+		probs = append(probs, parentProbs...)
+	}
+
+	return probs, nil
+}
+
+// wwwCounterpartChecker suggests the www subdomain when the apex is requested (and the apex when
+// www is requested), noting whether the other name resolves, since users commonly intend to cover
+// both. It is advisory only, so it doesn't make any requests to the other name's servers.
+type wwwCounterpartChecker struct{}
+
+func (c wwwCounterpartChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
+	var counterpart string
+	switch domain {
+	case registeredDomain:
+		counterpart = "www." + domain
+	case "www." + registeredDomain:
+		counterpart = registeredDomain
+	default:
+		return nil, errNotApplicable
+	}
+
+	// Nothing to suggest when both names are already being checked together
+	for _, name := range ctx.names {
+		if name == counterpart {
+			return nil, errNotApplicable
+		}
+	}
+
+	state := "resolves, so it could also be included"
+	if address, err := ctx.LookupRandomHTTPRecord(counterpart); err != nil || address == nil {
+		state = "does not appear to have any A or AAAA records, so it would not currently work"
+	}
+
+	return []Problem{{
+		Name: "WWWCounterpart",
+		Code: ProblemCodeWWWCounterpart,
+		Explanation: fmt.Sprintf(`Suggestion: many sites are accessed as both %s and %s, but only %s is being checked. `+
+			`If visitors may use %s, you may want to include it in the certificate too. %s %s. `+
+			`This is only a suggestion, and is not a problem with %s.`, domain, counterpart, domain, counterpart, counterpart, state, domain),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// highTTLThreshold is the TTL above which recent changes to a record are likely to go unnoticed
+const highTTLThreshold = 24 * 60 * 60
+
+// highTTLChecker reports records relevant to issuance which have unusually high TTLs, because
+// changes to them may take a long time to be seen by Let's Encrypt.
+type highTTLChecker struct{}
+
+func (c highTTLChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	var high []string
+	for _, rr := range issuanceRecords(ctx, domain, method) {
+		if rr.Header().Ttl > highTTLThreshold {
+			high = append(high, rr.String())
+		}
+	}
+
+	if len(high) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "HighTTL",
+		Code: ProblemCodeHighTTL,
+		Explanation: fmt.Sprintf(`Some of the DNS records which are used during issuance for %s have a TTL of more than `+
+			`%d hours. If these records were changed recently, DNS resolvers (including Let's Encrypt's) may continue to use `+
+			`the old values until their TTL expires. If you are about to change these records, consider lowering their TTL `+
+			`well in advance.`, domain, highTTLThreshold/3600),
+		Detail:   strings.Join(high, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// issuanceRecords returns the records which Let's Encrypt looks up during issuance for domain: its
+// A and AAAA records (for http-01), and the CAA records which apply to it.
+func issuanceRecords(ctx *scanContext, domain string, method ValidationMethod) []dns.RR {
+	var rrs []dns.RR
+
+	if method == HTTP01 && len(ctx.addressOverride) == 0 {
+		for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			found, _ := ctx.Lookup(domain, rrType)
+			rrs = append(rrs, found...)
+		}
+	}
+
+	if _, caas, err := lookupRelevantCAA(ctx, domain); err == nil {
+		for _, caa := range caas {
+			rrs = append(rrs, caa)
+		}
+	}
+
+	return rrs
+}
+
+// zeroTTLChecker notes records relevant to issuance which have a TTL of 0, because they can't be cached,
+// so every lookup by Let's Encrypt must reach the authoritative nameservers.
+type zeroTTLChecker struct{}
+
+func (c zeroTTLChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	var zero []string
+	for _, rr := range issuanceRecords(ctx, domain, method) {
+		if rr.Header().Ttl == 0 {
+			zero = append(zero, rr.String())
+		}
+	}
+
+	if len(zero) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "ZeroTTL",
+		Code: ProblemCodeZeroTTL,
+		Explanation: fmt.Sprintf(`Some of the DNS records which are used during issuance for %s have a TTL of 0, so they `+
+			`can't be cached and every lookup by Let's Encrypt (several per validation, from multiple locations) must be `+
+			`answered by the authoritative nameservers. If those nameservers are at all unreliable, lookups, particularly `+
+			`of CAA records, will fail intermittently. Consider giving these records a TTL of at least a few minutes.`, domain),
+		Detail:   strings.Join(zero, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// addressTTLDisparityFactor is how many times greater the TTL of the A or AAAA records of a name must be
+// than the others' (and by at least an hour) to be reported by addressTTLMismatchChecker
+const addressTTLDisparityFactor = 4
+
+// addressTTLMismatchChecker notes when the A and AAAA records of a domain have very different TTLs, since
+// after a change, resolvers may already use the new addresses of one family but still the old of the other.
+type addressTTLMismatchChecker struct{}
+
+func (c addressTTLMismatchChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if (method != HTTP01 && method != TLSALPN01) || len(ctx.addressOverride) > 0 || strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	maxTTL := func(rrType uint16) (uint32, bool) {
+		rrs, _ := ctx.Lookup(domain, rrType)
+		var ttl uint32
+		found := false
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == rrType {
+				found = true
+				if rr.Header().Ttl > ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+		return ttl, found
+	}
+	v4TTL, hasV4 := maxTTL(dns.TypeA)
+	v6TTL, hasV6 := maxTTL(dns.TypeAAAA)
+	if !hasV4 || !hasV6 {
+		return nil, nil
+	}
+
+	low, high := v4TTL, v6TTL
+	if low > high {
+		low, high = high, low
+	}
+	if high < low*addressTTLDisparityFactor || high-low < 3600 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "AddressTTLMismatch",
+		Code: ProblemCodeAddressTTLMismatch,
+		Explanation: fmt.Sprintf(`The A and AAAA records of %s have very different TTLs. When both are changed, DNS `+
+			`resolvers may pick up the new addresses of one family long before the other. Let's Encrypt prefers IPv6, so it `+
+			`may still be using an old AAAA record while you are seeing the new A record (or vice versa). Consider giving `+
+			`both the same TTL.`, domain),
+		Detail:   fmt.Sprintf("A TTL: %ds\nAAAA TTL: %ds", v4TTL, v6TTL),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// ipv4OnlyChecker notes when a name has A records but no AAAA records, while related names (the
+// registered domain, its www subdomain, the parent name or the zone's nameservers) do have AAAA
+// records, in case IPv6 was intended for the name as well. It is advisory only.
+type ipv4OnlyChecker struct{}
+
+func (c ipv4OnlyChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if (method != HTTP01 && method != TLSALPN01) || len(ctx.addressOverride) > 0 || strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	hasRecord := func(name string, rrType uint16) dns.RR {
+		rrs, _ := ctx.Lookup(name, rrType)
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == rrType {
+				return rr
+			}
+		}
+		return nil
+	}
+	if hasRecord(domain, dns.TypeA) == nil || hasRecord(domain, dns.TypeAAAA) != nil {
+		return nil, nil
+	}
+
+	var siblings []string
+	if parts := strings.SplitN(domain, ".", 2); len(parts) == 2 {
+		siblings = append(siblings, parts[1])
+	}
+	if registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		siblings = append(siblings, registeredDomain, "www."+registeredDomain)
+		nsRRs, _ := ctx.Lookup(registeredDomain, dns.TypeNS)
+		for _, rr := range nsRRs {
+			if ns, ok := rr.(*dns.NS); ok {
+				siblings = append(siblings, normalizeFqdn(ns.Ns))
+			}
+		}
+	}
+
+	seen := map[string]bool{domain: true}
+	for _, sibling := range siblings {
+		if seen[sibling] {
+			continue
+		}
+		seen[sibling] = true
+		if aaaa := hasRecord(sibling, dns.TypeAAAA); aaaa != nil {
+			return []Problem{{
+				Name: "IPv4Only",
+				Code: ProblemCodeIPv4Only,
+				Explanation: fmt.Sprintf(`%s has an A record but no AAAA record, while %s, which is related to it, has an `+
+					`AAAA record. If you intended %s to be reachable over IPv6 as well, an AAAA record may be missing. `+
+					`This is only a suggestion, and does not prevent issuance.`, domain, sibling, domain),
+				Detail:   aaaa.String(),
+				Severity: SeverityDebug,
+			}}, nil
+		}
+	}
+	return nil, nil
+}
+
+// caaWildcardDivergenceChecker checks requests which include both a name and its wildcard
+// (e.g. example.org and *.example.org), where the issue and issuewild CAA properties may
+// permit Let's Encrypt to issue for one of the names but not the other.
+type caaWildcardDivergenceChecker struct{}
+
+func (c caaWildcardDivergenceChecker) CheckNames(ctx *scanContext, domains []string, method ValidationMethod) ([]Problem, error) {
+	requested := map[string]bool{}
+	for _, d := range domains {
+		requested[d] = true
+	}
+
+	var probs []Problem
+	for _, d := range domains {
+		if strings.HasPrefix(d, "*.") || !requested["*."+d] {
+			continue
+		}
+
+		name, records, err := lookupRelevantCAA(ctx, d)
+		if err != nil || len(records) == 0 {
+			// Lookup failures are reported by caaChecker
+			continue
+		}
+
+		var issue, issuewild []*dns.CAA
+		for _, r := range records {
+			switch r.Tag {
+			case "issue":
+				issue = append(issue, r)
+			case "issuewild":
+				issuewild = append(issuewild, r)
+			}
+		}
+
+		// Without any issue property, non-wildcard issuance is unrestricted
+		baseAllowed := len(issue) == 0 || caaPermitsLetsEncrypt(issue, ctx.caaIssuers)
+		// issuewild takes precedence for wildcards, otherwise issue applies to both
+		wildcardAllowed := baseAllowed
+		if len(issuewild) > 0 {
+			wildcardAllowed = caaPermitsLetsEncrypt(issuewild, ctx.caaIssuers)
+		}
+
+		if baseAllowed == wildcardAllowed {
+			continue
+		}
+
+		probs = append(probs, caaWildcardDivergence(d, name, baseAllowed, issue, issuewild))
+	}
+
+	return probs, nil
+}
+
+// cdnCNAMESuffixes map the domains of CDN edge hostnames, which are typically the target of a CNAME
+// from the user's own name, to the CDN. To recognise another, add it here.
+var cdnCNAMESuffixes = map[string]string{
+	"cloudfront.net":     "Amazon CloudFront",
+	"akamaiedge.net":     "Akamai",
+	"edgekey.net":        "Akamai",
+	"edgesuite.net":      "Akamai",
+	"fastly.net":         "Fastly",
+	"azureedge.net":      "Azure CDN",
+	"cdn.cloudflare.net": "Cloudflare",
+	"b-cdn.net":          "BunnyCDN",
+}
+
+// cdnCAAChecker explains where CAA records are evaluated when the domain is a CNAME to a CDN edge
+// hostname, since users commonly publish CAA records on their origin server's hostname instead, where
+// Let's Encrypt never looks.
+type cdnCAAChecker struct{}
+
+func (c cdnCAAChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	rrs, err := ctx.Lookup(domain, dns.TypeCNAME)
+	if err != nil {
+		return nil, nil
+	}
+	var target, cdn string
+	for _, rr := range rrs {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		name := normalizeFqdn(cname.Target)
+		if provider := cdnOfHostname(name); provider != "" {
+			target, cdn = name, provider
+		}
+	}
+	if target == "" {
+		return nil, nil
+	}
+
+	name, records, err := lookupRelevantCAA(ctx, domain)
+	if err != nil {
+		// Reported by caaChecker
+		return nil, nil
+	}
+
+	var applies string
+	switch {
+	case len(records) == 0:
+		applies = fmt.Sprintf("No CAA records apply to %s, so any Certificate Authority may issue for it.", domain)
+	case name == domain && normalizeFqdn(records[0].Hdr.Name) != domain:
+		applies = fmt.Sprintf("The CAA records of the CDN's hostname %s apply to %s.", normalizeFqdn(records[0].Hdr.Name), domain)
+	default:
+		applies = fmt.Sprintf("The CAA records at %s apply to %s.", name, domain)
+	}
+
+	probs := []Problem{debugProblem(ProblemCodeCDNCAAEvaluation,
+		fmt.Sprintf("%s is a CNAME to %s (%s). Let's Encrypt looks up CAA records at %s, following the CNAME to the CDN's "+
+			"hostname, and then at the parent domains of %s. CAA records on an origin server's hostname are never consulted, "+
+			"so CAA records must be published at %s or one of its parent domains (unless the CDN's hostname has its own).",
+			domain, target, cdn, domain, domain, domain),
+		fmt.Sprintf("%s CNAME %s\n%s", domain, target, applies))}
+
+	if len(records) > 0 {
+		if owner := normalizeFqdn(records[0].Hdr.Name); cdnOfHostname(owner) != "" {
+			probs = append(probs, caaControlledByCDN(ctx, domain, owner, cdn, records))
+		}
+	}
+	return probs, nil
+}
+
+// cdnOfHostname returns the CDN whose edge hostnames name belongs to, or an empty string.
+func cdnOfHostname(name string) string {
+	for suffix, provider := range cdnCNAMESuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return provider
+		}
+	}
+	return ""
+}
+
+func caaControlledByCDN(ctx *scanContext, domain, owner, cdn string, records []*dns.CAA) Problem {
+	var issue []*dns.CAA
+	var rrs []string
+	for _, r := range records {
+		if r.Tag == "issue" {
+			issue = append(issue, r)
+		}
+		rrs = append(rrs, r.String())
+	}
+	verdict := "They permit Let's Encrypt to issue."
+	if len(issue) > 0 && !caaPermitsLetsEncrypt(issue, ctx.caaIssuers) {
+		verdict = "They do not permit Let's Encrypt to issue."
+	}
+	return debugProblem(ProblemCodeCaaControlledByCdn,
+		fmt.Sprintf("The CAA records which apply to %s are published at %s, which is controlled by %s rather than by you. "+
+			"Because %s is a CNAME into the CDN, these records take the place of any at %s or its parent domains, and you "+
+			"may not be able to change them. If they prevent issuance, ask %s to permit Let's Encrypt, let the CDN manage "+
+			"the certificate, or use the dns-01 challenge with a name that isn't a CNAME.", domain, owner, cdn, domain, domain, cdn),
+		fmt.Sprintf("Controlling domain: %s. %s\n%s", owner, verdict, strings.Join(rrs, "\n")))
+}
+
+// caaUnsupportedNameservers are the nameserver domains of DNS providers which do not support
+// publishing CAA records. To recognise another, add it here.
+var caaUnsupportedNameservers = map[string]string{
+	"freenom.com": "Freenom",
+	"yandex.net":  "Yandex",
+}
+
+// caaUnsupportedProviderChecker notes when no CAA records apply to the domain and its
+// Registered Domain is served by a DNS provider which cannot publish them, since any CAA
+// policy that the user intended to set up will not be in effect.
+type caaUnsupportedProviderChecker struct{}
+
+func (c caaUnsupportedProviderChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	registeredDomain, err := psl.DomainFromListWithOptions(psl.DefaultList, strings.TrimPrefix(domain, "*."),
+		&psl.FindOptions{IgnorePrivate: true})
+	if err != nil || registeredDomain == "" {
+		return nil, errNotApplicable
+	}
+
+	if _, records, err := lookupRelevantCAA(ctx, domain); err != nil || len(records) > 0 {
+		return nil, nil
+	}
+
+	// Make sure that the zone is actually being served, rather than the CAA lookup being empty
+	// because nothing is served at all
+	if soa, err := ctx.Lookup(registeredDomain, dns.TypeSOA); err != nil || len(soa) == 0 {
+		return nil, nil
+	}
+
+	nsRRs, err := ctx.Lookup(registeredDomain, dns.TypeNS)
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, rr := range nsRRs {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name := normalizeFqdn(ns.Ns)
+		for suffix, provider := range caaUnsupportedNameservers {
+			if name != suffix && !strings.HasSuffix(name, "."+suffix) {
+				continue
+			}
+			return []Problem{{
+				Name: "CAAUnsupportedByProvider",
+				Code: ProblemCodeCAAUnsupportedByProvider,
+				Explanation: fmt.Sprintf(`There are no CAA records for %s, and its DNS provider (%s) does not support `+
+					`publishing them. This does not prevent Let's Encrypt from issuing certificates, but if you intended to `+
+					`restrict which Certificate Authorities may issue for this domain, that policy is not in effect.`,
+					domain, provider),
+				Detail:   fmt.Sprintf("Nameserver: %s", name),
+				Severity: SeverityDebug,
+			}}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// wildcardCNAMEBaseChecker warns when the base name of a wildcard (sub.example.org for *.sub.example.org)
+// is a CNAME, since the CAA records which govern the wildcard are then those at the CNAME's target.
+type wildcardCNAMEBaseChecker struct{}
+
+func (c wildcardCNAMEBaseChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if !strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+	base := strings.TrimPrefix(domain, "*.")
+
+	rrs, err := ctx.Lookup(base, dns.TypeCNAME)
+	if err != nil {
+		return nil, nil
+	}
+	var target string
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && normalizeFqdn(cname.Hdr.Name) == base {
+			target = normalizeFqdn(cname.Target)
+		}
+	}
+	if target == "" {
+		return nil, nil
+	}
+
+	name, records, err := lookupRelevantCAA(ctx, base)
+	if err != nil {
+		// Reported by caaChecker
+		return nil, nil
+	}
+
+	var applies string
+	switch {
+	case len(records) == 0:
+		applies = fmt.Sprintf("No CAA records apply to %s, so any Certificate Authority may issue for it.", domain)
+	case name == base && normalizeFqdn(records[0].Hdr.Name) != base:
+		applies = fmt.Sprintf("The CAA records of the CNAME target %s apply to %s:\n%s",
+			normalizeFqdn(records[0].Hdr.Name), domain, collateRecords(records))
+	default:
+		applies = fmt.Sprintf("The CAA records at %s apply to %s:\n%s", name, domain, collateRecords(records))
+	}
+
+	return []Problem{{
+		Name: "WildcardBaseCNAME",
+		Code: ProblemCodeWildcardBaseCNAME,
+		Explanation: fmt.Sprintf(`%s is a CNAME to %s. For the wildcard %s, Let's Encrypt looks up CAA records at %s, `+
+			`which follows the CNAME, so any CAA records (including "issuewild") at %s decide whether the wildcard may `+
+			`be issued, and CAA records can't be published at %s itself. If %s has none, the search continues at the `+
+			`parent domains of %s, not those of %s. Make sure that the CAA records at %s (or, if it has none, at the `+
+			`parents of %s) permit Let's Encrypt to issue wildcard certificates.`,
+			base, target, domain, base, target, base, target, base, target, target, base),
+		Detail:   fmt.Sprintf("%s CNAME %s\n%s", base, target, applies),
+		Severity: SeverityWarning,
+	}}, nil
+}
+
+// lookupRelevantCAA finds the CAA RRset which applies to domain, by climbing the domain tree
+// until a name with CAA records is found, up to but excluding the public suffix.
+func lookupRelevantCAA(ctx *scanContext, domain string) (string, []*dns.CAA, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+	for {
+		rrs, err := ctx.Lookup(domain, dns.TypeCAA)
+		if err != nil {
+			return domain, nil, err
+		}
+
+		var records []*dns.CAA
+		for _, rr := range rrs {
+			if caaRr, ok := rr.(*dns.CAA); ok {
+				records = append(records, caaRr)
+			}
+		}
+		if len(records) > 0 {
+			return domain, records, nil
+		}
+
+		ps, _ := publicsuffix.PublicSuffix(domain)
+		if domain == ps || ps == "" {
+			return domain, nil, nil
+		}
+		domain = strings.SplitN(domain, ".", 2)[1]
+	}
+}
+
+// caaPermittedIssuers lists the distinct issuer domain names named by the records.
+func caaPermittedIssuers(records []*dns.CAA) []string {
+	var issuers []string
+	seen := map[string]bool{}
+	for _, r := range records {
+		if issuer := extractIssuerDomain(r.Value); issuer != "" && !seen[issuer] {
+			seen[issuer] = true
+			issuers = append(issuers, issuer)
+		}
+	}
+	return issuers
+}
+
+// caaPermitsLetsEncrypt returns whether any of the issue or issuewild records name Let's Encrypt,
+// or one of the other trusted issuer domains.
+func caaPermitsLetsEncrypt(records []*dns.CAA, issuers []string) bool {
+	for _, r := range records {
+		if isCAAIssuer(literalIssuerDomain(r.Value), issuers) {
+			return true
+		}
+	}
+	return false
+}
+
+// literalIssuerDomain returns the issuer domain name of a CAA value as Let's Encrypt compares it: the
+// text before any ";", without surrounding whitespace, but otherwise literally (quotes included).
+func literalIssuerDomain(value string) string {
+	return strings.ToLower(strings.Trim(strings.SplitN(value, ";", 2)[0], " \t"))
+}
+
+// caaPermitsAfterNormalizing returns whether any of the records would permit Let's Encrypt if the
+// quoting and escaping that ParseCAAValue ignores were removed.
+func caaPermitsAfterNormalizing(records []*dns.CAA, issuers []string) bool {
+	for _, r := range records {
+		if isCAAIssuer(extractIssuerDomain(r.Value), issuers) {
+			return true
+		}
+	}
+	return false
+}
+
+func caaWildcardDivergence(domain, caaName string, baseAllowed bool, issue, issuewild []*dns.CAA) Problem {
+	allowed, blocked, tag := "*."+domain, domain, "issue"
+	if baseAllowed {
+		allowed, blocked, tag = domain, "*."+domain, "issuewild"
+	}
+
+	// Like Let's Encrypt, each name is evaluated on its own, so the verdict for each is given along
+	// with the records that decided it
+	wildcardTag, wildcardRecords := "issuewild", issuewild
+	if len(issuewild) == 0 {
+		wildcardTag, wildcardRecords = "issue", issue
+	}
+	detail := []string{
+		caaVerdict(domain, caaName, baseAllowed, "issue", issue),
+		caaVerdict("*."+domain, caaName, !baseAllowed, wildcardTag, wildcardRecords),
+	}
+
+	return Problem{
+		Name: "CAAWildcardDivergence",
+		Code: ProblemCodeCAAWildcardDivergence,
+		Explanation: fmt.Sprintf(`The CAA records on %s permit Let's Encrypt to issue a certificate for %s, but not for %s, `+
+			`so a certificate which includes both names cannot be issued. The "%s" CAA record(s) must also include "letsencrypt.org". `+
+			`Keep in mind that "issuewild" records apply to wildcard names only, and that "issue" records apply to wildcard `+
+			`names only when there are no "issuewild" records.`, caaName, allowed, blocked, tag),
+		Detail:   strings.Join(detail, "\n"),
+		Severity: SeverityError,
+	}
+}
+
+// caaVerdict describes whether issuance for name is permitted, and the records of tag which decided it.
+func caaVerdict(name, caaName string, allowed bool, tag string, records []*dns.CAA) string {
+	verdict := "not permitted"
+	if allowed {
+		verdict = "permitted"
+	}
+	if len(records) == 0 {
+		return fmt.Sprintf("%s: %s, as there are no \"%s\" records on %s", name, verdict, tag, caaName)
+	}
+	return fmt.Sprintf("%s: %s, by the \"%s\" record(s) on %s:\n%s", name, verdict, tag, caaName,
+		indent(collateRecords(records), "  "))
+}
+
+func extractIssuerDomain(value string) string {
+	issuer, _, _ := ParseCAAValue(value)
+	return issuer
+}
+
+// ParseCAAValue parses the value of an issue or issuewild CAA property, as described by RFC 8659
+// section 4.2, into the issuer domain name and its parameters (e.g. the RFC 8657 "accounturi" and
+// "validationmethods" parameters). Surrounding quotes (including the escaped quotes which some DNS
+// editors add), empty parameters and whitespace are ignored. The issuer is empty
+// when the value names no issuer (e.g. ";", which forbids issuance). Parameter tags are case-insensitive,
+// and are returned in lower case.
+func ParseCAAValue(value string) (issuer string, params map[string]string, err error) {
+	value = strings.Trim(strings.TrimSpace(value), `"\ `)
+	parts := strings.Split(value, ";")
+
+	issuer = strings.ToLower(strings.Trim(parts[0], " \t"))
+	if strings.ContainsAny(issuer, " \t=") {
+		return "", nil, fmt.Errorf("invalid issuer domain name: %q", issuer)
+	}
+
+	params = map[string]string{}
+	for _, part := range parts[1:] {
+		part = strings.Trim(part, " \t")
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return issuer, params, fmt.Errorf("invalid parameter, missing '=': %q", part)
+		}
+		tag, val := strings.ToLower(strings.Trim(kv[0], " \t")), strings.Trim(kv[1], " \t")
+		if tag == "" || !isCAAParameterTag(tag) {
+			return issuer, params, fmt.Errorf("invalid parameter tag: %q", kv[0])
+		}
+		if strings.ContainsAny(val, " \t") {
+			return issuer, params, fmt.Errorf("invalid value for parameter %s: %q", tag, val)
+		}
+		params[tag] = val
+	}
+
+	return issuer, params, nil
+}
+
+// caaQuotingIssue explains how the value of a CAA record appears to have been corrupted by the quoting
+// or escaping of a DNS editor, or returns an empty string.
+func caaQuotingIssue(value string) string {
+	switch {
+	case strings.ContainsAny(value, `"\'`):
+		return "the value contains quote or backslash characters"
+	case strings.Contains(strings.Join(strings.Fields(value), ""), ";;"):
+		return `the value contains an empty parameter (";;")`
+	}
+	return ""
+}
+
+func caaQuotingIssueProblem(domain string, corrupted []string) Problem {
+	return Problem{
+		Name: "CaaQuotingIssue",
+		Code: ProblemCodeCaaQuotingIssue,
+		Explanation: fmt.Sprintf(`Some of the CAA records on %s contain extra quotes, escape characters or empty parameters, `+
+			`which are usually added by a DNS editor that quotes values itself (so that quotes entered by hand become part of `+
+			`the value). Let's Encrypt parses CAA values strictly, and does not recognize its issuer domain in such a `+
+			`record. Re-enter the value without quotes (e.g. letsencrypt.org).`, domain),
+		Detail:   strings.Join(corrupted, "\n"),
+		Severity: SeverityWarning,
+	}
+}
+
+// isCAAParameterTag returns whether s consists only of letters and digits, which are the only
+// characters permitted in a parameter tag.
+func isCAAParameterTag(s string) bool {
+	for _, ch := range s {
+		if !(('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCAAIssuer returns whether issuer is one of the trusted issuer domains.
+func isCAAIssuer(issuer string, issuers []string) bool {
+	for _, trusted := range issuers {
+		if issuer == trusted {
+			return true
+		}
+	}
+	return false
+}
+
+// caaPermittedForMethod returns the records which name Let's Encrypt and which do not restrict
+// the validationmethods (RFC 8657) to exclude method.
+func caaPermittedForMethod(records []*dns.CAA, method ValidationMethod, issuers []string) []*dns.CAA {
+	var permitted []*dns.CAA
+	for _, r := range records {
+		issuer, params, err := ParseCAAValue(r.Value)
+		if err != nil || !isCAAIssuer(issuer, issuers) {
+			continue
+		}
+		methods, ok := params["validationmethods"]
+		if !ok {
+			permitted = append(permitted, r)
+			continue
+		}
+		for _, m := range strings.Split(methods, ",") {
+			if ValidationMethod(strings.TrimSpace(m)) == method {
+				permitted = append(permitted, r)
+				break
+			}
+		}
+	}
+	return permitted
+}
+
+func caaUnrestricted(domain string, wildcard bool, records []*dns.CAA) Problem {
+	properties := `"issue"`
+	if wildcard {
+		properties = `"issue" or "issuewild"`
+	}
+	return debugProblem(ProblemCodeCAAUnrestricted,
+		fmt.Sprintf(`The CAA records at %s (wildcard=%t) have no %s property, so they do not restrict which certificate `+
+			`authorities may issue, and any of them (including Let's Encrypt) may. Because these are the closest CAA `+
+			`records to the domain, the search stops here: any "issue" records on parent domains are ignored, even `+
+			`though these records (e.g. only an "iodef" record) do not restrict issuance themselves.`, domain, wildcard, properties),
+		collateRecords(records))
+}
+
+func collateRecords(records []*dns.CAA) string {
+	var s []string
+	for _, r := range records {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+// contradictoryCAA returns the records of a single property (issue or issuewild) when some of them
+// forbid issuance (e.g. ";") while others name an issuer, or nil. The records naming an issuer win,
+// so the records which forbid issuance have no effect, but are likely to be a mistake.
+func contradictoryCAA(records []*dns.CAA) []*dns.CAA {
+	var denyAll, allow bool
+	for _, r := range records {
+		if extractIssuerDomain(r.Value) == "" {
+			denyAll = true
+		} else {
+			allow = true
+		}
+	}
+	if !denyAll || !allow {
+		return nil
+	}
+	return records
+}
+
+func contradictoryCAAProblem(domain string, records []*dns.CAA) Problem {
+	return debugProblem(ProblemCodeContradictoryCaa,
+		fmt.Sprintf(`The %q CAA records at %s both forbid issuance (with an empty issuer, such as ";") and permit it `+
+			`for specific certificate authorities. The records naming an issuer take precedence, so the record forbidding `+
+			`issuance has no effect, but the combination is contradictory and is likely to be a mistake. Remove whichever `+
+			`records don't reflect your intent.`, records[0].Tag, domain),
+		collateRecords(records))
+}
+
+func caaCriticalUnknown(domain string, wildcard bool, records, nullified []*dns.CAA) Problem {
+	explanation := fmt.Sprintf(`CAA record(s) exist on %s (wildcard=%t) that are marked as critical but are unknown to Let's Encrypt. `+
+		`These record(s) as shown in the detail must be removed, or marked as non-critical, before a certificate can be issued by the Let's Encrypt CA.`, domain, wildcard)
+	detail := collateRecords(records)
+	if len(nullified) > 0 {
+		explanation += ` The other CAA record(s) on this domain do permit Let's Encrypt, but have no effect while the critical record(s) exist.`
+		detail = "Blocking critical record(s):\n" + detail +
+			"\n\nRecord(s) permitting Let's Encrypt, which are overridden:\n" + collateRecords(nullified)
+	}
+	return Problem{
+		Name:        "CAACriticalUnknown",
+		Code:        ProblemCodeCAACriticalUnknown,
+		Explanation: explanation,
+		Detail:      detail,
+		Severity:    SeverityFatal,
+	}
+}
+
+// caaTypoMaxDistance is the largest edit distance from "letsencrypt.org" that is considered a typo
+// of it (e.g. "letsencrypt.com" or "lets-encrypt.org").
+const caaTypoMaxDistance = 3
+
+// findCAAIssuerTypo returns the first record whose issuer is a near miss of "letsencrypt.org".
+func findCAAIssuerTypo(records []*dns.CAA) *dns.CAA {
+	for _, r := range records {
+		// Parse the issuer loosely, since a typo may make it invalid
+		issuer := strings.SplitN(strings.Trim(strings.TrimSpace(r.Value), `"`), ";", 2)[0]
+		issuer = strings.ToLower(strings.TrimSpace(issuer))
+		if issuer == "" || issuer == "letsencrypt.org" {
+			continue
+		}
+		if editDistance(issuer, "letsencrypt.org") <= caaTypoMaxDistance {
+			return r
+		}
+	}
+	return nil
+}
+
+// findCAAIssuerSuffixMistake returns the first record whose issuer contains "letsencrypt.org" along
+// with other labels (e.g. "letsencrypt.org.example.com", where the zone's origin was appended to an
+// unqualified name), and that issuer. Near misses are left to findCAAIssuerTypo.
+func findCAAIssuerSuffixMistake(records []*dns.CAA) (*dns.CAA, string) {
+	for _, r := range records {
+		issuer := strings.SplitN(strings.Trim(strings.TrimSpace(r.Value), `"`), ";", 2)[0]
+		issuer = strings.ToLower(strings.TrimSpace(issuer))
+		if issuer != "letsencrypt.org" && strings.Contains(issuer, "letsencrypt.org") &&
+			editDistance(issuer, "letsencrypt.org") > caaTypoMaxDistance {
+			return r, issuer
+		}
+	}
+	return nil, ""
+}
+
+// findMalformedCAAIssuer returns the first record whose issuer includes a URL scheme, port or path, which
+// the issuer domain name is not allowed to have, along with the bare domain name that it contains.
+func findMalformedCAAIssuer(records []*dns.CAA) (*dns.CAA, string) {
+	for _, r := range records {
+		issuer := strings.SplitN(strings.Trim(strings.TrimSpace(r.Value), `"`), ";", 2)[0]
+		issuer = strings.ToLower(strings.TrimSpace(issuer))
+		if !strings.ContainsAny(issuer, ":/") {
+			continue
+		}
+		bare := issuer
+		if i := strings.Index(bare, "://"); i >= 0 {
+			bare = bare[i+3:]
+		}
+		bare = strings.SplitN(bare, "/", 2)[0]
+		bare = strings.SplitN(bare, ":", 2)[0]
+		return r, bare
+	}
+	return nil, ""
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// correctedCAAIssuer returns a copy of record which names "letsencrypt.org", keeping its parameters.
+func correctedCAAIssuer(record *dns.CAA) *dns.CAA {
+	fixed := *record
+	fixed.Value = "letsencrypt.org"
+	if _, params, err := ParseCAAValue(record.Value); err == nil {
+		var tags []string
+		for tag := range params {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			fixed.Value += "; " + tag + "=" + params[tag]
+		}
+	}
+	return &fixed
+}
+
+func caaLikelyTypo(domain string, wildcard bool, record *dns.CAA) Problem {
+	fixed := correctedCAAIssuer(record)
+	return Problem{
+		Name: "CaaLikelyTypo",
+		Code: ProblemCodeCaaLikelyTypo,
+		Explanation: fmt.Sprintf(`A CAA record on %s (wildcard=%t) names the issuer %q, which looks like a typo of "letsencrypt.org". `+
+			`Because it does not exactly match, the record does not permit Let's Encrypt to issue certificates. `+
+			`The record should be corrected as shown in the detail.`, domain, wildcard, record.Value),
+		Detail:   fmt.Sprintf("Current: %s\nCorrected: %s", record.String(), fixed.String()),
+		Severity: SeverityFatal,
+	}
+}
+
+func caaIssuerSuffixMistake(domain string, wildcard bool, record *dns.CAA, issuer string) Problem {
+	return Problem{
+		Name: "CaaIssuerSuffixMistake",
+		Code: ProblemCodeCaaIssuerSuffixMistake,
+		Explanation: fmt.Sprintf(`A CAA record on %s (wildcard=%t) names the issuer %q, which contains "letsencrypt.org" `+
+			`but is not exactly "letsencrypt.org". This usually happens when a domain was appended to the issuer, e.g. by `+
+			`a DNS provider or zone file treating it as a relative name. Because the issuer does not exactly match, the `+
+			`record does not permit Let's Encrypt to issue certificates. The record should be corrected as shown in the detail.`,
+			domain, wildcard, issuer),
+		Detail:   fmt.Sprintf("Current: %s\nCorrected: %s", record.String(), correctedCAAIssuer(record).String()),
+		Severity: SeverityFatal,
+	}
+}
+
+func malformedCAAIssuer(domain string, wildcard bool, record *dns.CAA, bare string) Problem {
+	return Problem{
+		Name: "MalformedCaaIssuer",
+		Code: ProblemCodeMalformedCaaIssuer,
+		Explanation: fmt.Sprintf(`A CAA record on %s (wildcard=%t) names the issuer %q, which includes a URL scheme, port `+
+			`or path. The issuer must be a bare domain name (optionally followed by ";" and parameters), so this record `+
+			`does not match any certificate authority, and does not permit Let's Encrypt to issue certificates. If %q `+
+			`was intended, the record should name it alone (e.g. "letsencrypt.org" for Let's Encrypt).`,
+			domain, wildcard, record.Value, bare),
+		Detail:   record.String(),
+		Severity: SeverityFatal,
+	}
+}
+
+func caaIssuanceNotAllowed(domain string, wildcard bool, records []*dns.CAA) Problem {
+	// For a wildcard, the issue records only apply when there are no issuewild records
+	var fallback string
+	if wildcard && len(records) > 0 && records[0].Tag == "issue" {
+		fallback = fmt.Sprintf(`There are no "issuewild" records on %s, so the "issue" records also apply to wildcard `+
+			`certificates, and they do not permit Let's Encrypt. Alternatively to the options below, an "issuewild" record `+
+			`for "letsencrypt.org" may be added, which takes precedence over the "issue" records for wildcards only. `, domain)
+	}
+	return Problem{
+		Name: "CAAIssuanceNotAllowed",
+		Code: ProblemCodeCAAIssuanceNotAllowed,
+		Explanation: fmt.Sprintf(`No CAA record on %s (wildcard=%t) contains the issuance domain "letsencrypt.org". `+
+			`%sYou must either add an additional record to include "letsencrypt.org" or remove every existing CAA record. `+
+			`A list of the CAA records are provided in the details.`, domain, wildcard, fallback),
+		Detail:   collateRecords(records),
+		Severity: SeverityFatal,
+	}
+}
+
+func caaLookupTimeoutExceeded(domain string) Problem {
+	return Problem{
+		Name: "CaaLookupTimeout",
+		Code: ProblemCodeCaaLookupTimeout,
+		Explanation: fmt.Sprintf(`Looking up the CAA records for %s (and its parent domains) took longer than %s. `+
+			`Let's Encrypt must be able to look up CAA records before issuing, and slow or unresponsive nameservers `+
+			`are likely to cause issuance to fail with a timeout or SERVFAIL error.`, domain, caaLookupTimeout),
+		Detail:   fmt.Sprintf("Gave up on the CAA lookup for %s", domain),
+		Severity: SeverityError,
+	}
+}
 
-		records := issue
-		if wildcard && len(issuewild) > 0 {
-			records = issuewild
+func caaValidationMethodNotAllowed(domain string, wildcard bool, method ValidationMethod, records []*dns.CAA, issuers []string) Problem {
+	var allowed, edits []string
+	seen := map[string]bool{}
+	for _, r := range records {
+		issuer, params, err := ParseCAAValue(r.Value)
+		if err != nil || !isCAAIssuer(issuer, issuers) {
+			continue
 		}
-
-		for _, r := range records {
-			if extractIssuerDomain(r.Value) == "letsencrypt.org" {
-				return probs, nil
+		for _, m := range strings.Split(params["validationmethods"], ",") {
+			if m = strings.TrimSpace(m); m != "" && !seen[m] {
+				seen[m] = true
+				allowed = append(allowed, m)
 			}
 		}
-
-		probs = append(probs, caaIssuanceNotAllowed(domain, wildcard, records))
-		return probs, nil
+		edited := *r
+		edited.Value = caaValueWithValidationMethod(r.Value, method)
+		edits = append(edits, fmt.Sprintf("%s\n  to:\n%s", r.String(), edited.String()))
 	}
 
-	// recurse up to the public suffix domain until a caa record is found
-	// a.b.c.com -> b.c.com -> c.com until
-	if ps, _ := publicsuffix.PublicSuffix(domain); domain != ps && ps != "" {
-		splitDomain := strings.SplitN(domain, ".", 2)
-
-		parentProbs, err := c.Check(ctx, splitDomain[1], method)
-		if err != nil {
-			return nil, fmt.Errorf("error checking caa record on domain: %s, %v", splitDomain[1], err)
-		}
-
-		probs = append(probs, parentProbs...)
+	return Problem{
+		Name: "CAAValidationMethodNotAllowed",
+		Code: ProblemCodeCAAValidationMethodNotAllowed,
+		Explanation: fmt.Sprintf(`The CAA record(s) on %s (wildcard=%t) permit Let's Encrypt to issue, but only using `+
+			`the validation method(s) %s, because of their "validationmethods" parameter. Let's Encrypt will refuse to issue `+
+			`using %s. To fix this, either add %s to the "validationmethods" parameter of the record(s) as shown in the `+
+			`details, or configure your ACME client to use %s instead.`,
+			domain, wildcard, strings.Join(allowed, ", "), method, method, strings.Join(allowed, " or ")),
+		Detail:   "Change:\n" + strings.Join(edits, "\n\n"),
+		Severity: SeverityFatal,
 	}
-
-	return probs, nil
 }
 
-func extractIssuerDomain(value string) string {
-	// record can be:
-	// issuedomain.tld; someparams
-	return strings.Trim(strings.SplitN(value, ";", 2)[0], " \t")
-}
-
-func collateRecords(records []*dns.CAA) string {
-	var s []string
-	for _, r := range records {
-		s = append(s, r.String())
+// caaValueWithValidationMethod adds method to the validationmethods parameter of a CAA value.
+func caaValueWithValidationMethod(value string, method ValidationMethod) string {
+	parts := strings.Split(value, ";")
+	for i, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "validationmethods") {
+			parts[i+1] = kv[0] + "=" + strings.TrimSpace(kv[1]) + "," + string(method)
+		}
 	}
-	return strings.Join(s, "\n")
+	return strings.Join(parts, ";")
 }
 
-func caaCriticalUnknown(domain string, wildcard bool, records []*dns.CAA) Problem {
+func caaAccountURIRestricted(domain string, wildcard bool, records []*dns.CAA) Problem {
 	return Problem{
-		Name: "CAACriticalUnknown",
-		Explanation: fmt.Sprintf(`CAA record(s) exist on %s (wildcard=%t) that are marked as critical but are unknown to Let's Encrypt. `+
-			`These record(s) as shown in the detail must be removed, or marked as non-critical, before a certificate can be issued by the Let's Encrypt CA.`, domain, wildcard),
+		Name: "CAAAccountURIRestricted",
+		Code: ProblemCodeCAAAccountURIRestricted,
+		Explanation: fmt.Sprintf(`The CAA record(s) on %s (wildcard=%t) only permit Let's Encrypt to issue to specific `+
+			`ACME accounts, using the "accounturi" parameter. Issuance will fail unless your ACME client is using `+
+			`one of these accounts. Make sure that the account URI (which differs between the staging and production `+
+			`environments) matches your ACME client's account exactly.`, domain, wildcard),
 		Detail:   collateRecords(records),
-		Severity: SeverityFatal,
+		Severity: SeverityWarning,
 	}
 }
 
-func caaIssuanceNotAllowed(domain string, wildcard bool, records []*dns.CAA) Problem {
+// ipLiteral returns the IP address that name is a literal of (IPv4, or IPv6 with or without brackets),
+// or nil.
+func ipLiteral(name string) net.IP {
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		name = name[1 : len(name)-1]
+	}
+	return net.ParseIP(name)
+}
+
+func ipAddressNotSupported(domain string, ip net.IP) Problem {
+	family := "IPv4"
+	if ip.To4() == nil {
+		family = "IPv6"
+	}
 	return Problem{
-		Name: "CAAIssuanceNotAllowed",
-		Explanation: fmt.Sprintf(`No CAA record on %s (wildcard=%t) contains the issuance domain "letsencrypt.org". `+
-			`You must either add an additional record to include "letsencrypt.org" or remove every existing CAA record. `+
-			`A list of the CAA records are provided in the details.`, domain, wildcard),
-		Detail:   collateRecords(records),
+		Name: "IpAddressNotSupported",
+		Code: ProblemCodeIpAddressNotSupported,
+		Explanation: fmt.Sprintf(`%s is an %s address, not a domain name. Let's Debug can only check domain names, and `+
+			`certificates for IP addresses can't be issued the way they are for domain names: they are only available `+
+			`with short-lived certificate profiles, and can't be validated with the dns-01 challenge. To secure a server `+
+			`reached at this address, point a domain name at it and request a certificate for that name instead.`,
+			domain, family),
+		Detail:   fmt.Sprintf("IP address: %s", ip),
 		Severity: SeverityFatal,
 	}
 }
@@ -226,6 +1540,7 @@ func caaIssuanceNotAllowed(domain string, wildcard bool, records []*dns.CAA) Pro
 func invalidDomain(domain, reason string) Problem {
 	return Problem{
 		Name:        "InvalidDomain",
+		Code:        ProblemCodeInvalidDomain,
 		Explanation: fmt.Sprintf(`"%s" is not a valid domain name that Let's Encrypt would be able to issue a certificate for.`, domain),
 		Detail:      reason,
 		Severity:    SeverityFatal,
@@ -240,12 +1555,11 @@ func (c cloudflareChecker) Check(ctx *scanContext, domain string, method Validat
 
 	domain = strings.TrimPrefix(domain, "*.")
 
-	cl := http.Client{
-		Timeout:   httpTimeout * time.Second,
-		Transport: makeSingleShotHTTPTransport(),
-	}
+	// Only the first response is needed, so redirects aren't followed
+	cl := guardedHTTPClient(ctx, domain)
 	resp, err := cl.Get("https://" + domain)
 	if err == nil { // no tls error, cert must be issued
+		resp.Body.Close()
 		// check if it's cloudflare
 		if hasCloudflareHeader(resp.Header) {
 			probs = append(probs, cloudflareCDN(domain))
@@ -254,16 +1568,12 @@ func (c cloudflareChecker) Check(ctx *scanContext, domain string, method Validat
 		return probs, nil
 	}
 
-	// disable redirects
-	cl.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
-
-	// attempt to connect over http with redirects disabled to check cloudflare header
+	// attempt to connect over http to check cloudflare header
 	resp, err = cl.Get("http://" + domain)
 	if err != nil {
 		return probs, nil
 	}
+	resp.Body.Close()
 
 	if hasCloudflareHeader(resp.Header) {
 		probs = append(probs, cloudflareCDN(domain))
@@ -280,6 +1590,7 @@ func hasCloudflareHeader(h http.Header) bool {
 func cloudflareCDN(domain string) Problem {
 	return Problem{
 		Name: "CloudflareCDN",
+		Code: ProblemCodeCloudflareCDN,
 		Explanation: fmt.Sprintf(`The domain %s is being served through Cloudflare CDN. Any Let's Encrypt certificate installed on the `+
 			`origin server will only encrypt traffic between the server and Cloudflare. It is strongly recommended that the SSL option 'Full SSL (strict)' `+
 			`be enabled.`, domain),
@@ -291,12 +1602,118 @@ func cloudflareCDN(domain string) Problem {
 func cloudflareSslNotProvisioned(domain string) Problem {
 	return Problem{
 		Name:        "CloudflareSSLNotProvisioned",
+		Code:        ProblemCodeCloudflareSSLNotProvisioned,
 		Explanation: fmt.Sprintf(`The domain %s is being served through Cloudflare CDN and a certificate has not yet been provisioned yet by Cloudflare.`, domain),
 		Detail:      "https://support.cloudflare.com/hc/en-us/articles/203045244-How-long-does-it-take-for-Cloudflare-s-SSL-to-activate-",
 		Severity:    SeverityWarning,
 	}
 }
 
+// managedPlatforms are hosting platforms which obtain and renew certificates for custom domains
+// themselves. A platform is recognised by the domain (or a CNAME target in its chain) being under one
+// of its Suffixes, by its Nameservers, or by the presence of a response Header containing HeaderValue
+// (any value, if empty). To recognise another, add it here.
+var managedPlatforms = []struct {
+	Platform    string
+	Suffixes    []string
+	Nameservers []string
+	Header      string
+	HeaderValue string
+}{
+	{"GitHub Pages", []string{"github.io"}, nil, "Server", "GitHub.com"},
+	{"Netlify", []string{"netlify.app", "netlify.com"}, nil, "Server", "Netlify"},
+	{"Vercel", []string{"vercel.app", "vercel-dns.com", "now.sh"}, []string{"vercel-dns.com"}, "X-Vercel-Id", ""},
+	{"Heroku", []string{"herokuapp.com", "herokudns.com"}, nil, "Via", "vegur"},
+	{"Cloudflare Pages", []string{"pages.dev"}, nil, "", ""},
+}
+
+// managedPlatformChecker notes when the domain is hosted on a platform which manages certificates
+// itself, since the user's own ACME client may then be unnecessary, or unable to validate at all.
+// Platforms which are only recognisable by their response headers are reported by
+// httpAccessibilityChecker, from the responses to the validation requests.
+type managedPlatformChecker struct{}
+
+func (c managedPlatformChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	domain = strings.TrimPrefix(domain, "*.")
+
+	if platform, detail := managedPlatformFromDNS(ctx, domain); platform != "" {
+		return []Problem{managedPlatform(domain, platform, detail)}, nil
+	}
+	return nil, nil
+}
+
+// managedPlatformFromDNS returns the managed platform which the domain's CNAME targets or nameservers
+// belong to, and a description of the one which identified it.
+func managedPlatformFromDNS(ctx *scanContext, domain string) (string, string) {
+	// The domain itself and the targets of any CNAMEs along the way to its addresses
+	names := []string{domain}
+	for _, rrType := range []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA} {
+		rrs, _ := ctx.Lookup(domain, rrType)
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				names = append(names, normalizeFqdn(cname.Target))
+			}
+		}
+	}
+	var nameservers []string
+	if registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain); registeredDomain != "" {
+		rrs, _ := ctx.Lookup(registeredDomain, dns.TypeNS)
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok {
+				nameservers = append(nameservers, normalizeFqdn(ns.Ns))
+			}
+		}
+	}
+
+	hasSuffix := func(name, suffix string) bool {
+		return name == suffix || strings.HasSuffix(name, "."+suffix)
+	}
+	for _, p := range managedPlatforms {
+		for _, suffix := range p.Suffixes {
+			for _, name := range names {
+				if hasSuffix(name, suffix) {
+					return p.Platform, fmt.Sprintf("%s is under %s", name, suffix)
+				}
+			}
+		}
+		for _, suffix := range p.Nameservers {
+			for _, ns := range nameservers {
+				if hasSuffix(ns, suffix) {
+					return p.Platform, fmt.Sprintf("Nameserver: %s", ns)
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// managedPlatformFromHeaders returns the managed platform which sent the response headers h, and
+// the header which identified it.
+func managedPlatformFromHeaders(h http.Header) (string, string) {
+	for _, p := range managedPlatforms {
+		if p.Header == "" {
+			continue
+		}
+		if v := h.Get(p.Header); v != "" && strings.Contains(strings.ToLower(v), strings.ToLower(p.HeaderValue)) {
+			return p.Platform, fmt.Sprintf("%s: %s", p.Header, v)
+		}
+	}
+	return "", ""
+}
+
+func managedPlatform(domain, platform, detail string) Problem {
+	return Problem{
+		Name: "ManagedPlatform",
+		Code: ProblemCodeManagedPlatform,
+		Explanation: fmt.Sprintf(`%s appears to be hosted on %s, which obtains and renews certificates for custom domains `+
+			`automatically. If so, issuing a certificate with your own ACME client is likely to be unnecessary, and may not `+
+			`be possible at all, since the platform answers the validation requests. Check the platform's custom domain `+
+			`settings for the status of its certificate instead.`, domain, platform),
+		Detail:   detail,
+		Severity: SeverityDebug,
+	}
+}
+
 // statusioChecker ensures there is no reported operational problem with the Let's Encrypt service via the status.io public api.
 type statusioChecker struct{}
 
@@ -338,7 +1755,7 @@ func (c statusioChecker) Check(ctx *scanContext, domain string, method Validatio
 		probs = append(probs, statusioNotOperational(apiResp.Result.StatusOverall.Status, apiResp.Result.StatusOverall.Updated))
 	}
 
-	probs = append(probs, debugProblem("StatusIO", "The current status.io status for Let's Encrypt",
+	probs = append(probs, debugProblem(ProblemCodeStatusIO, "The current status.io status for Let's Encrypt",
 		fmt.Sprintf("%v", apiResp.Result.StatusOverall.Status)))
 
 	return probs, nil
@@ -347,6 +1764,7 @@ func (c statusioChecker) Check(ctx *scanContext, domain string, method Validatio
 func statusioNotOperational(status string, updated time.Time) Problem {
 	return Problem{
 		Name: "StatusNotOperational",
+		Code: ProblemCodeStatusNotOperational,
 		Explanation: fmt.Sprintf(`The current status as reported by the Let's Encrypt status page is %s as at %v. `+
 			`Depending on the reported problem, this may affect certificate issuance. For more information, please visit the status page.`, status, updated),
 		Detail:   "https://letsencrypt.status.io/",
@@ -448,62 +1866,76 @@ LEFT JOIN LATERAL
 WHERE ci.ISSUER_CA_ID = ca.ID
 ORDER BY le.ENTRY_TIMESTAMP DESC;`
 
-// Pointer receiver because we're keeping state across runs
-func (c *rateLimitChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
-	if os.Getenv("LETSDEBUG_DISABLE_CERTWATCH") != "" {
-		return nil, errNotApplicable
-	}
+// ctLogSource finds certificates issued by Let's Encrypt in Certificate Transparency logs.
+type ctLogSource interface {
+	// FindCertificates returns the Let's Encrypt certificates which contain the Registered Domain
+	// `registeredDomain` and were issued after `since`.
+	FindCertificates(ctx context.Context, registeredDomain string, since time.Time) (crtList, error)
+}
 
-	domain = strings.TrimPrefix(domain, "*.")
+// certwatchSource is a ctLogSource which uses crt.sh's public certwatch database.
+type certwatchSource struct{}
 
+func (s certwatchSource) FindCertificates(ctx context.Context, registeredDomain string, since time.Time) (crtList, error) {
 	db, err := sql.Open("postgres", "user=guest dbname=certwatch host=crt.sh sslmode=disable connect_timeout=5")
 	if err != nil {
-		return []Problem{
-			internalProblem(fmt.Sprintf("Failed to connect to certwatch database to check rate limits: %v", err), SeverityDebug),
-		}, nil
+		return nil, fmt.Errorf("failed to connect to certwatch database: %v", err)
 	}
 	defer db.Close()
 
-	// Since we are checking rate limits, we need to query the Registered Domain
-	// for the domain in question
-	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
-
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
 	// Avoiding using a prepared statement here because it's being weird with crt.sh
-	q := fmt.Sprintf(rateLimitCheckerQuery,
-		registeredDomain, registeredDomain, time.Now().Add(-168*time.Hour).Format(time.RFC3339))
-	rows, err := db.QueryContext(timeoutCtx, q)
+	q := fmt.Sprintf(rateLimitCheckerQuery, registeredDomain, registeredDomain, since.Format(time.RFC3339))
+	rows, err := db.QueryContext(ctx, q)
 	if err != nil && err != sql.ErrNoRows {
-		return []Problem{
-			internalProblem(fmt.Sprintf("Failed to query certwatch database to check rate limits: %v", err), SeverityDebug),
-		}, nil
+		return nil, fmt.Errorf("failed to query certwatch database: %v", err)
 	}
-
-	probs := []Problem{}
+	defer rows.Close()
 
 	// Read in the DER-encoded certificates
 	certs := crtList{}
 	var certBytes []byte
 	for rows.Next() {
 		if err := rows.Scan(&certBytes); err != nil {
-			probs = append(probs, internalProblem(fmt.Sprintf("Failed to query certwatch database while checking rate limits: %v", err), SeverityDebug))
-			break
+			return certs, fmt.Errorf("failed to read from certwatch database: %v", err)
 		}
 		crt, err := x509.ParseCertificate(certBytes)
 		if err != nil {
-			probs = append(probs, internalProblem(fmt.Sprintf("Failed to parse certificate while checking rate limits: %v", err), SeverityDebug))
+			debug("Failed to parse certificate from certwatch: %v\n", err)
 			continue
 		}
 		certs[crt.SerialNumber.String()] = crt
 	}
 	if err := rows.Err(); err != nil {
+		return certs, fmt.Errorf("failed to query certwatch database: %v", err)
+	}
+
+	return certs, nil
+}
+
+// Pointer receiver because we're keeping state across runs
+func (c *rateLimitChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if ctx.ctLogs == nil {
+		return nil, errNotApplicable
+	}
+
+	domain = strings.TrimPrefix(domain, "*.")
+
+	// Since we are checking rate limits, we need to query the Registered Domain
+	// for the domain in question
+	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	certs, err := ctx.ctLogs.FindCertificates(timeoutCtx, registeredDomain, time.Now().Add(-168*time.Hour))
+	if err != nil {
 		return []Problem{
-			internalProblem(fmt.Sprintf("Failed to query certwatch database to check rate limits: %v", err), SeverityDebug),
+			internalProblem(fmt.Sprintf("Failed to check rate limits: %v", err), SeverityDebug),
 		}, nil
 	}
 
+	probs := []Problem{}
+
 	var debug string
 
 	// Limit: Certificates per Registered Domain
@@ -536,17 +1968,298 @@ func (c *rateLimitChecker) Check(ctx *scanContext, domain string, method Validat
 	}
 
 	if debug != "" {
-		probs = append(probs, debugProblem("RateLimit",
+		probs = append(probs, debugProblem(ProblemCodeRateLimit,
 			fmt.Sprintf("%d Certificates contributing to rate limits for this domain", len(certsTowardsRateLimit)), debug))
 	}
 
 	return probs, nil
 }
 
+// certificateRenewalWindow is how long before expiry a certificate is considered due for renewal
+const certificateRenewalWindow = 30 * 24 * time.Hour
+
+// certificateExpiryChecker looks for the most recently issued Let's Encrypt certificate covering
+// the domain in Certificate Transparency logs, and reports when it has expired or is due for renewal.
+type certificateExpiryChecker struct{}
+
+func (c certificateExpiryChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if ctx.ctLogs == nil {
+		return nil, errNotApplicable
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	certs, err := ctx.ctLogs.CertificatesForDomain(timeoutCtx, domain)
+	if err != nil {
+		return []Problem{
+			internalProblem(fmt.Sprintf("Failed to look up existing certificates: %v", err), SeverityDebug),
+		}, nil
+	}
+
+	latest := certs.FindLatestCovering(domain)
+	if latest == nil {
+		return nil, nil
+	}
+
+	probs := []Problem{debugProblem(ProblemCodeExistingCertificate,
+		"The most recently issued Let's Encrypt certificate for this domain, according to Certificate Transparency logs",
+		fmt.Sprintf("Serial: %s\nNotBefore: %v\nNotAfter: %v\nNames: %v",
+			latest.SerialNumber.String(), latest.NotBefore, latest.NotAfter, latest.DNSNames))}
+
+	if remaining := time.Until(latest.NotAfter); remaining < certificateRenewalWindow {
+		probs = append(probs, certificateExpiring(domain, latest))
+	} else if names := ctx.names; len(names) == 0 || certificateCoversAll(latest, names) {
+		if len(names) == 0 {
+			names = []string{domain}
+		}
+		probs = append(probs, renewalNotNeeded(names, latest, remaining))
+	}
+
+	return probs, nil
+}
+
+// certificateCoversAll returns whether cert is valid for every one of the names.
+func certificateCoversAll(cert *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if !certificateCovers(cert, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// certificateCovers returns whether cert is valid for `domain`, either by exact name or by wildcard.
+func certificateCovers(cert *x509.Certificate, domain string) bool {
+	var wildcardName string
+	if labels := strings.SplitN(strings.TrimPrefix(domain, "*."), ".", 2); len(labels) == 2 {
+		wildcardName = "*." + labels[1]
+	}
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(name)
+		if name == domain || (!strings.HasPrefix(domain, "*.") && name == wildcardName) {
+			return true
+		}
+	}
+	return false
+}
+
+func renewalNotNeeded(names []string, cert *x509.Certificate, remaining time.Duration) Problem {
+	return debugProblem(ProblemCodeRenewalNotNeeded,
+		fmt.Sprintf(`A Let's Encrypt certificate covering %s was issued at %v and remains valid for another %d days, so `+
+			`renewal may not be necessary yet. If the certificate isn't being used by your server, the problem may be `+
+			`with deploying it (e.g. the web server's configuration), rather than with issuance.`,
+			strings.Join(names, ", "), cert.NotBefore, int(remaining.Hours()/24)),
+		fmt.Sprintf("Serial: %s\nNotBefore: %v\nNotAfter: %v\nNames: %v",
+			cert.SerialNumber.String(), cert.NotBefore, cert.NotAfter, cert.DNSNames))
+}
+
+// FindLatestCovering finds the most recently issued certificate which would be valid for `domain`,
+// either by exact name or by wildcard.
+func (l crtList) FindLatestCovering(domain string) *x509.Certificate {
+	var latest *x509.Certificate
+	for _, cert := range l {
+		if !certificateCovers(cert, domain) {
+			continue
+		}
+		if latest == nil || cert.NotBefore.After(latest.NotBefore) {
+			latest = cert
+		}
+	}
+	return latest
+}
+
+func certificateExpiring(domain string, cert *x509.Certificate) Problem {
+	state := fmt.Sprintf("is due to expire at %v (%v from now)", cert.NotAfter, time.Until(cert.NotAfter).Truncate(time.Minute))
+	if time.Now().After(cert.NotAfter) {
+		state = fmt.Sprintf("expired at %v", cert.NotAfter)
+	}
+	return Problem{
+		Name: "ExistingCertificateExpiry",
+		Code: ProblemCodeExistingCertificateExpiry,
+		Explanation: fmt.Sprintf(`The most recently issued Let's Encrypt certificate for %s %s. `+
+			`If this certificate is in use, it should be renewed. This is informational only and does not `+
+			`prevent a new certificate from being issued.`, domain, state),
+		Detail: fmt.Sprintf("Serial: %s\nNotBefore: %v\nNotAfter: %v\nNames: %v",
+			cert.SerialNumber.String(), cert.NotBefore, cert.NotAfter, cert.DNSNames),
+		Severity: SeverityDebug,
+	}
+}
+
+// Directory URLs of the Let's Encrypt ACME servers
+const (
+	ACMEDirectoryProduction = "https://acme-v02.api.letsencrypt.org/directory"
+	ACMEDirectoryStaging    = "https://acme-staging-v02.api.letsencrypt.org/directory"
+)
+
+// acmeHTTPClient is shared by all requests to the ACME server which are made outside of the
+// ACME client library (e.g. ACME Renewal Information), so that connections are re-used between scans.
+var acmeHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// renewalInfoURLs caches the renewalInfo URL advertised by each ACME directory
+var renewalInfoURLs sync.Map
+
+// renewalInfoChecker looks up the ACME Renewal Information (ARI, RFC 9773) for the most recently
+// issued certificate covering the domain (or the certificate with the requested serial), and reports
+// whether the CA currently suggests that it be renewed.
+type renewalInfoChecker struct{}
+
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+}
+
+func (c renewalInfoChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if !ctx.renewalInfo || ctx.ctLogs == nil {
+		return nil, errNotApplicable
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	certs, err := ctx.ctLogs.CertificatesForDomain(timeoutCtx, domain)
+	if err != nil {
+		return []Problem{
+			internalProblem(fmt.Sprintf("Failed to look up existing certificates: %v", err), SeverityDebug),
+		}, nil
+	}
+
+	var cert *x509.Certificate
+	if ctx.certificateSerial != "" {
+		cert = certs.FindBySerial(ctx.certificateSerial)
+	} else {
+		cert = certs.FindLatestCovering(domain)
+	}
+	if cert == nil || time.Now().After(cert.NotAfter) {
+		return nil, nil
+	}
+
+	info, err := fetchRenewalInfo(timeoutCtx, ctx.acmeDirectory, cert)
+	if err != nil {
+		return []Problem{
+			internalProblem(fmt.Sprintf("Failed to look up ACME Renewal Information for certificate %s: %v",
+				cert.SerialNumber.Text(16), err), SeverityDebug),
+		}, nil
+	}
+
+	detail := fmt.Sprintf("Serial: %s\nNames: %v\nSuggested window: %v to %v",
+		cert.SerialNumber.Text(16), cert.DNSNames, info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	if info.ExplanationURL != "" {
+		detail += "\nExplanation: " + info.ExplanationURL
+	}
+
+	if time.Now().Before(info.SuggestedWindow.Start) {
+		return []Problem{debugProblem(ProblemCodeRenewalInfo,
+			"The CA's suggested renewal window for the most recently issued certificate, according to ACME Renewal Information",
+			detail)}, nil
+	}
+
+	return []Problem{{
+		Name: "RenewalSuggested",
+		Code: ProblemCodeRenewalSuggested,
+		Explanation: fmt.Sprintf(`Let's Encrypt suggests that the certificate for %s (serial %s) be renewed now, because `+
+			`its suggested renewal window (as advertised by ACME Renewal Information) began at %v. If this certificate `+
+			`is in use, it should be renewed. This is informational only and does not prevent a new certificate from being issued.`,
+			domain, cert.SerialNumber.Text(16), info.SuggestedWindow.Start),
+		Detail:   detail,
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// FindBySerial finds the certificate with the hexadecimal serial number (optionally colon-separated).
+func (l crtList) FindBySerial(serial string) *x509.Certificate {
+	serial = strings.TrimLeft(strings.ToLower(strings.Replace(serial, ":", "", -1)), "0")
+	for _, cert := range l {
+		if cert.SerialNumber.Text(16) == serial {
+			return cert
+		}
+	}
+	return nil
+}
+
+// renewalInfoCertID builds the ARI certificate identifier: the base64url-encoded Authority Key
+// Identifier and DER-encoded serial number, separated by a period.
+func renewalInfoCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no Authority Key Identifier")
+	}
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+func fetchRenewalInfo(ctx context.Context, directory string, cert *x509.Certificate) (*renewalInfo, error) {
+	certID, err := renewalInfoCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := renewalInfoURL(ctx, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var info renewalInfo
+	if err := getACMEJSON(ctx, strings.TrimSuffix(endpoint, "/")+"/"+certID, &info); err != nil {
+		return nil, err
+	}
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.IsZero() {
+		return nil, errors.New("response did not include a suggested window")
+	}
+	return &info, nil
+}
+
+func renewalInfoURL(ctx context.Context, directory string) (string, error) {
+	if cached, ok := renewalInfoURLs.Load(directory); ok {
+		return cached.(string), nil
+	}
+
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := getACMEJSON(ctx, directory, &dir); err != nil {
+		return "", err
+	}
+	if dir.RenewalInfo == "" {
+		return "", fmt.Errorf("the ACME directory %s does not support ACME Renewal Information", directory)
+	}
+
+	renewalInfoURLs.Store(directory, dir.RenewalInfo)
+	return dir.RenewalInfo, nil
+}
+
+func getACMEJSON(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "Let's Debug (https://letsdebug.net)")
+
+	resp, err := acmeHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s from %s", resp.Status, u)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
 func rateLimited(domain, detail string) Problem {
 	registeredDomain, _ := publicsuffix.EffectiveTLDPlusOne(domain)
 	return Problem{
 		Name: "RateLimit",
+		Code: ProblemCodeRateLimit,
 		Explanation: fmt.Sprintf(`%s is currently affected by Let's Encrypt-based rate limits (https://letsencrypt.org/docs/rate-limits/). `+
 			`You may review certificates that have already been issued by visiting https://crt.sh/?q=%%%s . `+
 			`Please note that it is not possible to ask for a rate limit to be manually cleared.`, domain, registeredDomain),
@@ -565,7 +2278,7 @@ type acmeStagingChecker struct {
 }
 
 func (c *acmeStagingChecker) buildAcmeClient() error {
-	cl, err := acme.NewClient("https://acme-staging-v02.api.letsencrypt.org/directory")
+	cl, err := acme.NewClient(ACMEDirectoryStaging)
 	if err != nil {
 		return err
 	}
@@ -625,7 +2338,7 @@ func (c *acmeStagingChecker) Check(ctx *scanContext, domain string, method Valid
 		if p := translateAcmeError(domain, err); p.Name != "" {
 			probs = append(probs, p)
 		}
-		probs = append(probs, debugProblem("LetsEncryptStaging", "Order creation error", err.Error()))
+		probs = append(probs, debugProblem(ProblemCodeLetsEncryptStaging, "Order creation error", err.Error()))
 		return probs, nil
 	}
 
@@ -673,11 +2386,11 @@ func (c *acmeStagingChecker) Check(ctx *scanContext, domain string, method Valid
 	wg.Wait()
 
 	if len(authzFailures) > 0 {
-		probs = append(probs, debugProblem("LetsEncryptStaging",
+		probs = append(probs, debugProblem(ProblemCodeLetsEncryptStaging,
 			fmt.Sprintf("Challenge update failures for %s in order %s", domain, order.URL),
 			strings.Join(authzFailures, "\n")))
 	} else {
-		probs = append(probs, debugProblem("LetsEncryptStaging", "Order for "+domain, order.URL))
+		probs = append(probs, debugProblem(ProblemCodeLetsEncryptStaging, "Order for "+domain, order.URL))
 	}
 
 	return probs, nil
@@ -716,6 +2429,7 @@ func translateAcmeError(domain string, err error) Problem {
 func letsencryptProblem(domain, detail string, severity SeverityLevel) Problem {
 	return Problem{
 		Name: "IssueFromLetsEncrypt",
+		Code: ProblemCodeIssueFromLetsEncrypt,
 		Explanation: fmt.Sprintf(`A test authorization for %s to the Let's Encrypt staging service has revealed `+
 			`issues that may prevent any certificate for this domain being issued.`, domain),
 		Detail:   detail,
@@ -746,6 +2460,7 @@ func (c *ofacSanctionChecker) Check(ctx *scanContext, domain string, method Vali
 
 		return []Problem{{
 			Name: "SanctionedDomain",
+			Code: ProblemCodeSanctionedDomain,
 			Explanation: fmt.Sprintf("The Registered Domain %s was found on the United States' OFAC "+
 				"Specially Designated Nationals and Blocked Persons (SDN) List. Let's Encrypt are unable to issue certificates "+
 				"for sanctioned entities. Search on https://sanctionssearch.ofac.treas.gov/ for futher details.", sanctionedRD),
@@ -0,0 +1,808 @@
+package letsdebug
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type mockCTLogSource crtList
+
+func (s mockCTLogSource) FindCertificates(ctx context.Context, registeredDomain string, since time.Time) (crtList, error) {
+	return crtList(s), nil
+}
+
+func makeTestCertificate(t *testing.T, serial int64, notBefore, notAfter time.Time, names ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func TestCertificateExpiryChecker_Check(t *testing.T) {
+	now := time.Now()
+	old := makeTestCertificate(t, 1, now.Add(-100*24*time.Hour), now.Add(-10*24*time.Hour), "example.org")
+	expiring := makeTestCertificate(t, 2, now.Add(-80*24*time.Hour), now.Add(10*24*time.Hour), "*.example.org")
+	fresh := makeTestCertificate(t, 3, now.Add(-24*time.Hour), now.Add(89*24*time.Hour), "other.example.org")
+
+	ctx := newScanContext()
+	ctx.ctLogs = newCTClient(mockCTLogSource{"1": old, "2": expiring, "3": fresh})
+
+	// www.example.org is only covered by the wildcard, which is expiring
+	probs, err := certificateExpiryChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 2 || probs[1].Name != "ExistingCertificateExpiry" {
+		t.Fatalf("expected the expiring certificate to be reported, got: %v", probs)
+	}
+
+	// other.example.org has a fresh certificate, which may not need renewing
+	probs, _ = certificateExpiryChecker{}.Check(ctx, "other.example.org", HTTP01)
+	if len(probs) != 2 || probs[0].Name != "ExistingCertificate" || probs[1].Code != ProblemCodeRenewalNotNeeded {
+		t.Fatalf("expected the existing certificate to be reported as not needing renewal, got: %v", probs)
+	}
+
+	// Unless it doesn't cover all of the requested names
+	ctx.names = []string{"other.example.org", "example.org"}
+	probs, _ = certificateExpiryChecker{}.Check(ctx, "other.example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Name != "ExistingCertificate" {
+		t.Fatalf("expected only the existing certificate to be reported, got: %v", probs)
+	}
+	ctx.names = nil
+
+	// *.example.org is not covered by a certificate for example.org
+	if l := (crtList{"1": old}).FindLatestCovering("*.example.org"); l != nil {
+		t.Fatalf("expected no covering certificate, got: %v", l.DNSNames)
+	}
+
+	ctx.ctLogs = nil
+	if _, err := (certificateExpiryChecker{}).Check(ctx, "example.org", HTTP01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable, got: %v", err)
+	}
+}
+
+func newCAATestContext(t *testing.T, name string, records ...string) *scanContext {
+	ctx := newScanContext()
+	var rrs []dns.RR
+	for _, r := range records {
+		rr, err := dns.NewRR(name + ". 60 IN CAA " + r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	ctx.rrs[name] = map[uint16]lookupResult{dns.TypeCAA: {RRs: rrs}}
+	return ctx
+}
+
+func TestCAAWildcardDivergenceChecker_CheckNames(t *testing.T) {
+	names := []string{"example.org", "*.example.org"}
+
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`)
+	if probs, _ := (caaWildcardDivergenceChecker{}).CheckNames(ctx, names, DNS01); len(probs) != 0 {
+		t.Fatalf("expected issuewild to fall back to issue, got: %v", probs)
+	}
+
+	ctx = newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`, `0 issuewild "otherca.com"`)
+	probs, _ := (caaWildcardDivergenceChecker{}).CheckNames(ctx, names, DNS01)
+	if len(probs) != 1 || !strings.Contains(probs[0].Explanation, "but not for *.example.org") {
+		t.Fatalf("expected the wildcard to be reported as blocked, got: %v", probs)
+	}
+	if !strings.Contains(probs[0].Detail, "example.org: permitted, by the \"issue\" record(s) on example.org:") ||
+		!strings.Contains(probs[0].Detail, "*.example.org: not permitted, by the \"issuewild\" record(s) on example.org:\n"+
+			"  example.org.\t60\tIN\tCAA\t0 issuewild \"otherca.com\"") {
+		t.Fatalf("expected a verdict for each name, got: %s", probs[0].Detail)
+	}
+
+	ctx = newCAATestContext(t, "example.org", `0 issue "otherca.com"`, `0 issuewild "letsencrypt.org"`)
+	probs, _ = (caaWildcardDivergenceChecker{}).CheckNames(ctx, names, DNS01)
+	if len(probs) != 1 || !strings.Contains(probs[0].Explanation, "but not for example.org") {
+		t.Fatalf("expected the base domain to be reported as blocked, got: %v", probs)
+	}
+
+	if probs, _ := (caaWildcardDivergenceChecker{}).CheckNames(ctx, names[:1], DNS01); len(probs) != 0 {
+		t.Fatalf("expected no problems without the wildcard being requested, got: %v", probs)
+	}
+}
+
+func TestCAAChecker_Parameters(t *testing.T) {
+	tests := []struct {
+		record   string
+		method   ValidationMethod
+		expected string
+	}{
+		{`0 issue "letsencrypt.org; validationmethods=tls-alpn-01"`, HTTP01, "CAAValidationMethodNotAllowed"},
+		{`0 issue "letsencrypt.org; validationmethods=dns-01,http-01"`, HTTP01, ""},
+		{`0 issue "letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/1"`, DNS01, "CAAAccountURIRestricted"},
+		{`0 issue "otherca.com; validationmethods=http-01"`, HTTP01, "CAAIssuanceNotAllowed"},
+	}
+	for _, tt := range tests {
+		ctx := newCAATestContext(t, "example.org", tt.record)
+		probs, err := caaChecker{}.Check(ctx, "example.org", tt.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, prob := range probs {
+			if prob.Severity != SeverityDebug {
+				got = prob.Name
+			}
+		}
+		if got != tt.expected {
+			t.Errorf("%s (%s): expected %q, got %q", tt.record, tt.method, tt.expected, got)
+		}
+	}
+}
+
+func TestParseCAAValue(t *testing.T) {
+	issuer, params, err := ParseCAAValue(` "LetsEncrypt.org ; validationmethods=dns-01 ; AccountURI=https://example.org/acct/1" `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer != "letsencrypt.org" || params["validationmethods"] != "dns-01" || params["accounturi"] != "https://example.org/acct/1" {
+		t.Fatalf("unexpected result: %q %v", issuer, params)
+	}
+
+	if issuer, _, err := ParseCAAValue(";"); err != nil || issuer != "" {
+		t.Fatalf("expected no issuer, got: %q %v", issuer, err)
+	}
+
+	for _, value := range []string{"letsencrypt.org; validationmethods", "letsencrypt.org; bad-tag=1", "letsencrypt.org; a=b c"} {
+		if _, _, err := ParseCAAValue(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestCAAChecker_IodefOnlyStopsClimb(t *testing.T) {
+	// The iodef-only RRset on the subdomain is the closest, so the apex's restrictive issue record is ignored
+	ctx := newCAATestContext(t, "sub.example.org", `0 iodef "mailto:security@example.org"`)
+	ctx.rrs["example.org"] = newCAATestContext(t, "example.org", `0 issue "otherca.com"`).rrs["example.org"]
+
+	for _, domain := range []string{"sub.example.org", "*.sub.example.org"} {
+		probs, _ := caaChecker{}.Check(ctx, domain, DNS01)
+		if hasFatalProblem(probs) || len(probs) != 2 || probs[1].Code != ProblemCodeCAAUnrestricted ||
+			!strings.Contains(probs[1].Detail, "iodef") {
+			t.Fatalf("%s: expected issuance to be unrestricted, got: %v", domain, probs)
+		}
+	}
+}
+
+func TestCAAChecker_Quoting(t *testing.T) {
+	for value, blocked := range map[string]bool{`0 issue "\"letsencrypt.org\""`: true, `0 issue "letsencrypt.org;;"`: false} {
+		ctx := newCAATestContext(t, "example.org", value)
+		probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+
+		var codes []ProblemCode
+		for _, prob := range probs {
+			if prob.Severity != SeverityDebug {
+				codes = append(codes, prob.Code)
+			}
+		}
+		// A quoted issuer is compared literally, so only the empty parameter still permits issuance
+		if !blocked && (len(codes) != 1 || codes[0] != ProblemCodeCaaQuotingIssue) {
+			t.Fatalf("%s: expected only CaaQuotingIssue, got: %v", value, probs)
+		}
+		if blocked && (len(codes) != 2 || codes[0] != ProblemCodeCaaQuotingIssue || codes[1] != ProblemCodeCAAIssuanceNotAllowed ||
+			!strings.Contains(probs[len(probs)-1].Explanation, "only once its extra quotes")) {
+			t.Fatalf("%s: expected CaaQuotingIssue and CAAIssuanceNotAllowed, got: %v", value, probs)
+		}
+	}
+
+	if reason := caaQuotingIssue("letsencrypt.org; validationmethods=http-01"); reason != "" {
+		t.Fatalf("expected no issue with a well-formed value, got: %s", reason)
+	}
+}
+
+func TestCAAChecker_DeepSubdomain(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "otherca.com"`, `0 issuewild "letsencrypt.org"`)
+	for _, name := range []string{"a.b.c.d.e.f.example.org", "b.c.d.e.f.example.org", "c.d.e.f.example.org",
+		"e.f.example.org", "f.example.org"} {
+		ctx.rrs[name] = map[uint16]lookupResult{dns.TypeCAA: {}}
+	}
+	ctx.rrs["d.e.f.example.org"] = map[uint16]lookupResult{dns.TypeCAA: {Error: errors.New("SERVFAIL")}}
+
+	var names []string
+	probs, err := caaChecker{}.Check(ctx, "a.b.c.d.e.f.example.org", DNS01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prob := range probs {
+		names = append(names, prob.Name)
+	}
+	if len(names) != 3 || names[0] != "DNSLookupFailed" || names[2] != "CAAIssuanceNotAllowed" {
+		t.Fatalf("expected the intermediate failure and the parent's records to be reported, got: %v", names)
+	}
+
+	// issuewild on the parent must still apply to a deep wildcard
+	probs, _ = caaChecker{}.Check(ctx, "*.e.f.example.org", DNS01)
+	for _, prob := range probs {
+		if prob.Severity != SeverityDebug {
+			t.Fatalf("expected the wildcard to be permitted, got: %v", probs)
+		}
+	}
+}
+
+func TestCAAChecker_ClosestRRsetTakesPrecedence(t *testing.T) {
+	caa := func(name, value string) dns.RR {
+		rr, err := dns.NewRR(name + ". 60 IN CAA " + value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	cname, _ := dns.NewRR("alias.example.org. 60 IN CNAME target.example.net.")
+
+	tests := []struct {
+		name    string
+		sub     []dns.RR
+		parent  []dns.RR
+		allowed bool
+		// The name whose records are reported as applying, if any
+		authoritative string
+	}{
+		{"permissive subdomain overrides restrictive parent",
+			[]dns.RR{caa("sub.example.org", `0 issue "letsencrypt.org"`)}, []dns.RR{caa("example.org", `0 issue ";"`)}, true,
+			"sub.example.org"},
+		{"restrictive subdomain overrides permissive parent",
+			[]dns.RR{caa("sub.example.org", `0 issue ";"`)}, []dns.RR{caa("example.org", `0 issue "letsencrypt.org"`)}, false,
+			"sub.example.org"},
+		{"subdomain with only iodef permits any CA",
+			[]dns.RR{caa("sub.example.org", `0 iodef "mailto:security@example.org"`)}, []dns.RR{caa("example.org", `0 issue ";"`)}, true,
+			"sub.example.org"},
+		{"no subdomain records falls back to parent",
+			nil, []dns.RR{caa("example.org", `0 issue ";"`)}, false, "example.org"},
+		{"a CNAME without CAA records falls back to parent",
+			[]dns.RR{cname}, []dns.RR{caa("example.org", `0 issue ";"`)}, false, "example.org"},
+		{"permissive subdomain is not overridden by a critical unknown record on the parent",
+			[]dns.RR{caa("sub.example.org", `0 issue "letsencrypt.org"`)}, []dns.RR{caa("example.org", `128 tbs "unknown"`)}, true,
+			"sub.example.org"},
+		{"critical unknown record on the parent applies without subdomain records",
+			nil, []dns.RR{caa("example.org", `128 tbs "unknown"`), caa("example.org", `0 issue "letsencrypt.org"`)}, false,
+			"example.org"},
+		{"critical unknown record on the subdomain overrides permissive parent",
+			[]dns.RR{caa("sub.example.org", `128 tbs "unknown"`)}, []dns.RR{caa("example.org", `0 issue "letsencrypt.org"`)}, false,
+			"sub.example.org"},
+	}
+
+	for _, tt := range tests {
+		ctx := newScanContext()
+		ctx.rrs["sub.example.org"] = map[uint16]lookupResult{dns.TypeCAA: {RRs: tt.sub}}
+		ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeCAA: {RRs: tt.parent}}
+
+		probs, err := caaChecker{}.Check(ctx, "sub.example.org", DNS01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := len(withoutDebugProblems(probs)) == 0; allowed != tt.allowed {
+			t.Errorf("%s: expected allowed=%t, got: %v", tt.name, tt.allowed, probs)
+		}
+		for _, p := range probs {
+			if p.Code == ProblemCodeCAA && !strings.Contains(p.Explanation, "records at "+tt.authoritative+" are") {
+				t.Errorf("%s: expected the records at %s to be reported as applying, got: %s", tt.name, tt.authoritative, p.Explanation)
+			}
+		}
+	}
+}
+
+func TestCAAValidationMethodNotAllowed_Remediation(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org; validationmethods=dns-01"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	p := probs[len(probs)-1]
+	if p.Code != ProblemCodeCAAValidationMethodNotAllowed {
+		t.Fatalf("expected CAAValidationMethodNotAllowed, got: %v", probs)
+	}
+	if !strings.Contains(p.Detail, `"letsencrypt.org; validationmethods=dns-01,http-01"`) {
+		t.Fatalf("expected the detail to contain the edited record, got: %s", p.Detail)
+	}
+	if !strings.Contains(p.Explanation, "use dns-01 instead") {
+		t.Fatalf("expected the explanation to suggest switching method, got: %s", p.Explanation)
+	}
+}
+
+func TestCAAChecker_AdditionalIssuers(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "reseller.example"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	if probs[len(probs)-1].Code != ProblemCodeCAAIssuanceNotAllowed {
+		t.Fatalf("expected CAAIssuanceNotAllowed, got: %v", probs)
+	}
+
+	ctx.caaIssuers = append(ctx.caaIssuers, "reseller.example")
+	probs, _ = caaChecker{}.Check(ctx, "example.org", HTTP01)
+	if len(withoutDebugProblems(probs)) != 0 {
+		t.Fatalf("expected the additional issuer to be accepted, got: %v", probs)
+	}
+}
+
+func TestCAAChecker_CriticalUnknown(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`, `1 tbs "unknown"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	last := probs[len(probs)-1]
+	if last.Code != ProblemCodeCAACriticalUnknown {
+		t.Fatalf("expected CAACriticalUnknown, got: %v", probs)
+	}
+	parts := strings.Split(last.Detail, "overridden:")
+	if len(parts) != 2 || !strings.Contains(parts[0], `tbs "unknown"`) || !strings.Contains(parts[1], `issue "letsencrypt.org"`) {
+		t.Fatalf("expected both the critical and the overridden records in the detail, got: %s", last.Detail)
+	}
+}
+
+func TestCAAChecker_Contradictory(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`, `0 issue ";"`, `0 issuewild ";"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	var found []Problem
+	for _, prob := range probs {
+		if prob.Code == ProblemCodeContradictoryCaa {
+			found = append(found, prob)
+		}
+	}
+	if len(found) != 1 || !strings.Contains(found[0].Detail, `issue "letsencrypt.org"`) ||
+		!strings.Contains(found[0].Detail, `issue ";"`) || strings.Contains(found[0].Detail, "issuewild") {
+		t.Fatalf("expected a ContradictoryCaa problem for the issue records, got: %v", probs)
+	}
+	if len(withoutDebugProblems(probs)) != 0 {
+		t.Fatalf("expected issuance to be permitted, got: %v", probs)
+	}
+}
+
+func TestCAAChecker_LikelyTypo(t *testing.T) {
+	for _, value := range []string{`"letsencrypt.com"`, `"lets-encrypt.org"`, `"letsencrypt.org."`} {
+		ctx := newCAATestContext(t, "example.org", `0 issue `+value)
+		probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+		last := probs[len(probs)-1]
+		if last.Code != ProblemCodeCaaLikelyTypo || !strings.HasSuffix(last.Detail, `0 issue "letsencrypt.org"`) {
+			t.Fatalf("expected CaaLikelyTypo for %s, got: %v", value, probs)
+		}
+	}
+
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org.example.org"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	if last := probs[len(probs)-1]; last.Code != ProblemCodeCaaIssuerSuffixMistake ||
+		!strings.Contains(last.Explanation, `"letsencrypt.org.example.org"`) || !strings.HasSuffix(last.Detail, `0 issue "letsencrypt.org"`) {
+		t.Fatalf("expected CaaIssuerSuffixMistake, got: %v", probs)
+	}
+
+	ctx = newCAATestContext(t, "example.org", `0 issue "sectigo.com"`)
+	probs, _ = caaChecker{}.Check(ctx, "example.org", HTTP01)
+	if probs[len(probs)-1].Code != ProblemCodeCAAIssuanceNotAllowed {
+		t.Fatalf("expected CAAIssuanceNotAllowed for another CA, got: %v", probs)
+	}
+}
+
+func TestCAAChecker_IssuewildScope(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`, `128 issuewild ";"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	found := false
+	for _, prob := range probs {
+		if prob.Code == ProblemCodeCAAIssuewildScope {
+			found = true
+		}
+		if prob.Severity != SeverityDebug {
+			t.Fatalf("expected issuewild not to block a non-wildcard, got: %v", prob)
+		}
+	}
+	if !found {
+		t.Fatalf("expected CAAIssuewildScope, got: %v", probs)
+	}
+
+	probs, _ = caaChecker{}.Check(ctx, "*.example.org", DNS01)
+	for _, prob := range probs {
+		if prob.Code == ProblemCodeCAAIssuewildScope {
+			t.Fatalf("expected no CAAIssuewildScope for a wildcard, got: %v", prob)
+		}
+	}
+}
+
+func TestCAAChecker_MalformedIssuer(t *testing.T) {
+	for _, value := range []string{`"https://letsencrypt.org"`, `"letsencrypt.org/acme"`, `"letsencrypt.org:443"`} {
+		ctx := newCAATestContext(t, "example.org", `0 issue `+value)
+		probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+		last := probs[len(probs)-1]
+		if last.Code != ProblemCodeMalformedCaaIssuer || !strings.Contains(last.Explanation, `If "letsencrypt.org" was intended`) {
+			t.Fatalf("expected MalformedCaaIssuer for %s, got: %v", value, probs)
+		}
+	}
+}
+
+func TestCAAChecker_PermittedIssuers(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "sectigo.com"`, `0 issue "letsencrypt.org"`, `0 issue "sectigo.com"`)
+	probs, _ := caaChecker{}.Check(ctx, "example.org", HTTP01)
+	if len(withoutDebugProblems(probs)) != 0 {
+		t.Fatalf("expected issuance to be permitted, got: %v", probs)
+	}
+	last := probs[len(probs)-1]
+	if last.Code != ProblemCodeCAAPermittedIssuers || last.Detail != "sectigo.com\nletsencrypt.org" {
+		t.Fatalf("expected the permitted issuers to be listed, got: %v", probs)
+	}
+}
+
+func TestHighTTLChecker_Check(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`)
+	a, _ := dns.NewRR("example.org. 604800 IN A 192.0.2.1")
+	ctx.rrs["example.org"][dns.TypeA] = lookupResult{RRs: []dns.RR{a}}
+	ctx.rrs["example.org"][dns.TypeAAAA] = lookupResult{}
+
+	probs, err := highTTLChecker{}.Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeHighTTL || strings.Contains(probs[0].Detail, "CAA") {
+		t.Fatalf("expected only the A record to be reported, got: %v", probs)
+	}
+}
+
+func TestZeroTTLChecker_Check(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`)
+	ctx.rrs["example.org"][dns.TypeCAA].RRs[0].Header().Ttl = 0
+	a, _ := dns.NewRR("example.org. 300 IN A 192.0.2.1")
+	ctx.rrs["example.org"][dns.TypeA] = lookupResult{RRs: []dns.RR{a}}
+	ctx.rrs["example.org"][dns.TypeAAAA] = lookupResult{}
+
+	probs, _ := zeroTTLChecker{}.Check(ctx, "example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeZeroTTL || !strings.Contains(probs[0].Detail, "CAA") ||
+		strings.Contains(probs[0].Detail, "192.0.2.1") {
+		t.Fatalf("expected only the CAA record to be reported, got: %v", probs)
+	}
+}
+
+func TestAddressTTLMismatchChecker_Check(t *testing.T) {
+	for _, test := range []struct {
+		v4TTL, v6TTL int
+		mismatch     bool
+	}{
+		{300, 86400, true},
+		{86400, 3600, true},
+		{300, 900, false},
+		{3600, 3600, false},
+	} {
+		ctx := newScanContext()
+		a, _ := dns.NewRR(fmt.Sprintf("example.org. %d IN A 192.0.2.1", test.v4TTL))
+		aaaa, _ := dns.NewRR(fmt.Sprintf("example.org. %d IN AAAA 2001:db8::1", test.v6TTL))
+		ctx.rrs["example.org"] = map[uint16]lookupResult{
+			dns.TypeA:    {RRs: []dns.RR{a}},
+			dns.TypeAAAA: {RRs: []dns.RR{aaaa}},
+		}
+
+		probs, _ := addressTTLMismatchChecker{}.Check(ctx, "example.org", HTTP01)
+		if (len(probs) == 1) != test.mismatch {
+			t.Fatalf("expected a mismatch (%t) for A %d and AAAA %d, got: %v", test.mismatch, test.v4TTL, test.v6TTL, probs)
+		}
+	}
+}
+
+func TestIPv4OnlyChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("www.example.org. 300 IN A 192.0.2.1")
+	aaaa, _ := dns.NewRR("example.org. 300 IN AAAA 2001:db8::1")
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {}}
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeAAAA: {RRs: []dns.RR{aaaa}}, dns.TypeNS: {}}
+
+	probs, _ := ipv4OnlyChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeIPv4Only || probs[0].Detail != aaaa.String() {
+		t.Fatalf("expected IPv4Only, got: %v", probs)
+	}
+
+	ctx.rrs["example.org"][dns.TypeAAAA] = lookupResult{}
+	if probs, _ := (ipv4OnlyChecker{}).Check(ctx, "www.example.org", HTTP01); len(probs) != 0 {
+		t.Fatalf("expected nothing for an IPv4-only zone, got: %v", probs)
+	}
+}
+
+func TestRenewalInfoChecker_Check(t *testing.T) {
+	now := time.Now()
+	cert := makeTestCertificate(t, 0x87, now.Add(-60*24*time.Hour), now.Add(30*24*time.Hour), "example.org")
+	cert.AuthorityKeyId = []byte{0x01, 0x02, 0x03}
+
+	if id, _ := renewalInfoCertID(cert); id != "AQID.AIc" {
+		t.Fatalf("unexpected ARI certificate ID: %s", id)
+	}
+
+	var windowStart time.Time
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"renewalInfo": "%s/renewal-info"}`, srv.URL)
+		case "/renewal-info/AQID.AIc":
+			fmt.Fprintf(w, `{"suggestedWindow": {"start": "%s", "end": "%s"}}`,
+				windowStart.Format(time.RFC3339), windowStart.Add(48*time.Hour).Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.ctLogs = newCTClient(mockCTLogSource{"1": cert})
+	ctx.acmeDirectory = srv.URL + "/directory"
+
+	if _, err := (renewalInfoChecker{}).Check(ctx, "example.org", HTTP01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable by default, got: %v", err)
+	}
+	ctx.renewalInfo = true
+
+	windowStart = now.Add(24 * time.Hour)
+	probs, err := renewalInfoChecker{}.Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeRenewalInfo {
+		t.Fatalf("expected only the renewal window to be reported, got: %v", probs)
+	}
+
+	windowStart = now.Add(-time.Hour)
+	ctx.certificateSerial = "00:87"
+	probs, _ = renewalInfoChecker{}.Check(ctx, "example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeRenewalSuggested {
+		t.Fatalf("expected renewal to be suggested, got: %v", probs)
+	}
+
+	ctx.certificateSerial = "01"
+	if probs, _ = (renewalInfoChecker{}).Check(ctx, "example.org", HTTP01); len(probs) != 0 {
+		t.Fatalf("expected no problems for an unknown serial, got: %v", probs)
+	}
+}
+
+func TestWWWCounterpartChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {}}
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeA: {}, dns.TypeAAAA: {}}
+
+	probs, err := wwwCounterpartChecker{}.Check(ctx, "example.org", DNS01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeWWWCounterpart || !strings.Contains(probs[0].Explanation, "would not currently work") {
+		t.Fatalf("expected www.example.org to be suggested as not working, got: %v", probs)
+	}
+
+	probs, _ = wwwCounterpartChecker{}.Check(ctx, "www.example.org", DNS01)
+	if len(probs) != 1 || !strings.Contains(probs[0].Explanation, "example.org resolves") {
+		t.Fatalf("expected example.org to be suggested as working, got: %v", probs)
+	}
+
+	if _, err := (wwwCounterpartChecker{}).Check(ctx, "mail.example.org", DNS01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable to other subdomains, got: %v", err)
+	}
+
+	ctx.names = []string{"example.org", "www.example.org"}
+	if _, err := (wwwCounterpartChecker{}).Check(ctx, "example.org", DNS01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable when both names are checked, got: %v", err)
+	}
+}
+
+func TestCAAUnsupportedProviderChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	soa, _ := dns.NewRR("example.org. 3600 IN SOA ns1.freenom.com. soa.freenom.com. 1 10800 3600 604800 3600")
+	ns, _ := dns.NewRR("example.org. 3600 IN NS ns01.freenom.com.")
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeCAA: {}}
+	ctx.rrs["example.org"] = map[uint16]lookupResult{
+		dns.TypeCAA: {},
+		dns.TypeSOA: {RRs: []dns.RR{soa}},
+		dns.TypeNS:  {RRs: []dns.RR{ns}},
+	}
+	ctx.rrs["org"] = map[uint16]lookupResult{dns.TypeCAA: {}}
+
+	probs, err := caaUnsupportedProviderChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Code != ProblemCodeCAAUnsupportedByProvider {
+		t.Fatalf("expected CAAUnsupportedByProvider, got: %v", probs)
+	}
+
+	caa, _ := dns.NewRR(`example.org. 3600 IN CAA 0 issue "letsencrypt.org"`)
+	ctx.rrs["example.org"][dns.TypeCAA] = lookupResult{RRs: []dns.RR{caa}}
+	if probs, _ = (caaUnsupportedProviderChecker{}).Check(ctx, "www.example.org", HTTP01); len(probs) != 0 {
+		t.Fatalf("expected no problems when CAA records are served, got: %v", probs)
+	}
+}
+
+func TestCAAChecker_WildcardFallsBackToIssue(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "otherca.example"`)
+	ctx.rrs["org"] = map[uint16]lookupResult{dns.TypeCAA: {}}
+	probs, _ := caaChecker{}.Check(ctx, "*.example.org", DNS01)
+	last := probs[len(probs)-1]
+	if last.Code != ProblemCodeCAAIssuanceNotAllowed || !strings.Contains(last.Explanation, `no "issuewild" records`) {
+		t.Fatalf("expected the fallback to issue to be explained, got: %v", probs)
+	}
+
+	// A denying issuewild is reported without the fallback
+	ctx = newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`, `0 issuewild "otherca.example"`)
+	probs, _ = caaChecker{}.Check(ctx, "*.example.org", DNS01)
+	last = probs[len(probs)-1]
+	if last.Code != ProblemCodeCAAIssuanceNotAllowed || strings.Contains(last.Explanation, `no "issuewild" records`) {
+		t.Fatalf("expected the issuewild denial without the fallback explanation, got: %v", probs)
+	}
+
+	// Without issue or issuewild records, wildcards are unrestricted
+	ctx = newCAATestContext(t, "example.org", `0 iodef "mailto:security@example.org"`)
+	if probs, _ = (caaChecker{}).Check(ctx, "*.example.org", DNS01); len(withoutDebugProblems(probs)) != 0 {
+		t.Fatalf("expected no problems, got: %v", probs)
+	}
+}
+
+func TestDomainBoundary(t *testing.T) {
+	prob := domainBoundary("foo.example.github.io", "io")
+	if prob.Code != ProblemCodeDomainBoundary || !strings.Contains(prob.Detail, "Registered Domain (used for rate limits): example.github.io") ||
+		!strings.Contains(prob.Detail, "including private suffixes (CAA records are searched for up to): github.io") {
+		t.Fatalf("unexpected problem: %v", prob)
+	}
+}
+
+func TestBrandImpersonation(t *testing.T) {
+	for domain, brand := range map[string]string{
+		"paypal.com.example.org":    "paypal",
+		"paypal-secure-login.com":   "paypal",
+		"www.apple-verify.co.uk":    "apple",
+		"www.paypal.com":            "",
+		"paypal.example.org":        "",
+		"apple-orchard.example.org": "",
+		"example.org":               "",
+	} {
+		if got, _ := brandImpersonation(domain); got != brand {
+			t.Errorf("expected %q for %s, got: %q", brand, domain, got)
+		}
+	}
+}
+
+func TestValidDomainChecker_UnusualPublicSuffix(t *testing.T) {
+	probs, _ := validDomainChecker{}.Check(newScanContext(), "example.github.io", HTTP01)
+	found := false
+	for _, prob := range probs {
+		if prob.Code == ProblemCodeUnusualPublicSuffix && prob.Detail == "Rule: github.io (private section, normal rule)" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected UnusualPublicSuffix, got: %v", probs)
+	}
+
+	probs, _ = validDomainChecker{}.Check(newScanContext(), "www.example.com", HTTP01)
+	for _, prob := range probs {
+		if prob.Code == ProblemCodeUnusualPublicSuffix {
+			t.Fatalf("expected no UnusualPublicSuffix, got: %v", prob)
+		}
+	}
+}
+
+func TestValidDomainChecker_UnlistedTLD(t *testing.T) {
+	probs, _ := validDomainChecker{}.Check(newScanContext(), "www.example.unlisted", HTTP01)
+	if len(probs) != 2 || probs[0].Code != ProblemCodeInvalidDomain || probs[1].Code != ProblemCodeUnlistedTLD ||
+		!strings.Contains(probs[1].Detail, "Registered Domain under the default rule: example.unlisted") {
+		t.Fatalf("expected InvalidDomain and UnlistedTLD, got: %v", probs)
+	}
+}
+
+func TestValidDomainChecker_NonIssuableTLD(t *testing.T) {
+	for domain, tld := range map[string]string{
+		"www.example.internal": "internal",
+		"printer.home.arpa":    "home.arpa",
+		"nas.local":            "local",
+	} {
+		probs, _ := validDomainChecker{}.Check(newScanContext(), domain, HTTP01)
+		if len(probs) != 1 || probs[0].Code != ProblemCodeNonIssuableTld || probs[0].Severity != SeverityFatal ||
+			!strings.HasPrefix(probs[0].Detail, "TLD: "+tld+" ") {
+			t.Fatalf("%s: expected NonIssuableTld, got: %v", domain, probs)
+		}
+	}
+
+	if tld, _ := nonIssuableTLDOf("example.com"); tld != "" {
+		t.Fatalf("expected a public TLD not to be matched, got: %s", tld)
+	}
+}
+
+func TestValidDomainChecker_IPAddress(t *testing.T) {
+	for domain, family := range map[string]string{
+		"192.0.2.1":        "IPv4",
+		"2001:db8::1":      "IPv6",
+		"[2001:db8::1]":    "IPv6",
+		"::ffff:192.0.2.1": "IPv4",
+	} {
+		probs, _ := validDomainChecker{}.Check(newScanContext(), domain, HTTP01)
+		if len(probs) != 1 || probs[0].Code != ProblemCodeIpAddressNotSupported || probs[0].Severity != SeverityFatal ||
+			!strings.Contains(probs[0].Explanation, "is an "+family+" address") {
+			t.Fatalf("%s: expected IpAddressNotSupported, got: %v", domain, probs)
+		}
+	}
+}
+
+func TestManagedPlatformFromHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Server", "GitHub.com")
+	if platform, _ := managedPlatformFromHeaders(h); platform != "GitHub Pages" {
+		t.Fatalf("expected GitHub Pages, got: %q", platform)
+	}
+
+	h = http.Header{}
+	h.Set("X-Vercel-Id", "iad1::abcde")
+	if platform, header := managedPlatformFromHeaders(h); platform != "Vercel" || header != "X-Vercel-Id: iad1::abcde" {
+		t.Fatalf("expected Vercel, got: %q (%q)", platform, header)
+	}
+
+	h = http.Header{}
+	h.Set("Server", "nginx")
+	if platform, _ := managedPlatformFromHeaders(h); platform != "" {
+		t.Fatalf("expected no platform, got: %q", platform)
+	}
+}
+
+func TestWildcardCNAMEBaseChecker_Check(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`)
+	cname, _ := dns.NewRR("sub.example.org. 300 IN CNAME target.example.net.")
+	targetCAA, _ := dns.NewRR(`target.example.net. 300 IN CAA 0 issuewild ";"`)
+	ctx.rrs["sub.example.org"] = map[uint16]lookupResult{
+		dns.TypeCNAME: {RRs: []dns.RR{cname}},
+		dns.TypeCAA:   {RRs: []dns.RR{cname, targetCAA}},
+	}
+
+	probs, _ := wildcardCNAMEBaseChecker{}.Check(ctx, "*.sub.example.org", DNS01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeWildcardBaseCNAME ||
+		!strings.HasPrefix(probs[0].Detail, "sub.example.org CNAME target.example.net\n"+
+			"The CAA records of the CNAME target target.example.net apply to *.sub.example.org:") {
+		t.Fatalf("expected the CNAME target's CAA records to apply, got: %v", probs)
+	}
+
+	if _, err := (wildcardCNAMEBaseChecker{}).Check(ctx, "sub.example.org", DNS01); err != errNotApplicable {
+		t.Fatalf("expected the check not to apply to a non-wildcard, got: %v", err)
+	}
+}
+
+func TestCDNCAAChecker_Check(t *testing.T) {
+	ctx := newCAATestContext(t, "example.org", `0 issue "letsencrypt.org"`)
+	cname, _ := dns.NewRR("www.example.org. 300 IN CNAME d111111abcdef8.cloudfront.net.")
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{
+		dns.TypeCNAME: {RRs: []dns.RR{cname}},
+		dns.TypeCAA:   {RRs: []dns.RR{cname}},
+	}
+
+	probs, _ := cdnCAAChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeCDNCAAEvaluation ||
+		!strings.Contains(probs[0].Detail, "The CAA records at example.org apply to www.example.org.") {
+		t.Fatalf("expected the parent's CAA records to apply, got: %v", probs)
+	}
+
+	edgeCAA, _ := dns.NewRR(`d111111abcdef8.cloudfront.net. 300 IN CAA 0 issue "amazon.com"`)
+	ctx.rrs["www.example.org"][dns.TypeCAA] = lookupResult{RRs: []dns.RR{cname, edgeCAA}}
+	probs, _ = cdnCAAChecker{}.Check(ctx, "www.example.org", HTTP01)
+	if len(probs) != 2 || !strings.Contains(probs[0].Detail, "The CAA records of the CDN's hostname d111111abcdef8.cloudfront.net apply") {
+		t.Fatalf("expected the CDN's CAA records to apply, got: %v", probs)
+	}
+	if probs[1].Code != ProblemCodeCaaControlledByCdn ||
+		!strings.HasPrefix(probs[1].Detail, "Controlling domain: d111111abcdef8.cloudfront.net. They do not permit") {
+		t.Fatalf("expected the CAA records to be controlled by the CDN, got: %v", probs[1])
+	}
+
+	if probs, _ = (cdnCAAChecker{}).Check(ctx, "example.org", HTTP01); len(probs) != 0 {
+		t.Fatalf("expected no problem without a CNAME, got: %v", probs)
+	}
+}
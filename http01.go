@@ -1,13 +1,24 @@
 package letsdebug
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"fmt"
+	"mime"
 	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/weppos/publicsuffix-go/publicsuffix"
 )
 
 var (
@@ -22,6 +33,129 @@ var (
 		// nginx: https://github.com/nginx/nginx/blob/15544440425008d5ad39a295b826665ad56fdc90/src/http/ngx_http_special_response.c#L274
 		[]byte("400 The plain HTTP request was sent to HTTPS port"),
 	}
+	defaultWebserverPages = []struct {
+		Server string
+		Needle []byte
+	}{
+		{"Apache (Ubuntu)", []byte("Apache2 Ubuntu Default Page")},
+		{"Apache (Debian)", []byte("Apache2 Debian Default Page")},
+		{"Apache (RHEL/CentOS/Fedora)", []byte("Test Page for the Apache HTTP Server")},
+		{"Apache", []byte("<h1>It works!</h1>")},
+		{"nginx", []byte("<title>Welcome to nginx!</title>")},
+		{"Microsoft IIS", []byte("<title>IIS Windows Server</title>")},
+	}
+	// hostingLandingPages identify the landing pages which hosting panels serve from their default
+	// virtual host, for names which have no virtual host of their own
+	hostingLandingPages = []struct {
+		Server string
+		Needle []byte
+	}{
+		{"cPanel", []byte("/cgi-sys/defaultwebpage.cgi")},
+		{"cPanel", []byte("Future home of something quite cool")},
+		{"Plesk", []byte("Web Server's Default Page")},
+		{"Plesk", []byte("<title>Domain Default page</title>")},
+	}
+	// apexFlatteningPTRSuffixes maps the reverse DNS names of CDN and load balancer
+	// addresses to the provider, since they are typically the target of ALIAS/ANAME records
+	apexFlatteningPTRSuffixes = map[string]string{
+		"cloudfront.net":           "Amazon CloudFront",
+		"awsglobalaccelerator.com": "AWS Global Accelerator",
+		"akamaitechnologies.com":   "Akamai",
+		"akamaiedge.net":           "Akamai",
+		"googleusercontent.com":    "Google Cloud",
+		"1e100.net":                "Google",
+		"azureedge.net":            "Azure CDN",
+	}
+	// anycastRanges are the address ranges which providers announce by anycast, so that requests
+	// from different networks may reach different nodes. To recognise another, add it here.
+	anycastRanges = map[string][]string{
+		"Cloudflare": {"104.16.0.0/13", "172.64.0.0/13", "188.114.96.0/20", "2606:4700::/32"},
+		"Fastly":     {"151.101.0.0/16", "2a04:4e42::/32"},
+		"Vercel":     {"76.76.21.0/24"},
+	}
+	// loadBalancerDefaultResponses identify the responses of load balancers which had no
+	// backend (or routing rule) for the request. Either ServerHeader or Needle may be empty.
+	loadBalancerDefaultResponses = []struct {
+		LoadBalancer string
+		ServerHeader string
+		Needle       []byte
+	}{
+		{"AWS Application Load Balancer", "awselb/", nil},
+		{"AWS Classic Load Balancer", "", []byte("Back-end server is at capacity")},
+		{"HAProxy", "", []byte("No server is available to handle this request")},
+		{"Envoy", "envoy", []byte("no healthy upstream")},
+		{"Kubernetes ingress-nginx", "", []byte("default backend - 404")},
+		{"Azure Application Gateway", "Microsoft-Azure-Application-Gateway", nil},
+	}
+	// geoBlockingHeaders and geoBlockingPayloads are signals that a request was refused because of
+	// the country or network that it came from
+	geoBlockingHeaders  = []string{"X-Sucuri-Block"}
+	geoBlockingPayloads = [][]byte{
+		// Cloudflare error 1009
+		[]byte("has banned the country or region your IP address is in"),
+		[]byte("Access denied for your country"),
+		[]byte("not available in your country"),
+		[]byte("not available in your region"),
+		[]byte("Your country is blocked"),
+	}
+	// wafBlockPages identify the block pages of web application firewalls, which are matched
+	// case-insensitively against the response body
+	wafBlockPages = []struct {
+		WAF    string
+		Needle []byte
+	}{
+		{"ModSecurity", []byte("mod_security")},
+		{"ModSecurity", []byte("modsecurity")},
+		{"Wordfence", []byte("generated by wordfence")},
+		{"Imperva Incapsula", []byte("incapsula incident id")},
+		{"F5 BIG-IP ASM", []byte("the requested url was rejected. please consult with your administrator.")},
+		{"Cloudflare WAF", []byte("sorry, you have been blocked")},
+		{"Akamai", []byte("you don't have permission to access")},
+	}
+	// wafReferenceID extracts the reference/incident ID from a WAF block page
+	wafReferenceID = regexp.MustCompile(`(?i)(?:support id is|incident id|reference #|ray id|unique_id|block id)[:\s]*` +
+		`(?:<[^>]*>\s*)*([A-Za-z0-9.\-]{4,})`)
+	// clientSideRedirects match an HTML meta refresh or a JavaScript redirect in a response body,
+	// capturing the target where possible
+	clientSideRedirects = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)<meta[^>]+http-equiv\s*=\s*["']?refresh["']?[^>]*content\s*=\s*["']?\s*\d*\s*;?\s*(?:url\s*=\s*)?([^"'>\s]*)`),
+		regexp.MustCompile(`(?i)(?:window\.|document\.|top\.)?location(?:\.href)?\s*=\s*["']([^"']*)`),
+		regexp.MustCompile(`(?i)location\.(?:replace|assign)\(\s*["']([^"']*)`),
+	}
+	// cacheStatusHeaders are the headers which CDNs and caching proxies use to report whether a
+	// response was served from their cache
+	cacheStatusHeaders = []string{"CF-Cache-Status", "X-Cache", "X-Cache-Status", "X-Proxy-Cache", "Age"}
+	// cloudflareInterstitialPayloads identify the JavaScript challenge page of Cloudflare's
+	// "I'm Under Attack" mode (and other managed challenges)
+	cloudflareInterstitialPayloads = [][]byte{
+		[]byte("<title>Just a moment...</title>"),
+		[]byte("Checking your browser before accessing"),
+		[]byte("window._cf_chl_opt"),
+		[]byte("jschl_vc"),
+	}
+	// loginPathFragments and captchaPayloads identify pages which require a human to log in
+	// or solve a challenge, which control panels and security products may redirect to
+	loginPathFragments = []string{"/login", "/signin", "/sign-in", "/wp-login.php", "/cgi-sys/", "/auth/", "/captcha"}
+	captchaPayloads    = [][]byte{
+		[]byte("g-recaptcha"),
+		[]byte("h-captcha"),
+		[]byte("cf-turnstile"),
+		[]byte("/cdn-cgi/challenge-platform/"),
+	}
+	directoryListingPayloads = [][]byte{
+		// Apache, nginx and lighttpd autoindex
+		[]byte("<title>Index of /"),
+		// IIS directoryBrowse
+		[]byte("[To Parent Directory]"),
+		// python -m http.server
+		[]byte("Directory listing for /"),
+	}
+	isLikelyIISHandlerPayloads = [][]byte{
+		// 404.3: no MIME map for the (lack of) file extension, 404.7: file extension denied by Request Filtering
+		[]byte("HTTP Error 404.3"),
+		[]byte("HTTP Error 404.7"),
+		[]byte("MIME map"),
+	}
 )
 
 // dnsAChecker checks if there are any issues in Unbound looking up the A and
@@ -37,6 +171,10 @@ func (c dnsAChecker) Check(ctx *scanContext, domain string, method ValidationMet
 	var aRRs, aaaaRRs []dns.RR
 	var aErr, aaaaErr error
 
+	if len(ctx.addressOverride) > 0 {
+		probs = append(probs, addressOverridden(domain, ctx.addressOverride))
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -60,12 +198,26 @@ func (c dnsAChecker) Check(ctx *scanContext, domain string, method ValidationMet
 	}
 
 	for _, rr := range aRRs {
-		if aRR, ok := rr.(*dns.A); ok && isAddressReserved(aRR.A) {
+		aRR, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		if reason := sensitiveAddressReason(aRR.A); reason != "" {
+			probs = append(probs, sensitiveTargetAddress(domain, domain, aRR.A, reason, nil))
+		} else if isAddressReserved(aRR.A) {
 			probs = append(probs, reservedAddress(domain, aRR.A.String()))
 		}
 	}
 	for _, rr := range aaaaRRs {
-		if aaaaRR, ok := rr.(*dns.AAAA); ok && isAddressReserved(aaaaRR.AAAA) {
+		aaaaRR, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		if reason := sensitiveAddressReason(aaaaRR.AAAA); reason != "" {
+			probs = append(probs, sensitiveTargetAddress(domain, domain, aaaaRR.AAAA, reason, nil))
+		} else if reason := ipv6TransitionReason(aaaaRR.AAAA); reason != "" {
+			probs = append(probs, ipv6TransitionAddress(domain, aaaaRR.AAAA.String(), reason, isAddressReserved(aaaaRR.AAAA)))
+		} else if isAddressReserved(aaaaRR.AAAA) {
 			probs = append(probs, reservedAddress(domain, aaaaRR.AAAA.String()))
 		}
 	}
@@ -76,16 +228,439 @@ func (c dnsAChecker) Check(ctx *scanContext, domain string, method ValidationMet
 	}
 
 	if len(sb) > 0 {
-		probs = append(probs, debugProblem("HTTPRecords", "A and AAAA records found for this domain", strings.Join(sb, "\n")))
+		probs = append(probs, debugProblem(ProblemCodeHTTPRecords, "A and AAAA records found for this domain", strings.Join(sb, "\n")))
 	}
 
-	if len(sb) == 0 {
+	if len(sb) == 0 && aErr == nil && aaaaErr == nil {
+		probs = append(probs, addressAbsence(ctx, domain))
+	} else if len(sb) == 0 {
 		probs = append(probs, noRecords(domain, "No A or AAAA records found."))
 	}
 
 	return probs, nil
 }
 
+// addressAbsence explains why a name which was resolved without error has no A or AAAA records:
+// either it does not exist at all (NXDOMAIN), or it exists but has no address records (NODATA).
+func addressAbsence(ctx *scanContext, domain string) Problem {
+	result := ctx.LookupWithRcode(domain, dns.TypeA)
+
+	detail := "The negative response did not include an SOA record"
+	for _, rr := range result.Authority {
+		if soa, ok := rr.(*dns.SOA); ok {
+			detail = fmt.Sprintf("The negative response came from the zone %s:\n%s", normalizeFqdn(soa.Hdr.Name), soa.String())
+			break
+		}
+	}
+
+	if result.Rcode == dns.RcodeNameError {
+		return Problem{
+			Name: "NameNotFound",
+			Code: ProblemCodeNameNotFound,
+			Explanation: fmt.Sprintf(`%s does not exist in the DNS (NXDOMAIN). Let's Encrypt would not be able to connect `+
+				`to your domain to perform HTTP validation. Either the record for %s has not been created yet, or the zone `+
+				`in which it should be created is not the one that is delegated (check that the zone named below is the `+
+				`one that you are editing).`, domain, domain),
+			Detail:   detail,
+			Severity: SeverityFatal,
+		}
+	}
+
+	return Problem{
+		Name: "NoAddressRecords",
+		Code: ProblemCodeNoAddressRecords,
+		Explanation: fmt.Sprintf(`%s exists in the DNS, but has no A or AAAA records (NODATA). The name may have other `+
+			`types of records (e.g. TXT or MX), but Let's Encrypt needs an address to connect to, to perform HTTP `+
+			`validation. Add an A and/or AAAA record for %s.`, domain, domain),
+		Detail:   detail,
+		Severity: SeverityFatal,
+	}
+}
+
+// partialResolutionChecker checks names which are to be issued together, and reports
+// when only some of them have any A or AAAA records (e.g. example.org but not www.example.org).
+type partialResolutionChecker struct{}
+
+func (c partialResolutionChecker) CheckNames(ctx *scanContext, domains []string, method ValidationMethod) ([]Problem, error) {
+	if method != HTTP01 && method != TLSALPN01 {
+		return nil, errNotApplicable
+	}
+
+	var resolved, unresolved []string
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") {
+			continue
+		}
+
+		hasRecords := false
+		nxdomain := false
+		for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			result := ctx.LookupWithRcode(domain, rrType)
+			if len(result.RRs) > 0 {
+				hasRecords = true
+			}
+			if result.Rcode == dns.RcodeNameError {
+				nxdomain = true
+			}
+		}
+
+		switch {
+		case hasRecords:
+			resolved = append(resolved, domain)
+		case nxdomain:
+			unresolved = append(unresolved, domain+" (NXDOMAIN)")
+		default:
+			unresolved = append(unresolved, domain+" (no A or AAAA records)")
+		}
+	}
+
+	if len(resolved) == 0 || len(unresolved) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "PartialNameResolution",
+		Code: ProblemCodePartialNameResolution,
+		Explanation: fmt.Sprintf(`Some of the names to be included in the certificate have A/AAAA records, but %s do(es) not. `+
+			`Let's Encrypt must be able to validate every name in a certificate, so issuance will fail until these names `+
+			`are given DNS records (often a www. or apex record is missing), or are removed from the certificate request.`,
+			strings.Join(unresolved, ", ")),
+		Detail:   fmt.Sprintf("Names with records: %s\nNames without records: %s", strings.Join(resolved, ", "), strings.Join(unresolved, ", ")),
+		Severity: SeverityError,
+	}}, nil
+}
+
+// clientSubnetChecker compares the addresses for a domain with the addresses which its
+// authoritative nameservers return to a query carrying an EDNS Client Subnet option from
+// Let's Encrypt's network, to detect geo-aware or split-horizon DNS.
+type clientSubnetChecker struct{}
+
+// clientSubnetProbe is a representative prefix from which Let's Encrypt performs validation.
+var clientSubnetProbe = &net.IPNet{IP: net.IPv4(66, 133, 109, 0), Mask: net.CIDRMask(24, 32)}
+
+func (c clientSubnetChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != HTTP01 || len(ctx.addressOverride) > 0 {
+		return nil, errNotApplicable
+	}
+
+	rrs, err := ctx.Lookup(domain, dns.TypeA)
+	if err != nil {
+		// Reported by dnsAChecker
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	var seenList []string
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			seen[a.A.String()] = true
+			seenList = append(seenList, a.A.String())
+		}
+	}
+	if len(seen) == 0 {
+		return nil, nil
+	}
+
+	subnetAddrs, err := lookupAWithClientSubnet(ctx, domain, clientSubnetProbe)
+	if err != nil {
+		return []Problem{debugProblem(ProblemCodeClientSubnetLookup, "Could not query the authoritative nameservers using EDNS Client Subnet",
+			err.Error())}, nil
+	}
+	if len(subnetAddrs) == 0 {
+		return nil, nil
+	}
+
+	for _, addr := range subnetAddrs {
+		if seen[addr] {
+			return nil, nil
+		}
+	}
+
+	return []Problem{geoDNSDivergence(domain, seenList, subnetAddrs)}, nil
+}
+
+// lookupAWithClientSubnet queries the authoritative nameservers for the A records of domain,
+// following any CNAME records to their own authoritative nameservers. If subnet is nil, no
+// EDNS Client Subnet option is sent.
+func lookupAWithClientSubnet(ctx *scanContext, domain string, subnet *net.IPNet) ([]string, error) {
+	name := domain
+	for hops := 0; hops < 8; hops++ {
+		_, servers, err := findAuthoritativeServers(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var rrs []dns.RR
+		for _, server := range servers {
+			if rrs, err = lookupWithClientSubnet(net.JoinHostPort(server.String(), "53"), name, dns.TypeA, subnet); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var addrs []string
+		var target string
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, v.A.String())
+			case *dns.CNAME:
+				target = normalizeFqdn(v.Target)
+			}
+		}
+		if len(addrs) > 0 || target == "" {
+			return addrs, nil
+		}
+		name = target
+	}
+	return nil, fmt.Errorf("Too many CNAME records were followed for %s", domain)
+}
+
+func geoDNSDivergence(domain string, seen, subnetAddrs []string) Problem {
+	return Problem{
+		Name: "GeoDNSDivergence",
+		Code: ProblemCodeGeoDNSDivergence,
+		Explanation: fmt.Sprintf(`The nameservers for %s return different addresses depending on where the query comes from `+
+			`(geo-aware or split-horizon DNS). When queried on behalf of Let's Encrypt's network, none of the addresses `+
+			`matched the ones seen by this test, so Let's Encrypt may validate against a server other than the one you are `+
+			`testing. Make sure that every server which may be returned serves the HTTP-01 challenge.`, domain),
+		Detail: fmt.Sprintf("Addresses seen by this test: %s\nAddresses returned for client subnet %s: %s",
+			strings.Join(seen, ", "), clientSubnetProbe.String(), strings.Join(subnetAddrs, ", ")),
+		Severity: SeverityDebug,
+	}
+}
+
+// resolverInterceptionChecker compares the addresses for a domain with the addresses that a
+// well-known public resolver returns, to detect a resolver (or network) which rewrites answers
+// with a block page or filtering address that Let's Encrypt would never see.
+type resolverInterceptionChecker struct{}
+
+func (c resolverInterceptionChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != HTTP01 || strings.HasPrefix(domain, "*.") || len(ctx.addressOverride) > 0 {
+		return nil, errNotApplicable
+	}
+
+	rrs, err := ctx.Lookup(domain, dns.TypeA)
+	if err != nil {
+		// Reported by dnsAChecker
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	var seenList []string
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			seen[a.A.String()] = true
+			seenList = append(seenList, a.A.String())
+		}
+	}
+	if len(seen) == 0 {
+		return nil, nil
+	}
+
+	publicRRs, err := lookupPublicResolver(domain, dns.TypeA)
+	if err != nil {
+		return []Problem{debugProblem(ProblemCodeResolverComparisonInconclusive, "Could not query the public resolver", err.Error())}, nil
+	}
+	var publicList []string
+	for _, rr := range publicRRs {
+		if a, ok := rr.(*dns.A); ok {
+			if seen[a.A.String()] {
+				return nil, nil
+			}
+			publicList = append(publicList, a.A.String())
+		}
+	}
+
+	// Geo-aware DNS may legitimately answer differently for the public resolver, so the answer is
+	// only suspect if the authoritative nameservers don't return it to us either
+	authoritative, err := lookupAWithClientSubnet(ctx, domain, nil)
+	if err != nil {
+		return []Problem{debugProblem(ProblemCodeResolverComparisonInconclusive,
+			"Could not query the authoritative nameservers to compare with the public resolver", err.Error())}, nil
+	}
+	for _, addr := range authoritative {
+		if seen[addr] {
+			return nil, nil
+		}
+	}
+
+	return []Problem{resolverInterception(domain, seenList, publicList, authoritative)}, nil
+}
+
+func resolverInterception(domain string, seen, public, authoritative []string) Problem {
+	none := func(addrs []string) string {
+		if len(addrs) == 0 {
+			return "(none)"
+		}
+		return strings.Join(addrs, ", ")
+	}
+	return Problem{
+		Name: "ResolverInterception",
+		Code: ProblemCodeResolverInterception,
+		Explanation: fmt.Sprintf(`The addresses which this test resolved for %s were not returned by the public resolver %s `+
+			`or by the domain's authoritative nameservers. The DNS resolver or network used by this test may be intercepting `+
+			`or filtering queries (e.g. returning a block page address), and Let's Encrypt, which does its own resolution, `+
+			`would not see these addresses. The results of the other checks may not reflect what Let's Encrypt sees.`,
+			domain, strings.TrimSuffix(publicResolver, ":53")),
+		Detail: fmt.Sprintf("Addresses seen by this test: %s\nAddresses returned by %s: %s\nAddresses returned by the authoritative nameservers: %s",
+			none(seen), strings.TrimSuffix(publicResolver, ":53"), none(public), none(authoritative)),
+		Severity: SeverityWarning,
+	}
+}
+
+// apexFlatteningChecker detects apex domains whose A records appear to belong to a CDN or load
+// balancer, which suggests that an ALIAS/ANAME (CNAME flattening) record is in use.
+type apexFlatteningChecker struct{}
+
+func (c apexFlatteningChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if strings.HasPrefix(domain, "*.") || len(ctx.addressOverride) > 0 {
+		return nil, errNotApplicable
+	}
+	if registeredDomain, err := publicsuffix.Domain(domain); err != nil || registeredDomain != domain {
+		return nil, errNotApplicable
+	}
+
+	if provider, address, ptr := detectApexFlattening(ctx, domain); provider != "" {
+		return []Problem{apexFlattening(domain, provider, address, ptr, apexCAASummary(ctx, domain))}, nil
+	}
+	return nil, nil
+}
+
+// detectApexFlattening returns the provider whose reverse DNS name one of the apex domain's A
+// records has (along with that address and name), or an empty provider if none do.
+func detectApexFlattening(ctx *scanContext, domain string) (provider, address, ptr string) {
+	if len(ctx.addressOverride) > 0 {
+		return "", "", ""
+	}
+	if registeredDomain, err := publicsuffix.Domain(domain); err != nil || registeredDomain != domain {
+		return "", "", ""
+	}
+
+	rrs, err := ctx.Lookup(domain, dns.TypeA)
+	if err != nil {
+		// Reported by dnsAChecker
+		return "", "", ""
+	}
+
+	for _, rr := range rrs {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		reverse, err := dns.ReverseAddr(a.A.String())
+		if err != nil {
+			continue
+		}
+		ptrs, _ := ctx.Lookup(normalizeFqdn(reverse), dns.TypePTR)
+		for _, ptrRR := range ptrs {
+			record, ok := ptrRR.(*dns.PTR)
+			if !ok {
+				continue
+			}
+			target := normalizeFqdn(record.Ptr)
+			for suffix, provider := range apexFlatteningPTRSuffixes {
+				if target == suffix || strings.HasSuffix(target, "."+suffix) {
+					return provider, a.A.String(), target
+				}
+			}
+		}
+	}
+
+	return "", "", ""
+}
+
+// apexCAASummary describes the CAA records which apply to a flattened apex domain, which are its own
+// rather than those of the flattened target.
+func apexCAASummary(ctx *scanContext, domain string) string {
+	name, records, err := lookupRelevantCAA(ctx, domain)
+	switch {
+	case err != nil:
+		// Reported by caaChecker
+		return ""
+	case len(records) == 0:
+		return fmt.Sprintf("No CAA records apply to %s, so Let's Encrypt may issue for it", domain)
+	case caaPermitsLetsEncrypt(records, ctx.caaIssuers):
+		return fmt.Sprintf("The CAA records at %s apply, and they permit Let's Encrypt", name)
+	default:
+		return fmt.Sprintf("The CAA records at %s apply, and they do not permit Let's Encrypt", name)
+	}
+}
+
+func apexFlattening(domain, provider, address, ptr, caaSummary string) Problem {
+	detail := fmt.Sprintf("%s has the reverse DNS name %s", address, ptr)
+	if caaSummary != "" {
+		detail += "\n" + caaSummary
+	}
+	return Problem{
+		Name: "ApexFlattening",
+		Code: ProblemCodeApexFlattening,
+		Explanation: fmt.Sprintf(`%s is an apex domain, but its A records appear to belong to %s, which suggests that an `+
+			`ALIAS, ANAME or "CNAME flattening" record is in use. Flattened records are resolved by your DNS provider, so `+
+			`Let's Encrypt never sees the target name: CAA records on the target do not apply, and only the CAA records `+
+			`on %s itself (or its parent domains) are used. If you set CAA records, those permitting Let's Encrypt must `+
+			`be on %s itself, whatever the target's CAA records say. The addresses may also change whenever the target changes.`,
+			domain, provider, domain, domain),
+		Detail:   detail,
+		Severity: SeverityWarning,
+	}
+}
+
+// anycastChecker notes when the domain's addresses are announced by anycast, since Let's Encrypt's
+// validation (from several networks) may reach different nodes than letsdebug does.
+type anycastChecker struct{}
+
+func (c anycastChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	var found []string
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, _ := ctx.Lookup(domain, rrType)
+		for _, rr := range rrs {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if provider := anycastProvider(ip); provider != "" {
+				found = append(found, fmt.Sprintf("%s (%s)", ip, provider))
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	return []Problem{{
+		Name: "AnycastAddress",
+		Code: ProblemCodeAnycastAddress,
+		Explanation: fmt.Sprintf(`Some of the addresses of %s are announced by anycast, so requests from different networks `+
+			`may be routed to different nodes of the provider. Let's Encrypt validates from several locations, which may `+
+			`reach different nodes (with different configuration or reachability) than this test did.`, domain),
+		Detail:   strings.Join(found, "\n"),
+		Severity: SeverityDebug,
+	}}, nil
+}
+
+// anycastProvider returns the provider which announces ip by anycast, or an empty string.
+func anycastProvider(ip net.IP) string {
+	for provider, cidrs := range anycastRanges {
+		for _, cidr := range cidrs {
+			if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+				return provider
+			}
+		}
+	}
+	return ""
+}
+
 // httpAccessibilityChecker checks whether an HTTP ACME validation request
 // would lead to any issues such as:
 // - Bad redirects
@@ -93,13 +668,14 @@ func (c dnsAChecker) Check(ctx *scanContext, domain string, method ValidationMet
 type httpAccessibilityChecker struct{}
 
 func (c httpAccessibilityChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
-	if method != HTTP01 {
+	// Wildcards can't be validated over HTTP at all, which wildcardDNS01OnlyChecker reports
+	if method != HTTP01 || strings.HasPrefix(domain, "*.") {
 		return nil, errNotApplicable
 	}
 
 	var probs []Problem
 
-	var ips []net.IP
+	var v6IPs, v4IPs []net.IP
 
 	rrs, _ := ctx.Lookup(domain, dns.TypeAAAA)
 	for _, rr := range rrs {
@@ -107,7 +683,7 @@ func (c httpAccessibilityChecker) Check(ctx *scanContext, domain string, method
 		if !ok {
 			continue
 		}
-		ips = append(ips, aaaa.AAAA)
+		v6IPs = append(v6IPs, aaaa.AAAA)
 	}
 	rrs, _ = ctx.Lookup(domain, dns.TypeA)
 	for _, rr := range rrs {
@@ -115,10 +691,10 @@ func (c httpAccessibilityChecker) Check(ctx *scanContext, domain string, method
 		if !ok {
 			continue
 		}
-		ips = append(ips, a.A)
+		v4IPs = append(v4IPs, a.A)
 	}
 
-	if len(ips) == 0 {
+	if len(v6IPs) == 0 && len(v4IPs) == 0 {
 		return probs, nil
 	}
 
@@ -128,14 +704,99 @@ func (c httpAccessibilityChecker) Check(ctx *scanContext, domain string, method
 
 	var debug []string
 
-	for _, ip := range ips {
-		res, prob := checkHTTP(ctx, domain, ip)
-		allCheckResults = append(allCheckResults, res)
-		if !prob.IsZero() {
-			probs = append(probs, prob)
+	// The problem produced by the request to each address, if any
+	addressProbs := map[string]Problem{}
+
+	// Check each address family separately, so that the results for each
+	// can be compared
+	checkAll := func(ips []net.IP) (working, broken []net.IP) {
+		for _, ip := range ips {
+			res, prob := checkHTTP(ctx, domain, ip)
+			allCheckResults = append(allCheckResults, res)
+			if !prob.IsZero() {
+				probs = append(probs, prob)
+				addressProbs[ip.String()] = prob
+			}
+			if !res.IsZero() {
+				working = append(working, ip)
+			} else {
+				broken = append(broken, ip)
+			}
+			debug = append(debug, fmt.Sprintf("Request to: %s/%s, Result: %s, Issue: %s\nRequest: %s\nReproduce with: %s\nTrace:\n%s\n",
+				domain, ip.String(), res.String(), prob.Name, res.Request(), res.Reproduction(), strings.Join(res.DialStack, "\n")))
+		}
+		return working, broken
+	}
+
+	// Never probe the host running letsdebug, whose responses would be mistaken for the domain's
+	withoutSelf := func(ips []net.IP) []net.IP {
+		var filtered []net.IP
+		for _, ip := range ips {
+			if isSelfAddress(ip) {
+				probs = append(probs, loopbackTarget(domain, domain, ip, nil))
+				continue
+			}
+			// Reported by dnsAChecker
+			if sensitiveAddressReason(ip) != "" {
+				continue
+			}
+			filtered = append(filtered, ip)
+		}
+		return filtered
+	}
+	v6IPs, v4IPs = withoutSelf(v6IPs), withoutSelf(v4IPs)
+
+	if len(v6IPs) > manyAddressesThreshold || len(v4IPs) > manyAddressesThreshold {
+		probs = append(probs, manyAddresses(domain, v6IPs, v4IPs))
+		v6IPs, v4IPs = sampleAddresses(v6IPs, manyAddressesThreshold), sampleAddresses(v4IPs, manyAddressesThreshold)
+	}
+
+	v6Working, v6Broken := checkAll(v6IPs)
+	v4Working, v4Broken := checkAll(v4IPs)
+
+	// Within each address family, Let's Encrypt picks a single address
+	if len(v6Working) > 0 && len(v6Broken) > 0 {
+		probs = append(probs, roundRobinPartialFailure(domain, "AAAA", v6Working, v6Broken))
+	}
+	if len(v4Working) > 0 && len(v4Broken) > 0 {
+		probs = append(probs, roundRobinPartialFailure(domain, "A", v4Working, v4Broken))
+	}
+
+	if len(v6IPs) > 0 && len(v6Working) == 0 && len(v4Working) > 0 {
+		cdn := ""
+		for _, res := range allCheckResults {
+			if res.IP.To4() != nil {
+				if cdn = detectCDN(res.ServerHeader); cdn != "" {
+					break
+				}
+			}
+		}
+		probs = ipv6BrokenVerdict(ctx, domain, cdn, v6IPs, v4IPs, probs, addressProbs)
+	}
+
+	if len(v6IPs) == 0 && len(v4IPs) > 0 {
+		if provider, _, _ := detectApexFlattening(ctx, domain); provider != "" {
+			probs = append(probs, apexAliasNoIPv6(domain, provider))
+		}
+	}
+
+	// IPv4 working in plaintext while IPv6 fails after a redirect to HTTPS is explained as one problem,
+	// rather than as separate IPv6, TLS and IPv4/IPv6 problems
+	if len(v6IPs) > 0 && len(v6Working) == 0 && len(v4Working) > 0 && len(v4Broken) == 0 {
+		if v6Res, v6Prob := isIPv6HTTPSRedirectBroken(allCheckResults, addressProbs); !v6Prob.IsZero() {
+			dropped := map[Problem]bool{}
+			for _, ip := range v6IPs {
+				dropped[addressProbs[ip.String()]] = true
+			}
+			var kept []Problem
+			for _, prob := range probs {
+				if !dropped[prob] && prob.Name != "IPv6BrokenIPv4Working" && prob.Name != "IPv6BrokenBehindCDN" &&
+					prob.Name != "ApexAliasIPv6" {
+					kept = append(kept, prob)
+				}
+			}
+			probs = append(kept, ipv6HTTPSRedirectBroken(domain, v6Res, v6Prob))
 		}
-		debug = append(debug, fmt.Sprintf("Request to: %s/%s, Result: %s, Issue: %s\nTrace:\n%s\n",
-			domain, ip.String(), res.String(), prob.Name, strings.Join(res.DialStack, "\n")))
 	}
 
 	// Filter out the servers that didn't respond at all
@@ -158,85 +819,1549 @@ func (c httpAccessibilityChecker) Check(ctx *scanContext, domain string, method
 		}
 	}
 
-	probs = append(probs, debugProblem("HTTPCheck", "Requests made to the domain", strings.Join(debug, "\n")))
-
-	if res := isLikelyModemRouter(allCheckResults); !res.IsZero() {
+	if v6Res, v4Res := isDualStackContentMismatch(nonZeroResults); !v6Res.IsZero() {
 		probs = append(probs, Problem{
-			Name: "PortForwarding",
-			Explanation: "A request to your domain revealed that the web server that responded may be " +
-				"the administrative interface of a modem or router. This can indicate an issue with the port forwarding " +
-				"setup on that modem or router. You may need to reconfigure the device to properly forward traffic to your " +
-				"intended webserver.",
-			Detail: fmt.Sprintf(`The web server that responded identified itself as "%s", `+
-				"which is a known webserver commonly used by modems/routers.", res.ServerHeader),
-			Severity: SeverityWarning,
+			Name: "DualStackContentMismatch",
+			Code: ProblemCodeDualStackContentMismatch,
+			Explanation: fmt.Sprintf(`The IPv6 and IPv4 addresses of %s respond differently to the validation request, which `+
+				`may mean that they are served by different servers or virtual hosts. Let's Encrypt prefers IPv6 addresses when `+
+				`they are available, so validation will be decided by the IPv6 response, which may not be the one you expect.`, domain),
+			Detail:   fmt.Sprintf("IPv6: %s\nIPv4: %s", v6Res.String(), v4Res.String()),
+			Severity: SeverityDebug,
 		})
 	}
 
-	if res := isLikelyNginxTestcookie(allCheckResults); !res.IsZero() {
+	probs = append(probs, debugProblem(ProblemCodeHTTPCheck, "Requests made to the domain", strings.Join(debug, "\n")))
+
+	if res := isCloudflareDroppedChallengePath(allCheckResults); !res.IsZero() {
 		probs = append(probs, Problem{
-			Name: "BlockedByNginxTestCookie",
-			Explanation: "The validation request to this domain was blocked by a deployment of the nginx " +
-				"testcookie module (https://github.com/kyprizel/testcookie-nginx-module). This module is designed to " +
-				"block robots, and causes the Let's Encrypt validation process to fail. The server administrator can " +
-				"solve this issue by disabling the module (`testcookie off;`) for requests under the path of `/.well-known" +
-				"/acme-challenge/`.",
-			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Name: "CloudflareRedirectDropsChallengePath",
+			Code: ProblemCodeCloudflareRedirectDropsChallengePath,
+			Explanation: "The validation request to this domain was served by Cloudflare and was redirected to a URL " +
+				"which no longer contains the /.well-known/acme-challenge/ path, so the challenge file can never be found. " +
+				"This is usually caused by a Cloudflare Page Rule or Redirect Rule (e.g. a forwarding URL to the site root) " +
+				"combined with \"Always Use HTTPS\". Add a rule that excludes /.well-known/acme-challenge/* from " +
+				"redirection, or change the rule so that it preserves the request path.",
+			Detail:   fmt.Sprintf("The request to %s was redirected to: %s", res.IP.String(), res.FinalURL),
 			Severity: SeverityError,
 		})
 	}
 
-	if res := isHTTP497(allCheckResults); !res.IsZero() {
+	if res := isTemporarilyUnavailable(allCheckResults); !res.IsZero() {
+		retryAfter := "The server did not provide a Retry-After header."
+		if res.RetryAfterHeader != "" {
+			retryAfter = fmt.Sprintf("The server asked for requests to be retried after: %s", res.RetryAfterHeader)
+		}
 		probs = append(probs, Problem{
-			Name: "HttpOnHttpsPort",
-			Explanation: "A validation request to this domain resulted in an HTTP request being made to a port that expects " +
-				"to receive HTTPS requests. This could be the result of an incorrect redirect (such as to http://example.com:443/) " +
-				"or it could be the result of a webserver misconfiguration, such as trying to enable SSL on a port 80 virtualhost.",
-			Detail:   strings.Join(res.DialStack, "\n"),
-			Severity: SeverityError,
+			Name: "TemporarilyUnavailable",
+			Code: ProblemCodeTemporarilyUnavailable,
+			Explanation: fmt.Sprintf("A validation request to this domain received an HTTP %d response, which indicates that "+
+				"the server is temporarily unavailable (e.g. in maintenance mode or rate limiting requests). Validation will fail "+
+				"while this is the case, but this may be a transient issue rather than a permanent misconfiguration.", res.StatusCode),
+			Detail:   fmt.Sprintf("The server at %s produced this result. %s", res.IP.String(), retryAfter),
+			Severity: SeverityDebug,
 		})
 	}
 
-	if res := isLikelyPaloAltoFirewall(allCheckResults); !res.IsZero() {
+	if res := isOriginRateLimited(allCheckResults); !res.IsZero() {
+		retryAfter := "The server did not provide a Retry-After header."
+		if res.RetryAfterHeader != "" {
+			retryAfter = fmt.Sprintf("The server asked for requests to be retried after: %s", res.RetryAfterHeader)
+		}
 		probs = append(probs, Problem{
-			Name: "BlockedByFirewall",
-			Explanation: "The validation request to this domain was blocked by what is likely a " +
-				"Palto Alto web application firewall device. The 'acme-protocol' application needs " +
-				"to be permitted on the firewall in order for the request to succeed. See " +
-				"https://community.letsencrypt.org/t/177600 for more information.",
-			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Name: "OriginRateLimiting",
+			Code: ProblemCodeOriginRateLimiting,
+			Explanation: "A validation request to this domain received an HTTP 429 (Too Many Requests) response, which means " +
+				"that the web server itself (or a firewall, proxy or CDN in front of it) is rate limiting requests. This is " +
+				"not one of Let's Encrypt's rate limits. Let's Encrypt makes several validation requests, from multiple " +
+				"locations, for each challenge, so validation may fail while the limit applies. Exempt " +
+				"/.well-known/acme-challenge/ from rate limiting.",
+			Detail:   fmt.Sprintf("The server at %s produced this result. %s", res.IP.String(), retryAfter),
 			Severity: SeverityError,
 		})
 	}
 
-	return probs, nil
-}
+	if ctx.httpPort != 80 {
+		probs = append(probs, nonStandardHTTPPort(domain, ctx.httpPort))
+	}
 
-func noRecords(name, rrSummary string) Problem {
-	return Problem{
-		Name: "NoRecords",
-		Explanation: fmt.Sprintf(`No valid A or AAAA records could be ultimately resolved for %s. `+
-			`This means that Let's Encrypt would not be able to to connect to your domain to perform HTTP validation, since `+
-			`it would not know where to connect to.`, name),
-		Detail:   rrSummary,
-		Severity: SeverityFatal,
+	if ctx.httpProxy != nil {
+		probs = append(probs, httpProxyInUse(domain, ctx.httpProxy))
 	}
-}
 
-func reservedAddress(name, address string) Problem {
-	return Problem{
-		Name: "ReservedAddress",
-		Explanation: fmt.Sprintf(`A private, inaccessible, IANA/IETF-reserved IP address was found for %s. Let's Encrypt will always fail HTTP validation `+
-			`for any domain that is pointing to an address that is not routable on the internet. You should either remove this address `+
-			`and replace it with a public one or use the DNS validation method instead.`, name),
-		Detail:   address,
-		Severity: SeverityFatal,
+	if ctx.keyAuthorization != "" {
+		probs = append(probs, checkKeyAuthorization(ctx, domain, allCheckResults)...)
 	}
-}
 
-func multipleIPAddressDiscrepancy(domain string, result1, result2 httpCheckResult) Problem {
-	return Problem{
+	if ctx.httpControlProbe && ctx.httpExpectResponse == "" && ctx.keyAuthorization == "" {
+		probs = append(probs, checkHTTPControlPath(ctx, domain, allCheckResults)...)
+	}
+
+	for _, res := range allCheckResults {
+		if !res.IsZero() {
+			// Only one server needs to be checked, since the servers are compared above
+			probs = append(probs, checkHTTPDirectoryListing(ctx, domain, res)...)
+			break
+		}
+	}
+
+	probs = append(probs, checkHTTPChallengePathHang(ctx, domain, allCheckResults)...)
+	probs = append(probs, checkHTTPChallengePathServerError(ctx, domain, allCheckResults)...)
+	probs = append(probs, checkHTTPPathStripped(ctx, domain, allCheckResults)...)
+	probs = append(probs, checkHTTPCertBasedRedirect(ctx, domain, allCheckResults)...)
+	probs = append(probs, checkHTTP10Only(ctx, domain, allCheckResults)...)
+
+	if ctx.httpHeadProbe {
+		probs = append(probs, checkHTTPHeadMethod(ctx, domain, allCheckResults)...)
+	}
+
+	if ctx.httpUserAgentProbe {
+		probs = append(probs, checkHTTPUserAgent(ctx, domain, allCheckResults)...)
+	}
+
+	if ctx.httpPathProbe {
+		probs = append(probs, checkHTTPPathVariants(ctx, domain, allCheckResults)...)
+	}
+
+	if ctx.httpRepeatProbe {
+		probs = append(probs, checkHTTPRepeatability(ctx, domain, allCheckResults)...)
+	}
+
+	if ctx.httpVirtualHostProbe {
+		probs = append(probs, checkHTTPVirtualHost(ctx, domain, allCheckResults)...)
+		probs = append(probs, checkHTTPTrailingDotHost(ctx, domain, allCheckResults)...)
+		probs = append(probs, checkHTTPHostCase(ctx, domain, allCheckResults)...)
+	}
+
+	if res := isChunkedTrailerIssue(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "ChunkedTrailerIssue",
+			Code: ProblemCodeChunkedTrailerIssue,
+			Explanation: "The response to the validation request used chunked transfer encoding with trailer headers, and " +
+				"its body could not be read completely. Strict HTTP clients (such as Let's Encrypt's) may reject such a " +
+				"response or see a truncated challenge token. Consider serving /.well-known/acme-challenge/ as a static file, " +
+				"or disabling trailers for it in the application server.",
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s", res.IP.String(), res.BodyError),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res := isCompressedChallengeResponse(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "CompressedChallengeResponse",
+			Code: ProblemCodeCompressedChallengeResponse,
+			Explanation: fmt.Sprintf(`The response to the validation request was compressed (Content-Encoding: %s). The `+
+				`challenge token should be served as plain, uncompressed text. Let's Encrypt does handle some compressed `+
+				`responses, but intermediaries or unusual encodings may cause validation to fail, so you may want to `+
+				`disable compression for the /.well-known/acme-challenge/ path.`, res.ContentEncoding),
+			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, contentType := isUnexpectedContentType(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "UnexpectedContentType",
+			Code: ProblemCodeUnexpectedContentType,
+			Explanation: fmt.Sprintf(`The validation request received a successful response with a Content-Type of %s. `+
+				`Let's Encrypt does not check the Content-Type, but challenge files served as static files are normally `+
+				`text/plain or application/octet-stream, so this suggests that the path is handled by an application or `+
+				`framework (e.g. a catch-all route) rather than served from the challenge directory.`, contentType),
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s", res.IP.String(), res.String()),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, disposition := isAttachmentResponse(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "AttachmentResponse",
+			Code: ProblemCodeAttachmentResponse,
+			Explanation: `The response to the validation request was served as a download (Content-Disposition: attachment). ` +
+				`Let's Encrypt ignores this header, so it does not affect validation by itself, but it suggests a blanket rule ` +
+				`for static files which also applies to /.well-known/acme-challenge/ and may interfere with how the challenge ` +
+				`files are served.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s\nContent-Disposition: %s", res.IP.String(), res.String(), disposition),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, altSvc := isAltSvcAdvertised(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "AltSvcAdvertised",
+			Code: ProblemCodeAltSvcAdvertised,
+			Explanation: `The response to the validation request included an Alt-Svc header, which advertises alternative ` +
+				`services (such as HTTP/3 or another host or port) for later requests, or clears them. Let's Encrypt ignores it, ` +
+				`and always validates with plain HTTP on port 80, but it shows that a CDN or edge with a complex configuration ` +
+				`is serving the challenge path.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s\nAlt-Svc: %s", res.IP.String(), res.String(), altSvc),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if notHTTP := isPort80NotSpeakingHTTP(allCheckResults); len(notHTTP) > 0 {
+		var symptoms []string
+		var ips []net.IP
+		for _, res := range notHTTP {
+			symptoms = append(symptoms, fmt.Sprintf("%s: %s", res.IP.String(), res.NotHTTP))
+			ips = append(ips, res.IP)
+		}
+		// The verdict replaces the empty or malformed reply reported for each of the addresses
+		probs, _ = supersedeAddressProblems(probs, ips, addressProbs, ProblemCodeEmptyReply, ProblemCodeMalformedHttpResponse)
+		probs = append(probs, Problem{
+			Name: "Port80NotSpeakingHttp",
+			Code: ProblemCodePort80NotSpeakingHttp,
+			Explanation: fmt.Sprintf(`The TCP connection to port %d of %s succeeded, but whatever accepted it does not speak `+
+				`HTTP: it closed or reset the connection without a response, or answered with something which isn't HTTP. `+
+				`This is different from a closed port (which refuses the connection) or a firewall (which lets it time out), `+
+				`and usually means that a TCP load balancer, port forward or NAT rule is sending port %d to a backend which is `+
+				`down or isn't a web server. Check where port %d is forwarded to, and that a web server is listening there.`,
+				ctx.httpPort, domain, ctx.httpPort, ctx.httpPort),
+			Detail:   strings.Join(symptoms, "\n"),
+			Severity: SeverityError,
+		})
+	}
+
+	// managedPlatformChecker reports the platforms which the DNS identifies
+	if platform, _ := managedPlatformFromDNS(ctx, domain); platform == "" {
+		for _, res := range allCheckResults {
+			if platform, header := managedPlatformFromHeaders(res.Headers); platform != "" {
+				probs = append(probs, managedPlatform(domain, platform, header))
+				break
+			}
+		}
+	}
+
+	if res, hsts := isHSTSAdvertised(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "HSTSNotAnIssue",
+			Code: ProblemCodeHSTSNotAnIssue,
+			Explanation: `The response to the validation request included a Strict-Transport-Security (HSTS) header. HSTS ` +
+				`(including preloading, and includeSubDomains on a parent domain) only makes browsers use HTTPS: Let's ` +
+				`Encrypt's HTTP-01 validation does not honor it, and always starts with a plain HTTP request to port 80, so ` +
+				`HSTS is not the cause of a validation failure. A browser refusing to load the site over HTTP is expected, ` +
+				`and does not mean that Let's Encrypt can't reach it.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s\nStrict-Transport-Security: %s", res.IP.String(), res.String(), hsts),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, hints := isEdgeHints(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "EdgeHints",
+			Code: ProblemCodeEdgeHints,
+			Explanation: `The response to the validation request was accompanied by 103 Early Hints interim responses or ` +
+				`Link: rel=preload hints. Let's Encrypt ignores these, so they don't affect validation by themselves, but ` +
+				`they show that a CDN or HTTP/2 edge is doing non-trivial processing of the challenge path, which may be ` +
+				`worth ruling out if validation fails for some clients but not others.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s\n%s", res.IP.String(), res.String(), hints),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, target := isClientSideRedirect(allCheckResults); !res.IsZero() {
+		if target == "" {
+			target = "(unknown)"
+		}
+		probs = append(probs, Problem{
+			Name: "ClientSideRedirect",
+			Code: ProblemCodeClientSideRedirect,
+			Explanation: `The validation request received an HTTP 200 response containing an HTML meta refresh or a ` +
+				`JavaScript redirect. Let's Encrypt does not follow these (it doesn't render HTML or run JavaScript), so ` +
+				`this won't redirect it anywhere; instead, the response is this HTML page rather than the challenge token. ` +
+				`This is typical of a "redirect to HTTPS" done by a CMS plugin or theme. Serve the challenge files ` +
+				`directly, or redirect with an HTTP 301/302 from the web server instead.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s\nRedirect target: %s", res.IP.String(), res.String(), target),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res := isEmptyChallengeResponse(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "EmptyChallengeResponse",
+			Code: ProblemCodeEmptyChallengeResponse,
+			Explanation: `The validation request received an HTTP 200 response with an empty body. The challenge path is ` +
+				`reachable, but no content is served for it, which suggests that the server answers any request under ` +
+				`/.well-known/acme-challenge/ (e.g. with a catch-all rule or an empty file) rather than serving the token ` +
+				`file. This is harmless for the test path requested here, but if the real token also produces an empty ` +
+				`response, validation will fail.`,
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s", res.IP.String(), res.String()),
+			Severity: SeverityDebug,
+		})
+	}
+
+	// Cloudflare's own redirect rules are reported more specifically above
+	if res := isChallengePathDropped(allCheckResults); !res.IsZero() && isCloudflareDroppedChallengePath(allCheckResults).IsZero() {
+		probs = append(probs, Problem{
+			Name: "RedirectDropsChallengePath",
+			Code: ProblemCodeRedirectDropsChallengePath,
+			Explanation: `A redirect which was followed during the validation request did not preserve the ` +
+				`/.well-known/acme-challenge/ path, so Let's Encrypt ends up requesting a different page (often the home page) ` +
+				`instead of the challenge file. Redirects must keep the full path, e.g. from ` +
+				`http://www.example.com/.well-known/acme-challenge/token to https://example.com/.well-known/acme-challenge/token. ` +
+				`Check the redirect rules of your web server or CDN, or exclude the ACME challenge path from them.`,
+			Detail:   fmt.Sprintf("The server at %s redirected: %s", res.IP.String(), res.ChallengePathDroppedAt),
+			Severity: SeverityError,
+		})
+	}
+
+	if res := isCrossDomainRedirect(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "CrossDomainRedirect",
+			Code: ProblemCodeCrossDomainRedirect,
+			Explanation: fmt.Sprintf(`The validation request to %s was redirected to a different Registered Domain (%s). `+
+				`Let's Encrypt will follow the redirect, so the challenge file must be served by that other website. `+
+				`If this is not intended, make sure that the /.well-known/acme-challenge/ path is not redirected away.`,
+				domain, res.CrossDomainRedirect),
+			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res := isDifferentlyEncodedRedirect(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "IDNRedirectEncodingMismatch",
+			Code: ProblemCodeIDNRedirectEncodingMismatch,
+			Explanation: fmt.Sprintf(`The validation request to %s was redirected to %s, which is the same domain written `+
+				`in a different encoding (Unicode rather than punycode, or the other way around). Both are treated as the `+
+				`same host, but software which compares them literally (as some proxies and applications do) may treat the `+
+				`redirect as going to a different site, or into a redirect loop. Consider redirecting to the punycode `+
+				`(A-label) form of the domain, which is what Let's Encrypt requests.`, domain, res.DifferentlyEncodedRedirect),
+			Detail: fmt.Sprintf("The server at %s produced this result.\nRequested host (A-label): %s",
+				res.IP.String(), toASCIIDomain(domain)),
+			Severity: SeverityWarning,
+		})
+	}
+
+	if res := isLikelyModemRouter(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "PortForwarding",
+			Code: ProblemCodePortForwarding,
+			Explanation: "A request to your domain revealed that the web server that responded may be " +
+				"the administrative interface of a modem or router. This can indicate an issue with the port forwarding " +
+				"setup on that modem or router. You may need to reconfigure the device to properly forward traffic to your " +
+				"intended webserver.",
+			Detail: fmt.Sprintf(`The web server that responded identified itself as "%s", `+
+				"which is a known webserver commonly used by modems/routers.", res.ServerHeader),
+			Severity: SeverityWarning,
+		})
+	}
+
+	if res := isLikelyNginxTestcookie(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "BlockedByNginxTestCookie",
+			Code: ProblemCodeBlockedByNginxTestCookie,
+			Explanation: "The validation request to this domain was blocked by a deployment of the nginx " +
+				"testcookie module (https://github.com/kyprizel/testcookie-nginx-module). This module is designed to " +
+				"block robots, and causes the Let's Encrypt validation process to fail. The server administrator can " +
+				"solve this issue by disabling the module (`testcookie off;`) for requests under the path of `/.well-known" +
+				"/acme-challenge/`.",
+			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Severity: SeverityError,
+		})
+	}
+
+	if res := isHTTP497(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "HttpOnHttpsPort",
+			Code: ProblemCodeHttpOnHttpsPort,
+			Explanation: "A validation request to this domain resulted in an HTTP request being made to a port that expects " +
+				"to receive HTTPS requests. This could be the result of an incorrect redirect (such as to http://example.com:443/) " +
+				"or it could be the result of a webserver misconfiguration, such as trying to enable SSL on a port 80 virtualhost.",
+			Detail:   strings.Join(res.DialStack, "\n"),
+			Severity: SeverityError,
+		})
+	}
+
+	if res := isLikelyPaloAltoFirewall(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "BlockedByFirewall",
+			Code: ProblemCodeBlockedByFirewall,
+			Explanation: "The validation request to this domain was blocked by what is likely a " +
+				"Palto Alto web application firewall device. The 'acme-protocol' application needs " +
+				"to be permitted on the firewall in order for the request to succeed. See " +
+				"https://community.letsencrypt.org/t/177600 for more information.",
+			Detail:   fmt.Sprintf("The server at %s produced this result.", res.IP.String()),
+			Severity: SeverityError,
+		})
+	}
+
+	if res := isLocationWithoutRedirect(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "LocationWithoutRedirect",
+			Code: ProblemCodeLocationWithoutRedirect,
+			Explanation: fmt.Sprintf("A validation request to this domain returned an HTTP %d response that also included a "+
+				"Location header. Since the response is not a redirect, the Location header is ignored by Let's Encrypt. "+
+				"This is an unusual configuration, and often indicates that a rule which was intended to redirect the "+
+				"request is not setting the correct status code.", res.StatusCode),
+			Detail:   fmt.Sprintf("The server at %s responded with Location: %s", res.IP.String(), res.LocationHeader),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, server := isDefaultWebserverPage(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "DefaultWebserverPage",
+			Code: ProblemCodeDefaultWebserverPage,
+			Explanation: "A validation request to this domain was answered with the default welcome page of a freshly " +
+				"installed web server, rather than with the contents of a file. This indicates that the web server " +
+				"has not yet been configured to serve this domain, or the /.well-known/acme-challenge/ directory. " +
+				"Validation will fail until the server (or your ACME client's webroot) is set up for this domain.",
+			Detail:   fmt.Sprintf("The server at %s responded with the default page of: %s", res.IP.String(), server),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, lb := isLikelyLoadBalancerNoBackend(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "LoadBalancerNoBackend",
+			Code: ProblemCodeLoadBalancerNoBackend,
+			Explanation: fmt.Sprintf("A validation request to this domain received an HTTP %d response which appears to have "+
+				"been generated by a load balancer (%s), rather than by a web server behind it. This usually means that the load "+
+				"balancer has no routing rule for /.well-known/acme-challenge/ and is falling through to a default action, or "+
+				"that the backend servers are unhealthy. Add a rule which routes the ACME challenge path to the server "+
+				"running your ACME client.", res.StatusCode, lb),
+			Detail:   fmt.Sprintf(`The server at %s identified itself as "%s".`, res.IP.String(), res.ServerHeader),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, waf, ref := isWAFBlockPage(allCheckResults); !res.IsZero() {
+		detail := fmt.Sprintf("The server at %s responded with HTTP %d, and a block page from: %s", res.IP.String(), res.StatusCode, waf)
+		if ref != "" {
+			detail += fmt.Sprintf(" (reference ID: %s)", ref)
+		}
+		probs = append(probs, Problem{
+			Name: "WafBlockingChallenge",
+			Code: ProblemCodeWafBlockingChallenge,
+			Explanation: fmt.Sprintf("A validation request to this domain was blocked by a web application firewall (%s). "+
+				"Firewall rules sometimes block requests for paths beginning with a dot, or the User-Agent of automated "+
+				"clients like Let's Encrypt. Add an exception to the firewall for /.well-known/acme-challenge/, or tune the "+
+				"rule that was triggered (the firewall's logs will identify it by the reference ID, if there is one).", waf),
+			Detail:   detail,
+			Severity: SeverityError,
+		})
+	}
+
+	if res, signal := isPossibleGeoBlocking(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "PossibleGeoBlocking",
+			Code: ProblemCodePossibleGeoBlocking,
+			Explanation: "A validation request to this domain appears to have been refused because of the country or network " +
+				"that it came from. Let's Encrypt validates from multiple locations around the world, which are unlikely to " +
+				"match your own, so any geographic or network-based blocking (in a firewall, CDN or web server) must allow " +
+				"requests to /.well-known/acme-challenge/ from anywhere.",
+			Detail:   fmt.Sprintf("The server at %s responded with HTTP %d. Signal: %s", res.IP.String(), res.StatusCode, signal),
+			Severity: SeverityDebug,
+		})
+	}
+
+	if res, host := isMisdirectedRequest(domain, allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "MisdirectedRequest",
+			Code: ProblemCodeMisdirectedRequest,
+			Explanation: "A validation request to this domain was answered with HTTP 421 Misdirected Request, which means that " +
+				"the server is not willing to serve the requested Host on that connection. This is common with reverse proxies " +
+				"which strictly match the virtual host (or TLS SNI) and will prevent Let's Encrypt from validating the domain. " +
+				"Make sure that the server (or the proxy in front of it) has a virtual host configured for this domain.",
+			Detail:   fmt.Sprintf("The server at %s responded with HTTP 421 for Host: %s", res.IP.String(), host),
+			Severity: SeverityError,
+		})
+	}
+
+	if res, headers := isCachedChallengeResponse(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "ChallengeResponseCached",
+			Code: ProblemCodeChallengeResponseCached,
+			Explanation: "The response to the validation request appears to have been served from a cache (such as a CDN). " +
+				"Challenge tokens are unique to every validation attempt, so a cached response (such as an old token or a " +
+				"cached 404 page) may cause validation to fail. Make sure that caching is bypassed for the " +
+				"/.well-known/acme-challenge/ path.",
+			Detail:   fmt.Sprintf("The server at %s responded with: %s", res.IP.String(), strings.Join(headers, ", ")),
+			Severity: SeverityDebug,
+		})
+	}
+
+	underAttack, signal := isCloudflareUnderAttackMode(allCheckResults)
+	if !underAttack.IsZero() {
+		probs = append(probs, Problem{
+			Name: "CloudflareUnderAttackMode",
+			Code: ProblemCodeCloudflareUnderAttackMode,
+			Explanation: `A validation request to this domain was answered with Cloudflare's JavaScript challenge page, ` +
+				`which is shown by the "I'm Under Attack" mode (or a bot protection rule). Let's Encrypt cannot solve this ` +
+				`challenge, so validation will fail. In the Cloudflare dashboard, create a rule which sets the Security Level ` +
+				`to "Essentially Off" (or skips the challenge) for the /.well-known/acme-challenge/* path, or disable ` +
+				`"I'm Under Attack" mode while the certificate is issued.`,
+			Detail:   fmt.Sprintf("The server at %s responded with HTTP %d (%s)", underAttack.IP.String(), underAttack.StatusCode, signal),
+			Severity: SeverityError,
+		})
+	}
+
+	// The Cloudflare interstitial would also be reported as a captcha page
+	if res, signal := isRedirectToLogin(allCheckResults); !res.IsZero() && underAttack.IsZero() {
+		probs = append(probs, Problem{
+			Name: "RedirectToLogin",
+			Code: ProblemCodeRedirectToLogin,
+			Explanation: "A validation request to this domain was sent to a login or captcha page, which Let's Encrypt " +
+				"cannot get past. This is usually caused by a hosting control panel (e.g. cPanel or Plesk), a CMS security " +
+				"plugin, or a bot protection service which requires unknown visitors to authenticate. Exclude the " +
+				"/.well-known/acme-challenge/ path from the login or bot protection rule.",
+			Detail:   fmt.Sprintf("The request to %s ended at %s (%s)", res.IP.String(), res.FinalURL, signal),
+			Severity: SeverityError,
+		})
+	}
+
+	if res, scheme := isIntegratedAuthRequired(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "IntegratedAuthRequired",
+			Code: ProblemCodeIntegratedAuthRequired,
+			Explanation: fmt.Sprintf(`A validation request to this domain received an HTTP 401 response asking for %s `+
+				`authentication, which means that Integrated Windows Authentication is required for the challenge path. `+
+				`Let's Encrypt cannot authenticate, so validation will fail. In IIS Manager, select the `+
+				`/.well-known/acme-challenge/ directory, open Authentication, enable Anonymous Authentication and disable `+
+				`Windows Authentication for it.`, scheme),
+			Detail:   fmt.Sprintf("The server at %s produced this result: %s", res.IP.String(), res.String()),
+			Severity: SeverityError,
+		})
+	}
+
+	if res := isLikelyIISHandlerIssue(allCheckResults); !res.IsZero() {
+		probs = append(probs, Problem{
+			Name: "IISChallengeHandler",
+			Code: ProblemCodeIISChallengeHandler,
+			Explanation: fmt.Sprintf("A validation request to this domain was served by Microsoft IIS, which responded with "+
+				"HTTP %d. ACME challenge files have no file extension, which IIS refuses to serve by default. Add a "+
+				"web.config to the /.well-known/acme-challenge/ directory which adds a MIME map for extensionless files "+
+				`(<mimeMap fileExtension="." mimeType="text/plain" />) and which uses the StaticFile handler for all `+
+				"requests, so that the challenge is not handled by another module (e.g. ASP.NET or URL Rewrite).", res.StatusCode),
+			Detail:   fmt.Sprintf(`The server at %s identified itself as "%s".`, res.IP.String(), res.ServerHeader),
+			Severity: SeverityError,
+		})
+	}
+
+	if prob := vantageNotNeutral(ctx, domain, allCheckResults, probs); !prob.IsZero() {
+		probs = append(probs, prob)
+	}
+
+	return probs, nil
+}
+
+// vantageNotNeutral notes, when every validation request succeeded from a vantage point which isn't
+// known to be neutral, that access controls scoped to the scanner's source address would not have
+// been visible. Requests made through an HTTP proxy don't come from the scanner's own address.
+func vantageNotNeutral(ctx *scanContext, domain string, results []httpCheckResult, probs []Problem) Problem {
+	if ctx.neutralVantage || len(ctx.vantagePoints) > 0 || ctx.httpProxy != nil {
+		return Problem{}
+	}
+	for _, prob := range probs {
+		if severityRank[prob.Severity] <= severityRank[SeverityError] {
+			return Problem{}
+		}
+	}
+
+	var sources []string
+	var shared bool
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		source := localSourceAddress(res.IP)
+		if source == nil {
+			continue
+		}
+		line := fmt.Sprintf("Requests to %s were made from %s", res.IP, source)
+		if sameNetwork(source, res.IP) {
+			line += " (the same network)"
+			shared = true
+		}
+		sources = append(sources, line)
+	}
+	if len(sources) == 0 {
+		return Problem{}
+	}
+
+	explanation := fmt.Sprintf(`The validation requests to %s succeeded, but only from the network that Let's Debug is `+
+		`running in. If the server is protected by access controls based on the source address (such as a firewall rule, `+
+		`security group or web server allow list which only permits your own IP address), Let's Encrypt's validation `+
+		`servers may be blocked even though these requests were not. Check that port 80 is open to the whole Internet, `+
+		`or run Let's Debug from an unrelated network (such as letsdebug.net).`, domain)
+	if shared {
+		explanation += ` Let's Debug may be running on the same network as the server, in which case its requests ` +
+			`may have been allowed by rules which don't apply to requests from the Internet.`
+	}
+	return debugProblem(ProblemCodeVantageNotNeutral, explanation, strings.Join(sources, "\n"))
+}
+
+// localSourceAddress returns the local address that connections to address are made from, or nil.
+// Connecting a UDP socket only selects the route, and sends nothing.
+func localSourceAddress(address net.IP) net.IP {
+	conn, err := net.Dial("udp", net.JoinHostPort(address.String(), "80"))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// sameNetwork reports whether a and b are in the same IPv4 /24 or IPv6 /64.
+func sameNetwork(a, b net.IP) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		return a4 != nil && b4 != nil && a4.Mask(net.CIDRMask(24, 32)).Equal(b4.Mask(net.CIDRMask(24, 32)))
+	}
+	return a.Mask(net.CIDRMask(64, 128)).Equal(b.Mask(net.CIDRMask(64, 128)))
+}
+
+// multiPerspectiveChecker repeats the HTTP validation request from each configured
+// vantage point, and reports when an address is only reachable from some of them.
+type multiPerspectiveChecker struct{}
+
+type vantagePointResult struct {
+	VantagePoint string
+	StatusCode   int
+	Error        error
+}
+
+func (r vantagePointResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("%s: %v", r.VantagePoint, r.Error)
+	}
+	return fmt.Sprintf("%s: HTTP %d", r.VantagePoint, r.StatusCode)
+}
+
+// localVantagePoint makes requests directly from the host running letsdebug. It is always included, so
+// that even a single configured vantage point has something to be compared to.
+var localVantagePoint VantagePoint = proxyVantagePoint{name: "letsdebug"}
+
+func (c multiPerspectiveChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != HTTP01 || strings.HasPrefix(domain, "*.") || len(ctx.vantagePoints) == 0 {
+		return nil, errNotApplicable
+	}
+
+	var ips []net.IP
+	for _, rrType := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		rrs, _ := ctx.Lookup(domain, rrType)
+		for _, rr := range rrs {
+			var ip net.IP
+			switch v := rr.(type) {
+			case *dns.AAAA:
+				ip = v.AAAA
+			case *dns.A:
+				ip = v.A
+			default:
+				continue
+			}
+			// Reported by dnsAChecker, and never requested from any vantage point
+			if sensitiveAddressReason(ip) != "" {
+				continue
+			}
+			// Reported by httpAccessibilityChecker; the local vantage point would reach this host instead
+			if isSelfAddress(ip) {
+				continue
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, errNotApplicable
+	}
+
+	vantagePoints := append([]VantagePoint{localVantagePoint}, ctx.vantagePoints...)
+
+	var probs []Problem
+	var debug []string
+
+	for _, ip := range ips {
+		results := make([]vantagePointResult, len(vantagePoints))
+
+		var wg sync.WaitGroup
+		wg.Add(len(vantagePoints))
+		for i, vp := range vantagePoints {
+			go func(i int, vp VantagePoint) {
+				defer wg.Done()
+				probeCtx, cancel := context.WithTimeout(ctx.Context(), httpTimeout*time.Second)
+				defer cancel()
+				code, err := vp.Probe(probeCtx, domain, ip, ctx.httpPort, "/.well-known/acme-challenge/"+ctx.httpRequestPath)
+				results[i] = vantagePointResult{VantagePoint: vp.Name(), StatusCode: code, Error: err}
+			}(i, vp)
+		}
+		wg.Wait()
+
+		var reachable, unreachable []string
+		for _, res := range results {
+			debug = append(debug, fmt.Sprintf("%s via %s", ip.String(), res.String()))
+			if res.Error != nil {
+				unreachable = append(unreachable, res.String())
+			} else {
+				reachable = append(reachable, res.String())
+			}
+		}
+
+		if len(reachable) > 0 && len(unreachable) > 0 {
+			probs = append(probs, multiPerspectiveDiscrepancy(domain, ip, reachable, unreachable))
+		}
+	}
+
+	probs = append(probs, debugProblem(ProblemCodeMultiPerspective, "Requests made to the domain from each vantage point",
+		strings.Join(debug, "\n")))
+
+	return probs, nil
+}
+
+func multiPerspectiveDiscrepancy(domain string, ip net.IP, reachable, unreachable []string) Problem {
+	return Problem{
+		Name: "MultiPerspectiveDiscrepancy",
+		Code: ProblemCodeMultiPerspectiveDiscrepancy,
+		Explanation: fmt.Sprintf(`The address %s for %s was reachable from some network locations but not from others. `+
+			`Let's Encrypt validates domains from multiple network perspectives, and validation will fail if the server `+
+			`cannot be reached from enough of them. This can be caused by firewalls, geographic blocking or routing issues.`,
+			ip.String(), domain),
+		Detail: fmt.Sprintf("Reachable from:\n%s\n\nNot reachable from:\n%s",
+			strings.Join(reachable, "\n"), strings.Join(unreachable, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+// checkHTTPControlPath makes a request for an unrelated, nonexistent path to each server, and reports
+// when the ACME challenge path is treated differently. Since neither path should exist, they
+// would normally produce the same response.
+func checkHTTPControlPath(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	controlPath := fmt.Sprintf("/letsdebug-control-%x", nonce)
+
+	var probs []Problem
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		control, _ := checkHTTPPath(ctx, domain, res.IP, controlPath, "")
+		if control.IsZero() || control.InitialStatusCode == res.InitialStatusCode {
+			continue
+		}
+		probs = append(probs, Problem{
+			Name: "ACMEPathIntercepted",
+			Code: ProblemCodeACMEPathIntercepted,
+			Explanation: fmt.Sprintf(`The server at %s responded differently to a request under /.well-known/acme-challenge/ `+
+				`than to a request for an unrelated path, even though neither should exist. This indicates that a web `+
+				`application firewall, CDN or web server rule is handling the ACME challenge path specially. If a `+
+				`certificate cannot be issued, check that this rule serves challenge files from the correct location.`,
+				res.IP.String()),
+			Detail: fmt.Sprintf("/.well-known/acme-challenge/%s: HTTP %d\n%s: HTTP %d",
+				ctx.httpRequestPath, res.InitialStatusCode, controlPath, control.InitialStatusCode),
+			Severity: SeverityDebug,
+		})
+	}
+	return probs
+}
+
+// checkHTTPPathStripped requests a distinct, random path from a server which answered the validation
+// request with content, and reports when the same content is served for both: a sign that a proxy is
+// discarding the request path and forwarding every request to the root of the backend.
+func checkHTTPPathStripped(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	for _, res := range results {
+		if res.StatusCode != http.StatusOK || len(bytes.TrimSpace(res.Content)) == 0 {
+			continue
+		}
+		// The expected response can't be a sign of the path being stripped
+		if content := strings.TrimRight(string(res.Content), " \t\r\n"); (ctx.keyAuthorization != "" && content == ctx.keyAuthorization) ||
+			(ctx.httpExpectResponse != "" && content == ctx.httpExpectResponse) {
+			return nil
+		}
+
+		nonce := make([]byte, 8)
+		_, _ = rand.Read(nonce)
+		randomPath := fmt.Sprintf("/letsdebug-path-%x/%x", nonce[:4], nonce[4:])
+		other, _ := checkHTTPPath(ctx, domain, res.IP, randomPath, "")
+		if other.StatusCode != http.StatusOK || !bytes.Equal(other.Content, res.Content) {
+			return nil
+		}
+
+		evidence := []string{
+			fmt.Sprintf("/.well-known/acme-challenge/%s: HTTP %d, %d bytes", ctx.httpRequestPath, res.StatusCode, len(res.Content)),
+			fmt.Sprintf("%s: HTTP %d, %d bytes (identical)", randomPath, other.StatusCode, len(other.Content)),
+		}
+		if root, _ := checkHTTPPath(ctx, domain, res.IP, "/", ""); root.StatusCode == http.StatusOK && bytes.Equal(root.Content, res.Content) {
+			evidence = append(evidence, fmt.Sprintf("/: HTTP %d, %d bytes (identical)", root.StatusCode, len(root.Content)))
+		}
+
+		return []Problem{{
+			Name: "ProxyStripsPath",
+			Code: ProblemCodeProxyStripsPath,
+			Explanation: fmt.Sprintf(`The server at %s served exactly the same content for the validation request as for an `+
+				`unrelated, random path. This means that the request path is being ignored: usually a reverse proxy (e.g. an `+
+				`nginx proxy_pass, Traefik or Apache ProxyPass rule) forwards every request to the root of the backend, or an `+
+				`application serves the same page for every path. Single-page applications and catch-all rewrite rules can `+
+				`still serve real files from /.well-known/acme-challenge/, but if the request path is being discarded, the `+
+				`challenge file can't be served and HTTP-01 validation will fail. Make sure that the proxy preserves the `+
+				`request path, or serve /.well-known/acme-challenge/ before the request reaches it.`, res.IP.String()),
+			Detail:   strings.Join(evidence, "\n"),
+			Severity: SeverityWarning,
+		}}
+	}
+	return nil
+}
+
+// httpRepeatCount is the number of times that the validation request is repeated to check that the
+// server answers it consistently
+const httpRepeatCount = 3
+
+// checkHTTPRepeatability repeats the validation request to the first server which responded, and
+// reports when the responses vary: a sign of a load-balanced backend where only some instances are
+// configured to serve the challenge. Rate limiting and overload responses are expected to come and go,
+// so they are not compared.
+func checkHTTPRepeatability(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	for _, res := range results {
+		if res.IsZero() || isTransientStatus(res.InitialStatusCode) {
+			continue
+		}
+
+		first := describeResponse(res)
+		responses := []string{first}
+		varied := false
+		for i := 0; i < httpRepeatCount && ctx.Context().Err() == nil; i++ {
+			again, _ := checkHTTP(ctx, domain, res.IP)
+			if isTransientStatus(again.InitialStatusCode) {
+				continue
+			}
+			description := describeResponse(again)
+			responses = append(responses, description)
+			if description != first {
+				varied = true
+			}
+		}
+		if !varied {
+			return nil
+		}
+
+		for i := range responses {
+			responses[i] = fmt.Sprintf("Request %d: %s", i+1, responses[i])
+		}
+		return []Problem{{
+			Name: "NonDeterministicOrigin",
+			Code: ProblemCodeNonDeterministicOrigin,
+			Explanation: fmt.Sprintf(`Identical validation requests to the server at %s received different responses. This `+
+				`usually means that the server is a load balancer in front of several backends, and that only some of them `+
+				`are configured to serve the challenge, so validation will succeed or fail depending on which backend answers `+
+				`each of Let's Encrypt's requests. Make sure that every backend serves /.well-known/acme-challenge/ the same `+
+				`way (e.g. from shared storage), or route that path to a single backend.`, res.IP.String()),
+			Detail:   strings.Join(responses, "\n"),
+			Severity: SeverityWarning,
+		}}
+	}
+	return nil
+}
+
+// isTransientStatus returns whether status is a response to a rate limited or overloaded request.
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// describeResponse summarises the parts of the response to a validation request which should not vary
+// between identical requests, ignoring those (such as dates and cookies) which are expected to.
+func describeResponse(res httpCheckResult) string {
+	if res.IsZero() {
+		return "no response"
+	}
+	description := fmt.Sprintf("HTTP %d", res.InitialStatusCode)
+	if res.NumRedirects > 0 {
+		description += fmt.Sprintf(" (final HTTP %d after %d redirects)", res.StatusCode, res.NumRedirects)
+	}
+	return fmt.Sprintf("%s, Server: %q", description, res.ServerHeader)
+}
+
+// checkHTTPDirectoryListing requests the challenge directory itself, and reports when the
+// server responds with a directory listing.
+func checkHTTPDirectoryListing(ctx *scanContext, domain string, res httpCheckResult) []Problem {
+	listing, _ := checkHTTPPath(ctx, domain, res.IP, "/.well-known/acme-challenge/", "")
+	if listing.StatusCode != http.StatusOK {
+		return nil
+	}
+	for _, needle := range directoryListingPayloads {
+		if !bytes.Contains(listing.Content, needle) {
+			continue
+		}
+		return []Problem{{
+			Name: "ChallengeDirectoryListing",
+			Code: ProblemCodeChallengeDirectoryListing,
+			Explanation: fmt.Sprintf(`The server at %s responds to a request for /.well-known/acme-challenge/ with a directory `+
+				`listing, which means that the directory exists and that directory indexes are enabled. This does not affect `+
+				`validation, but the challenge file itself must still be served (as a plain file, not a listing) when Let's `+
+				`Encrypt requests it. You may want to disable directory indexes for this directory.`, res.IP.String()),
+			Detail:   fmt.Sprintf("The response contained %q", needle),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// checkHTTPHeadMethod repeats the validation request for each responding address using HEAD, and
+// reports when the response differs materially from the response to GET.
+func checkHTTPHeadMethod(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	var probs []Problem
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		head, _ := checkHTTPPathWithMethod(ctx, domain, res.IP, http.MethodHead,
+			"/.well-known/acme-challenge/"+ctx.httpRequestPath, "")
+		if head.IsZero() || !isMaterialStatusDifference(res.InitialStatusCode, head.InitialStatusCode) {
+			continue
+		}
+		probs = append(probs, Problem{
+			Name: "HEADRequestDiscrepancy",
+			Code: ProblemCodeHEADRequestDiscrepancy,
+			Explanation: fmt.Sprintf(`The server at %s responded differently to a HEAD request for the ACME challenge path `+
+				`than to a GET request. Let's Encrypt only uses GET, so this does not affect validation, but it suggests that `+
+				`a proxy, firewall or web server rule is sensitive to the request method, which may be fragile.`, res.IP.String()),
+			Detail:   fmt.Sprintf("GET: HTTP %d\nHEAD: HTTP %d", res.InitialStatusCode, head.InitialStatusCode),
+			Severity: SeverityDebug,
+		})
+	}
+	return probs
+}
+
+// checkHTTPUserAgent repeats a failed validation request with the User-Agent of a web browser, and
+// reports when that succeeds, since it means that the server (or a bot protection service in front
+// of it) filters requests by User-Agent and may refuse Let's Encrypt's requests too.
+func checkHTTPUserAgent(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	for _, res := range results {
+		if res.IsZero() || res.StatusCode < http.StatusBadRequest {
+			continue
+		}
+		browser, _ := checkHTTPPathWithUserAgent(ctx, domain, res.IP, http.MethodGet, browserUserAgent,
+			"/.well-known/acme-challenge/"+ctx.httpRequestPath, "")
+		if browser.IsZero() || browser.StatusCode >= http.StatusBadRequest {
+			continue
+		}
+		return []Problem{{
+			Name: "UserAgentFiltering",
+			Code: ProblemCodeUserAgentFiltering,
+			Explanation: fmt.Sprintf(`The server at %s refused the validation request, but responded successfully when the `+
+				`same request was made with the User-Agent of a web browser. This suggests that the server, or a bot protection `+
+				`feature of a CDN or firewall in front of it, is filtering requests by User-Agent, which may block Let's Encrypt `+
+				`as well. Exclude /.well-known/acme-challenge/ from bot protection.`, res.IP.String()),
+			Detail:   fmt.Sprintf("Default User-Agent: %s\nBrowser User-Agent: %s", res.String(), browser.String()),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// checkHTTPPathVariants repeats the validation request to the first responding address with a trailing
+// slash and with a query string appended to the path, and reports when the responses differ. Let's
+// Encrypt never requests either, but a difference reveals rewrite rules which only match a narrow
+// pattern of path, and which may also not match real challenge tokens.
+func checkHTTPPathVariants(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	path := "/.well-known/acme-challenge/" + ctx.httpRequestPath
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		var diverged []string
+		for _, variant := range []string{path + "/", path + "?letsdebug=1"} {
+			other, _ := checkHTTPPath(ctx, domain, res.IP, variant, "")
+			if other.InitialStatusCode != res.InitialStatusCode || other.StatusCode != res.StatusCode ||
+				other.ServerHeader != res.ServerHeader {
+				diverged = append(diverged, fmt.Sprintf("%s: %s", variant, other.String()))
+			}
+		}
+		if len(diverged) == 0 {
+			return nil
+		}
+		return []Problem{{
+			Name: "FragileRewriteRule",
+			Code: ProblemCodeFragileRewriteRule,
+			Explanation: fmt.Sprintf(`The server at %s responded differently to the validation request when a trailing slash `+
+				`or a query string was added to the path. Let's Encrypt requests the path exactly, so this does not affect `+
+				`validation by itself, but it suggests that a rewrite rule for /.well-known/acme-challenge/ matches a narrow `+
+				`pattern, which may not match real challenge tokens either.`, res.IP.String()),
+			Detail:   fmt.Sprintf("%s: %s\n%s", path, res.String(), strings.Join(diverged, "\n")),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// vhostProbeHost is a Host header which no web server should have a virtual host for
+const vhostProbeHost = "letsdebug-vhost-probe.invalid"
+
+// checkHTTPVirtualHost repeats the validation request to the first responding address with an
+// unrelated Host header, and reports when the response is identical, which suggests that port 80
+// serves a single default virtual host rather than routing by name to the domain's site.
+func checkHTTPVirtualHost(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		other, _ := checkHTTPPath(ctx, vhostProbeHost, res.IP, "/.well-known/acme-challenge/"+ctx.httpRequestPath, "")
+		if other.IsZero() || other.InitialStatusCode != res.InitialStatusCode || other.StatusCode != res.StatusCode ||
+			other.ServerHeader != res.ServerHeader || !bytes.Equal(other.Content, res.Content) {
+			return nil
+		}
+		// A landing page for any name means that the domain has no virtual host at all
+		if server := landingPageServer(res); server != "" {
+			return []Problem{{
+				Name: "NameBasedVhostMissing",
+				Code: ProblemCodeNameBasedVhostMissing,
+				Explanation: fmt.Sprintf(`The server at %s answers the validation request for %s with the same %s default `+
+					`page as a request for an unrelated name, so there is no port 80 virtual host for %s and requests fall `+
+					`through to the default one. This is commonly caused by a reverse proxy or web server which only `+
+					`selects virtual hosts by SNI on port 443; plain HTTP on port 80 has no SNI, so the Host header must be `+
+					`matched instead. Add a port 80 virtual host (or server_name / binding) for %s.`,
+					res.IP.String(), domain, server, domain, domain),
+				Detail:   fmt.Sprintf("%s: %s\n%s: %s", domain, res.String(), vhostProbeHost, other.String()),
+				Severity: SeverityError,
+			}}
+		}
+		return []Problem{{
+			Name: "DefaultVirtualHost",
+			Code: ProblemCodeDefaultVirtualHost,
+			Explanation: fmt.Sprintf(`The server at %s responds identically to the validation request for %s and to a request `+
+				`for an unrelated name, which suggests that port 80 serves a single default virtual host regardless of the Host `+
+				`header. HTTP validation relies on name-based virtual hosting on port 80 (there is no SNI for plain HTTP), so if `+
+				`this is shared hosting or a proxy, make sure that a port 80 virtual host is configured for %s itself.`,
+				res.IP.String(), domain, domain),
+			Detail:   fmt.Sprintf("%s: %s\n%s: %s", domain, res.String(), vhostProbeHost, other.String()),
+			Severity: SeverityWarning,
+		}}
+	}
+	return nil
+}
+
+// checkHTTPTrailingDotHost repeats the validation request to the first responding address with the
+// fully-qualified Host header (with a trailing dot), and reports when the response differs. Let's
+// Encrypt never sends the trailing dot, but a difference reveals fragile virtual host matching.
+func checkHTTPTrailingDotHost(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		fqdn, _ := checkHTTPPath(ctx, domain+".", res.IP, "/.well-known/acme-challenge/"+ctx.httpRequestPath, "")
+		if fqdn.IsZero() || (fqdn.InitialStatusCode == res.InitialStatusCode && fqdn.StatusCode == res.StatusCode &&
+			fqdn.ServerHeader == res.ServerHeader) {
+			return nil
+		}
+		return []Problem{{
+			Name: "HostHeaderSensitivity",
+			Code: ProblemCodeHostHeaderSensitivity,
+			Explanation: fmt.Sprintf(`The server at %s responds differently when the Host header is %s. (with a trailing dot) `+
+				`than when it is %s. Let's Encrypt sends the Host header without a trailing dot, so this does not affect `+
+				`validation, but it suggests that the virtual host configuration matches names in a fragile way.`,
+				res.IP.String(), domain, domain),
+			Detail:   fmt.Sprintf("%s: %s\n%s.: %s", domain, res.String(), domain, fqdn.String()),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// checkHTTPHostCase repeats the validation request to the first responding address with the Host
+// header in a different case, and reports when the response differs. Host names are case-insensitive,
+// but virtual hosts matched by a regular expression (such as nginx's "server_name ~^...$") may not be.
+func checkHTTPHostCase(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	// Let's Encrypt sends the Host header in lowercase; when the domain already is, any other case
+	// reveals the same sensitivity
+	variant := strings.ToLower(domain)
+	if variant == domain {
+		variant = strings.ToUpper(domain)
+	}
+	if variant == domain {
+		return nil
+	}
+
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		other, _ := checkHTTPPath(ctx, variant, res.IP, "/.well-known/acme-challenge/"+ctx.httpRequestPath, "")
+		if other.IsZero() || (other.InitialStatusCode == res.InitialStatusCode && other.StatusCode == res.StatusCode &&
+			other.ServerHeader == res.ServerHeader) {
+			return nil
+		}
+		return []Problem{{
+			Name: "CaseSensitiveVhost",
+			Code: ProblemCodeCaseSensitiveVhost,
+			Explanation: fmt.Sprintf(`The server at %s responds differently when the Host header is %s than when it is %s. `+
+				`Host names are case-insensitive, but this server's virtual host matching is not, which is usually caused by `+
+				`a regular expression server_name (or similar) without case-insensitive matching. Let's Encrypt sends the `+
+				`Host header in lowercase, so make sure that the virtual host which serves the challenge matches it.`,
+				res.IP.String(), variant, domain),
+			Detail:   fmt.Sprintf("%s: %s\n%s: %s", domain, res.String(), variant, other.String()),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// checkHTTPChallengePathHang makes a request for the root path to each server whose validation request
+// timed out, and reports when that is answered, since it means that the server is up but that whatever
+// handles /.well-known/acme-challenge/ hangs.
+func checkHTTPChallengePathHang(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	var probs []Problem
+	for _, res := range results {
+		// A timeout caused by the scan deadline would affect the root path too, and one while connecting
+		// (e.g. to a firewalled port) would affect every path
+		if !res.TimedOut || !res.Connected || ctx.Context().Err() != nil {
+			continue
+		}
+		root, _ := checkHTTPPath(ctx, domain, res.IP, "/", "")
+		if root.IsZero() || root.TimedOut {
+			continue
+		}
+		probs = append(probs, Problem{
+			Name: "ChallengePathHangs",
+			Code: ProblemCodeChallengePathHangs,
+			Explanation: fmt.Sprintf(`The validation request to %s timed out, but a request for / on the same server was `+
+				`answered promptly. This means that the server is reachable, but that the handler or route for `+
+				`/.well-known/acme-challenge/ blocks (for example an application route, proxy rule or script which never `+
+				`responds). Serve /.well-known/acme-challenge/ as static files, or fix the handler which serves it.`,
+				res.IP.String()),
+			Detail:   fmt.Sprintf("/: %s", root.String()),
+			Severity: SeverityError,
+		})
+	}
+	return probs
+}
+
+// checkHTTPChallengePathServerError makes a request for the root path to each server which answered
+// the validation request with a 5xx status, and reports when that is not also a server error, since it
+// means that the server is working, but that whatever handles /.well-known/acme-challenge/ is broken.
+func checkHTTPChallengePathServerError(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	var probs []Problem
+	for _, res := range results {
+		if res.IsZero() || res.StatusCode < http.StatusInternalServerError || ctx.Context().Err() != nil {
+			continue
+		}
+		root, _ := checkHTTPPath(ctx, domain, res.IP, "/", "")
+		if root.IsZero() || root.StatusCode >= http.StatusInternalServerError {
+			continue
+		}
+		probs = append(probs, Problem{
+			Name: "ChallengePathServerError",
+			Code: ProblemCodeChallengePathServerError,
+			Explanation: fmt.Sprintf(`The validation request to %s failed with HTTP %d, but a request for / on the same `+
+				`server received HTTP %d. This means that the server itself is working, but that the handler for `+
+				`/.well-known/acme-challenge/ is broken (for example a rewrite rule which passes the challenge path to an `+
+				`application or script that crashes). Check the server's error log, and serve /.well-known/acme-challenge/ `+
+				`as static files.`, res.IP.String(), res.StatusCode, root.StatusCode),
+			Detail:   fmt.Sprintf("/.well-known/acme-challenge/%s: %s\n/: %s", ctx.httpRequestPath, res.String(), root.String()),
+			Severity: SeverityError,
+		})
+	}
+	return probs
+}
+
+// checkHTTPCertBasedRedirect inspects the certificate which a server presents for the domain, when the
+// validation request was redirected to a different hostname, and reports when that hostname is one that
+// the certificate covers but the domain isn't: a sign of a proxy which redirects to the name on its
+// certificate rather than to the requested Host.
+func checkHTTPCertBasedRedirect(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	if ctx.httpProxy != nil || ctx.Context().Err() != nil {
+		return nil
+	}
+	for _, res := range results {
+		if res.FirstRedirect == "" {
+			continue
+		}
+		target, err := url.Parse(res.FirstRedirect)
+		if err != nil || target.Hostname() == "" || strings.EqualFold(normalizeFqdn(target.Hostname()), domain) {
+			continue
+		}
+
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: httpTimeout * time.Second},
+			Config:    &tls.Config{ServerName: domain, InsecureSkipVerify: true},
+		}
+		netConn, err := dialer.DialContext(ctx.Context(), "tcp", net.JoinHostPort(res.IP.String(), strconv.Itoa(ctx.httpsPort)))
+		if err != nil {
+			return nil
+		}
+		conn := netConn.(*tls.Conn)
+		state := conn.ConnectionState()
+		conn.Close()
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		leaf := state.PeerCertificates[0]
+		if leaf.VerifyHostname(domain) == nil || leaf.VerifyHostname(target.Hostname()) != nil {
+			return nil
+		}
+
+		return []Problem{{
+			Name: "CertBasedRedirect",
+			Code: ProblemCodeCertBasedRedirect,
+			Explanation: fmt.Sprintf(`The validation request to %s was redirected to %s, which is covered by the certificate `+
+				`that the server at %s presents for %s, while %s itself is not. This suggests that a proxy is redirecting to `+
+				`the name on its installed certificate, rather than to the Host that was requested, which sends the challenge `+
+				`somewhere unexpected. Check the proxy's redirect rules (they should use the requested Host), or exclude `+
+				`/.well-known/acme-challenge/ from them.`, domain, target.Hostname(), res.IP.String(), domain, domain),
+			Detail: fmt.Sprintf("Redirect: %s\nCertificate subject: %s\nCertificate names: %s",
+				res.FirstRedirect, leaf.Subject.CommonName, strings.Join(leaf.DNSNames, ", ")),
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// checkHTTP10Only retries a validation request which was accepted but not answered with HTTP, or which
+// got a 400 or 505 response, once as an HTTP/1.0 request sent directly over TCP. If the server answers
+// that properly, it only understands HTTP/1.0, whereas Let's Encrypt sends HTTP/1.1.
+func checkHTTP10Only(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	if ctx.httpProxy != nil || ctx.Context().Err() != nil {
+		return nil
+	}
+	for _, res := range results {
+		if res.RequestURL == "" {
+			continue
+		}
+		if res.IsZero() {
+			// Only when the connection was accepted; a closed or filtered port would fail the same way
+			if res.NotHTTP == "" {
+				continue
+			}
+		} else if res.InitialStatusCode != http.StatusBadRequest && res.InitialStatusCode != http.StatusHTTPVersionNotSupported {
+			continue
+		}
+		reqURL, err := url.Parse(res.RequestURL)
+		if err != nil {
+			return nil
+		}
+
+		status, err := requestHTTP10(ctx.Context(), net.JoinHostPort(res.IP.String(), strconv.Itoa(res.Port)),
+			res.RequestHost, reqURL.RequestURI(), res.RequestUserAgent)
+		if err != nil || status == http.StatusBadRequest || status == http.StatusHTTPVersionNotSupported {
+			return nil
+		}
+
+		observed := fmt.Sprintf("HTTP %d", res.InitialStatusCode)
+		if res.IsZero() {
+			observed = res.NotHTTP
+		}
+		return []Problem{{
+			Name: "Http10Only",
+			Code: ProblemCodeHttp10Only,
+			Explanation: fmt.Sprintf(`The server at %s did not properly answer the HTTP/1.1 validation request, but answered `+
+				`the same request when it was sent as HTTP/1.0. Let's Encrypt only sends HTTP/1.1 requests, so validation `+
+				`will fail. This is typical of old or embedded web servers (e.g. on routers, cameras or other devices) being `+
+				`used as the origin. Serve the domain from a web server which supports HTTP/1.1, or put one in front of the `+
+				`device.`, res.IP.String()),
+			Detail:   fmt.Sprintf("HTTP/1.1 request: %s\nHTTP/1.0 request: HTTP %d", observed, status),
+			Severity: SeverityError,
+		}}
+	}
+	return nil
+}
+
+// requestHTTP10 sends an HTTP/1.0 GET request to address and returns the status code of the response.
+func requestHTTP10(ctx context.Context, address, host, requestURI, userAgent string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout*time.Second)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: %s\r\nUser-Agent: %s\r\nAccept: */*\r\n\r\n",
+		requestURI, host, userAgent); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// isMaterialStatusDifference returns whether two status codes are of a different class, or
+// whether the second indicates that its request method was refused.
+func isMaterialStatusDifference(get, head int) bool {
+	switch head {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return head != get
+	}
+	return get/100 != head/100
+}
+
+func addressOverridden(domain string, addrs []net.IP) Problem {
+	var sb []string
+	for _, addr := range addrs {
+		sb = append(sb, addr.String())
+	}
+	return Problem{
+		Name: "AddressOverridden",
+		Code: ProblemCodeAddressOverridden,
+		Explanation: fmt.Sprintf(`The A and AAAA records for %s were not looked up in the DNS, and the addresses %s `+
+			`were used instead, as requested. The results of this test show whether validation would succeed if the DNS `+
+			`for %s pointed at these addresses, not whether it will succeed with the DNS as it is now.`,
+			domain, strings.Join(sb, ", "), domain),
+		Detail:   "Overridden addresses: " + strings.Join(sb, ", "),
+		Severity: SeverityWarning,
+	}
+}
+
+func noRecords(name, rrSummary string) Problem {
+	return Problem{
+		Name: "NoRecords",
+		Code: ProblemCodeNoRecords,
+		Explanation: fmt.Sprintf(`No valid A or AAAA records could be ultimately resolved for %s. `+
+			`This means that Let's Encrypt would not be able to to connect to your domain to perform HTTP validation, since `+
+			`it would not know where to connect to.`, name),
+		Detail:   rrSummary,
+		Severity: SeverityFatal,
+	}
+}
+
+func reservedAddress(name, address string) Problem {
+	return Problem{
+		Name: "ReservedAddress",
+		Code: ProblemCodeReservedAddress,
+		Explanation: fmt.Sprintf(`A private, inaccessible, IANA/IETF-reserved IP address was found for %s. Let's Encrypt will always fail HTTP validation `+
+			`for any domain that is pointing to an address that is not routable on the internet. You should either remove this address `+
+			`and replace it with a public one or use the DNS validation method instead.`, name),
+		Detail:   address,
+		Severity: SeverityFatal,
+	}
+}
+
+// isIPv6HTTPSRedirectBroken finds an IPv6 address which failed after being redirected to HTTPS,
+// when every IPv4 address responded without one. It returns the result and problem for that address.
+func isIPv6HTTPSRedirectBroken(results []httpCheckResult, addressProbs map[string]Problem) (httpCheckResult, Problem) {
+	var v6Res httpCheckResult
+	var v6Prob Problem
+	for _, res := range results {
+		redirectedToHTTPS := false
+		for _, line := range res.DialStack {
+			if strings.Contains(line, "Received redirect to https://") {
+				redirectedToHTTPS = true
+				break
+			}
+		}
+		if res.IP.To4() != nil {
+			if redirectedToHTTPS {
+				return httpCheckResult{}, Problem{}
+			}
+			continue
+		}
+		if prob, ok := addressProbs[res.IP.String()]; ok && redirectedToHTTPS && v6Prob.IsZero() &&
+			(prob.Name == "AAAANotWorking" || prob.Name == "InvalidRedirectCertificate") {
+			v6Res, v6Prob = res, prob
+		}
+	}
+	return v6Res, v6Prob
+}
+
+func ipv6HTTPSRedirectBroken(domain string, v6Res httpCheckResult, v6Prob Problem) Problem {
+	return Problem{
+		Name: "IPv6HTTPSRedirectBroken",
+		Code: ProblemCodeIPv6HTTPSRedirectBroken,
+		Explanation: fmt.Sprintf(`%s responds to the validation request in plain HTTP over IPv4, but over IPv6 it redirects `+
+			`to HTTPS, and the HTTPS request then fails (e.g. because of a TLS or certificate problem). Let's Encrypt prefers `+
+			`IPv6 when a domain has AAAA records, so validation follows the broken IPv6 path and fails, even though IPv4 works. `+
+			`This usually means that the IPv6 address is served by a different virtual host or server than IPv4. Make the `+
+			`IPv6 server behave the same as the IPv4 one (or fix its HTTPS configuration), or remove the AAAA record(s).`, domain),
+		Detail:   fmt.Sprintf("IPv6 address: %s\n%s: %s", v6Res.IP.String(), v6Prob.Name, v6Prob.Detail),
+		Severity: SeverityError,
+	}
+}
+
+// ipv6BrokenVerdict gives one verdict for a domain whose IPv6 addresses all failed while IPv4 worked,
+// explaining it by the apex flattening provider or CDN when there is one, and removes the separate
+// problem for each unreachable IPv6 address (including those which accepted the connection but closed
+// it without a response) from probs.
+func ipv6BrokenVerdict(ctx *scanContext, domain, cdn string, v6IPs, v4IPs []net.IP, probs []Problem,
+	addressProbs map[string]Problem) []Problem {
+	probs, failures := supersedeAddressProblems(probs, v6IPs, addressProbs, ProblemCodeAAAANotWorking, ProblemCodeEmptyReply)
+	if provider, _, _ := detectApexFlattening(ctx, domain); provider != "" {
+		return append(probs, apexAliasIPv6Broken(domain, provider, v6IPs, v4IPs, failures))
+	}
+	if cdn != "" {
+		return append(probs, ipv6BrokenBehindCDN(domain, cdn, v6IPs, v4IPs, failures))
+	}
+	return append(probs, ipv6BrokenIPv4Working(domain, v6IPs, v4IPs, failures))
+}
+
+// supersedeAddressProblems removes the problems with any of the given codes that were found for each of
+// ips, since a single verdict explains them, and returns the remaining problems along with the address
+// and detail of each one which was removed.
+func supersedeAddressProblems(probs []Problem, ips []net.IP, addressProbs map[string]Problem,
+	codes ...ProblemCode) ([]Problem, []string) {
+	matches := map[ProblemCode]bool{}
+	for _, code := range codes {
+		matches[code] = true
+	}
+	superseded := map[Problem]bool{}
+	var failures []string
+	for _, ip := range ips {
+		if prob, ok := addressProbs[ip.String()]; ok && matches[prob.Code] {
+			superseded[prob] = true
+			failures = append(failures, fmt.Sprintf("%s: %s", ip, strings.SplitN(prob.Detail, "\n", 2)[0]))
+		}
+	}
+	var kept []Problem
+	for _, prob := range probs {
+		if !superseded[prob] {
+			kept = append(kept, prob)
+		}
+	}
+	return kept, failures
+}
+
+func ipv6BrokenIPv4Working(domain string, v6IPs, v4IPs []net.IP, failures []string) Problem {
+	var v6, v4 []string
+	for _, ip := range v6IPs {
+		v6 = append(v6, ip.String())
+	}
+	for _, ip := range v4IPs {
+		v4 = append(v4, ip.String())
+	}
+	detail := fmt.Sprintf("IPv6 (not working): %s\nIPv4 (working): %s", strings.Join(v6, ", "), strings.Join(v4, ", "))
+	if len(failures) > 0 {
+		detail += "\n\nIPv6 failures:\n" + strings.Join(failures, "\n")
+	}
+	return Problem{
+		Name: "IPv6BrokenIPv4Working",
+		Code: ProblemCodeIPv6BrokenIPv4Working,
+		Explanation: fmt.Sprintf(`Issuance will fail because Let's Encrypt prefers your broken IPv6 address over your `+
+			`working IPv4 address. %s is reachable over IPv4, but none of its IPv6 (AAAA) addresses responded to a test `+
+			`request, and when a domain has both A and AAAA records, Let's Encrypt attempts validation over IPv6. This `+
+			`usually occurs when the web server is not listening on IPv6, or when the firewall does not allow IPv6 traffic. `+
+			`Either fix IPv6 connectivity (the web server must listen on, and the firewall allow, port 80 on the IPv6 `+
+			`address), or remove the AAAA record(s) so that only IPv4 is used.`, domain),
+		Detail:   detail,
+		Severity: SeverityFatal,
+	}
+}
+
+// manyAddressesThreshold is the number of addresses in an address family beyond which only a sample
+// of them are probed, to stay within the scan budget
+const manyAddressesThreshold = 8
+
+func manyAddresses(domain string, v6IPs, v4IPs []net.IP) Problem {
+	return Problem{
+		Name: "ManyAddresses",
+		Code: ProblemCodeManyAddresses,
+		Explanation: fmt.Sprintf(`%s has %d AAAA and %d A records. Let's Encrypt only tries one address of each family, `+
+			`which may not be the one you expect, so if any of these addresses are broken, validation will fail `+
+			`unpredictably. There were too many addresses to probe all of them, so only %d of each family (chosen at `+
+			`random) were tested, and a broken address may have been missed.`,
+			domain, len(v6IPs), len(v4IPs), manyAddressesThreshold),
+		Detail:   fmt.Sprintf("AAAA: %d\nA: %d", len(v6IPs), len(v4IPs)),
+		Severity: SeverityDebug,
+	}
+}
+
+func roundRobinPartialFailure(domain, rrType string, working, broken []net.IP) Problem {
+	var w, b []string
+	for _, ip := range working {
+		w = append(w, ip.String())
+	}
+	for _, ip := range broken {
+		b = append(b, ip.String())
+	}
+	return Problem{
+		Name: "RoundRobinPartialFailure",
+		Code: ProblemCodeRoundRobinPartialFailure,
+		Explanation: fmt.Sprintf(`%s has multiple %s records, but only some of those addresses responded to a test request. `+
+			`Let's Encrypt will pick one of the addresses for each validation attempt, so validation will fail intermittently `+
+			`whenever a non-working address is picked. This usually means that one of the servers behind the domain is down `+
+			`or misconfigured. Fix the non-working servers, or remove their addresses from the DNS.`, domain, rrType),
+		Detail:   fmt.Sprintf("Working: %s\nNot working: %s", strings.Join(w, ", "), strings.Join(b, ", ")),
+		Severity: SeverityError,
+	}
+}
+
+func ipv6BrokenBehindCDN(domain, cdn string, v6IPs, v4IPs []net.IP, failures []string) Problem {
+	prob := ipv6BrokenIPv4Working(domain, v6IPs, v4IPs, failures)
+	prob.Severity = SeverityError
+	prob.Name = "IPv6BrokenBehindCDN"
+	prob.Code = ProblemCodeIPv6BrokenBehindCDN
+	prob.Explanation = fmt.Sprintf(`%s is served through %s, which is reachable over IPv4, but none of the IPv6 (AAAA) `+
+		`addresses responded to a test request. Let's Encrypt prefers IPv6, so validation will be attempted (and will fail) `+
+		`over IPv6. Since a CDN is in use, this usually means that the AAAA records point to the origin server rather than `+
+		`to the CDN (e.g. a record which is not proxied, or was left over from before the CDN was set up), or that the CDN's `+
+		`IPv6 edge is misconfigured. Check that the AAAA records are managed by %s, or remove them.`, domain, cdn, cdn)
+	return prob
+}
+
+func apexAliasIPv6Broken(domain, provider string, v6IPs, v4IPs []net.IP, failures []string) Problem {
+	prob := ipv6BrokenIPv4Working(domain, v6IPs, v4IPs, failures)
+	prob.Severity = SeverityError
+	prob.Name = "ApexAliasIPv6"
+	prob.Code = ProblemCodeApexAliasIPv6
+	prob.Explanation = fmt.Sprintf(`%s is an apex domain whose records appear to be flattened from %s (by an ALIAS, ANAME `+
+		`or "CNAME flattening" record). It is reachable over IPv4, but none of the IPv6 (AAAA) addresses responded to a `+
+		`test request, and Let's Encrypt prefers IPv6. Your DNS provider copies the AAAA records from the ALIAS target, so `+
+		`whether IPv6 works (and whether AAAA records are served at all, which may vary between queries) depends on the `+
+		`target's IPv6 support. Enable IPv6 on the target, or configure the DNS provider to only flatten A records.`,
+		domain, provider)
+	return prob
+}
+
+func apexAliasNoIPv6(domain, provider string) Problem {
+	return Problem{
+		Name: "ApexAliasIPv6",
+		Code: ProblemCodeApexAliasIPv6,
+		Explanation: fmt.Sprintf(`%s is an apex domain whose records appear to be flattened from %s (by an ALIAS, ANAME `+
+			`or "CNAME flattening" record), and no AAAA records are currently served. Your DNS provider copies the AAAA `+
+			`records from the ALIAS target, so if the target gains (or intermittently serves) IPv6 addresses which don't `+
+			`work, validation over IPv6 will fail even though IPv4 works.`, domain, provider),
+		Detail:   "No AAAA records were found.",
+		Severity: SeverityDebug,
+	}
+}
+
+func httpProxyInUse(domain string, proxy *url.URL) Problem {
+	return Problem{
+		Name: "HTTPProxyInUse",
+		Code: ProblemCodeHTTPProxyInUse,
+		Explanation: fmt.Sprintf(`The HTTP check for %s was performed via a proxy. These results reflect what can be `+
+			`seen from the proxy's network, which may differ from what Let's Encrypt will see.`, domain),
+		Detail:   fmt.Sprintf("Proxy used: %s", proxy.Redacted()),
+		Severity: SeverityWarning,
+	}
+}
+
+func nonStandardHTTPPort(domain string, port int) Problem {
+	return Problem{
+		Name: "NonStandardHTTPPort",
+		Code: ProblemCodeNonStandardHTTPPort,
+		Explanation: fmt.Sprintf(`The HTTP check for %s was performed against port %d instead of port 80. These results `+
+			`are for diagnostic purposes only, and do not reflect what Let's Encrypt will see, since Let's Encrypt `+
+			`always performs HTTP validation using port 80.`, domain, port),
+		Detail:   fmt.Sprintf("Port used: %d", port),
+		Severity: SeverityWarning,
+	}
+}
+
+func ipv6TransitionAddress(name, address, reason string, reserved bool) Problem {
+	severity := SeverityError
+	if reserved {
+		severity = SeverityFatal
+	}
+	return Problem{
+		Name: "IPv6TransitionAddress",
+		Code: ProblemCodeIPv6TransitionAddress,
+		Explanation: fmt.Sprintf(`An AAAA record for %s contains an address (%s) which is not a regular IPv6 address: %s. `+
+			`Let's Encrypt will not be able to reach your server at this address. This usually indicates that the AAAA record `+
+			`was created by mistake: you should either replace it with your server's real IPv6 address, or remove it.`,
+			name, address, reason),
+		Detail:   address,
+		Severity: severity,
+	}
+}
+
+func multipleIPAddressDiscrepancy(domain string, result1, result2 httpCheckResult) Problem {
+	return Problem{
 		Name: "MultipleIPAddressDiscrepancy",
+		Code: ProblemCodeMultipleIPAddressDiscrepancy,
 		Explanation: fmt.Sprintf(`%s has multiple IP addresses in its DNS records. While they appear to be accessible on the network, `+
 			`we have detected that they produce differing results when sent an ACME HTTP validation request. This may indicate that `+
 			`some of the IP addresses may unintentionally point to different servers, which would cause validation to fail.`,
@@ -246,6 +2371,24 @@ func multipleIPAddressDiscrepancy(domain string, result1, result2 httpCheckResul
 	}
 }
 
+// isDualStackContentMismatch compares the first IPv6 and IPv4 responses, and returns both
+// if their status codes or Server headers differ.
+func isDualStackContentMismatch(results []httpCheckResult) (httpCheckResult, httpCheckResult) {
+	var v6Res, v4Res httpCheckResult
+	for _, res := range results {
+		if res.IP.To4() == nil && v6Res.IsZero() {
+			v6Res = res
+		} else if res.IP.To4() != nil && v4Res.IsZero() {
+			v4Res = res
+		}
+	}
+	if v6Res.IsZero() || v4Res.IsZero() ||
+		(v6Res.StatusCode == v4Res.StatusCode && v6Res.ServerHeader == v4Res.ServerHeader) {
+		return httpCheckResult{}, httpCheckResult{}
+	}
+	return v6Res, v4Res
+}
+
 func isLikelyModemRouter(results []httpCheckResult) httpCheckResult {
 	for _, res := range results {
 		for _, toMatch := range likelyModemRouters {
@@ -288,3 +2431,471 @@ func isLikelyPaloAltoFirewall(results []httpCheckResult) httpCheckResult {
 	}
 	return httpCheckResult{}
 }
+
+func isLocationWithoutRedirect(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.LocationHeader != "" && (res.StatusCode < 300 || res.StatusCode >= 400) {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isTemporarilyUnavailable(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+// isOriginRateLimited finds a validation request which was refused by the server's own rate limiting.
+func isOriginRateLimited(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.StatusCode == http.StatusTooManyRequests {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isCloudflareDroppedChallengePath(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.NumRedirects == 0 || res.FinalURL == "" ||
+			!strings.Contains(strings.ToLower(res.ServerHeader), "cloudflare") {
+			continue
+		}
+		u, err := url.Parse(res.FinalURL)
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(u.Path, "/.well-known/acme-challenge/") {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isLikelyIISHandlerIssue(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if !strings.HasPrefix(res.ServerHeader, "Microsoft-IIS") {
+			continue
+		}
+		// 503 is reported as TemporarilyUnavailable
+		if res.StatusCode == http.StatusForbidden ||
+			(res.StatusCode >= http.StatusInternalServerError && res.StatusCode != http.StatusServiceUnavailable) {
+			return res
+		}
+		for _, needle := range isLikelyIISHandlerPayloads {
+			if bytes.Contains(res.Content, needle) {
+				return res
+			}
+		}
+	}
+	return httpCheckResult{}
+}
+
+// landingPageServer returns the web server or hosting panel whose default or landing page the result is,
+// or an empty string.
+func landingPageServer(res httpCheckResult) string {
+	if _, server := isDefaultWebserverPage([]httpCheckResult{res}); server != "" {
+		return server
+	}
+	for _, page := range hostingLandingPages {
+		if bytes.Contains(res.Content, page.Needle) {
+			return page.Server
+		}
+	}
+	return ""
+}
+
+func isDefaultWebserverPage(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		for _, page := range defaultWebserverPages {
+			if bytes.Contains(res.Content, page.Needle) {
+				return res, page.Server
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+func isLikelyLoadBalancerNoBackend(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode != http.StatusNotFound && res.StatusCode < http.StatusInternalServerError {
+			continue
+		}
+		for _, lb := range loadBalancerDefaultResponses {
+			if lb.ServerHeader != "" && !strings.HasPrefix(res.ServerHeader, lb.ServerHeader) {
+				continue
+			}
+			if lb.Needle != nil && !bytes.Contains(res.Content, lb.Needle) {
+				continue
+			}
+			return res, lb.LoadBalancer
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isWAFBlockPage returns the first result which was refused by a web application firewall, along
+// with the name of the firewall and the reference ID from the block page, if one was found.
+func isWAFBlockPage(results []httpCheckResult) (httpCheckResult, string, string) {
+	for _, res := range results {
+		if res.StatusCode < http.StatusBadRequest {
+			continue
+		}
+		content := bytes.ToLower(res.Content)
+		for _, page := range wafBlockPages {
+			if !bytes.Contains(content, page.Needle) {
+				continue
+			}
+			var ref string
+			if m := wafReferenceID.FindSubmatch(res.Content); m != nil {
+				ref = string(m[1])
+			}
+			return res, page.WAF, ref
+		}
+	}
+	return httpCheckResult{}, "", ""
+}
+
+func isPossibleGeoBlocking(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode == http.StatusUnavailableForLegalReasons {
+			return res, "HTTP 451 Unavailable For Legal Reasons"
+		}
+		for _, header := range geoBlockingHeaders {
+			if v := res.Headers.Get(header); v != "" {
+				return res, fmt.Sprintf("%s: %s", header, v)
+			}
+		}
+		for _, needle := range geoBlockingPayloads {
+			if bytes.Contains(bytes.ToLower(res.Content), bytes.ToLower(needle)) {
+				return res, fmt.Sprintf("The response contained %q", needle)
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isMisdirectedRequest returns the first result which was rejected with HTTP 421, and the Host
+// which was rejected (which is the redirect target, if the 421 followed a redirect).
+func isMisdirectedRequest(domain string, results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.InitialStatusCode == http.StatusMisdirectedRequest {
+			return res, domain
+		}
+		if res.StatusCode == http.StatusMisdirectedRequest {
+			host := domain
+			if u, err := url.Parse(res.FinalURL); err == nil && u.Host != "" {
+				host = u.Host
+			}
+			return res, host
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+func isCachedChallengeResponse(results []httpCheckResult) (httpCheckResult, []string) {
+	for _, res := range results {
+		var cached bool
+		var headers []string
+		for _, header := range cacheStatusHeaders {
+			v := res.Headers.Get(header)
+			if v == "" {
+				continue
+			}
+			headers = append(headers, fmt.Sprintf("%s: %s", header, v))
+			if header == "Age" {
+				if age, err := strconv.Atoi(v); err == nil && age > 0 {
+					cached = true
+				}
+				continue
+			}
+			if status := strings.ToUpper(v); strings.Contains(status, "HIT") || strings.Contains(status, "STALE") ||
+				strings.Contains(status, "UPDATING") || strings.Contains(status, "REVALIDATED") {
+				cached = true
+			}
+		}
+		if cached {
+			return res, headers
+		}
+	}
+	return httpCheckResult{}, nil
+}
+
+// isCloudflareUnderAttackMode returns the first result which was Cloudflare's JavaScript challenge
+// interstitial, and the signal which identified it.
+func isCloudflareUnderAttackMode(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode < http.StatusBadRequest {
+			continue
+		}
+		if v := res.Headers.Get("Cf-Mitigated"); strings.EqualFold(v, "challenge") {
+			return res, "cf-mitigated: " + v
+		}
+		if !strings.Contains(strings.ToLower(res.ServerHeader), "cloudflare") {
+			continue
+		}
+		for _, needle := range cloudflareInterstitialPayloads {
+			if bytes.Contains(res.Content, needle) {
+				return res, fmt.Sprintf("the page contained %q", needle)
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isIntegratedAuthRequired returns the first result which was a 401 asking for Negotiate or NTLM
+// (Integrated Windows Authentication), along with the scheme.
+func isIntegratedAuthRequired(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode != http.StatusUnauthorized {
+			continue
+		}
+		for _, challenge := range res.Headers.Values("WWW-Authenticate") {
+			fields := strings.Fields(challenge)
+			if len(fields) > 0 && (strings.EqualFold(fields[0], "Negotiate") || strings.EqualFold(fields[0], "NTLM")) {
+				return res, fields[0]
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+func isRedirectToLogin(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.NumRedirects > 0 && res.FinalURL != "" {
+			if u, err := url.Parse(res.FinalURL); err == nil {
+				path := strings.ToLower(u.Path)
+				for _, fragment := range loginPathFragments {
+					if strings.Contains(path, fragment) {
+						return res, "redirected to a login path"
+					}
+				}
+			}
+		}
+		// Many ordinary pages embed a captcha widget (e.g. in a contact form), so only consider it when the
+		// request was diverted or refused
+		if res.NumRedirects == 0 && res.StatusCode != http.StatusUnauthorized &&
+			res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+			continue
+		}
+		for _, needle := range captchaPayloads {
+			if bytes.Contains(res.Content, needle) {
+				return res, fmt.Sprintf("the page contained %q", needle)
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+func isChunkedTrailerIssue(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.Chunked && res.Trailers && res.BodyError != "" {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+// isUnexpectedContentType returns the first successful result whose Content-Type is not one that
+// a static challenge file would be served with, along with that Content-Type.
+func isUnexpectedContentType(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode != http.StatusOK || res.Headers == nil {
+			continue
+		}
+		contentType := res.Headers.Get("Content-Type")
+		if contentType == "" {
+			continue
+		}
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil &&
+			(mediaType == "text/plain" || mediaType == "application/octet-stream") {
+			continue
+		}
+		return res, contentType
+	}
+	return httpCheckResult{}, ""
+}
+
+// isAttachmentResponse returns the first successful result which was served with a Content-Disposition
+// of attachment, along with the header's value.
+func isAttachmentResponse(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode != http.StatusOK {
+			continue
+		}
+		disposition := res.Headers.Get("Content-Disposition")
+		if dispositionType, _, err := mime.ParseMediaType(disposition); err == nil && dispositionType == "attachment" {
+			return res, disposition
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isAltSvcAdvertised returns the first result with an Alt-Svc header, along with its value.
+func isAltSvcAdvertised(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if values := res.Headers.Values("Alt-Svc"); len(values) > 0 {
+			return res, strings.Join(values, ", ")
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isPort80NotSpeakingHTTP returns the results whose connection to port 80 was accepted, but not answered
+// with HTTP.
+func isPort80NotSpeakingHTTP(results []httpCheckResult) []httpCheckResult {
+	var notHTTP []httpCheckResult
+	for _, res := range results {
+		if res.NotHTTP != "" {
+			notHTTP = append(notHTTP, res)
+		}
+	}
+	return notHTTP
+}
+
+// isHSTSAdvertised returns the first result with a Strict-Transport-Security header, along with its value.
+func isHSTSAdvertised(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if v := res.Headers.Get("Strict-Transport-Security"); v != "" {
+			return res, v
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isEdgeHints returns the first result which received interim (1xx) responses, or preload hints in
+// its Link header, along with a description of them.
+func isEdgeHints(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		var hints []string
+		for _, interim := range res.InterimResponses {
+			hints = append(hints, "Interim response: "+interim)
+		}
+		for _, link := range res.Headers.Values("Link") {
+			if strings.Contains(strings.ToLower(link), "preload") {
+				hints = append(hints, "Link: "+link)
+			}
+		}
+		if len(hints) > 0 {
+			return res, strings.Join(hints, "\n")
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isClientSideRedirect returns the first 200 result whose body contains a meta refresh or JavaScript
+// redirect, along with its target (if it could be found).
+func isClientSideRedirect(results []httpCheckResult) (httpCheckResult, string) {
+	for _, res := range results {
+		if res.StatusCode != http.StatusOK {
+			continue
+		}
+		for _, re := range clientSideRedirects {
+			if m := re.FindSubmatch(res.Content); m != nil {
+				return res, string(m[1])
+			}
+		}
+	}
+	return httpCheckResult{}, ""
+}
+
+// isEmptyChallengeResponse returns the first result which was a 200 with an empty body (as opposed to
+// a page of content, such as a single-page application's HTML, which is served for any path).
+func isEmptyChallengeResponse(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.StatusCode == http.StatusOK && len(res.Content) == 0 && res.BodyError == "" {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isCompressedChallengeResponse(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if enc := strings.ToLower(res.ContentEncoding); enc != "" && enc != "identity" {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+// isChallengePathDropped returns the first result which was redirected away from the challenge
+// path, without a later redirect returning to it.
+func isChallengePathDropped(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.ChallengePathDroppedAt == "" {
+			continue
+		}
+		if u, err := url.Parse(res.FinalURL); err == nil && !strings.HasPrefix(u.Path, "/.well-known/acme-challenge/") {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isDifferentlyEncodedRedirect(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.DifferentlyEncodedRedirect != "" {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+func isCrossDomainRedirect(results []httpCheckResult) httpCheckResult {
+	for _, res := range results {
+		if res.CrossDomainRedirect != "" {
+			return res
+		}
+	}
+	return httpCheckResult{}
+}
+
+// checkKeyAuthorization verifies that each server which responded served the expected key
+// authorization for the challenge token, in the same way as Let's Encrypt (which ignores
+// trailing whitespace).
+func checkKeyAuthorization(ctx *scanContext, domain string, results []httpCheckResult) []Problem {
+	token := strings.SplitN(ctx.keyAuthorization, ".", 2)[0]
+
+	for _, res := range results {
+		if res.IsZero() {
+			continue
+		}
+		body := strings.TrimRight(string(res.Content), " \n\r\t")
+		if res.StatusCode == http.StatusOK && body == ctx.keyAuthorization {
+			continue
+		}
+
+		var reason string
+		switch {
+		case res.StatusCode != http.StatusOK:
+			reason = fmt.Sprintf("The server responded with HTTP %d rather than HTTP 200.", res.StatusCode)
+		case body == token:
+			reason = "The server responded with only the token, rather than the key authorization."
+		case strings.HasPrefix(body, token+"."):
+			reason = "The server responded with a key authorization for this token, but for a different ACME account " +
+				"key. This usually means that the challenge was requested with a different account than the one which is serving it."
+		default:
+			reason = "The server did not respond with the key authorization for this token."
+		}
+
+		if len(body) > 256 {
+			body = body[:256] + "..."
+		}
+		return []Problem{{
+			Name: "KeyAuthorizationMismatch",
+			Code: ProblemCodeKeyAuthorizationMismatch,
+			Explanation: fmt.Sprintf(`A request for the challenge token at http://%s/.well-known/acme-challenge/%s did not `+
+				`return the expected key authorization. %s`, domain, token, reason),
+			Detail: fmt.Sprintf("The server at %s produced this result.\nExpected: %q\nReceived: %q",
+				res.IP.String(), ctx.keyAuthorization, body),
+			Severity: SeverityError,
+		}}
+	}
+	return nil
+}
@@ -0,0 +1,944 @@
+package letsdebug
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type mockVantagePoint struct {
+	name string
+	err  error
+}
+
+func (vp mockVantagePoint) Name() string {
+	return vp.name
+}
+
+func (vp mockVantagePoint) Probe(ctx context.Context, domain string, address net.IP, port int, path string) (int, error) {
+	return 404, vp.err
+}
+
+func TestMultiPerspectiveChecker_Check(t *testing.T) {
+	if _, err := (multiPerspectiveChecker{}).Check(newScanContext(), "example.org", HTTP01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable without vantage points, got: %v", err)
+	}
+
+	// The local vantage point succeeds, without making a request
+	defer func(vp VantagePoint) { localVantagePoint = vp }(localVantagePoint)
+	localVantagePoint = mockVantagePoint{name: "letsdebug"}
+
+	newCtx := func(vps ...VantagePoint) *scanContext {
+		ctx := newScanContext()
+		ctx.vantagePoints = vps
+		a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+		ctx.rrs["example.org"] = map[uint16]lookupResult{
+			dns.TypeA:    {RRs: []dns.RR{a}},
+			dns.TypeAAAA: {},
+		}
+		return ctx
+	}
+
+	ctx := newCtx(mockVantagePoint{name: "ok"}, mockVantagePoint{name: "blocked", err: errors.New("timeout")})
+	probs, err := (multiPerspectiveChecker{}).Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(probs) != 2 || probs[0].Name != "MultiPerspectiveDiscrepancy" {
+		t.Fatalf("expected a discrepancy to be reported, got: %v", probs)
+	}
+
+	probs, _ = (multiPerspectiveChecker{}).Check(newCtx(mockVantagePoint{name: "ok"}), "example.org", HTTP01)
+	for _, p := range probs {
+		if p.Name == "MultiPerspectiveDiscrepancy" {
+			t.Fatalf("expected no discrepancy, got: %v", probs)
+		}
+	}
+}
+
+// recordingVantagePoint records the addresses which it is asked to probe
+type recordingVantagePoint struct {
+	mu     *sync.Mutex
+	probed *[]string
+}
+
+func (vp recordingVantagePoint) Name() string {
+	return "recording"
+}
+
+func (vp recordingVantagePoint) Probe(ctx context.Context, domain string, address net.IP, port int, path string) (int, error) {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+	*vp.probed = append(*vp.probed, address.String())
+	return 404, nil
+}
+
+func TestMultiPerspectiveChecker_SkipsUnsafeAddresses(t *testing.T) {
+	var probed []string
+	recorder := recordingVantagePoint{mu: &sync.Mutex{}, probed: &probed}
+	defer func(vp VantagePoint) { localVantagePoint = vp }(localVantagePoint)
+	localVantagePoint = recorder
+
+	ctx := newScanContext()
+	ctx.vantagePoints = []VantagePoint{recorder}
+	metadata, _ := dns.NewRR("example.org. 60 IN A 169.254.169.254")
+	loopback, _ := dns.NewRR("example.org. 60 IN A 127.0.0.1")
+	public, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	linkLocal, _ := dns.NewRR("example.org. 60 IN AAAA fe80::1")
+	loopback6, _ := dns.NewRR("example.org. 60 IN AAAA ::1")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{
+		dns.TypeA:    {RRs: []dns.RR{metadata, loopback, public}},
+		dns.TypeAAAA: {RRs: []dns.RR{linkLocal, loopback6}},
+	}
+
+	if _, err := (multiPerspectiveChecker{}).Check(ctx, "example.org", HTTP01); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range probed {
+		if addr != "192.0.2.1" {
+			t.Fatalf("expected only the public address to be probed, got: %v", probed)
+		}
+	}
+	if len(probed) != 2 {
+		t.Fatalf("expected the public address to be probed from both vantage points, got: %v", probed)
+	}
+}
+
+func TestPartialResolutionChecker_CheckNames(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {}}
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{
+		dns.TypeA:    {Rcode: dns.RcodeNameError},
+		dns.TypeAAAA: {Rcode: dns.RcodeNameError},
+	}
+
+	probs, err := partialResolutionChecker{}.CheckNames(ctx, []string{"example.org", "www.example.org"}, HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Name != "PartialNameResolution" {
+		t.Fatalf("expected PartialNameResolution, got: %v", probs)
+	}
+
+	if probs, _ := (partialResolutionChecker{}).CheckNames(ctx, []string{"example.org"}, HTTP01); len(probs) != 0 {
+		t.Fatalf("expected no problems, got: %v", probs)
+	}
+}
+
+func TestDNSAChecker_AddressOverride(t *testing.T) {
+	ctx := newScanContext()
+	ctx.addressOverride = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+	ctx.overrideAddresses("example.org")
+
+	probs, err := dnsAChecker{}.Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, prob := range probs {
+		names = append(names, prob.Name)
+	}
+	// 192.0.2.1 and 2001:db8::1 are both documentation addresses
+	expected := []string{"AddressOverridden", "ReservedAddress", "ReservedAddress", "HTTPRecords"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got: %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v, got: %v", expected, names)
+		}
+	}
+}
+
+func TestDNSAChecker_AddressAbsence(t *testing.T) {
+	soa, _ := dns.NewRR("example.org. 60 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 60")
+	for _, test := range []struct {
+		rcode int
+		code  ProblemCode
+	}{
+		{dns.RcodeNameError, ProblemCodeNameNotFound},
+		{dns.RcodeSuccess, ProblemCodeNoAddressRecords},
+	} {
+		ctx := newScanContext()
+		result := lookupResult{Rcode: test.rcode, Authority: []dns.RR{soa}}
+		ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeA: result, dns.TypeAAAA: result}
+
+		probs, _ := dnsAChecker{}.Check(ctx, "www.example.org", HTTP01)
+		if len(probs) != 1 || probs[0].Code != test.code || !strings.Contains(probs[0].Detail, "zone example.org") {
+			t.Fatalf("expected %s, got: %v", test.code, probs)
+		}
+	}
+}
+
+func TestCheckHTTPCertBasedRedirect(t *testing.T) {
+	// The test server's certificate is for example.com
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpsPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	res := httpCheckResult{StatusCode: 200, IP: net.ParseIP("127.0.0.1"),
+		FirstRedirect: "https://example.com/.well-known/acme-challenge/letsdebug-test"}
+	probs := checkHTTPCertBasedRedirect(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeCertBasedRedirect {
+		t.Fatalf("expected CertBasedRedirect, got: %v", probs)
+	}
+
+	res.FirstRedirect = "https://www.example.net/.well-known/acme-challenge/letsdebug-test"
+	if probs := checkHTTPCertBasedRedirect(ctx, "example.org", []httpCheckResult{res}); len(probs) != 0 {
+		t.Fatalf("expected nothing for a name the certificate doesn't cover, got: %v", probs)
+	}
+}
+
+func TestIsDefaultWebserverPage(t *testing.T) {
+	results := []httpCheckResult{
+		{StatusCode: 404, Content: []byte("Not Found")},
+		{StatusCode: 200, Content: []byte("<html><head><title>Welcome to nginx!</title></head></html>")},
+	}
+	if res, server := isDefaultWebserverPage(results); res.IsZero() || server != "nginx" {
+		t.Fatalf("expected the nginx welcome page to be matched, got: %q", server)
+	}
+	if res, _ := isDefaultWebserverPage(results[:1]); !res.IsZero() {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestApexFlatteningChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	ptr, _ := dns.NewRR("1.2.0.192.in-addr.arpa. 60 IN PTR server-192-0-2-1.lhr50.r.cloudfront.net.")
+	caa, _ := dns.NewRR(`example.org. 60 IN CAA 0 issue "sectigo.com"`)
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeCAA: {RRs: []dns.RR{caa}}}
+	ctx.rrs["1.2.0.192.in-addr.arpa"] = map[uint16]lookupResult{dns.TypePTR: {RRs: []dns.RR{ptr}}}
+
+	probs, err := apexFlatteningChecker{}.Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Name != "ApexFlattening" ||
+		!strings.HasSuffix(probs[0].Detail, "The CAA records at example.org apply, and they do not permit Let's Encrypt") {
+		t.Fatalf("expected ApexFlattening with the domain's own CAA records, got: %v", probs)
+	}
+
+	if _, err := (apexFlatteningChecker{}).Check(ctx, "www.example.org", HTTP01); err != errNotApplicable {
+		t.Fatalf("expected checker to be not applicable to a subdomain, got: %v", err)
+	}
+}
+
+func TestAnycastChecker_Check(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 104.16.1.1")
+	aaaa, _ := dns.NewRR("example.org. 60 IN AAAA 2001:db8::1")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {RRs: []dns.RR{aaaa}}}
+
+	probs, err := anycastChecker{}.Check(ctx, "example.org", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 1 || probs[0].Detail != "104.16.1.1 (Cloudflare)" {
+		t.Fatalf("expected the Cloudflare address to be reported, got: %v", probs)
+	}
+}
+
+func TestIsLikelyLoadBalancerNoBackend(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 503, ServerHeader: "awselb/2.0"}}
+	if res, lb := isLikelyLoadBalancerNoBackend(results); res.IsZero() || lb != "AWS Application Load Balancer" {
+		t.Fatalf("expected the ALB to be matched, got: %q", lb)
+	}
+
+	results = []httpCheckResult{{StatusCode: 404, ServerHeader: "nginx", Content: []byte("Not Found")}}
+	if res, _ := isLikelyLoadBalancerNoBackend(results); !res.IsZero() {
+		t.Fatal("expected no match for an ordinary 404")
+	}
+}
+
+func TestIsPossibleGeoBlocking(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 403, Content: []byte("Sorry, this site is NOT AVAILABLE IN YOUR COUNTRY.")}}
+	if res, _ := isPossibleGeoBlocking(results); res.IsZero() {
+		t.Fatal("expected the geo-blocking page to be matched")
+	}
+
+	results = []httpCheckResult{{StatusCode: 404, Content: []byte("Not Found")}}
+	if res, _ := isPossibleGeoBlocking(results); !res.IsZero() {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestIsChallengePathDropped(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 200, NumRedirects: 2, FinalURL: "https://example.org/",
+		ChallengePathDroppedAt: "http://www.example.org/.well-known/acme-challenge/foo -> http://example.org/"}}
+	if res := isChallengePathDropped(results); res.IsZero() {
+		t.Fatal("expected the dropped path to be matched")
+	}
+
+	// A later redirect back to the challenge path works
+	results[0].FinalURL = "https://example.org/.well-known/acme-challenge/foo"
+	if res := isChallengePathDropped(results); !res.IsZero() {
+		t.Fatal("expected no match when the path was restored")
+	}
+}
+
+func TestIsMisdirectedRequest(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 421, InitialStatusCode: 301, NumRedirects: 1,
+		FinalURL: "https://www.example.org/.well-known/acme-challenge/foo"}}
+	if res, host := isMisdirectedRequest("example.org", results); res.IsZero() || host != "www.example.org" {
+		t.Fatalf("expected the 421 after the redirect to be matched, got: %q", host)
+	}
+
+	results = []httpCheckResult{{StatusCode: 404, InitialStatusCode: 404}}
+	if res, _ := isMisdirectedRequest("example.org", results); !res.IsZero() {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestIsCachedChallengeResponse(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 404, Headers: http.Header{"Cf-Cache-Status": {"HIT"}, "Age": {"512"}}}}
+	res, headers := isCachedChallengeResponse(results)
+	if res.IsZero() || len(headers) != 2 {
+		t.Fatalf("expected the cached response to be matched, got: %v", headers)
+	}
+
+	results = []httpCheckResult{{StatusCode: 404, Headers: http.Header{"Cf-Cache-Status": {"DYNAMIC"}, "Age": {"0"}}}}
+	if res, _ := isCachedChallengeResponse(results); !res.IsZero() {
+		t.Fatal("expected no match for an uncached response")
+	}
+}
+
+func TestIsEmptyChallengeResponse(t *testing.T) {
+	if res := isEmptyChallengeResponse([]httpCheckResult{{StatusCode: 200}}); res.IsZero() {
+		t.Fatal("expected an empty 200 to be matched")
+	}
+	for _, res := range []httpCheckResult{
+		{StatusCode: 200, Content: []byte("<html></html>")},
+		{StatusCode: 404},
+		{StatusCode: 200, BodyError: "unexpected EOF"},
+	} {
+		if !isEmptyChallengeResponse([]httpCheckResult{res}).IsZero() {
+			t.Fatalf("expected no match for %+v", res)
+		}
+	}
+}
+
+func TestIsClientSideRedirect(t *testing.T) {
+	for body, target := range map[string]string{
+		`<html><head><meta http-equiv="refresh" content="0; url=https://example.org/"></head></html>`: "https://example.org/",
+		`<script>window.location.href = "https://example.org/";</script>`:                             "https://example.org/",
+		`<script>location.replace('https://example.org/')</script>`:                                   "https://example.org/",
+	} {
+		res, got := isClientSideRedirect([]httpCheckResult{{StatusCode: 200, Content: []byte(body)}})
+		if res.IsZero() || got != target {
+			t.Fatalf("expected %q to be matched with %s, got: %q", body, target, got)
+		}
+	}
+
+	if res, _ := isClientSideRedirect([]httpCheckResult{{StatusCode: 200, Content: []byte("token.thumbprint")}}); !res.IsZero() {
+		t.Fatal("expected no match for a token")
+	}
+}
+
+func TestIsWAFBlockPage(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 403, Content: []byte("<html><body>The requested URL was rejected. " +
+		"Please consult with your administrator.<br><br>Your support ID is: 7063295407601148357</body></html>")}}
+	res, waf, ref := isWAFBlockPage(results)
+	if res.IsZero() || waf != "F5 BIG-IP ASM" || ref != "7063295407601148357" {
+		t.Fatalf("expected the F5 block page to be matched, got: %q, %q", waf, ref)
+	}
+
+	results = []httpCheckResult{{StatusCode: 406, Content: []byte("This error was generated by Mod_Security.")}}
+	if res, waf, ref = isWAFBlockPage(results); res.IsZero() || waf != "ModSecurity" || ref != "" {
+		t.Fatalf("expected the ModSecurity block page to be matched, got: %q, %q", waf, ref)
+	}
+
+	results = []httpCheckResult{{StatusCode: 403, Content: []byte("Forbidden")}}
+	if res, _, _ = isWAFBlockPage(results); !res.IsZero() {
+		t.Fatal("expected a plain 403 not to be matched")
+	}
+}
+
+func TestIsCloudflareUnderAttackMode(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 503, ServerHeader: "cloudflare",
+		Content: []byte("<html><head><title>Just a moment...</title></head></html>")}}
+	if res, _ := isCloudflareUnderAttackMode(results); res.IsZero() {
+		t.Fatal("expected the interstitial to be matched")
+	}
+
+	results = []httpCheckResult{{StatusCode: 403, ServerHeader: "cloudflare", Headers: http.Header{"Cf-Mitigated": {"challenge"}}}}
+	if res, signal := isCloudflareUnderAttackMode(results); res.IsZero() || signal != "cf-mitigated: challenge" {
+		t.Fatalf("expected the cf-mitigated header to be matched, got: %q", signal)
+	}
+
+	results = []httpCheckResult{{StatusCode: 404, ServerHeader: "cloudflare", Content: []byte("Not Found")}}
+	if res, _ := isCloudflareUnderAttackMode(results); !res.IsZero() {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestIsUnexpectedContentType(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 200, Headers: http.Header{"Content-Type": {"text/html; charset=utf-8"}}}}
+	if res, contentType := isUnexpectedContentType(results); res.IsZero() || contentType != "text/html; charset=utf-8" {
+		t.Fatalf("expected text/html to be matched, got: %q", contentType)
+	}
+
+	for _, contentType := range []string{"text/plain; charset=UTF-8", "application/octet-stream"} {
+		results = []httpCheckResult{{StatusCode: 200, Headers: http.Header{"Content-Type": {contentType}}}}
+		if res, _ := isUnexpectedContentType(results); !res.IsZero() {
+			t.Fatalf("expected no match for %s", contentType)
+		}
+	}
+}
+
+func TestIsAttachmentResponse(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 200, Headers: http.Header{"Content-Disposition": {`attachment; filename="token"`}}}}
+	if res, disposition := isAttachmentResponse(results); res.IsZero() || disposition != `attachment; filename="token"` {
+		t.Fatalf("expected an attachment to be matched, got: %q", disposition)
+	}
+
+	results = []httpCheckResult{{StatusCode: 200, Headers: http.Header{"Content-Disposition": {"inline"}}}}
+	if res, _ := isAttachmentResponse(results); !res.IsZero() {
+		t.Fatal("expected no match for inline")
+	}
+}
+
+func TestIsPort80NotSpeakingHTTP(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 200}, {NotHTTP: "EOF: the connection was closed without any response"}, {}}
+	if notHTTP := isPort80NotSpeakingHTTP(results); len(notHTTP) != 1 || notHTTP[0].NotHTTP != results[1].NotHTTP {
+		t.Fatalf("expected the result which wasn't HTTP, got: %v", notHTTP)
+	}
+	if notHTTP := isPort80NotSpeakingHTTP(results[:1]); len(notHTTP) != 0 {
+		t.Fatalf("expected no match for an HTTP response, got: %v", notHTTP)
+	}
+}
+
+func TestIsHSTSAdvertised(t *testing.T) {
+	hsts := "max-age=63072000; includeSubDomains; preload"
+	results := []httpCheckResult{{StatusCode: 200}, {StatusCode: 200, Headers: http.Header{"Strict-Transport-Security": {hsts}}}}
+	if res, v := isHSTSAdvertised(results); res.IsZero() || v != hsts {
+		t.Fatalf("expected HSTS to be matched, got: %q", v)
+	}
+	if res, _ := isHSTSAdvertised(results[:1]); !res.IsZero() {
+		t.Fatal("expected no match without HSTS")
+	}
+}
+
+func TestIsAltSvcAdvertised(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 404}, {StatusCode: 404, Headers: http.Header{"Alt-Svc": {`h3=":443"; ma=86400`}}}}
+	if res, altSvc := isAltSvcAdvertised(results); res.IsZero() || altSvc != `h3=":443"; ma=86400` {
+		t.Fatalf("expected Alt-Svc to be matched, got: %q", altSvc)
+	}
+	if res, _ := isAltSvcAdvertised(results[:1]); !res.IsZero() {
+		t.Fatal("expected no match without Alt-Svc")
+	}
+}
+
+func TestIsIntegratedAuthRequired(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 401, Headers: http.Header{"Www-Authenticate": {"Basic realm=\"x\"", "NTLM"}}}}
+	if res, scheme := isIntegratedAuthRequired(results); res.IsZero() || scheme != "NTLM" {
+		t.Fatalf("expected NTLM to be matched, got: %q", scheme)
+	}
+
+	results = []httpCheckResult{{StatusCode: 401, Headers: http.Header{"Www-Authenticate": {"Basic realm=\"x\"", ""}}}}
+	if res, _ := isIntegratedAuthRequired(results); !res.IsZero() {
+		t.Fatal("expected no match for Basic authentication")
+	}
+}
+
+func TestIsRedirectToLogin(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 200, NumRedirects: 1, FinalURL: "https://example.org:2083/cgi-sys/login.cgi"}}
+	if res, _ := isRedirectToLogin(results); res.IsZero() {
+		t.Fatal("expected the cPanel login to be matched")
+	}
+
+	results = []httpCheckResult{{StatusCode: 200, FinalURL: "http://example.org/.well-known/acme-challenge/login"}}
+	if res, _ := isRedirectToLogin(results); !res.IsZero() {
+		t.Fatal("expected no match without a redirect")
+	}
+
+	results = []httpCheckResult{{StatusCode: 403, Content: []byte(`<div class="g-recaptcha"></div>`)}}
+	if res, _ := isRedirectToLogin(results); res.IsZero() {
+		t.Fatal("expected the captcha challenge to be matched")
+	}
+
+	results = []httpCheckResult{{StatusCode: 200, Content: []byte(`<form><div class="h-captcha"></div></form>`)}}
+	if res, _ := isRedirectToLogin(results); !res.IsZero() {
+		t.Fatal("expected no match for a page which embeds a captcha widget")
+	}
+}
+
+func TestCheckHTTPDirectoryListing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/acme-challenge/" {
+			_, _ = w.Write([]byte("<html><head><title>Index of /.well-known/acme-challenge/</title></head></html>"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	probs := checkHTTPDirectoryListing(ctx, "example.org", httpCheckResult{IP: net.ParseIP("127.0.0.1"), StatusCode: 404})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeChallengeDirectoryListing {
+		t.Fatalf("expected ChallengeDirectoryListing, got: %v", probs)
+	}
+}
+
+func TestIsDualStackContentMismatch(t *testing.T) {
+	v6 := httpCheckResult{IP: net.ParseIP("2001:db8::1"), StatusCode: 404, ServerHeader: "nginx"}
+	v4 := httpCheckResult{IP: net.ParseIP("192.0.2.1"), StatusCode: 404, ServerHeader: "nginx"}
+	if res, _ := isDualStackContentMismatch([]httpCheckResult{v6, v4}); !res.IsZero() {
+		t.Fatal("expected no mismatch for identical responses")
+	}
+
+	v4.ServerHeader = "Apache"
+	if res, other := isDualStackContentMismatch([]httpCheckResult{v4, v6}); res.ServerHeader != "nginx" || other.ServerHeader != "Apache" {
+		t.Fatalf("expected the IPv6 and IPv4 responses to be returned, got: %v, %v", res, other)
+	}
+
+	if res, _ := isDualStackContentMismatch([]httpCheckResult{v4}); !res.IsZero() {
+		t.Fatal("expected no mismatch with a single address family")
+	}
+}
+
+func TestCheckKeyAuthorization(t *testing.T) {
+	ctx := newScanContextFromOptions(Options{HTTPChallengeToken: "tok", AccountThumbprint: "thumb"})
+	if ctx.httpRequestPath != "tok" {
+		t.Fatalf("expected the token to be requested, got: %s", ctx.httpRequestPath)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	ok := httpCheckResult{IP: ip, StatusCode: 200, Content: []byte("tok.thumb\n")}
+	if probs := checkKeyAuthorization(ctx, "example.org", []httpCheckResult{ok}); len(probs) != 0 {
+		t.Fatalf("expected the key authorization to match, got: %v", probs)
+	}
+
+	other := httpCheckResult{IP: ip, StatusCode: 200, Content: []byte("tok.other")}
+	probs := checkKeyAuthorization(ctx, "example.org", []httpCheckResult{ok, other})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeKeyAuthorizationMismatch || !strings.Contains(probs[0].Explanation, "different ACME account") {
+		t.Fatalf("expected a mismatched account key to be reported, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPVirtualHost(t *testing.T) {
+	namedVhost := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if namedVhost && r.Host != "example.org" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPVirtualHost(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeDefaultVirtualHost {
+		t.Fatalf("expected DefaultVirtualHost, got: %v", probs)
+	}
+
+	namedVhost = true
+	if probs := checkHTTPVirtualHost(ctx, "example.org", []httpCheckResult{res}); len(probs) != 0 {
+		t.Fatalf("expected no problem with name-based virtual hosting, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPVirtualHost_LandingPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<html><title>Welcome to nginx!</title></html>`))
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPVirtualHost(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeNameBasedVhostMissing {
+		t.Fatalf("expected NameBasedVhostMissing, got: %v", probs)
+	}
+}
+
+func TestIsIPv6HTTPSRedirectBroken(t *testing.T) {
+	v6 := httpCheckResult{IP: net.ParseIP("2001:db8::1"), InitialStatusCode: 301,
+		DialStack: []string{"@0ms: Received redirect to https://example.org/.well-known/acme-challenge/letsdebug-test"}}
+	v4 := httpCheckResult{IP: net.ParseIP("192.0.2.1"), StatusCode: 404, InitialStatusCode: 404}
+	probs := map[string]Problem{"2001:db8::1": {Name: "AAAANotWorking", Detail: "remote error: tls: internal error"}}
+
+	res, prob := isIPv6HTTPSRedirectBroken([]httpCheckResult{v6, v4}, probs)
+	if prob.Name != "AAAANotWorking" || !res.IP.Equal(v6.IP) {
+		t.Fatalf("expected the IPv6 failure to be found, got: %v", prob)
+	}
+	if p := ipv6HTTPSRedirectBroken("example.org", res, prob); !strings.Contains(p.Detail, "tls: internal error") {
+		t.Fatalf("expected the TLS failure in the detail, got: %v", p)
+	}
+
+	// IPv4 redirecting to HTTPS too is not this problem
+	v4.DialStack = v6.DialStack
+	if _, prob := isIPv6HTTPSRedirectBroken([]httpCheckResult{v6, v4}, probs); !prob.IsZero() {
+		t.Fatalf("expected no match when IPv4 also redirects, got: %v", prob)
+	}
+}
+
+func TestCheckHTTPTrailingDotHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, _ := net.SplitHostPort(r.Host); strings.HasSuffix(host, ".") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPTrailingDotHost(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeHostHeaderSensitivity {
+		t.Fatalf("expected HostHeaderSensitivity, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPHostCase(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like an nginx server_name ~^example\.org$ block, which is case-sensitive
+		if host, _, _ := net.SplitHostPort(r.Host); host != "example.org" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPHostCase(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeCaseSensitiveVhost ||
+		!strings.Contains(probs[0].Detail, "EXAMPLE.ORG: ") {
+		t.Fatalf("expected CaseSensitiveVhost, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.UserAgent(), "Let's Debug") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("token"))
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPUserAgent(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeUserAgentFiltering {
+		t.Fatalf("expected UserAgentFiltering, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPChallengePathHang(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("home page"))
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	// The validation request itself would take httpTimeout to time out
+	res := httpCheckResult{IP: net.ParseIP("127.0.0.1"), TimedOut: true, Connected: true}
+
+	probs := checkHTTPChallengePathHang(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeChallengePathHangs {
+		t.Fatalf("expected ChallengePathHangs, got: %v", probs)
+	}
+
+	if probs = checkHTTPChallengePathHang(ctx, "example.org", []httpCheckResult{{IP: res.IP}}); len(probs) != 0 {
+		t.Fatalf("expected no problems without a timeout, got: %v", probs)
+	}
+	// e.g. a firewalled port
+	dialTimeout := httpCheckResult{IP: res.IP, TimedOut: true}
+	if probs = checkHTTPChallengePathHang(ctx, "example.org", []httpCheckResult{dialTimeout}); len(probs) != 0 {
+		t.Fatalf("expected no problems for a timeout while connecting, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPChallengePathServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("home page"))
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPChallengePathServerError(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeChallengePathServerError ||
+		!strings.Contains(probs[0].Explanation, "failed with HTTP 502, but a request for / on the same server received HTTP 200") {
+		t.Fatalf("expected ChallengePathServerError, got: %v", probs)
+	}
+
+	res.StatusCode = http.StatusNotFound
+	if probs = checkHTTPChallengePathServerError(ctx, "example.org", []httpCheckResult{res}); len(probs) != 0 {
+		t.Fatalf("expected no problems without a server error, got: %v", probs)
+	}
+}
+
+func TestCheckHTTPPathVariants(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A rewrite rule which only matches the path when nothing follows the token
+		if strings.HasSuffix(r.URL.Path, "/") || r.URL.RawQuery != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+
+	probs := checkHTTPPathVariants(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeFragileRewriteRule || strings.Count(probs[0].Detail, "\n") != 2 {
+		t.Fatalf("expected FragileRewriteRule for both variants, got: %v", probs)
+	}
+}
+
+func TestCheckHTTP10Only(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			n, _ := conn.Read(buf)
+			if strings.Contains(string(buf[:n]), "HTTP/1.1") {
+				_, _ = conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+			} else {
+				_, _ = conn.Write([]byte("HTTP/1.0 200 OK\r\n\r\ntoken"))
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	ctx := newScanContext()
+	ctx.httpPort = l.Addr().(*net.TCPAddr).Port
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	probs := checkHTTP10Only(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeHttp10Only {
+		t.Fatalf("expected Http10Only, got: %v", probs)
+	}
+
+	// Without an accepted connection (e.g. a filtered port), the request isn't retried
+	unanswered := httpCheckResult{IP: res.IP, RequestURL: res.RequestURL, Port: res.Port, TimedOut: true}
+	if probs := checkHTTP10Only(ctx, "example.org", []httpCheckResult{unanswered}); len(probs) != 0 {
+		t.Fatalf("expected no retry without a connection, got: %v", probs)
+	}
+}
+
+func TestIsOriginRateLimited(t *testing.T) {
+	results := []httpCheckResult{{StatusCode: 503}, {StatusCode: 429, RetryAfterHeader: "120"}}
+	if res := isOriginRateLimited(results); res.RetryAfterHeader != "120" {
+		t.Fatalf("expected the 429 response to be matched, got: %v", res)
+	}
+	if res := isTemporarilyUnavailable(results[1:]); !res.IsZero() {
+		t.Fatalf("expected a 429 response not to be reported as temporarily unavailable, got: %v", res)
+	}
+}
+
+func TestCheckHTTPPathStripped(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected bool
+	}{
+		{"stripped", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("<html>Home page</html>")) }, true},
+		{"preserved", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(r.URL.Path)) }, false},
+	} {
+		srv := httptest.NewServer(test.handler)
+		ctx := newScanContext()
+		ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+		res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+		probs := checkHTTPPathStripped(ctx, "example.org", []httpCheckResult{res})
+		srv.Close()
+		if found := len(probs) == 1 && probs[0].Code == ProblemCodeProxyStripsPath &&
+			strings.Contains(probs[0].Detail, "/: HTTP 200"); found != test.expected {
+			t.Fatalf("%s: unexpected problems: %v", test.name, probs)
+		}
+	}
+}
+
+func TestIPv6BrokenIPv4Working_Supersedes(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")
+	v6Prob := aaaaNotWorking("example.org", v6.String(), errors.New("connect: connection refused"), []string{"Dialing 2001:db8::1"})
+	other := Problem{Name: "Other", Code: "Other", Severity: SeverityDebug}
+	addressProbs := map[string]Problem{v6.String(): v6Prob}
+
+	probs, failures := supersedeAddressProblems([]Problem{v6Prob, other}, []net.IP{v6}, addressProbs, ProblemCodeAAAANotWorking)
+	if len(probs) != 1 || probs[0] != other || len(failures) != 1 || failures[0] != "2001:db8::1: connect: connection refused" {
+		t.Fatalf("expected the AAAANotWorking problem to be superseded, got: %v %v", probs, failures)
+	}
+
+	// An IPv6 address which closed the connection without a response is part of the same verdict
+	v6Empty := net.ParseIP("2001:db8::2")
+	emptyProb := translateHTTPError("example.org", v6Empty, io.EOF, nil)
+	addressProbs[v6Empty.String()] = emptyProb
+	emptyProbs, emptyFailures := supersedeAddressProblems([]Problem{v6Prob, emptyProb, other}, []net.IP{v6, v6Empty}, addressProbs,
+		ProblemCodeAAAANotWorking, ProblemCodeEmptyReply)
+	if len(emptyProbs) != 1 || emptyProbs[0] != other || len(emptyFailures) != 2 || emptyFailures[1] != "2001:db8::2: EOF" {
+		t.Fatalf("expected the EmptyReply problem to be superseded, got: %v %v", emptyProbs, emptyFailures)
+	}
+
+	prob := ipv6BrokenIPv4Working("example.org", []net.IP{v6}, []net.IP{v4}, failures)
+	if prob.Severity != SeverityFatal || !strings.HasPrefix(prob.Explanation, "Issuance will fail because Let's Encrypt prefers your broken IPv6") ||
+		!strings.Contains(prob.Detail, "IPv6 failures:\n2001:db8::1: connect: connection refused") {
+		t.Fatalf("unexpected problem: %v", prob)
+	}
+}
+
+func TestIPv6BrokenVerdict(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")
+	v6Prob := aaaaNotWorking("example.org", v6.String(), errors.New("connect: connection refused"), nil)
+	addressProbs := map[string]Problem{v6.String(): v6Prob}
+
+	newCtx := func(ptr string) *scanContext {
+		ctx := newScanContext()
+		a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+		ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}}
+		var ptrs []dns.RR
+		if ptr != "" {
+			rr, _ := dns.NewRR("1.2.0.192.in-addr.arpa. 60 IN PTR " + ptr)
+			ptrs = append(ptrs, rr)
+		}
+		ctx.rrs["1.2.0.192.in-addr.arpa"] = map[uint16]lookupResult{dns.TypePTR: {RRs: ptrs}}
+		return ctx
+	}
+
+	for _, test := range []struct {
+		name     string
+		ctx      *scanContext
+		cdn      string
+		expected ProblemCode
+	}{
+		{"apex alias", newCtx("server-192-0-2-1.cloudfront.net."), "", ProblemCodeApexAliasIPv6},
+		{"cdn", newCtx(""), "Cloudflare", ProblemCodeIPv6BrokenBehindCDN},
+		{"direct", newCtx(""), "", ProblemCodeIPv6BrokenIPv4Working},
+	} {
+		probs := ipv6BrokenVerdict(test.ctx, "example.org", test.cdn, []net.IP{v6}, []net.IP{v4}, []Problem{v6Prob}, addressProbs)
+		if len(probs) != 1 || probs[0].Code != test.expected ||
+			!strings.Contains(probs[0].Detail, "IPv6 failures:\n2001:db8::1: connect: connection refused") {
+			t.Fatalf("%s: expected only %s, got: %v", test.name, test.expected, probs)
+		}
+	}
+}
+
+func TestCheckHTTPRepeatability(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 0 {
+			w.Header().Set("Server", "backend-b")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Server", "backend-a")
+		_, _ = w.Write([]byte("token"))
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	probs := checkHTTPRepeatability(ctx, "example.org", []httpCheckResult{res})
+	if len(probs) != 1 || probs[0].Code != ProblemCodeNonDeterministicOrigin ||
+		!strings.Contains(probs[0].Detail, `Request 2: HTTP 404, Server: "backend-b"`) {
+		t.Fatalf("expected NonDeterministicOrigin, got: %v", probs)
+	}
+
+	overloaded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("token"))
+	}))
+	defer overloaded.Close()
+	ctx.httpPort = overloaded.Listener.Addr().(*net.TCPAddr).Port
+	requests = 0
+
+	res, _ = checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if probs := checkHTTPRepeatability(ctx, "example.org", []httpCheckResult{res}); len(probs) != 0 {
+		t.Fatalf("expected 503 responses not to be compared, got: %v", probs)
+	}
+
+	if probs := checkHTTPRepeatability(ctx, "example.org", []httpCheckResult{{}}); len(probs) != 0 {
+		t.Fatalf("expected no problems without a response, got: %v", probs)
+	}
+}
+
+func TestVantageNotNeutral(t *testing.T) {
+	ctx := newScanContext()
+	results := []httpCheckResult{{IP: net.ParseIP("127.0.0.1"), StatusCode: 200, InitialStatusCode: 200}}
+
+	prob := vantageNotNeutral(ctx, "example.org", results, nil)
+	if prob.Code != ProblemCodeVantageNotNeutral || prob.Severity != SeverityDebug ||
+		prob.Detail != "Requests to 127.0.0.1 were made from 127.0.0.1 (the same network)" {
+		t.Fatalf("expected VantageNotNeutral on the same network, got: %v", prob)
+	}
+
+	if prob := vantageNotNeutral(ctx, "example.org", results, []Problem{{Severity: SeverityError}}); !prob.IsZero() {
+		t.Fatalf("expected no note when a request failed, got: %v", prob)
+	}
+
+	ctx.httpProxy = &url.URL{Scheme: "http", Host: "127.0.0.1:3128"}
+	if prob := vantageNotNeutral(ctx, "example.org", results, nil); !prob.IsZero() {
+		t.Fatalf("expected no note when requests go through a proxy, got: %v", prob)
+	}
+
+	ctx.httpProxy = nil
+	ctx.neutralVantage = true
+	if prob := vantageNotNeutral(ctx, "example.org", results, nil); !prob.IsZero() {
+		t.Fatalf("expected no note from a neutral vantage point, got: %v", prob)
+	}
+
+	if !sameNetwork(net.ParseIP("198.51.100.7"), net.ParseIP("198.51.100.200")) ||
+		sameNetwork(net.ParseIP("198.51.100.7"), net.ParseIP("203.0.113.7")) ||
+		!sameNetwork(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::ffff")) ||
+		sameNetwork(net.ParseIP("2001:db8::1"), net.ParseIP("198.51.100.7")) {
+		t.Fatal("unexpected sameNetwork result")
+	}
+}
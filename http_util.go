@@ -1,17 +1,26 @@
 package letsdebug
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/weppos/publicsuffix-go/publicsuffix"
 )
 
 const (
@@ -24,9 +33,86 @@ func (e redirectError) Error() string {
 	return string(e)
 }
 
+// sensitiveTargetError is returned instead of connecting to a cloud metadata or link-local address
+type sensitiveTargetError struct {
+	host   string
+	ip     net.IP
+	reason string
+}
+
+func (e sensitiveTargetError) Error() string {
+	return fmt.Sprintf("Refusing to connect to %s (%s), which is %s", e.host, e.ip, e.reason)
+}
+
+// loopbackTargetError is returned instead of connecting to an address of the host running letsdebug
+type loopbackTargetError struct {
+	host string
+	ip   net.IP
+}
+
+func (e loopbackTargetError) Error() string {
+	return fmt.Sprintf("Refusing to connect to %s (%s), which is an address of the host running this test", e.host, e.ip)
+}
+
+// redirectTargetError is returned when a redirect target other than the domain (whose address is
+// resolved separately from the domain's) could not be resolved or connected to
+type redirectTargetError struct {
+	host string
+	ip   net.IP
+	err  error
+}
+
+func (e redirectTargetError) Error() string {
+	if e.ip == nil {
+		return fmt.Sprintf("The redirect target %s could not be resolved: %v", e.host, e.err)
+	}
+	return fmt.Sprintf("The redirect target %s (%s) could not be connected to: %v", e.host, e.ip, e.err)
+}
+
+func (e redirectTargetError) Unwrap() error {
+	return e.err
+}
+
 type httpCheckResult struct {
-	StatusCode        int
-	ServerHeader      string
+	StatusCode       int
+	ServerHeader     string
+	LocationHeader   string
+	RetryAfterHeader string
+	FinalURL         string
+	ContentEncoding  string
+	// CrossDomainRedirect is the first redirect target outside of the domain's Registered Domain
+	CrossDomainRedirect string
+	// DifferentlyEncodedRedirect is the first redirect target which is the domain itself, but written
+	// in a different IDN encoding (U-labels rather than A-labels, or the other way around)
+	DifferentlyEncodedRedirect string
+	// Chunked is set when the response used chunked transfer encoding, and Trailers when it also
+	// announced or sent trailer headers. BodyError is any error from reading the response body.
+	Chunked   bool
+	Trailers  bool
+	BodyError string
+	// TimedOut is set when the request, or reading its response body, timed out
+	TimedOut bool
+	// Connected is set when the most recent connection was established, so that a timeout happened
+	// while waiting for the response rather than while connecting
+	Connected bool
+	// NotHTTP describes how the server on port 80 failed to speak HTTP after accepting the connection
+	// (closing or resetting it without a response, or answering with something else), if it did
+	NotHTTP string
+	// InterimResponses are the informational (1xx) responses which preceded the final response, e.g.
+	// "103 (Link: </style.css>; rel=preload)"
+	InterimResponses []string
+	// FirstRedirect is the target of the first redirect which was followed
+	FirstRedirect string
+	// ChallengePathDroppedAt is the first redirect ("from -> to") which left /.well-known/acme-challenge/
+	ChallengePathDroppedAt string
+	Headers                http.Header
+	// RequestMethod, RequestURL, RequestHost, RequestUserAgent and Port describe the initial request
+	// exactly as it was sent to IP, so that it can be reproduced
+	RequestMethod     string
+	RequestURL        string
+	RequestHost       string
+	RequestUserAgent  string
+	Port              int
 	IP                net.IP
 	InitialStatusCode int
 	NumRedirects      int
@@ -35,6 +121,26 @@ type httpCheckResult struct {
 	Content           []byte
 }
 
+// knownCDNServerHeaders maps fragments of the Server header to the CDN which sends them
+var knownCDNServerHeaders = map[string]string{
+	"cloudflare":  "Cloudflare",
+	"akamaighost": "Akamai",
+	"cloudfront":  "Amazon CloudFront",
+	"bunnycdn":    "BunnyCDN",
+	"sucuri":      "Sucuri",
+}
+
+// detectCDN returns the name of the CDN which sent a Server header, or an empty string.
+func detectCDN(serverHeader string) string {
+	serverHeader = strings.ToLower(serverHeader)
+	for fragment, cdn := range knownCDNServerHeaders {
+		if strings.Contains(serverHeader, fragment) {
+			return cdn
+		}
+	}
+	return ""
+}
+
 func (r *httpCheckResult) Trace(s string) {
 	if r.FirstDial.IsZero() {
 		r.FirstDial = time.Now()
@@ -43,6 +149,39 @@ func (r *httpCheckResult) Trace(s string) {
 		fmt.Sprintf("@%dms: %s", time.Since(r.FirstDial).Nanoseconds()/1e6, s))
 }
 
+// Request summarises the initial request which was sent, e.g.
+// "GET http://example.org/.well-known/acme-challenge/letsdebug-test (Host: example.org, ...)".
+func (r httpCheckResult) Request() string {
+	return fmt.Sprintf("%s %s (Host: %s, User-Agent: %s, Address: %s)", r.RequestMethod, r.RequestURL, r.RequestHost,
+		r.RequestUserAgent, net.JoinHostPort(r.IP.String(), strconv.Itoa(r.Port)))
+}
+
+// Reproduction returns a curl command which makes the same initial request to the same address.
+func (r httpCheckResult) Reproduction() string {
+	u, err := url.Parse(r.RequestURL)
+	if err != nil {
+		return ""
+	}
+	address := r.IP.String()
+	if r.IP.To4() == nil {
+		address = "[" + address + "]"
+	}
+	args := []string{"curl", "-sv"}
+	if r.RequestMethod == http.MethodHead {
+		args = append(args, "-I")
+	}
+	args = append(args,
+		"--resolve", shellQuote(fmt.Sprintf("%s:%d:%s", u.Hostname(), r.Port, address)),
+		"-H", shellQuote("User-Agent: "+r.RequestUserAgent),
+		shellQuote(r.RequestURL))
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func (r httpCheckResult) IsZero() bool {
 	return r.StatusCode == 0
 }
@@ -104,7 +243,223 @@ func makeSingleShotHTTPTransport() *http.Transport {
 	}
 }
 
+// requestDialer connects to addr for a single request made with a transport from newDialingHTTPTransport
+type requestDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// requestDialerKey is the request context key of the requestDialer which connects for that request
+type requestDialerKey struct{}
+
+// newDialingHTTPTransport returns a transport which can be shared by requests which connect in
+// different ways (e.g. pinned to a different address, or traced into their own result), by making
+// them with a dialingTransport. Connections are not reused, as they aren't by Let's Encrypt: a
+// reused connection would not be to the address being checked, and would always reach the same
+// load-balanced backend.
+func newDialingHTTPTransport(strictTLS bool, proxy *url.URL) *http.Transport {
+	transport := makeSingleShotHTTPTransport()
+	transport.TLSClientConfig.InsecureSkipVerify = !strictTLS
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dial, ok := ctx.Value(requestDialerKey{}).(requestDialer)
+		if !ok {
+			return nil, fmt.Errorf("No dialer was provided for the connection to %s", addr)
+		}
+		return dial(ctx, network, addr)
+	}
+	return transport
+}
+
+// dialingTransport makes requests with a transport from newDialingHTTPTransport, connecting with dial.
+type dialingTransport struct {
+	transport http.RoundTripper
+	dial      requestDialer
+}
+
+func (t dialingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(context.WithValue(req.Context(), requestDialerKey{}, t.dial)))
+}
+
+// VantagePoint is a network location from which an HTTP validation request can be
+// made, so that reachability of a server can be compared from different networks,
+// as Let's Encrypt does with multi-perspective validation.
+type VantagePoint interface {
+	// Name identifies the vantage point in any reported problems.
+	Name() string
+	// Probe makes an HTTP request for path to the server at address, using domain as the Host,
+	// and returns the response status code.
+	Probe(ctx context.Context, domain string, address net.IP, port int, path string) (int, error)
+}
+
+type proxyVantagePoint struct {
+	name  string
+	proxy *url.URL
+}
+
+// NewProxyVantagePoint creates a VantagePoint which makes its requests via an
+// HTTP or SOCKS5 proxy (e.g. http://proxy.example.org:3128 or socks5://127.0.0.1:1080).
+// An empty proxyURL results in a vantage point that makes requests directly.
+func NewProxyVantagePoint(name, proxyURL string) (VantagePoint, error) {
+	vp := proxyVantagePoint{name: name}
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL for vantage point %s: %v", name, err)
+		}
+		vp.proxy = u
+	}
+	return vp, nil
+}
+
+func (vp proxyVantagePoint) Name() string {
+	return vp.name
+}
+
+func (vp proxyVantagePoint) Probe(ctx context.Context, domain string, address net.IP, port int, path string) (int, error) {
+	transport := makeSingleShotHTTPTransport()
+	if vp.proxy != nil {
+		transport.Proxy = http.ProxyURL(vp.proxy)
+	}
+
+	cl := http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://"+net.JoinHostPort(address.String(), strconv.Itoa(port))+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = domain
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("User-Agent", validationUserAgent)
+
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
 func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckResult, Problem) {
+	return checkHTTPPath(scanCtx, domain, address,
+		"/.well-known/acme-challenge/"+scanCtx.httpRequestPath, scanCtx.httpExpectResponse)
+}
+
+// checkHTTPPath emulates an HTTP validation request to a specific path. If expectResponse
+// is not empty, the response body must match it exactly.
+func checkHTTPPath(scanCtx *scanContext, domain string, address net.IP, path, expectResponse string) (httpCheckResult, Problem) {
+	return checkHTTPPathWithMethod(scanCtx, domain, address, http.MethodGet, path, expectResponse)
+}
+
+// checkHTTPPathWithMethod is like checkHTTPPath, but allows a request method other than GET to be used.
+func checkHTTPPathWithMethod(scanCtx *scanContext, domain string, address net.IP, method, path, expectResponse string) (httpCheckResult, Problem) {
+	return checkHTTPPathWithUserAgent(scanCtx, domain, address, method, validationUserAgent, path, expectResponse)
+}
+
+const (
+	// validationUserAgent identifies letsdebug's requests, in the same way as Let's Encrypt's do
+	validationUserAgent = "Mozilla/5.0 (compatible; Let's Debug emulating Let's Encrypt validation server; +https://letsdebug.net)"
+	// browserUserAgent is used to detect servers which filter requests by User-Agent
+	browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+// dialTarget returns the address to connect to for host. Connections for the domain itself (including
+// same-host redirects) are pinned to address, the address being checked, while any other host (the
+// target of a cross-host redirect, or a proxy configured by name) is resolved to one of its own addresses.
+func dialTarget(scanCtx *scanContext, domain string, address net.IP, host string) (net.IP, error) {
+	// e.g. a proxy which was configured by its address, or a redirect to an address
+	if ip := net.ParseIP(host); ip != nil {
+		if isProxyHost(scanCtx, host) {
+			return ip, nil
+		}
+		// The response would come from this host, and would be misleading
+		if isSelfAddress(ip) {
+			return nil, loopbackTargetError{host: host, ip: ip}
+		}
+		if reason := sensitiveAddressReason(ip); reason != "" {
+			return nil, sensitiveTargetError{host: host, ip: ip, reason: reason}
+		}
+		return ip, nil
+	}
+
+	// Only override the address for this specific domain.
+	// We don't want to mangle redirects. The domain may carry a trailing dot when probing
+	// how the server treats the Host header.
+	if isSameHost(host, domain) {
+		if reason := sensitiveAddressReason(address); reason != "" {
+			return nil, sensitiveTargetError{host: host, ip: address, reason: reason}
+		}
+		return address, nil
+	}
+
+	// For other hosts, we need to use Unbound to resolve the name
+	otherAddr, err := scanCtx.LookupRandomHTTPRecord(host)
+	if err != nil {
+		if isProxyHost(scanCtx, host) {
+			return nil, err
+		}
+		return nil, redirectTargetError{host: host, err: err}
+	}
+	// The response would come from this host, and would be misleading
+	if isSelfAddress(otherAddr) {
+		return nil, loopbackTargetError{host: host, ip: otherAddr}
+	}
+	if reason := sensitiveAddressReason(otherAddr); reason != "" {
+		return nil, sensitiveTargetError{host: host, ip: otherAddr, reason: reason}
+	}
+	return otherAddr, nil
+}
+
+// guardedHTTPClient returns a client for incidental requests to domain (other than the validation
+// request), which connects the way checkHTTP does: to one of the domain's addresses as looked up by
+// the scan, never to this host or a sensitive address, and via the configured proxy. Redirects are
+// not followed.
+func guardedHTTPClient(scanCtx *scanContext, domain string) *http.Client {
+	dialer := net.Dialer{
+		Timeout: httpTimeout * time.Second,
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, _ := net.SplitHostPort(addr)
+		host = normalizeFqdn(host)
+
+		var address net.IP
+		if isSameHost(host, domain) {
+			var err error
+			if address, err = scanCtx.LookupRandomHTTPRecord(domain); err != nil {
+				return nil, err
+			}
+			if isSelfAddress(address) {
+				return nil, loopbackTargetError{host: host, ip: address}
+			}
+		}
+		ip, err := dialTarget(scanCtx, domain, address, host)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	}
+	return &http.Client{
+		Timeout:   httpTimeout * time.Second,
+		Transport: dialingTransport{transport: scanCtx.HTTPTransport(), dial: dial},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// isProxyHost returns whether host is that of the configured HTTP proxy.
+func isProxyHost(scanCtx *scanContext, host string) bool {
+	return scanCtx.httpProxy != nil && normalizeFqdn(scanCtx.httpProxy.Hostname()) == host
+}
+
+// checkHTTPPathWithUserAgent is like checkHTTPPathWithMethod, but allows the User-Agent to be changed.
+func checkHTTPPathWithUserAgent(scanCtx *scanContext, domain string, address net.IP, method, userAgent, path,
+	expectResponse string) (httpCheckResult, Problem) {
 	dialer := net.Dialer{
 		Timeout: httpTimeout * time.Second,
 	}
@@ -116,8 +471,10 @@ func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckRe
 
 	var redirErr redirectError
 
-	baseHTTPTransport := makeSingleShotHTTPTransport()
-	baseHTTPTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+	// With a proxy, the proxy makes the connection to the server, so a SOCKS5 proxy is given the
+	// address by putting it in the request URL instead (see below). HTTP proxies always resolve
+	// the name in the Host header themselves.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		host, port, _ := net.SplitHostPort(addr)
 		host = normalizeFqdn(host)
 
@@ -129,36 +486,44 @@ func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckRe
 			return dialer.DialContext(ctx, "tcp", ip.String()+":"+port)
 		}
 
-		// Only override the address for this specific domain.
-		// We don't want to mangle redirects.
-		if host == domain {
-			return dialFunc(address, port)
-		}
-
-		// For other hosts, we need to use Unbound to resolve the name
-		otherAddr, err := scanCtx.LookupRandomHTTPRecord(host)
+		ip, err := dialTarget(scanCtx, domain, address, host)
 		if err != nil {
 			return nil, err
 		}
 
-		return dialFunc(otherAddr, port)
+		// A different host than the domain (other than the proxy) is the target of a redirect
+		isRedirectTarget := net.ParseIP(host) == nil && !isSameHost(host, domain) && !isProxyHost(scanCtx, host)
+		if isRedirectTarget {
+			checkRes.Trace(fmt.Sprintf("Resolved redirect target %s to %s", host, ip))
+		}
+
+		conn, err := dialFunc(ip, port)
+		checkRes.Connected = err == nil
+		if err != nil && isRedirectTarget {
+			return nil, redirectTargetError{host: host, ip: ip, err: err}
+		}
+		return conn, err
 	}
 
 	cl := http.Client{
 		Transport: checkHTTPTransport{
 			result:    checkRes,
-			transport: baseHTTPTransport,
+			transport: dialingTransport{transport: scanCtx.HTTPTransport(), dial: dial},
 		},
 		// boulder: va.go fetchHTTP
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			checkRes.NumRedirects++
 
-			if len(via) >= 10 {
-				redirErr = redirectError(fmt.Sprintf("Too many (%d) redirects, last redirect was to: %s", len(via), req.URL.String()))
+			if len(via) >= scanCtx.httpMaxRedirects {
+				redirErr = redirectError(fmt.Sprintf("Too many (%d) redirects (the maximum is %d), last redirect was to: %s",
+					len(via), scanCtx.httpMaxRedirects, req.URL.String()))
 				return redirErr
 			}
 
 			checkRes.Trace(fmt.Sprintf("Received redirect to %s", req.URL.String()))
+			if checkRes.FirstRedirect == "" {
+				checkRes.FirstRedirect = req.URL.String()
+			}
 
 			host := req.URL.Host
 			if _, p, err := net.SplitHostPort(host); err == nil {
@@ -182,32 +547,86 @@ func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckRe
 				return redirErr
 			}
 
+			if checkRes.ChallengePathDroppedAt == "" && strings.HasPrefix(path, "/.well-known/acme-challenge/") &&
+				!strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/") {
+				checkRes.ChallengePathDroppedAt = fmt.Sprintf("%s -> %s", via[len(via)-1].URL.String(), req.URL.String())
+			}
+
+			if checkRes.DifferentlyEncodedRedirect == "" && isDifferentlyEncodedHost(domain, req.URL.Hostname()) {
+				checkRes.DifferentlyEncodedRedirect = req.URL.String()
+			}
+
+			if checkRes.CrossDomainRedirect == "" && isCrossDomainTarget(domain, req.URL.Hostname()) {
+				checkRes.CrossDomainRedirect = req.URL.String()
+			}
+
 			return nil
 		},
 	}
 
-	reqURL := "http://" + domain + "/.well-known/acme-challenge/" + scanCtx.httpRequestPath
+	host := domain
+	if scanCtx.httpPort != 80 {
+		host = net.JoinHostPort(domain, strconv.Itoa(scanCtx.httpPort))
+	}
+
+	reqURL := "http://" + host + path
 	checkRes.Trace(fmt.Sprintf("Making a request to %s (using initial IP %s)", reqURL, address))
+	if scanCtx.httpProxy != nil {
+		checkRes.Trace(fmt.Sprintf("Using proxy %s", scanCtx.httpProxy.Redacted()))
+		if strings.HasPrefix(scanCtx.httpProxy.Scheme, "socks5") {
+			reqURL = "http://" + net.JoinHostPort(address.String(), strconv.Itoa(scanCtx.httpPort)) + path
+		}
+	}
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequest(method, reqURL, nil)
 	if err != nil {
 		return *checkRes, internalProblem(fmt.Sprintf("Failed to construct validation request: %v", err), SeverityError)
 	}
+	// The Host header is exactly the domain as given (plus the port, if it isn't the default).
+	// Like Let's Encrypt, callers normally pass the lowercase domain without a trailing dot.
+	req.Host = host
 
 	req.Header.Set("Accept", "*/*")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Let's Debug emulating Let's Encrypt validation server; +https://letsdebug.net)")
+	req.Header.Set("User-Agent", userAgent)
+
+	checkRes.RequestMethod = method
+	checkRes.RequestURL = "http://" + host + path
+	checkRes.RequestHost = host
+	checkRes.RequestUserAgent = userAgent
+	checkRes.Port = scanCtx.httpPort
 
-	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout*time.Second)
+	ctx, cancel := context.WithTimeout(scanCtx.Context(), httpTimeout*time.Second)
 	defer cancel()
 
-	req = req.WithContext(ctx)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim := strconv.Itoa(code)
+			if links := header.Values("Link"); len(links) > 0 {
+				interim += fmt.Sprintf(" (Link: %s)", strings.Join(links, ", "))
+			}
+			checkRes.InterimResponses = append(checkRes.InterimResponses, interim)
+			checkRes.Trace(fmt.Sprintf("Server interim response: HTTP %s", interim))
+			return nil
+		},
+	}))
 
 	resp, err := cl.Do(req)
 	if resp != nil {
 		checkRes.StatusCode = resp.StatusCode
 		checkRes.ServerHeader = resp.Header.Get("Server")
+		checkRes.LocationHeader = resp.Header.Get("Location")
+		checkRes.RetryAfterHeader = resp.Header.Get("Retry-After")
+		checkRes.Headers = resp.Header
+		if resp.Request != nil {
+			checkRes.FinalURL = resp.Request.URL.String()
+		}
 	}
 	if err != nil {
+		checkRes.TimedOut = isTimeout(err)
+		// Through a proxy, or after a redirect, the connection that failed may not be to port 80 of address
+		if checkRes.NumRedirects == 0 && scanCtx.httpProxy == nil {
+			checkRes.NotHTTP = notHTTPSymptom(err)
+		}
 		if redirErr != "" {
 			err = redirErr
 		}
@@ -217,25 +636,44 @@ func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckRe
 	defer resp.Body.Close()
 
 	maxLen := 8192
-	if l := len(scanCtx.httpExpectResponse) + 2; l > maxLen {
+	if l := len(expectResponse) + 2; l > maxLen {
 		maxLen = l
 	}
-	r := io.LimitReader(resp.Body, int64(maxLen))
+	// The transport transparently decompresses gzip responses to its own Accept-Encoding,
+	// anything else is decompressed here. Either way, the decompressed size is bounded by maxLen.
+	var body io.Reader = resp.Body
+	checkRes.ContentEncoding = resp.Header.Get("Content-Encoding")
+	if resp.Uncompressed {
+		checkRes.ContentEncoding = "gzip"
+	} else if decoded := decodeContentEncoding(checkRes.ContentEncoding, resp.Body); decoded != nil {
+		body = decoded
+	}
+	r := io.LimitReader(body, int64(maxLen))
 
 	buf, err := ioutil.ReadAll(r)
 	checkRes.Content = buf
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			checkRes.Chunked = true
+		}
+	}
+	checkRes.Trailers = len(resp.Trailer) > 0 || resp.Header.Get("Trailer") != ""
+	if err != nil {
+		checkRes.BodyError = err.Error()
+		checkRes.TimedOut = isTimeout(err)
+	}
 
 	// If we expect a certain response, check for it
-	if scanCtx.httpExpectResponse != "" {
+	if expectResponse != "" {
 		if err != nil {
 			return *checkRes, translateHTTPError(domain, address,
 				fmt.Errorf(`This test expected the server to respond with "%s" but instead we experienced an error reading the response: %v`,
-					scanCtx.httpExpectResponse, err),
+					expectResponse, err),
 				checkRes.DialStack)
-		} else if respStr := string(buf); respStr != scanCtx.httpExpectResponse {
+		} else if respStr := string(buf); respStr != expectResponse {
 			return *checkRes, translateHTTPError(domain, address,
 				fmt.Errorf(`This test expected the server to respond with "%s" but instead we got a response beginning with "%s"`,
-					scanCtx.httpExpectResponse, respStr),
+					expectResponse, respStr),
 				checkRes.DialStack)
 		}
 	}
@@ -243,16 +681,64 @@ func checkHTTP(scanCtx *scanContext, domain string, address net.IP) (httpCheckRe
 	return *checkRes, Problem{}
 }
 
+// decodeContentEncoding wraps body in a decompressor for the Content-Encoding, or returns
+// nil if the encoding is not supported or the body is not validly encoded.
+func decodeContentEncoding(encoding string, body io.Reader) io.Reader {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	}
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
 func translateHTTPError(domain string, address net.IP, e error, dialStack []string) Problem {
 	if redirErr, ok := e.(redirectError); ok {
 		return badRedirect(domain, redirErr, dialStack)
 	}
 
+	if certErr := asCertificateError(e); certErr != nil {
+		return invalidRedirectCertificate(domain, certErr, dialStack)
+	}
+
 	if strings.HasSuffix(e.Error(), "http: server gave HTTP response to HTTPS client") {
 		return httpServerMisconfiguration(domain, "Web server is serving the wrong protocol on the wrong port: "+e.Error()+
 			". This may be due to a previous HTTP redirect rather than a webserver misconfiguration.\n\nTrace:\n"+strings.Join(dialStack, "\n"))
 	}
 
+	if isTLSRecordResponse(e) {
+		return httpsOnPort80(domain, address, e, dialStack)
+	}
+
+	var loopbackErr loopbackTargetError
+	if errors.As(e, &loopbackErr) {
+		return loopbackTarget(domain, loopbackErr.host, loopbackErr.ip, dialStack)
+	}
+
+	var sensitiveErr sensitiveTargetError
+	if errors.As(e, &sensitiveErr) {
+		return sensitiveTargetAddress(domain, sensitiveErr.host, sensitiveErr.ip, sensitiveErr.reason, dialStack)
+	}
+
+	var redirectTargetErr redirectTargetError
+	if errors.As(e, &redirectTargetErr) {
+		return redirectTargetUnreachable(domain, address, redirectTargetErr, dialStack)
+	}
+
+	if isMalformedHTTPResponse(e) {
+		return malformedHTTPResponse(domain, address, e, dialStack)
+	}
+
+	if errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) {
+		return emptyReply(domain, address, e, dialStack)
+	}
+
 	// Make a nicer error message if it was a context timeout
 	if urlErr, ok := e.(*url.Error); ok && urlErr.Timeout() {
 		e = fmt.Errorf("A timeout was experienced while communicating with %s/%s: %v",
@@ -266,9 +752,159 @@ func translateHTTPError(domain string, address net.IP, e error, dialStack []stri
 	}
 }
 
+// isTimeout returns whether a request failed because it (or the scan) timed out.
+func isTimeout(e error) bool {
+	var netErr net.Error
+	return errors.Is(e, context.DeadlineExceeded) || (errors.As(e, &netErr) && netErr.Timeout())
+}
+
+// notHTTPSymptom describes how a request failed after the TCP connection was made but before any HTTP
+// response was received, or returns an empty string. A TLS response is left to HttpsOnPort80.
+func notHTTPSymptom(e error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF):
+		return "EOF: the connection was closed without any response"
+	case errors.As(e, &opErr) && opErr.Op == "read" && errors.Is(e, syscall.ECONNRESET):
+		return "Reset: the connection was reset without any response"
+	case isMalformedHTTPResponse(e) && !isTLSRecordResponse(e):
+		return fmt.Sprintf("Garbage: the response was not HTTP (%v)", e)
+	}
+	return ""
+}
+
+// isTLSRecordResponse returns whether a plaintext HTTP request was answered with a TLS record
+// (an alert or a handshake), which net/http reports as a malformed HTTP response.
+func isTLSRecordResponse(e error) bool {
+	msg := e.Error()
+	return strings.Contains(msg, `malformed HTTP response "\x15\x03`) ||
+		strings.Contains(msg, `malformed HTTP response "\x16\x03`)
+}
+
+// isMalformedHTTPResponse returns whether the response could not be parsed as HTTP/1.x, e.g. because
+// the server speaks HTTP/0.9 or sends a broken status line.
+func isMalformedHTTPResponse(e error) bool {
+	msg := e.Error()
+	return strings.Contains(msg, "malformed HTTP response") ||
+		strings.Contains(msg, "malformed HTTP status code") ||
+		strings.Contains(msg, "malformed HTTP version")
+}
+
+func malformedHTTPResponse(domain string, address net.IP, err error, dialStack []string) Problem {
+	return Problem{
+		Name: "MalformedHttpResponse",
+		Code: ProblemCodeMalformedHttpResponse,
+		Explanation: fmt.Sprintf(`The server at %s/%s responded, but its response was not valid HTTP/1.x (e.g. HTTP/0.9, `+
+			`or a broken status line). This commonly happens when port 80 is answered by a device which is not a web server, `+
+			`or by an old embedded web server (such as on a printer, camera or router). Check that the DNS records for %s `+
+			`point at the right device, and that port 80 is forwarded to your web server.`, domain, address.String(), domain),
+		Detail:   fmt.Sprintf("%s\n\nTrace:\n%s", err.Error(), strings.Join(dialStack, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+func httpsOnPort80(domain string, address net.IP, err error, dialStack []string) Problem {
+	return Problem{
+		Name: "HttpsOnPort80",
+		Code: ProblemCodeHttpsOnPort80,
+		Explanation: fmt.Sprintf(`A plaintext HTTP request to %s/%s was answered with a TLS (HTTPS) response. Let's Encrypt `+
+			`performs HTTP validation using plain HTTP on port 80, so the web server must not be serving HTTPS on this port. `+
+			`This is usually caused by enabling SSL on a port 80 virtualhost, or by a port forward from port 80 to port 443. `+
+			`If HTTPS is desired, redirect from plain HTTP on port 80 to HTTPS on port 443 instead.`, domain, address.String()),
+		Detail:   fmt.Sprintf("%s\n\nTrace:\n%s", err.Error(), strings.Join(dialStack, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+func loopbackTarget(domain, host string, address net.IP, dialStack []string) Problem {
+	return Problem{
+		Name: "LoopbackTarget",
+		Code: ProblemCodeLoopbackTarget,
+		Explanation: fmt.Sprintf(`The HTTP check for %s would have connected to %s at %s, which is a loopback address or an `+
+			`address of the host running this test, so the request was not made: any response would have come from the `+
+			`test host itself rather than from your server. Let's Encrypt cannot reach such an address either. Make sure `+
+			`that %s (and any redirect targets) resolve to the public address of your server.`, domain, host, address, domain),
+		Detail:   fmt.Sprintf("%s: %s\n\nTrace:\n%s", host, address, strings.Join(dialStack, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+func sensitiveTargetAddress(domain, host string, address net.IP, reason string, dialStack []string) Problem {
+	return Problem{
+		Name: "SensitiveTargetAddress",
+		Code: ProblemCodeSensitiveTargetAddress,
+		Explanation: fmt.Sprintf(`The HTTP check for %s would have connected to %s at %s, which is %s, so the request was `+
+			`not made. Such addresses are internal to the network that a request is made from, and are never reachable `+
+			`by Let's Encrypt. Make sure that %s (and any redirect targets) resolve to the public address of your server.`,
+			domain, host, address, reason, domain),
+		Detail:   fmt.Sprintf("%s: %s (%s)\n\nTrace:\n%s", host, address, reason, strings.Join(dialStack, "\n")),
+		Severity: SeverityFatal,
+	}
+}
+
+func redirectTargetUnreachable(domain string, address net.IP, err redirectTargetError, dialStack []string) Problem {
+	target := err.host
+	if err.ip != nil {
+		target = fmt.Sprintf("%s (%s)", err.host, err.ip)
+	}
+	return Problem{
+		Name: "RedirectTargetUnreachable",
+		Code: ProblemCodeRedirectTargetUnreachable,
+		Explanation: fmt.Sprintf(`The server at %s/%s responded to the validation request, but redirected it to %s, which `+
+			`could not be reached. Let's Encrypt follows redirects, resolving each new host name separately, so validation `+
+			`fails at the redirect target. Make sure that %s resolves to a working web server, or change the redirect.`,
+			domain, address, target, err.host),
+		Detail:   fmt.Sprintf("%s\n\nTrace:\n%s", err.Error(), strings.Join(dialStack, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+func emptyReply(domain string, address net.IP, err error, dialStack []string) Problem {
+	return Problem{
+		Name: "EmptyReply",
+		Code: ProblemCodeEmptyReply,
+		Explanation: fmt.Sprintf(`The server at %s/%s accepted the connection, but closed it without sending any HTTP response `+
+			`(an "empty reply from server"). This usually means that the web server or the application behind it crashed or `+
+			`rejected the request, or that the service on port 80 is not speaking plain HTTP (e.g. it expects HTTPS or another `+
+			`protocol). Check the web server's error logs, and make sure that port 80 is served by a plain HTTP virtualhost.`,
+			domain, address.String()),
+		Detail:   fmt.Sprintf("%s\n\nTrace:\n%s", err.Error(), strings.Join(dialStack, "\n")),
+		Severity: SeverityError,
+	}
+}
+
+// asCertificateError returns the underlying certificate verification error, if there is one.
+func asCertificateError(e error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(e, &unknownAuthority):
+		return unknownAuthority
+	case errors.As(e, &hostname):
+		return hostname
+	case errors.As(e, &invalid):
+		return invalid
+	}
+	return nil
+}
+
+func invalidRedirectCertificate(domain string, err error, dialStack []string) Problem {
+	return Problem{
+		Name: "InvalidRedirectCertificate",
+		Code: ProblemCodeInvalidRedirectCertificate,
+		Explanation: fmt.Sprintf(`Sending an ACME HTTP validation request to %s results in a redirect to an HTTPS server `+
+			`whose certificate could not be verified. Let's Encrypt does not verify certificates when following redirects `+
+			`during HTTP validation, but this test was run in strict mode, where certificate errors are treated as fatal.`, domain),
+		Detail:   fmt.Sprintf("%s\n\nTrace:\n%s", err.Error(), strings.Join(dialStack, "\n")),
+		Severity: SeverityFatal,
+	}
+}
+
 func httpServerMisconfiguration(domain, detail string) Problem {
 	return Problem{
 		Name:        "WebserverMisconfiguration",
+		Code:        ProblemCodeWebserverMisconfiguration,
 		Explanation: fmt.Sprintf(`%s's webserver may be misconfigured.`, domain),
 		Detail:      detail,
 		Severity:    SeverityError,
@@ -278,6 +914,7 @@ func httpServerMisconfiguration(domain, detail string) Problem {
 func aaaaNotWorking(domain, ipv6Address string, err error, dialStack []string) Problem {
 	return Problem{
 		Name: "AAAANotWorking",
+		Code: ProblemCodeAAAANotWorking,
 		Explanation: fmt.Sprintf(`%s has an AAAA (IPv6) record (%s) but a test request to this address over port 80 did not succeed. `+
 			`Your web server must have at least one working IPv4 or IPv6 address. `+
 			`You should either ensure that validation requests to this domain succeed over IPv6, or remove its AAAA record.`,
@@ -290,6 +927,7 @@ func aaaaNotWorking(domain, ipv6Address string, err error, dialStack []string) P
 func aNotWorking(domain, addr string, err error, dialStack []string) Problem {
 	return Problem{
 		Name: "ANotWorking",
+		Code: ProblemCodeANotWorking,
 		Explanation: fmt.Sprintf(`%s has an A (IPv4) record (%s) but a request to this address over port 80 did not succeed. `+
 			`Your web server must have at least one working IPv4 or IPv6 address.`,
 			domain, addr),
@@ -301,6 +939,7 @@ func aNotWorking(domain, addr string, err error, dialStack []string) Problem {
 func badRedirect(domain string, err error, dialStack []string) Problem {
 	return Problem{
 		Name: "BadRedirect",
+		Code: ProblemCodeBadRedirect,
 		Explanation: fmt.Sprintf(`Sending an ACME HTTP validation request to %s results in an unacceptable redirect. `+
 			`This is most likely a misconfiguration of your web server or your web application.`,
 			domain),
@@ -308,3 +947,33 @@ func badRedirect(domain string, err error, dialStack []string) Problem {
 		Severity: SeverityError,
 	}
 }
+
+// isSameHost returns whether two host names are the same, after converting both to their A-label
+// (punycode) form, so that an internationalized name matches regardless of its encoding.
+func isSameHost(a, b string) bool {
+	return toASCIIDomain(normalizeFqdn(a)) == toASCIIDomain(normalizeFqdn(b))
+}
+
+// isDifferentlyEncodedHost returns whether target is the same host as domain, but written in a different
+// encoding (i.e. as U-labels rather than A-labels, or the other way around).
+func isDifferentlyEncodedHost(domain, target string) bool {
+	return isSameHost(domain, target) && normalizeFqdn(domain) != normalizeFqdn(target)
+}
+
+// isCrossDomainTarget returns whether a redirect from domain to target leaves domain's
+// Registered Domain (e.g. example.com to example.net, but not example.com to www.example.com).
+func isCrossDomainTarget(domain, target string) bool {
+	target = toASCIIDomain(normalizeFqdn(target))
+	if target == "" || net.ParseIP(target) != nil {
+		return false
+	}
+	from, err := publicsuffix.Domain(toASCIIDomain(normalizeFqdn(domain)))
+	if err != nil {
+		return false
+	}
+	to, err := publicsuffix.Domain(target)
+	if err != nil {
+		return false
+	}
+	return from != to
+}
@@ -0,0 +1,357 @@
+package letsdebug
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTranslateHTTPError_Certificate(t *testing.T) {
+	e := &url.Error{Op: "Get", URL: "https://example.org/", Err: x509.UnknownAuthorityError{}}
+	if p := translateHTTPError("example.org", net.ParseIP("192.0.2.1"), e, nil); p.Name != "InvalidRedirectCertificate" {
+		t.Fatalf("expected InvalidRedirectCertificate, got: %v", p)
+	}
+
+	e = &url.Error{Op: "Get", URL: "http://example.org/", Err: errors.New("connection refused")}
+	if p := translateHTTPError("example.org", net.ParseIP("192.0.2.1"), e, nil); p.Name != "ANotWorking" {
+		t.Fatalf("expected ANotWorking, got: %v", p)
+	}
+}
+
+func TestDetectCDN(t *testing.T) {
+	tests := map[string]string{
+		"cloudflare":   "Cloudflare",
+		"AkamaiGHost":  "Akamai",
+		"nginx/1.18.0": "",
+		"":             "",
+	}
+	for header, expected := range tests {
+		if got := detectCDN(header); got != expected {
+			t.Errorf("%q: expected %q, got %q", header, expected, got)
+		}
+	}
+}
+
+func TestIsCrossDomainTarget(t *testing.T) {
+	tests := []struct {
+		domain, target string
+		expected       bool
+	}{
+		{"example.com", "www.example.com", false},
+		{"www.example.com", "example.com.", false},
+		{"example.com", "example.net", true},
+		{"foo.example.co.uk", "bar.example.co.uk", false},
+		{"example.co.uk", "other.co.uk", true},
+		{"example.com", "192.0.2.1", false},
+		{"xn--bcher-kva.example", "www.bücher.example", false},
+	}
+	for _, tc := range tests {
+		if got := isCrossDomainTarget(tc.domain, tc.target); got != tc.expected {
+			t.Errorf("%s -> %s: expected %v, got %v", tc.domain, tc.target, tc.expected, got)
+		}
+	}
+}
+
+func TestIsDifferentlyEncodedHost(t *testing.T) {
+	if !isDifferentlyEncodedHost("xn--bcher-kva.example", "bücher.example") || !isSameHost("xn--bcher-kva.example", "Bücher.example.") {
+		t.Fatal("expected the U-label form to be recognised as the same host")
+	}
+	if isDifferentlyEncodedHost("xn--bcher-kva.example", "XN--BCHER-KVA.example") || isDifferentlyEncodedHost("example.com", "example.net") {
+		t.Fatal("expected only a different encoding of the same host to be matched")
+	}
+}
+
+func TestTranslateHTTPError_TLSOnPlaintextPort(t *testing.T) {
+	e := &url.Error{Op: "Get", URL: "http://example.org/",
+		Err: errors.New(`net/http: HTTP/1.x transport connection broken: malformed HTTP response "\x15\x03\x01\x00\x02\x02P"`)}
+	if p := translateHTTPError("example.org", net.ParseIP("192.0.2.1"), e, nil); p.Name != "HttpsOnPort80" {
+		t.Fatalf("expected HttpsOnPort80, got: %v", p)
+	}
+}
+
+func TestTranslateHTTPError_LoopbackTarget(t *testing.T) {
+	e := &url.Error{Op: "Get", URL: "http://localhost/", Err: loopbackTargetError{host: "localhost", ip: net.ParseIP("127.0.0.1")}}
+	if p := translateHTTPError("example.org", net.ParseIP("192.0.2.1"), e, nil); p.Name != "LoopbackTarget" {
+		t.Fatalf("expected LoopbackTarget, got: %v", p)
+	}
+}
+
+func TestHTTPCheckResult_Reproduction(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	host := fmt.Sprintf("example.org:%d", ctx.httpPort)
+	if res.RequestMethod != http.MethodGet || res.RequestHost != host ||
+		res.RequestURL != "http://"+host+"/.well-known/acme-challenge/letsdebug-test" {
+		t.Fatalf("unexpected request metadata: %s", res.Request())
+	}
+
+	expected := fmt.Sprintf(`curl -sv --resolve 'example.org:%d:127.0.0.1' -H 'User-Agent: Mozilla/5.0 (compatible; `+
+		`Let'\''s Debug emulating Let'\''s Encrypt validation server; +https://letsdebug.net)' `+
+		`'http://%s/.well-known/acme-challenge/letsdebug-test'`, ctx.httpPort, host)
+	if res.Reproduction() != expected {
+		t.Fatalf("unexpected reproduction:\n%s\nexpected:\n%s", res.Reproduction(), expected)
+	}
+}
+
+func TestCheckHTTP_SensitiveRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	_, prob := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if prob.Code != ProblemCodeSensitiveTargetAddress || !strings.Contains(prob.Detail, "metadata") {
+		t.Fatalf("expected SensitiveTargetAddress, got: %v", prob)
+	}
+}
+
+func TestCheckHTTP_UnreachableRedirectTarget(t *testing.T) {
+	srv := httptest.NewServer(http.RedirectHandler("https://www.example.org/.well-known/acme-challenge/letsdebug-test", http.StatusFound))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+	// The redirect target must be resolved by itself, rather than reusing the domain's address
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeA: {}, dns.TypeAAAA: {}}
+
+	_, prob := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if prob.Code != ProblemCodeRedirectTargetUnreachable || !strings.Contains(prob.Detail, "www.example.org could not be resolved") {
+		t.Fatalf("expected RedirectTargetUnreachable, got: %v", prob)
+	}
+}
+
+func TestCheckHTTP_Proxy(t *testing.T) {
+	var gotURL, gotHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL, gotHost = r.URL.String(), r.Host
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+
+	ctx := newScanContext()
+	ctx.httpProxy, _ = url.Parse(proxy.URL)
+
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("192.0.2.1"))
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the request to reach the proxy, got: %v", res)
+	}
+	if gotURL != "http://example.org/.well-known/acme-challenge/letsdebug-test" || gotHost != "example.org" {
+		t.Fatalf("expected an absolute request for the domain, got: %s (Host: %s)", gotURL, gotHost)
+	}
+}
+
+func TestCheckHTTP_ContentEncoding(t *testing.T) {
+	var encoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wr io.WriteCloser
+		switch encoding {
+		case "gzip":
+			wr = gzip.NewWriter(w)
+		case "deflate":
+			wr = zlib.NewWriter(w)
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		_, _ = wr.Write(bytes.Repeat([]byte("a"), 1<<20))
+		_ = wr.Close()
+	}))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, encoding = range []string{"gzip", "deflate"} {
+		res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+		if res.ContentEncoding != encoding {
+			t.Fatalf("expected Content-Encoding %s, got: %q", encoding, res.ContentEncoding)
+		}
+		// The decompressed content should be bounded
+		if len(res.Content) != 8192 || res.Content[0] != 'a' {
+			t.Fatalf("expected 8192 bytes of decompressed content, got %d for %s", len(res.Content), encoding)
+		}
+		if isCompressedChallengeResponse([]httpCheckResult{res}).IsZero() {
+			t.Fatalf("expected a compressed response to be detected for %s", encoding)
+		}
+	}
+}
+
+// rawTCPServer accepts connections, reads the request and replies with response before closing
+func rawTCPServer(t *testing.T, response string) (port int, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			_, _ = conn.Read(buf)
+			_, _ = conn.Write([]byte(response))
+			_ = conn.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, func() { _ = l.Close() }
+}
+
+func TestCheckHTTP_EmptyReply(t *testing.T) {
+	port, closer := rawTCPServer(t, "")
+	defer closer()
+
+	ctx := newScanContext()
+	ctx.httpPort = port
+
+	res, prob := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if prob.Code != ProblemCodeEmptyReply || !strings.HasPrefix(res.NotHTTP, "EOF: ") {
+		t.Fatalf("expected EmptyReply, got: %v (%q)", prob, res.NotHTTP)
+	}
+}
+
+func TestCheckHTTP_ConnectionReset(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			_, _ = conn.Read(buf)
+			// Closing without lingering sends a RST
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+		}
+	}()
+
+	ctx := newScanContext()
+	ctx.httpPort = l.Addr().(*net.TCPAddr).Port
+
+	if res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1")); !strings.HasPrefix(res.NotHTTP, "Reset: ") {
+		t.Fatalf("expected a reset, got: %q", res.NotHTTP)
+	}
+}
+
+func TestCheckHTTP_MalformedResponse(t *testing.T) {
+	for _, response := range []string{"<html>HTTP/0.9 says hello</html>\r\n", "HTTP/1.1 OK\r\n\r\n"} {
+		port, closer := rawTCPServer(t, response)
+
+		ctx := newScanContext()
+		ctx.httpPort = port
+
+		res, prob := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+		if prob.Code != ProblemCodeMalformedHttpResponse || !strings.HasPrefix(res.NotHTTP, "Garbage: ") {
+			t.Errorf("expected MalformedHttpResponse for %q, got: %v (%q)", response, prob, res.NotHTTP)
+		}
+		closer()
+	}
+}
+
+func TestCheckHTTP_EarlyHints(t *testing.T) {
+	port, closer := rawTCPServer(t, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\n"+
+		"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	defer closer()
+
+	ctx := newScanContext()
+	ctx.httpPort = port
+
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if len(res.InterimResponses) != 1 || res.InterimResponses[0] != "103 (Link: </style.css>; rel=preload; as=style)" {
+		t.Fatalf("expected the early hints to be recorded, got: %v", res.InterimResponses)
+	}
+	if res, hints := isEdgeHints([]httpCheckResult{res}); res.IsZero() || !strings.Contains(hints, "Interim response: 103") {
+		t.Fatalf("expected EdgeHints to be matched, got: %q", hints)
+	}
+}
+
+func TestCheckHTTP_ChunkedTrailers(t *testing.T) {
+	port, closer := rawTCPServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+		"5\r\ntoken\r\n0\r\nX-Checksum abc\r\n\r\n")
+	defer closer()
+
+	ctx := newScanContext()
+	ctx.httpPort = port
+
+	res, _ := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if string(res.Content) != "token" || !res.Chunked || !res.Trailers || res.BodyError == "" {
+		t.Fatalf("expected a chunked response with a broken trailer, got: %+v", res)
+	}
+	if isChunkedTrailerIssue([]httpCheckResult{res}).IsZero() {
+		t.Fatal("expected ChunkedTrailerIssue to be matched")
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	ctx := newScanContext()
+	rr, _ := dns.NewRR("www.example.org. 60 IN A 198.51.100.2")
+	ctx.rrs["www.example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{rr}}, dns.TypeAAAA: {}}
+
+	pinned := net.ParseIP("192.0.2.1")
+	for host, expected := range map[string]string{
+		"example.org":     "192.0.2.1",
+		"www.example.org": "198.51.100.2",
+		"203.0.113.1":     "203.0.113.1",
+	} {
+		ip, err := dialTarget(ctx, "example.org", pinned, host)
+		if err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("%s: expected %s, got: %v (%v)", host, expected, ip, err)
+		}
+	}
+
+	// A redirect to a loopback address is refused, unless it is the configured proxy
+	var loopbackErr loopbackTargetError
+	if _, err := dialTarget(ctx, "example.org", pinned, "127.0.0.1"); !errors.As(err, &loopbackErr) {
+		t.Fatalf("expected a loopback address to be refused, got: %v", err)
+	}
+	ctx.httpProxy = &url.URL{Scheme: "http", Host: "127.0.0.1:3128"}
+	if ip, err := dialTarget(ctx, "example.org", pinned, "127.0.0.1"); err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("expected the proxy to be dialled, got: %v (%v)", ip, err)
+	}
+}
+
+func TestCheckHTTP_LoopbackRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.RedirectHandler("http://127.0.0.1/.well-known/acme-challenge/letsdebug-test", http.StatusFound))
+	defer srv.Close()
+
+	ctx := newScanContext()
+	ctx.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	_, prob := checkHTTP(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if prob.Code != ProblemCodeLoopbackTarget {
+		t.Fatalf("expected LoopbackTarget, got: %v", prob)
+	}
+}
+
+func TestGuardedHTTPClient(t *testing.T) {
+	ctx := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 169.254.169.254")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {}}
+
+	_, err := guardedHTTPClient(ctx, "example.org").Get("http://example.org")
+	var sensitiveErr sensitiveTargetError
+	if !errors.As(err, &sensitiveErr) {
+		t.Fatalf("expected the metadata service not to be connected to, got: %v", err)
+	}
+}
@@ -9,10 +9,17 @@
 package letsdebug
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"reflect"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Options provide additional configuration to the various checkers
@@ -24,6 +31,116 @@ type Options struct {
 	// respond with specific content. If the content does not match, then the test
 	// will fail with severity Error.
 	HTTPExpectResponse string
+	// HTTPChallengeToken and AccountThumbprint, if both provided, cause the HTTP checker to request
+	// the path of a real http-01 challenge token, and to verify that the server responds with the
+	// key authorization (token.thumbprint) for it, as Let's Encrypt would. AccountThumbprint is the
+	// base64url-encoded RFC 7638 thumbprint of the ACME account key.
+	HTTPChallengeToken string
+	AccountThumbprint  string
+	// HTTPPort changes the port that the HTTP checker connects to, instead of
+	// port 80. This is for debugging only (e.g. checking the internal port of a
+	// port-forward), as Let's Encrypt will only ever validate using port 80.
+	HTTPPort int
+	// HTTPControlProbe causes the HTTP checker to make an additional request to an unrelated
+	// path, to detect firewalls and CDNs which treat the ACME challenge path specially.
+	HTTPControlProbe bool
+	// HTTPHeadProbe causes the HTTP checker to repeat the validation request using the HEAD
+	// method, to detect proxies and firewalls which treat HEAD and GET differently.
+	HTTPHeadProbe bool
+	// HTTPVirtualHostProbe causes the HTTP checker to repeat the validation request with an
+	// unrelated Host header, to detect servers which serve a single default virtual host on port 80,
+	// and with a trailing dot on the Host header, to detect fragile virtual host matching.
+	HTTPVirtualHostProbe bool
+	// HTTPUserAgentProbe causes the HTTP checker to repeat a failed validation request with the
+	// User-Agent of a web browser, to detect bot protection which filters requests by User-Agent.
+	HTTPUserAgentProbe bool
+	// HTTPPathProbe causes the HTTP checker to repeat the validation request with a trailing slash
+	// and with a query string, to detect rewrite rules which only match a narrow pattern of path.
+	HTTPPathProbe bool
+	// HTTPRepeatProbe causes the HTTP checker to repeat the validation request to the same server, to
+	// detect load-balanced backends which don't all serve the challenge.
+	HTTPRepeatProbe bool
+	// HTTPStrictTLS causes the HTTP checker to verify the certificates of any HTTPS servers
+	// it is redirected to, and to report verification failures as fatal. By default, certificates
+	// are not verified, as is the case for Let's Encrypt's HTTP validation.
+	HTTPStrictTLS bool
+	// HTTPMaxRedirects changes the maximum number of redirects that the HTTP checker
+	// will follow, which is otherwise 10 (the same as Let's Encrypt).
+	HTTPMaxRedirects int
+	// HTTPProxy, if provided, causes the HTTP checker to make its requests via an HTTP or
+	// SOCKS5 proxy (e.g. socks5://127.0.0.1:1080), so that the results reflect the
+	// network that the proxy is in. With a SOCKS5 proxy, the initial request is still made
+	// to each address of the domain, but HTTP proxies (and redirects) are resolved by the proxy.
+	HTTPProxy *url.URL
+	// VantagePoints, if provided, causes the HTTP validation request to be
+	// repeated from each vantage point, to detect servers which are only
+	// reachable from some networks.
+	VantagePoints []VantagePoint
+	// NeutralVantage declares that the scan runs from a network which is unrelated to the servers being
+	// checked and to their administrators (e.g. a hosted service). Otherwise, a successful HTTP check is
+	// accompanied by a note that access controls scoped to the scanner's source address (such as a
+	// firewall rule which only allows the administrator's IP) would not be visible to it.
+	NeutralVantage bool
+	// AdditionalCAAIssuers are CAA issuer domain names which should be accepted as permitting
+	// issuance, in addition to letsencrypt.org (e.g. when issuing through a reseller).
+	AdditionalCAAIssuers []string
+	// AddressOverride, if provided, is used in place of the A and AAAA records of the
+	// domain(s) being checked, to test whether validation would succeed if the DNS
+	// pointed at these addresses (e.g. before a migration).
+	AddressOverride []net.IP
+	// RenewalInfo causes the ACME server's Renewal Information (ARI) endpoint to be consulted
+	// for the most recently issued certificate covering each domain, to report whether the CA
+	// currently suggests that it be renewed. Requires Certificate Transparency lookups.
+	RenewalInfo bool
+	// ACMEDirectory changes the ACME directory URL used for RenewalInfo, which is otherwise
+	// ACMEDirectoryProduction.
+	ACMEDirectory string
+	// CertificateSerial, if provided, selects the certificate (by hexadecimal serial number) whose
+	// Renewal Information is looked up, instead of the most recently issued one.
+	CertificateSerial string
+	// SkipCheckers are the names of checkers (as listed by CheckerNames) which should not be
+	// run, e.g. to avoid HTTP requests when only DNS validation is used. Names are case-insensitive.
+	// Skipping the checkers which validate the domain and method is not recommended.
+	SkipCheckers []string
+	// IncludeDebug causes problems with SeverityDebug to be included in the results.
+	// By default, only problems of SeverityWarning and above are returned.
+	IncludeDebug bool
+	// SortProblems causes the problems to be deduplicated (where they have the same Name
+	// and Detail) and ordered by severity, most severe first.
+	SortProblems bool
+	// ScanTimeout, if provided, limits the total time that a scan may take. Once it passes, any
+	// checkers which are still running are abandoned (and the remaining ones are not started),
+	// and the problems found so far are returned along with a ScanTimedOut problem.
+	ScanTimeout time.Duration
+	// EventHook, if set, is called as each checker starts and finishes. It may
+	// be called concurrently from multiple goroutines.
+	EventHook func(event ScanEvent)
+	// Concurrency limits the number of domains which ScanMany scans at once, which is otherwise
+	// defaultScanManyConcurrency.
+	Concurrency int
+	// Method is the validation method which ScanMany scans each domain for, which is otherwise
+	// http-01. The other scanning functions are given the method as an argument instead.
+	Method ValidationMethod
+}
+
+// ScanEventType distinguishes the start of a checker's execution from its end
+type ScanEventType string
+
+const (
+	ScanEventStart  ScanEventType = "start"  // ScanEventStart is emitted before a checker runs.
+	ScanEventFinish ScanEventType = "finish" // ScanEventFinish is emitted after a checker has run.
+)
+
+// ScanEvent is delivered to Options.EventHook to trace the execution of each checker
+type ScanEvent struct {
+	Type    ScanEventType
+	Checker string
+	Domain  string
+	Method  ValidationMethod
+	// The following are only set for ScanEventFinish
+	Duration time.Duration
+	Problems int
+	Error    error
 }
 
 // Check calls CheckWithOptions with default options
@@ -33,6 +150,7 @@ func Check(domain string, method ValidationMethod) (probs []Problem, retErr erro
 
 // CheckWithOptions will run each checker against the domain and validation method provided.
 // It is expected that this method may take a long time to execute, and may not be cancelled.
+// Problems with SeverityDebug are only returned if opts.IncludeDebug is set.
 func CheckWithOptions(domain string, method ValidationMethod, opts Options) (probs []Problem, retErr error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -40,6 +158,460 @@ func CheckWithOptions(domain string, method ValidationMethod, opts Options) (pro
 		}
 	}()
 
+	ctx := newScanContextFromOptions(opts)
+
+	result, err := scan(ctx, []string{toASCIIDomain(normalizeFqdn(domain))}, method, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Problems, nil
+}
+
+// CheckMultiple calls CheckMultipleWithOptions with default options
+func CheckMultiple(domains []string, method ValidationMethod) ([]Problem, error) {
+	return CheckMultipleWithOptions(domains, method, Options{})
+}
+
+// CheckMultipleWithOptions checks a set of domains which are intended to be issued together
+// in the same certificate (e.g. example.org and www.example.org).
+// Each domain is checked as if by CheckWithOptions, after which further checks are run
+// which consider the names together, such as whether only some of them are resolvable.
+func CheckMultipleWithOptions(domains []string, method ValidationMethod, opts Options) ([]Problem, error) {
+	result, err := Scan(domains, method, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Problems, nil
+}
+
+// ScanResult is the outcome of a scan, along with metadata about how the scan ran.
+type ScanResult struct {
+	Problems []Problem
+	// CheckerErrors lists the checkers which failed with an error (or panicked). The scan
+	// continues without them, and each is also reported in Problems as an InternalProblem.
+	CheckerErrors []CheckerError
+	// TimedOut is set when Options.ScanTimeout passed before every checker had finished, in which
+	// case Problems are incomplete and include a ScanTimedOut problem.
+	TimedOut bool
+}
+
+// CheckerError records the failure of a single checker during a scan.
+type CheckerError struct {
+	Checker string
+	Domain  string
+	Error   error
+}
+
+// Scan is like CheckMultipleWithOptions, but returns the full ScanResult.
+func Scan(domains []string, method ValidationMethod, opts Options) (result ScanResult, retErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			retErr = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	ctx := newScanContextFromOptions(opts)
+
+	var names []string
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		domain = toASCIIDomain(normalizeFqdn(domain))
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		names = append(names, domain)
+	}
+
+	return scan(ctx, names, method, opts)
+}
+
+// ScanMethods scans the domains once for each of the validation methods (or for http-01, dns-01
+// and tls-alpn-01, if none are provided), for when the method that will be used isn't known yet.
+// The scans run concurrently, and every problem is tagged with the method it was found for, so
+// that e.g. OverallVerdict can be compared between methods.
+func ScanMethods(domains []string, methods []ValidationMethod, opts Options) (map[ValidationMethod]ScanResult, error) {
+	if len(methods) == 0 {
+		methods = []ValidationMethod{HTTP01, DNS01, TLSALPN01}
+	}
+
+	type methodResult struct {
+		method ValidationMethod
+		result ScanResult
+		err    error
+	}
+	resultCh := make(chan methodResult, len(methods))
+	for _, method := range methods {
+		go func(method ValidationMethod) {
+			result, err := Scan(domains, method, opts)
+			resultCh <- methodResult{method, result, err}
+		}(method)
+	}
+
+	results := map[ValidationMethod]ScanResult{}
+	var firstErr error
+	for range methods {
+		r := <-resultCh
+		if r.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", r.method, r.err)
+		}
+		results[r.method] = r.result
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// defaultScanManyConcurrency is the number of domains which ScanMany scans at once by default
+const defaultScanManyConcurrency = 8
+
+// ScanMany scans each of the domains separately (as if each was to be issued in its own certificate)
+// for opts.Method, for checking a large inventory of domains in one call. The results are keyed by the
+// domains as given. The scans share a DNS lookup cache, an HTTP transport and (like any scan) the
+// Certificate Transparency client, and at most opts.Concurrency of them run at once. A scan which fails
+// is reported as an InternalProblem in its result, rather than aborting the others.
+// Once ctx is done, no further scans are started and those which are running stop early (as if they
+// had reached their ScanTimeout), and the results of the scans which had been started are returned
+// along with ctx's error.
+func ScanMany(ctx context.Context, domains []string, opts Options) (map[string]ScanResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultScanManyConcurrency
+	}
+	method := opts.Method
+	if method == "" {
+		method = HTTP01
+	}
+
+	shared := newScanContextFromOptions(opts)
+	results := map[string]ScanResult{}
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	var err error
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+
+		if err = ctx.Err(); err == nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := scanShared(ctx, shared, domain, method, opts)
+			if err != nil {
+				result = ScanResult{Problems: []Problem{
+					internalProblem(fmt.Sprintf("The scan of %s failed: %v", domain, err), SeverityFatal),
+				}}
+			}
+
+			resultsMutex.Lock()
+			results[domain] = result
+			resultsMutex.Unlock()
+		}(domain)
+	}
+
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return results, err
+}
+
+// scanShared scans a single domain, like Scan, but using the DNS lookup cache and HTTP transport of
+// shared, and stopping early once parent is done.
+func scanShared(parent context.Context, shared *scanContext, domain string, method ValidationMethod,
+	opts Options) (result ScanResult, retErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			retErr = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	ctx := newScanContextFromOptions(opts)
+	ctx.share(shared)
+	ctx.deadline = parent
+
+	name := toASCIIDomain(normalizeFqdn(domain))
+	if name == "" {
+		return ScanResult{}, fmt.Errorf("%q is not a domain name", domain)
+	}
+	return scan(ctx, []string{name}, method, opts)
+}
+
+// scan runs every checker against each of the names, and then the multi-name checkers
+// against them together.
+func scan(ctx *scanContext, names []string, method ValidationMethod, opts Options) (ScanResult, error) {
+	ctx.names = names
+
+	// The time limit applies within any deadline that the scan already has (e.g. ScanMany's context)
+	if opts.ScanTimeout > 0 {
+		deadline, cancel := context.WithTimeout(ctx.Context(), opts.ScanTimeout)
+		defer cancel()
+		ctx.deadline = deadline
+	}
+
+	var probs []Problem
+	for _, domain := range names {
+		domainProbs, err := runCheckers(ctx, domain, method)
+		if err != nil {
+			return ScanResult{}, err
+		}
+		probs = append(probs, domainProbs...)
+	}
+
+	// A wildcard can't be issued with any method other than dns-01, so the results of checking the
+	// names together wouldn't apply; the MethodNotSuitable problem is the whole story.
+	wildcardNotSuitable := false
+	// Likewise, an IP address has no DNS records to compare with the other names
+	hasIPAddress := false
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") && method != DNS01 {
+			wildcardNotSuitable = true
+		}
+		if ipLiteral(name) != nil {
+			hasIPAddress = true
+		}
+	}
+
+	if len(names) > 1 && !wildcardNotSuitable && !hasIPAddress {
+		for _, checker := range multiNameCheckers {
+			if ctx.skips(checker) {
+				continue
+			}
+			if ctx.Context().Err() != nil {
+				ctx.recordUnfinished(checkerName(checker), strings.Join(names, ","))
+				continue
+			}
+			debug("[*] + %T\n", checker)
+			checker := checker
+			checkerProbs, finished, err := ctx.runBeforeDeadline(func() ([]Problem, error) {
+				return checker.CheckNames(ctx, names, method)
+			})
+			debug("[*] - %T\n", checker)
+			if !finished {
+				ctx.recordUnfinished(checkerName(checker), strings.Join(names, ","))
+				continue
+			}
+			if err != nil && err != errNotApplicable {
+				ctx.recordCheckerError(checkerName(checker), strings.Join(names, ","), err)
+				checkerProbs = append(checkerProbs, checkerFailed(checker, err))
+			}
+			probs = append(probs, checkerProbs...)
+		}
+	}
+
+	timedOut := len(ctx.unfinished) > 0
+	if timedOut {
+		probs = append(probs, scanTimedOut(opts.ScanTimeout, ctx.Context().Err() == context.Canceled, ctx.unfinished))
+	}
+
+	probs = append(probs, failedValidationLimit(method, probs)...)
+
+	for i := range probs {
+		probs[i].Method = method
+	}
+
+	probs = withUnicodeNames(probs)
+
+	if !opts.IncludeDebug {
+		probs = withoutDebugProblems(probs)
+	}
+	if opts.SortProblems {
+		probs = sortAndDeduplicateProblems(probs)
+	}
+
+	return ScanResult{Problems: probs, CheckerErrors: ctx.checkerErrors, TimedOut: timedOut}, nil
+}
+
+func scanTimedOut(timeout time.Duration, cancelled bool, unfinished []string) Problem {
+	reason := fmt.Sprintf("did not complete within its time limit of %v", timeout)
+	if cancelled {
+		reason = "was cancelled before it completed"
+	}
+	return Problem{
+		Name: "ScanTimedOut",
+		Code: ProblemCodeScanTimedOut,
+		Explanation: fmt.Sprintf(`The scan %s, so some checks did not finish and their results are missing. The `+
+			`problems which were found are shown, but there may be others.`, reason),
+		Detail:   fmt.Sprintf("Unfinished checks: %s", strings.Join(unfinished, ", ")),
+		Severity: SeverityWarning,
+	}
+}
+
+// failedValidationProblems are the problems which are found by Let's Encrypt while it attempts
+// validation, and so count as failed validations. Others, such as an invalid domain, an unsuitable
+// method or a rate limit, are refused before any validation is attempted.
+var failedValidationProblems = map[ProblemCode]bool{
+	// Resolving the domain, and looking up CAA records
+	ProblemCodeDNSLookupFailed:               true,
+	ProblemCodeDnsRefused:                    true,
+	ProblemCodeDnssecDsMismatch:              true,
+	ProblemCodeDnssecMissingDnskey:           true,
+	ProblemCodeDnssecExpiredSignature:        true,
+	ProblemCodeNoRecords:                     true,
+	ProblemCodeReservedAddress:               true,
+	ProblemCodeTXTRecordError:                true,
+	ProblemCodeCaaLookupTimeout:              true,
+	ProblemCodeCAAIssuanceNotAllowed:         true,
+	ProblemCodeCAACriticalUnknown:            true,
+	ProblemCodeCaaLikelyTypo:                 true,
+	ProblemCodeMalformedCaaIssuer:            true,
+	ProblemCodeCaaIssuerSuffixMistake:        true,
+	ProblemCodeCAAValidationMethodNotAllowed: true,
+	ProblemCodeCAAAccountURIRestricted:       true,
+
+	// Making the HTTP validation request
+	ProblemCodeANotWorking:                          true,
+	ProblemCodeAAAANotWorking:                       true,
+	ProblemCodeIPv6BrokenIPv4Working:                true,
+	ProblemCodeIPv6BrokenBehindCDN:                  true,
+	ProblemCodeIPv6HTTPSRedirectBroken:              true,
+	ProblemCodeLoopbackTarget:                       true,
+	ProblemCodeSensitiveTargetAddress:               true,
+	ProblemCodeBadRedirect:                          true,
+	ProblemCodeRedirectTargetUnreachable:            true,
+	ProblemCodeRedirectDropsChallengePath:           true,
+	ProblemCodeCloudflareRedirectDropsChallengePath: true,
+	ProblemCodeEmptyReply:                           true,
+	ProblemCodeMalformedHttpResponse:                true,
+	ProblemCodeHttpsOnPort80:                        true,
+	ProblemCodePort80NotSpeakingHttp:                true,
+	ProblemCodeWebserverMisconfiguration:            true,
+	ProblemCodeChallengePathHangs:                   true,
+	ProblemCodeChallengePathServerError:             true,
+	ProblemCodeHttp10Only:                           true,
+	ProblemCodeKeyAuthorizationMismatch:             true,
+	ProblemCodeWafBlockingChallenge:                 true,
+	ProblemCodeBlockedByFirewall:                    true,
+	ProblemCodeBlockedByNginxTestCookie:             true,
+	ProblemCodeCloudflareUnderAttackMode:            true,
+	ProblemCodeIntegratedAuthRequired:               true,
+	ProblemCodeIISChallengeHandler:                  true,
+	ProblemCodeRedirectToLogin:                      true,
+	ProblemCodeOriginRateLimiting:                   true,
+	ProblemCodeLoadBalancerNoBackend:                true,
+	ProblemCodeMisdirectedRequest:                   true,
+}
+
+// failedValidationLimit notes that retrying issuance will trip the Failed Validations rate limit, when
+// any of the problems found with an http-01 or dns-01 scan would cause validation to fail.
+func failedValidationLimit(method ValidationMethod, probs []Problem) []Problem {
+	if method != HTTP01 && method != DNS01 {
+		return nil
+	}
+	for _, p := range probs {
+		if (p.Severity != SeverityFatal && p.Severity != SeverityError) || !failedValidationProblems[p.Code] {
+			continue
+		}
+		return []Problem{{
+			Name: "FailedValidationLimit",
+			Code: ProblemCodeFailedValidationLimit,
+			Explanation: `Some of the problems found will cause validation to fail. Let's Encrypt limits the number of ` +
+				`failed validations per account, per hostname, per hour, so repeatedly retrying issuance before they are ` +
+				`fixed will temporarily block every attempt, including correct ones. Fix the problems first (and consider ` +
+				`testing against the staging environment), then retry.`,
+			Detail:   "https://letsencrypt.org/docs/failed-validation-limit/",
+			Severity: SeverityDebug,
+		}}
+	}
+	return nil
+}
+
+// selfTestDomain is a domain which is expected to always resolve and serve HTTP
+const selfTestDomain = "letsencrypt.org"
+
+// interceptionProbeHost and interceptionProbePath are a well-known endpoint which answers any plain HTTP
+// request with an empty 204 response, unless the request is intercepted on the way
+const (
+	interceptionProbeHost = "connectivitycheck.gstatic.com"
+	interceptionProbePath = "/generate_204"
+)
+
+// SelfTest checks that the DNS resolver and outbound HTTP requests which scans depend on are
+// working, by resolving and making a request to a known-good domain using the same code as a scan.
+// It also checks that plain HTTP requests on port 80 aren't intercepted by a captive portal or
+// transparent proxy in the network letsdebug runs in, which would make the results of HTTP checks
+// reflect that network rather than what Let's Encrypt sees.
+// It is intended as a readiness check when deploying letsdebug as a service.
+func SelfTest(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- selfTest(selfTestDomain)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("self-test did not complete: %v", ctx.Err())
+	}
+}
+
+func selfTest(domain string) error {
+	sc := newScanContext()
+
+	rrs, err := sc.Lookup(domain, dns.TypeA)
+	if err != nil {
+		return fmt.Errorf("self-test DNS lookup of %s failed: %v", domain, err)
+	}
+	var address net.IP
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			address = a.A
+			break
+		}
+	}
+	if address == nil {
+		return fmt.Errorf("self-test DNS lookup of %s returned no A records", domain)
+	}
+
+	res, prob := checkHTTPPath(sc, domain, address, "/", "")
+	if res.IsZero() {
+		return fmt.Errorf("self-test HTTP request to %s/%s failed: %s", domain, address, prob.Detail)
+	}
+
+	return detectHTTPInterception(sc)
+}
+
+// detectHTTPInterception makes a request to the interception probe endpoint, and returns an error if
+// the response isn't the expected empty 204. If the endpoint can't be reached at all, that isn't
+// treated as interception.
+func detectHTTPInterception(sc *scanContext) error {
+	address, err := sc.LookupRandomHTTPRecord(interceptionProbeHost)
+	if err != nil {
+		return nil
+	}
+	// A captive portal's redirect may not be followable, but the initial response is enough
+	res, _ := checkHTTPPath(sc, interceptionProbeHost, address, interceptionProbePath, "")
+	if res.InitialStatusCode == 0 {
+		return nil
+	}
+	if res.InitialStatusCode != http.StatusNoContent || len(res.Content) > 0 {
+		return fmt.Errorf("self-test detected interception of plain HTTP requests (e.g. by a captive portal or transparent "+
+			"proxy), so HTTP checks would not reflect what Let's Encrypt sees: %s%s was answered with %s",
+			interceptionProbeHost, interceptionProbePath, res.String())
+	}
+	return nil
+}
+
+func newScanContextFromOptions(opts Options) *scanContext {
 	ctx := newScanContext()
 	if opts.HTTPRequestPath != "" {
 		ctx.httpRequestPath = opts.HTTPRequestPath
@@ -47,15 +619,55 @@ func CheckWithOptions(domain string, method ValidationMethod, opts Options) (pro
 	if opts.HTTPExpectResponse != "" {
 		ctx.httpExpectResponse = opts.HTTPExpectResponse
 	}
+	if opts.HTTPPort != 0 {
+		ctx.httpPort = opts.HTTPPort
+	}
+	if opts.HTTPChallengeToken != "" && opts.AccountThumbprint != "" {
+		ctx.httpRequestPath = opts.HTTPChallengeToken
+		ctx.keyAuthorization = opts.HTTPChallengeToken + "." + opts.AccountThumbprint
+	}
+	ctx.httpControlProbe = opts.HTTPControlProbe
+	ctx.httpHeadProbe = opts.HTTPHeadProbe
+	ctx.httpVirtualHostProbe = opts.HTTPVirtualHostProbe
+	ctx.httpUserAgentProbe = opts.HTTPUserAgentProbe
+	ctx.httpPathProbe = opts.HTTPPathProbe
+	ctx.httpRepeatProbe = opts.HTTPRepeatProbe
+	ctx.httpStrictTLS = opts.HTTPStrictTLS
+	if opts.HTTPMaxRedirects > 0 {
+		ctx.httpMaxRedirects = opts.HTTPMaxRedirects
+	}
+	ctx.httpProxy = opts.HTTPProxy
+	ctx.vantagePoints = opts.VantagePoints
+	ctx.neutralVantage = opts.NeutralVantage
+	ctx.addressOverride = opts.AddressOverride
+	for _, issuer := range opts.AdditionalCAAIssuers {
+		if issuer = normalizeFqdn(issuer); issuer != "" {
+			ctx.caaIssuers = append(ctx.caaIssuers, issuer)
+		}
+	}
+	ctx.renewalInfo = opts.RenewalInfo
+	if opts.ACMEDirectory != "" {
+		ctx.acmeDirectory = opts.ACMEDirectory
+	}
+	ctx.certificateSerial = opts.CertificateSerial
+	for _, name := range opts.SkipCheckers {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			ctx.skipCheckers[name] = true
+		}
+	}
+	ctx.eventHook = opts.EventHook
+	return ctx
+}
 
-	domain = normalizeFqdn(domain)
+// runCheckers runs each checker against a single domain, stopping early when a fatal problem is found.
+func runCheckers(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if len(ctx.addressOverride) > 0 {
+		ctx.overrideAddresses(domain)
+	}
 
+	var probs []Problem
 	for _, checker := range checkers {
-		t := reflect.TypeOf(checker)
-		debug("[*] + %v\n", t)
-		start := time.Now()
-		checkerProbs, err := checker.Check(ctx, domain, method)
-		debug("[*] - %v in %v\n", t, time.Since(start))
+		checkerProbs, err := runChecker(ctx, checker, domain, method, "[*]")
 		if err == nil {
 			if len(checkerProbs) > 0 {
 				probs = append(probs, checkerProbs...)
@@ -1,6 +1,18 @@
 package letsdebug
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
 
 func TestCheck(t *testing.T) {
 	// check success condition
@@ -17,19 +29,377 @@ func TestCheck(t *testing.T) {
 		t.Fatalf("expected 2 problems, got: %d", len(probs))
 	}
 
-	// check fail condition
+	// check that a failing checker doesn't abort the scan
 	checkers = []checker{
 		checkerFail{},
+		checkerSucceedWithProblem{},
+	}
+	probs, err = Check("", "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
 	}
-	if _, err := Check("", ""); err == nil {
-		t.Fatal("expected error, got none")
+	if len(probs) != 2 || probs[0].Name != "InternalProblem" || !strings.Contains(probs[0].Detail, "checkerFail") {
+		t.Fatalf("expected the failure to be reported as a problem, got: %v", probs)
 	}
 
 	// check panic recovery
 	checkers = []checker{
 		checkerPanic{},
+		checkerSucceedEmpty{},
+	}
+	probs, err = Check("", "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(probs) != 1 || probs[0].Name != "InternalProblem" || probs[0].Severity != SeverityError {
+		t.Fatalf("expected panic to be reported as a problem, got: %v", probs)
+	}
+}
+
+func TestCheckWithOptions_EventHook(t *testing.T) {
+	checkers = []checker{
+		checkerSucceedWithProblem{},
+		asyncCheckerBlock{
+			checkerSucceedEmpty{},
+		},
+	}
+
+	var mu sync.Mutex
+	events := map[string][]ScanEvent{}
+	_, err := CheckWithOptions("", "", Options{
+		EventHook: func(ev ScanEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events[ev.Checker] = append(events[ev.Checker], ev)
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected events for 2 checkers, got: %v", events)
+	}
+	evs := events["checkerSucceedWithProblem"]
+	if len(evs) != 2 || evs[0].Type != ScanEventStart || evs[1].Type != ScanEventFinish || evs[1].Problems != 1 {
+		t.Fatalf("unexpected events for checkerSucceedWithProblem: %v", evs)
+	}
+}
+
+func TestCheckWithOptions_IncludeDebug(t *testing.T) {
+	checkers = []checker{checkerSucceedWithDebugProblem{}, checkerSucceedWithProblem{}}
+
+	probs, err := Check("", "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(probs) != 1 {
+		t.Fatalf("expected debug problems to be excluded, got: %v", probs)
+	}
+
+	probs, _ = CheckWithOptions("", "", Options{IncludeDebug: true})
+	if len(probs) != 2 {
+		t.Fatalf("expected debug problems to be included, got: %v", probs)
+	}
+}
+
+type multiNameCounter struct {
+	names *[]string
+}
+
+func (c multiNameCounter) CheckNames(ctx *scanContext, domains []string, method ValidationMethod) ([]Problem, error) {
+	*c.names = domains
+	return []Problem{{Name: "Multi"}}, nil
+}
+
+func TestCheckMultipleWithOptions(t *testing.T) {
+	var names []string
+	checkers = []checker{checkerSucceedWithProblem{}}
+	multiNameCheckers = []multiNameChecker{multiNameCounter{&names}}
+
+	probs, err := CheckMultiple([]string{"example.org", "WWW.example.org.", "example.org"}, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(names) != 2 || names[1] != "www.example.org" {
+		t.Fatalf("expected normalized and deduplicated names, got: %v", names)
+	}
+	if len(probs) != 3 {
+		t.Fatalf("expected a problem per name and one from the multi-name checker, got: %v", probs)
+	}
+}
+
+func TestScan_CheckerErrors(t *testing.T) {
+	checkers = []checker{
+		asyncCheckerBlock{checkerFail{}, checkerPanic{}},
+		checkerSucceedWithProblem{},
+	}
+	multiNameCheckers = nil
+
+	result, err := Scan([]string{"example.org"}, HTTP01, Options{})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(result.Problems) != 3 {
+		t.Fatalf("expected both failures and the remaining problem, got: %v", result.Problems)
+	}
+
+	failed := map[string]string{}
+	for _, ce := range result.CheckerErrors {
+		if ce.Domain != "example.org" {
+			t.Fatalf("expected the domain to be recorded, got: %v", ce)
+		}
+		failed[ce.Checker] = ce.Error.Error()
+	}
+	if failed["checkerFail"] != "failure" || failed["checkerPanic"] != "panic: hi" {
+		t.Fatalf("expected both failing checkers to be recorded, got: %v", result.CheckerErrors)
+	}
+}
+
+func TestCheckMultipleWithOptions_WildcardHTTP01(t *testing.T) {
+	var names []string
+	checkers = []checker{wildcardDNS01OnlyChecker{}, checkerSucceedWithProblem{}}
+	multiNameCheckers = []multiNameChecker{multiNameCounter{&names}}
+
+	probs, err := CheckMultiple([]string{"example.org", "*.example.org"}, HTTP01)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// The base name is checked as usual, but the wildcard only produces MethodNotSuitable
+	if len(probs) != 2 || probs[1].Code != ProblemCodeMethodNotSuitable || names != nil {
+		t.Fatalf("expected only MethodNotSuitable for the wildcard, got: %v", probs)
+	}
+}
+
+func TestSelfTest_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := SelfTest(ctx); err == nil {
+		t.Fatal("expected the cancelled self-test to fail")
+	}
+}
+
+func TestDetectHTTPInterception(t *testing.T) {
+	for _, test := range []struct {
+		handler     http.Handler
+		intercepted bool
+	}{
+		{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }), false},
+		{http.RedirectHandler("http://portal.example.net/login", http.StatusFound), true},
+	} {
+		srv := httptest.NewServer(test.handler)
+		sc := newScanContext()
+		sc.httpPort = srv.Listener.Addr().(*net.TCPAddr).Port
+		a, _ := dns.NewRR(interceptionProbeHost + ". 60 IN A 127.0.0.1")
+		sc.rrs[interceptionProbeHost] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {}}
+
+		if err := detectHTTPInterception(sc); (err != nil) != test.intercepted {
+			t.Errorf("expected interception (%t), got: %v", test.intercepted, err)
+		}
+		srv.Close()
+	}
+}
+
+type checkerEchoDomain struct {
+	received *string
+}
+
+func (c checkerEchoDomain) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	*c.received = domain
+	return []Problem{{Name: "Echo", Explanation: "Checked " + domain + ".", Detail: domain}}, nil
+}
+
+func TestCheck_IDN(t *testing.T) {
+	var received string
+	checkers = []checker{checkerEchoDomain{&received}}
+
+	probs, err := Check("Bücher.example", HTTP01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "xn--bcher-kva.example" {
+		t.Fatalf("expected the checkers to receive the A-label, got: %s", received)
+	}
+	if len(probs) != 1 || probs[0].Explanation != "Checked bücher.example." || probs[0].Detail != received {
+		t.Fatalf("expected the explanation to show the U-label, got: %v", probs)
+	}
+}
+
+type checkerSlow struct{}
+
+func (c checkerSlow) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	time.Sleep(time.Second)
+	return []Problem{{Name: "Slow"}}, nil
+}
+
+func TestScan_ScanTimeout(t *testing.T) {
+	checkers = []checker{
+		asyncCheckerBlock{checkerSucceedWithProblem{}, checkerSlow{}},
+		checkerSucceedWithProblem{},
+	}
+	multiNameCheckers = nil
+
+	start := time.Now()
+	result, err := Scan([]string{"example.org"}, HTTP01, Options{ScanTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("expected the scan to stop at its deadline, took %v", took)
+	}
+	if !result.TimedOut || len(result.Problems) != 2 {
+		t.Fatalf("expected the completed problem and ScanTimedOut, got: %v", result.Problems)
+	}
+	timedOut := result.Problems[1]
+	if timedOut.Code != ProblemCodeScanTimedOut || !strings.Contains(timedOut.Detail, "checkerSlow (example.org)") ||
+		!strings.Contains(timedOut.Detail, "checkerSucceedWithProblem (example.org)") {
+		t.Fatalf("expected the unfinished checkers to be listed, got: %v", timedOut)
+	}
+}
+
+type checkerMethod struct{}
+
+func (c checkerMethod) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != HTTP01 {
+		return nil, errNotApplicable
+	}
+	return []Problem{{Name: "HTTPOnly", Code: ProblemCodeANotWorking, Severity: SeverityError}}, nil
+}
+
+func TestScanMethods(t *testing.T) {
+	checkers = []checker{checkerMethod{}}
+	multiNameCheckers = nil
+
+	results, err := ScanMethods([]string{"example.org"}, nil, Options{IncludeDebug: true})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected a result for each method, got: %v", results)
+	}
+	// The Error problem is followed by the FailedValidationLimit note
+	if probs := results[HTTP01].Problems; len(probs) != 2 || probs[0].Method != HTTP01 || probs[1].Method != HTTP01 {
+		t.Fatalf("expected the problems to be tagged with http-01, got: %v", probs)
+	}
+	if v := OverallVerdict(results[DNS01].Problems); v != VerdictOK {
+		t.Fatalf("expected dns-01 to be OK, got: %s", v)
+	}
+}
+
+// checkerLookup records the A records of each domain that it is run against
+type checkerLookup struct{}
+
+func (c checkerLookup) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	rrs, _ := ctx.Lookup(domain, dns.TypeA)
+	return []Problem{{Name: "Lookup", Detail: fmt.Sprint(len(rrs)), Severity: SeverityWarning}}, nil
+}
+
+func TestScanMany(t *testing.T) {
+	checkers = []checker{checkerLookup{}}
+	multiNameCheckers = nil
+
+	// Every scan gets the same (seeded) DNS cache
+	lookups := newScanContext()
+	a, _ := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	lookups.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}}
+	lookups.rrs["example.net"] = map[uint16]lookupResult{dns.TypeA: {}}
+	for _, domain := range []string{"example.org", "example.net"} {
+		result, err := scanShared(context.Background(), lookups, domain, HTTP01, Options{})
+		if err != nil || len(result.Problems) != 1 {
+			t.Fatalf("unexpected result for %s: %v, %v", domain, result, err)
+		}
+		if expected := map[string]string{"example.org": "1", "example.net": "0"}[domain]; result.Problems[0].Detail != expected {
+			t.Fatalf("expected the shared cache to be used for %s, got: %v", domain, result.Problems)
+		}
+	}
+
+	results, err := ScanMany(context.Background(), []string{"", "example.org"}, Options{Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[""].Problems[0].Code != ProblemCodeInternalProblem {
+		t.Fatalf("expected the invalid domain to fail on its own, got: %v", results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ScanMany(ctx, []string{"example.org"}, Options{}); err != context.Canceled {
+		t.Fatalf("expected the cancellation to be returned, got: %v", err)
+	}
+}
+
+// checkerTransport records the HTTP transport of each scan that it is run in
+type checkerTransport struct {
+	mu         *sync.Mutex
+	transports map[*http.Transport]bool
+}
+
+func (c checkerTransport) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transports[ctx.HTTPTransport()] = true
+	return nil, nil
+}
+
+func TestScanMany_SharedTransport(t *testing.T) {
+	recorder := checkerTransport{mu: &sync.Mutex{}, transports: map[*http.Transport]bool{}}
+	checkers = []checker{recorder}
+	multiNameCheckers = nil
+
+	if _, err := ScanMany(context.Background(), []string{"example.org", "example.net", "example.com"}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.transports) != 1 {
+		t.Fatalf("expected every scan to share one transport, got: %d", len(recorder.transports))
+	}
+}
+
+// checkerBlock blocks until the scan is cancelled
+type checkerBlock struct{}
+
+func (c checkerBlock) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	<-ctx.Context().Done()
+	return nil, nil
+}
+
+func TestScanMany_CancelInFlight(t *testing.T) {
+	checkers = []checker{checkerBlock{}}
+	multiNameCheckers = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	results, err := ScanMany(ctx, []string{"example.org"}, Options{IncludeDebug: true})
+	if err != context.Canceled {
+		t.Fatalf("expected the cancellation to be returned, got: %v", err)
+	}
+	result := results["example.org"]
+	if !result.TimedOut || len(result.Problems) != 1 || result.Problems[0].Code != ProblemCodeScanTimedOut ||
+		!strings.Contains(result.Problems[0].Explanation, "was cancelled") {
+		t.Fatalf("expected the running scan to be cancelled, got: %v", result)
+	}
+}
+
+func TestFailedValidationLimit(t *testing.T) {
+	blocking := []Problem{{Name: "ANotWorking", Code: ProblemCodeANotWorking, Severity: SeverityError}}
+	if probs := failedValidationLimit(HTTP01, blocking); len(probs) != 1 || probs[0].Code != ProblemCodeFailedValidationLimit {
+		t.Fatalf("expected FailedValidationLimit, got: %v", probs)
+	}
+	if probs := failedValidationLimit(TLSALPN01, blocking); len(probs) != 0 {
+		t.Fatalf("expected nothing for tls-alpn-01, got: %v", probs)
+	}
+
+	notBlocking := []Problem{
+		{Name: "HighTTL", Code: ProblemCodeHighTTL, Severity: SeverityDebug},
+		internalProblem("The check failed", SeverityError),
+	}
+	if probs := failedValidationLimit(HTTP01, []Problem{wildcardHTTP01("*.example.org", HTTP01)}); len(probs) != 0 {
+		t.Fatalf("expected nothing for an unsuitable method, got: %v", probs)
+	}
+	if probs := failedValidationLimit(HTTP01, []Problem{invalidDomain("example.invalid", "Domain is a TLD")}); len(probs) != 0 {
+		t.Fatalf("expected nothing for a problem found before validation, got: %v", probs)
 	}
-	if _, err := Check("", ""); err == nil {
-		t.Fatal("expected error, got none")
+	if probs := failedValidationLimit(DNS01, notBlocking); len(probs) != 0 {
+		t.Fatalf("expected nothing without blocking problems, got: %v", probs)
 	}
 }
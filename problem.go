@@ -2,7 +2,11 @@ package letsdebug
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
 // SeverityLevel represents the priority of a reported problem
@@ -11,11 +15,14 @@ type SeverityLevel string
 // Problem represents an issue found by one of the checkers in this package.
 // Explanation is a human-readable explanation of the issue.
 // Detail is usually the underlying machine error.
+// Method is the validation method which the scan that found the problem was for.
 type Problem struct {
-	Name        string        `json:"name"`
-	Explanation string        `json:"explanation"`
-	Detail      string        `json:"detail"`
-	Severity    SeverityLevel `json:"severity"`
+	Name        string           `json:"name"`
+	Code        ProblemCode      `json:"code"`
+	Explanation string           `json:"explanation"`
+	Detail      string           `json:"detail"`
+	Severity    SeverityLevel    `json:"severity"`
+	Method      ValidationMethod `json:"method,omitempty"`
 }
 
 const (
@@ -25,6 +32,201 @@ const (
 	SeverityDebug   SeverityLevel = "Debug" // Not to be shown by default
 )
 
+// ProblemCode identifies the type of a Problem. Its value is the same as Problem.Name,
+// but it allows the type of a problem to be checked without comparing strings.
+type ProblemCode string
+
+const (
+	ProblemCodeAAAANotWorking                       ProblemCode = "AAAANotWorking"
+	ProblemCodeACMEPathIntercepted                  ProblemCode = "ACMEPathIntercepted"
+	ProblemCodeAddressOverridden                    ProblemCode = "AddressOverridden"
+	ProblemCodeAddressTTLMismatch                   ProblemCode = "AddressTTLMismatch"
+	ProblemCodeAltSvcAdvertised                     ProblemCode = "AltSvcAdvertised"
+	ProblemCodeANotWorking                          ProblemCode = "ANotWorking"
+	ProblemCodeAnycastAddress                       ProblemCode = "AnycastAddress"
+	ProblemCodeApexAliasIPv6                        ProblemCode = "ApexAliasIPv6"
+	ProblemCodeApexFlattening                       ProblemCode = "ApexFlattening"
+	ProblemCodeAttachmentResponse                   ProblemCode = "AttachmentResponse"
+	ProblemCodeBadRedirect                          ProblemCode = "BadRedirect"
+	ProblemCodeBlockedByFirewall                    ProblemCode = "BlockedByFirewall"
+	ProblemCodeBlockedByNginxTestCookie             ProblemCode = "BlockedByNginxTestCookie"
+	ProblemCodeBrokenParentZone                     ProblemCode = "BrokenParentZone"
+	ProblemCodeCAA                                  ProblemCode = "CAA"
+	ProblemCodeCAAAccountURIRestricted              ProblemCode = "CAAAccountURIRestricted"
+	ProblemCodeCaaControlledByCdn                   ProblemCode = "CaaControlledByCdn"
+	ProblemCodeCAACriticalUnknown                   ProblemCode = "CAACriticalUnknown"
+	ProblemCodeCAADepth                             ProblemCode = "CAADepth"
+	ProblemCodeCAAIssuanceNotAllowed                ProblemCode = "CAAIssuanceNotAllowed"
+	ProblemCodeCaaIssuerSuffixMistake               ProblemCode = "CaaIssuerSuffixMistake"
+	ProblemCodeCAAIssuewildScope                    ProblemCode = "CAAIssuewildScope"
+	ProblemCodeCaaLikelyTypo                        ProblemCode = "CaaLikelyTypo"
+	ProblemCodeCaaLookupTimeout                     ProblemCode = "CaaLookupTimeout"
+	ProblemCodeCAAPermittedIssuers                  ProblemCode = "CAAPermittedIssuers"
+	ProblemCodeCaaQuotingIssue                      ProblemCode = "CaaQuotingIssue"
+	ProblemCodeCAAUnrestricted                      ProblemCode = "CAAUnrestricted"
+	ProblemCodeCAAUnsupportedByProvider             ProblemCode = "CAAUnsupportedByProvider"
+	ProblemCodeCAAValidationMethodNotAllowed        ProblemCode = "CAAValidationMethodNotAllowed"
+	ProblemCodeCAAWildcardDivergence                ProblemCode = "CAAWildcardDivergence"
+	ProblemCodeCaseSensitiveVhost                   ProblemCode = "CaseSensitiveVhost"
+	ProblemCodeCDNCAAEvaluation                     ProblemCode = "CDNCAAEvaluation"
+	ProblemCodeCertBasedRedirect                    ProblemCode = "CertBasedRedirect"
+	ProblemCodeChallengePathHangs                   ProblemCode = "ChallengePathHangs"
+	ProblemCodeChallengePathServerError             ProblemCode = "ChallengePathServerError"
+	ProblemCodeChallengeResponseCached              ProblemCode = "ChallengeResponseCached"
+	ProblemCodeChunkedTrailerIssue                  ProblemCode = "ChunkedTrailerIssue"
+	ProblemCodeClientSideRedirect                   ProblemCode = "ClientSideRedirect"
+	ProblemCodeClientSubnetLookup                   ProblemCode = "ClientSubnetLookup"
+	ProblemCodeChallengeDirectoryListing            ProblemCode = "ChallengeDirectoryListing"
+	ProblemCodeCloudflareCDN                        ProblemCode = "CloudflareCDN"
+	ProblemCodeCloudflareRedirectDropsChallengePath ProblemCode = "CloudflareRedirectDropsChallengePath"
+	ProblemCodeCloudflareSSLNotProvisioned          ProblemCode = "CloudflareSSLNotProvisioned"
+	ProblemCodeCloudflareUnderAttackMode            ProblemCode = "CloudflareUnderAttackMode"
+	ProblemCodeCompressedChallengeResponse          ProblemCode = "CompressedChallengeResponse"
+	ProblemCodeContradictoryCaa                     ProblemCode = "ContradictoryCaa"
+	ProblemCodeCrossDomainRedirect                  ProblemCode = "CrossDomainRedirect"
+	ProblemCodeDefaultVirtualHost                   ProblemCode = "DefaultVirtualHost"
+	ProblemCodeDefaultWebserverPage                 ProblemCode = "DefaultWebserverPage"
+	ProblemCodeDelegationLookup                     ProblemCode = "DelegationLookup"
+	ProblemCodeDnameRedirection                     ProblemCode = "DnameRedirection"
+	ProblemCodeDNSLookupFailed                      ProblemCode = "DNSLookupFailed"
+	ProblemCodeDnsRefused                           ProblemCode = "DnsRefused"
+	ProblemCodeDnssecDsMismatch                     ProblemCode = "DnssecDsMismatch"
+	ProblemCodeDnssecExpiredSignature               ProblemCode = "DnssecExpiredSignature"
+	ProblemCodeDnssecMissingDnskey                  ProblemCode = "DnssecMissingDnskey"
+	ProblemCodeDomainBoundary                       ProblemCode = "DomainBoundary"
+	ProblemCodeDualStackContentMismatch             ProblemCode = "DualStackContentMismatch"
+	ProblemCodeEdgeHints                            ProblemCode = "EdgeHints"
+	ProblemCodeEmptyChallengeResponse               ProblemCode = "EmptyChallengeResponse"
+	ProblemCodeEmptyReply                           ProblemCode = "EmptyReply"
+	ProblemCodeExistingCertificate                  ProblemCode = "ExistingCertificate"
+	ProblemCodeExistingCertificateExpiry            ProblemCode = "ExistingCertificateExpiry"
+	ProblemCodeFailedValidationLimit                ProblemCode = "FailedValidationLimit"
+	ProblemCodeFlappingDns                          ProblemCode = "FlappingDns"
+	ProblemCodeFragileRewriteRule                   ProblemCode = "FragileRewriteRule"
+	ProblemCodeGeoDNSDivergence                     ProblemCode = "GeoDNSDivergence"
+	ProblemCodeHEADRequestDiscrepancy               ProblemCode = "HEADRequestDiscrepancy"
+	ProblemCodeHighRiskName                         ProblemCode = "HighRiskName"
+	ProblemCodeHighTTL                              ProblemCode = "HighTTL"
+	ProblemCodeHostHeaderSensitivity                ProblemCode = "HostHeaderSensitivity"
+	ProblemCodeHSTSNotAnIssue                       ProblemCode = "HSTSNotAnIssue"
+	ProblemCodeHttp10Only                           ProblemCode = "Http10Only"
+	ProblemCodeHTTPCheck                            ProblemCode = "HTTPCheck"
+	ProblemCodeHttpOnHttpsPort                      ProblemCode = "HttpOnHttpsPort"
+	ProblemCodeHTTPProxyInUse                       ProblemCode = "HTTPProxyInUse"
+	ProblemCodeHTTPRecords                          ProblemCode = "HTTPRecords"
+	ProblemCodeHttpsOnPort80                        ProblemCode = "HttpsOnPort80"
+	ProblemCodeIDNRedirectEncodingMismatch          ProblemCode = "IDNRedirectEncodingMismatch"
+	ProblemCodeIISChallengeHandler                  ProblemCode = "IISChallengeHandler"
+	ProblemCodeIntegratedAuthRequired               ProblemCode = "IntegratedAuthRequired"
+	ProblemCodeInternalProblem                      ProblemCode = "InternalProblem"
+	ProblemCodeInvalidDomain                        ProblemCode = "InvalidDomain"
+	ProblemCodeInvalidMethod                        ProblemCode = "InvalidMethod"
+	ProblemCodeInvalidRedirectCertificate           ProblemCode = "InvalidRedirectCertificate"
+	ProblemCodeIpAddressNotSupported                ProblemCode = "IpAddressNotSupported"
+	ProblemCodeIPv4Only                             ProblemCode = "IPv4Only"
+	ProblemCodeIPv6BrokenBehindCDN                  ProblemCode = "IPv6BrokenBehindCDN"
+	ProblemCodeIPv6BrokenIPv4Working                ProblemCode = "IPv6BrokenIPv4Working"
+	ProblemCodeIPv6HTTPSRedirectBroken              ProblemCode = "IPv6HTTPSRedirectBroken"
+	ProblemCodeIPv6TransitionAddress                ProblemCode = "IPv6TransitionAddress"
+	ProblemCodeIssueFromLetsEncrypt                 ProblemCode = "IssueFromLetsEncrypt"
+	ProblemCodeKeyAuthorizationMismatch             ProblemCode = "KeyAuthorizationMismatch"
+	ProblemCodeLameNameserver                       ProblemCode = "LameNameserver"
+	ProblemCodeLetsEncryptStaging                   ProblemCode = "LetsEncryptStaging"
+	ProblemCodeLoadBalancerNoBackend                ProblemCode = "LoadBalancerNoBackend"
+	ProblemCodeLocationWithoutRedirect              ProblemCode = "LocationWithoutRedirect"
+	ProblemCodeLoopbackTarget                       ProblemCode = "LoopbackTarget"
+	ProblemCodeMalformedCaaIssuer                   ProblemCode = "MalformedCaaIssuer"
+	ProblemCodeMalformedChallengeTxt                ProblemCode = "MalformedChallengeTxt"
+	ProblemCodeMalformedHttpResponse                ProblemCode = "MalformedHttpResponse"
+	ProblemCodeManagedPlatform                      ProblemCode = "ManagedPlatform"
+	ProblemCodeManyAddresses                        ProblemCode = "ManyAddresses"
+	ProblemCodeMethodNotSuitable                    ProblemCode = "MethodNotSuitable"
+	ProblemCodeMisdirectedRequest                   ProblemCode = "MisdirectedRequest"
+	ProblemCodeMissingGlueRecords                   ProblemCode = "MissingGlueRecords"
+	ProblemCodeMultiPerspective                     ProblemCode = "MultiPerspective"
+	ProblemCodeMultiPerspectiveDiscrepancy          ProblemCode = "MultiPerspectiveDiscrepancy"
+	ProblemCodeMultipleChallengeTxtRecords          ProblemCode = "MultipleChallengeTxtRecords"
+	ProblemCodeMultipleIPAddressDiscrepancy         ProblemCode = "MultipleIPAddressDiscrepancy"
+	ProblemCodeNameBasedVhostMissing                ProblemCode = "NameBasedVhostMissing"
+	ProblemCodeNameNotFound                         ProblemCode = "NameNotFound"
+	ProblemCodeNoAddressRecords                     ProblemCode = "NoAddressRecords"
+	ProblemCodeNonDeterministicOrigin               ProblemCode = "NonDeterministicOrigin"
+	ProblemCodeNonIssuableTld                       ProblemCode = "NonIssuableTld"
+	ProblemCodeNonStandardHTTPPort                  ProblemCode = "NonStandardHTTPPort"
+	ProblemCodeNoRecords                            ProblemCode = "NoRecords"
+	ProblemCodeOriginRateLimiting                   ProblemCode = "OriginRateLimiting"
+	ProblemCodeParkingNameservers                   ProblemCode = "ParkingNameservers"
+	ProblemCodePartialNameResolution                ProblemCode = "PartialNameResolution"
+	ProblemCodePort80NotSpeakingHttp                ProblemCode = "Port80NotSpeakingHttp"
+	ProblemCodePortForwarding                       ProblemCode = "PortForwarding"
+	ProblemCodePossibleGeoBlocking                  ProblemCode = "PossibleGeoBlocking"
+	ProblemCodeProxyStripsPath                      ProblemCode = "ProxyStripsPath"
+	ProblemCodePublicSuffix                         ProblemCode = "PublicSuffix"
+	ProblemCodeRateLimit                            ProblemCode = "RateLimit"
+	ProblemCodeRedirectDropsChallengePath           ProblemCode = "RedirectDropsChallengePath"
+	ProblemCodeRedirectTargetUnreachable            ProblemCode = "RedirectTargetUnreachable"
+	ProblemCodeRedirectToLogin                      ProblemCode = "RedirectToLogin"
+	ProblemCodeRenewalInfo                          ProblemCode = "RenewalInfo"
+	ProblemCodeRenewalNotNeeded                     ProblemCode = "RenewalNotNeeded"
+	ProblemCodeRenewalSuggested                     ProblemCode = "RenewalSuggested"
+	ProblemCodeReservedAddress                      ProblemCode = "ReservedAddress"
+	ProblemCodeResolverComparisonInconclusive       ProblemCode = "ResolverComparisonInconclusive"
+	ProblemCodeResolverInterception                 ProblemCode = "ResolverInterception"
+	ProblemCodeRoundRobinPartialFailure             ProblemCode = "RoundRobinPartialFailure"
+	ProblemCodeSanctionedDomain                     ProblemCode = "SanctionedDomain"
+	ProblemCodeScanTimedOut                         ProblemCode = "ScanTimedOut"
+	ProblemCodeSensitiveTargetAddress               ProblemCode = "SensitiveTargetAddress"
+	ProblemCodeSOA                                  ProblemCode = "SOA"
+	ProblemCodeStatusIO                             ProblemCode = "StatusIO"
+	ProblemCodeStatusNotOperational                 ProblemCode = "StatusNotOperational"
+	ProblemCodeTemporarilyUnavailable               ProblemCode = "TemporarilyUnavailable"
+	ProblemCodeTLSALPNAcmeIdentifierMalformed       ProblemCode = "TLSALPNAcmeIdentifierMalformed"
+	ProblemCodeTLSALPNAcmeIdentifierMissing         ProblemCode = "TLSALPNAcmeIdentifierMissing"
+	ProblemCodeTLSALPNCertificateNameMismatch       ProblemCode = "TLSALPNCertificateNameMismatch"
+	ProblemCodeTLSALPNDualStackMismatch             ProblemCode = "TLSALPNDualStackMismatch"
+	ProblemCodeTLSALPNNotNegotiated                 ProblemCode = "TLSALPNNotNegotiated"
+	ProblemCodeTLSALPNNotWorking                    ProblemCode = "TLSALPNNotWorking"
+	ProblemCodeTXTDoubleLabel                       ProblemCode = "TXTDoubleLabel"
+	ProblemCodeTXTRecordError                       ProblemCode = "TXTRecordError"
+	ProblemCodeTXTStaleChallengeRecords             ProblemCode = "TXTStaleChallengeRecords"
+	ProblemCodeUnexpectedContentType                ProblemCode = "UnexpectedContentType"
+	ProblemCodeUnlistedTLD                          ProblemCode = "UnlistedTLD"
+	ProblemCodeUnusualPublicSuffix                  ProblemCode = "UnusualPublicSuffix"
+	ProblemCodeUserAgentFiltering                   ProblemCode = "UserAgentFiltering"
+	ProblemCodeVantageNotNeutral                    ProblemCode = "VantageNotNeutral"
+	ProblemCodeWafBlockingChallenge                 ProblemCode = "WafBlockingChallenge"
+	ProblemCodeWebserverMisconfiguration            ProblemCode = "WebserverMisconfiguration"
+	ProblemCodeWildcardBaseCNAME                    ProblemCode = "WildcardBaseCNAME"
+	ProblemCodeWildcardChallengeWrongName           ProblemCode = "WildcardChallengeWrongName"
+	ProblemCodeWildcardShadowsChallenge             ProblemCode = "WildcardShadowsChallenge"
+	ProblemCodeWWWCounterpart                       ProblemCode = "WWWCounterpart"
+	ProblemCodeZeroTTL                              ProblemCode = "ZeroTTL"
+	ProblemCodeZoneNotFound                         ProblemCode = "ZoneNotFound"
+)
+
+// Verdict summarises whether issuance is likely to succeed, given a set of problems
+type Verdict string
+
+const (
+	VerdictOK      Verdict = "OK"      // No problems that would affect issuance were found
+	VerdictWarning Verdict = "Warning" // Issuance will probably succeed, but there are warnings
+	VerdictBlocked Verdict = "Blocked" // Issuance will probably fail
+)
+
+// OverallVerdict derives a single Verdict from the severities of a set of problems.
+func OverallVerdict(probs []Problem) Verdict {
+	verdict := VerdictOK
+	for _, p := range probs {
+		switch p.Severity {
+		case SeverityFatal, SeverityError:
+			return VerdictBlocked
+		case SeverityWarning:
+			verdict = VerdictWarning
+		}
+	}
+	return verdict
+}
+
 func (p Problem) String() string {
 	return fmt.Sprintf("[%s] %s: %s", p.Name, p.Explanation, p.Detail)
 }
@@ -47,9 +249,61 @@ func hasFatalProblem(probs []Problem) bool {
 	return false
 }
 
+// severityRank orders severities from most to least severe
+var severityRank = map[SeverityLevel]int{SeverityFatal: 0, SeverityError: 1, SeverityWarning: 2, SeverityDebug: 3}
+
+// sortAndDeduplicateProblems removes problems which have the same Name and Detail as an earlier
+// problem, and then orders the remainder by severity, most severe first, otherwise preserving their order.
+func sortAndDeduplicateProblems(probs []Problem) []Problem {
+	type key struct{ name, detail string }
+	seen := map[key]bool{}
+	var out []Problem
+	for _, p := range probs {
+		k := key{p.Name, p.Detail}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, p)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return severityRank[out[i].Severity] < severityRank[out[j].Severity]
+	})
+	return out
+}
+
+// aLabelNames matches domain names which contain at least one A-label (e.g. xn--bcher-kva.example)
+var aLabelNames = regexp.MustCompile(`[a-zA-Z0-9*_.-]*xn--[a-zA-Z0-9_.-]*`)
+
+// withUnicodeNames converts any internationalized domain names in the explanations of problems
+// to their U-label (Unicode) form, so that they are recognisable. The detail, which is usually
+// the underlying record or error, is left unchanged.
+func withUnicodeNames(probs []Problem) []Problem {
+	for i := range probs {
+		probs[i].Explanation = aLabelNames.ReplaceAllStringFunc(probs[i].Explanation, func(name string) string {
+			if u, err := idna.ToUnicode(name); err == nil {
+				return u
+			}
+			return name
+		})
+	}
+	return probs
+}
+
+func withoutDebugProblems(probs []Problem) []Problem {
+	var out []Problem
+	for _, p := range probs {
+		if p.Severity != SeverityDebug {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func internalProblem(message string, level SeverityLevel) Problem {
 	return Problem{
 		Name:        "InternalProblem",
+		Code:        ProblemCodeInternalProblem,
 		Explanation: "An internal error occurred while checking the domain",
 		Detail:      message,
 		Severity:    level,
@@ -57,17 +311,42 @@ func internalProblem(message string, level SeverityLevel) Problem {
 }
 
 func dnsLookupFailed(name, rrType string, err error) Problem {
+	if refused, ok := err.(*dnsRefusedError); ok {
+		return dnsRefused(name, rrType, refused)
+	}
 	return Problem{
 		Name:        "DNSLookupFailed",
+		Code:        ProblemCodeDNSLookupFailed,
 		Explanation: fmt.Sprintf(`A fatal issue occurred during the DNS lookup process for %s/%s.`, name, rrType),
 		Detail:      err.Error(),
 		Severity:    SeverityFatal,
 	}
 }
 
-func debugProblem(name, message, detail string) Problem {
+func dnsRefused(name, rrType string, err *dnsRefusedError) Problem {
+	detail := err.Error()
+	if servers := err.Servers(); len(servers) == 0 {
+		detail += "\nThe nameservers which refused the query could not be identified."
+	} else {
+		detail += "\nRefused by: " + strings.Join(servers, ", ")
+	}
+	return Problem{
+		Name: "DnsRefused",
+		Code: ProblemCodeDnsRefused,
+		Explanation: fmt.Sprintf(`The DNS lookup for %s/%s was answered with REFUSED, meaning that the nameserver declined `+
+			`to answer. This usually means that the server is not authoritative for the domain and will not recurse: `+
+			`either the delegation is lame (the parent zone lists nameservers which are not configured to serve the `+
+			`zone), or the domain is pointed at the wrong nameservers. Check that each nameserver in the delegation `+
+			`is configured to serve the zone.`, name, rrType),
+		Detail:   detail,
+		Severity: SeverityFatal,
+	}
+}
+
+func debugProblem(code ProblemCode, message, detail string) Problem {
 	return Problem{
-		Name:        name,
+		Name:        string(code),
+		Code:        code,
 		Explanation: message,
 		Detail:      detail,
 		Severity:    SeverityDebug,
@@ -0,0 +1,60 @@
+package letsdebug
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverallVerdict(t *testing.T) {
+	tests := []struct {
+		Severities []SeverityLevel
+		Expected   Verdict
+	}{
+		{nil, VerdictOK},
+		{[]SeverityLevel{SeverityDebug}, VerdictOK},
+		{[]SeverityLevel{SeverityDebug, SeverityWarning}, VerdictWarning},
+		{[]SeverityLevel{SeverityWarning, SeverityError}, VerdictBlocked},
+		{[]SeverityLevel{SeverityFatal, SeverityDebug}, VerdictBlocked},
+	}
+	for _, test := range tests {
+		var probs []Problem
+		for _, s := range test.Severities {
+			probs = append(probs, Problem{Name: "Test", Severity: s})
+		}
+		if v := OverallVerdict(probs); v != test.Expected {
+			t.Errorf("%v: expected %s, got %s", test.Severities, test.Expected, v)
+		}
+	}
+}
+
+func TestProblemCode(t *testing.T) {
+	for _, p := range []Problem{
+		debugProblem(ProblemCodeHTTPCheck, "", ""),
+		internalProblem("", SeverityError),
+		zoneNotFound("www.example.org", "example.org"),
+		ipv6BrokenBehindCDN("example.org", "Cloudflare", nil, nil, nil),
+		apexAliasIPv6Broken("example.org", "Amazon CloudFront", nil, nil, nil),
+		apexAliasNoIPv6("example.org", "Amazon CloudFront"),
+	} {
+		if p.Code == "" || string(p.Code) != p.Name {
+			t.Errorf("expected the code to match the name %s, got: %s", p.Name, p.Code)
+		}
+	}
+}
+
+func TestSortAndDeduplicateProblems(t *testing.T) {
+	probs := sortAndDeduplicateProblems([]Problem{
+		{Name: "A", Detail: "1", Severity: SeverityDebug},
+		{Name: "B", Detail: "1", Severity: SeverityError},
+		{Name: "A", Detail: "1", Severity: SeverityDebug},
+		{Name: "A", Detail: "2", Severity: SeverityDebug},
+		{Name: "C", Severity: SeverityFatal},
+	})
+	var got []string
+	for _, p := range probs {
+		got = append(got, p.Name+p.Detail)
+	}
+	if strings.Join(got, ",") != "C,B1,A1,A2" {
+		t.Fatalf("unexpected order: %v", got)
+	}
+}
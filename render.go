@@ -0,0 +1,174 @@
+package letsdebug
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Renderer formats a set of problems for presentation, e.g. by a front-end.
+type Renderer interface {
+	Render(w io.Writer, probs []Problem) error
+}
+
+// PlaintextRenderer renders problems as plain text, grouped by severity (most severe first).
+type PlaintextRenderer struct{}
+
+// MarkdownRenderer renders problems as Markdown, with a section for each severity (most severe first).
+type MarkdownRenderer struct{}
+
+// APIRenderer renders problems as JSON, byte-compatible with the result of a test from the letsdebug.net
+// API, so that its existing consumers can also use results from this package. Problems are rendered in
+// the order given, with only the fields which that schema has.
+type APIRenderer struct{}
+
+// apiResult and apiProblem are the schema of the result of a test from the letsdebug.net API
+type apiResult struct {
+	Error    string       `json:"error,omitempty"`
+	Problems []apiProblem `json:"problems,omitempty"`
+}
+
+type apiProblem struct {
+	Name        string        `json:"name"`
+	Explanation string        `json:"explanation"`
+	Detail      string        `json:"detail"`
+	Severity    SeverityLevel `json:"severity"`
+}
+
+// Render implements Renderer.
+func (r PlaintextRenderer) Render(w io.Writer, probs []Problem) error {
+	bw := bufio.NewWriter(w)
+	if len(probs) == 0 {
+		fmt.Fprintln(bw, "No problems were found.")
+		return bw.Flush()
+	}
+
+	for _, group := range groupBySeverity(probs) {
+		title := fmt.Sprintf("%s (%d)", group.severity, len(group.probs))
+		fmt.Fprintf(bw, "%s\n%s\n\n", title, strings.Repeat("=", len(title)))
+		for _, p := range group.probs {
+			fmt.Fprintf(bw, "[%s] %s%s\n", p.Severity, p.Name, methodSuffix(p))
+			fmt.Fprintf(bw, "%s\n", indent(p.Explanation, "  "))
+			if p.Detail != "" {
+				fmt.Fprintf(bw, "\n  Detail:\n%s\n", indent(p.Detail, "    "))
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+	return bw.Flush()
+}
+
+// Render implements Renderer.
+func (r MarkdownRenderer) Render(w io.Writer, probs []Problem) error {
+	bw := bufio.NewWriter(w)
+	if len(probs) == 0 {
+		fmt.Fprintln(bw, "No problems were found.")
+		return bw.Flush()
+	}
+
+	for _, group := range groupBySeverity(probs) {
+		fmt.Fprintf(bw, "## %s (%d)\n\n", group.severity, len(group.probs))
+		for _, p := range group.probs {
+			fmt.Fprintf(bw, "### %s%s\n\n", p.Name, methodSuffix(p))
+			fmt.Fprintf(bw, "**Severity:** %s\n\n", p.Severity)
+			fmt.Fprintf(bw, "%s\n\n", p.Explanation)
+			if p.Detail != "" {
+				// A fence longer than any backtick run in the detail keeps it intact
+				fence := "```"
+				for strings.Contains(p.Detail, fence) {
+					fence += "`"
+				}
+				fmt.Fprintf(bw, "%s\n%s\n%s\n\n", fence, p.Detail, fence)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Render implements Renderer.
+func (r APIRenderer) Render(w io.Writer, probs []Problem) error {
+	result := apiResult{}
+	for _, p := range probs {
+		result.Problems = append(result.Problems, apiProblem{
+			Name:        p.Name,
+			Explanation: p.Explanation,
+			Detail:      p.Detail,
+			Severity:    p.Severity,
+		})
+	}
+	return json.NewEncoder(w).Encode(result)
+}
+
+// ParseAPIResult parses the result of a test from the letsdebug.net API (as rendered by APIRenderer).
+// The Code of each problem is derived from its Name. If the test failed, its error is returned.
+func ParseAPIResult(r io.Reader) ([]Problem, error) {
+	var result apiResult
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+
+	var probs []Problem
+	for _, p := range result.Problems {
+		probs = append(probs, Problem{
+			Name:        p.Name,
+			Code:        ProblemCode(p.Name),
+			Explanation: p.Explanation,
+			Detail:      p.Detail,
+			Severity:    p.Severity,
+		})
+	}
+	return probs, nil
+}
+
+type severityGroup struct {
+	severity SeverityLevel
+	probs    []Problem
+}
+
+// groupBySeverity groups the problems by severity, most severe first, otherwise preserving
+// their order. Unrecognised severities are grouped after the known ones.
+func groupBySeverity(probs []Problem) []severityGroup {
+	var groups []severityGroup
+	index := map[SeverityLevel]int{}
+	for _, p := range probs {
+		i, ok := index[p.Severity]
+		if !ok {
+			i = len(groups)
+			index[p.Severity] = i
+			groups = append(groups, severityGroup{severity: p.Severity})
+		}
+		groups[i].probs = append(groups[i].probs, p)
+	}
+
+	rank := func(s SeverityLevel) int {
+		if r, ok := severityRank[s]; ok {
+			return r
+		}
+		return len(severityRank)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return rank(groups[i].severity) < rank(groups[j].severity)
+	})
+	return groups
+}
+
+func methodSuffix(p Problem) string {
+	if p.Method == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", p.Method)
+}
+
+func indent(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
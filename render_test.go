@@ -0,0 +1,77 @@
+package letsdebug
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderers(t *testing.T) {
+	probs := []Problem{
+		{Name: "B", Explanation: "Warning explanation", Detail: "warning detail", Severity: SeverityWarning},
+		{Name: "A", Explanation: "Fatal explanation", Detail: "line 1\nline 2", Severity: SeverityFatal, Method: HTTP01},
+		{Name: "C", Explanation: "Another warning", Severity: SeverityWarning},
+	}
+
+	var buf bytes.Buffer
+	if err := (PlaintextRenderer{}).Render(&buf, probs); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "Fatal (1)\n") || !strings.Contains(out, "[Fatal] A (http-01)\n  Fatal explanation\n") ||
+		!strings.Contains(out, "    line 1\n    line 2\n") {
+		t.Fatalf("unexpected plaintext output:\n%s", out)
+	}
+	if strings.Index(out, "[Warning] B") > strings.Index(out, "[Warning] C") {
+		t.Fatalf("expected the order within a severity to be preserved:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := (MarkdownRenderer{}).Render(&buf, probs); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	if !strings.HasPrefix(out, "## Fatal (1)\n\n### A (http-01)\n\n**Severity:** Fatal\n\nFatal explanation\n\n```\nline 1\nline 2\n```\n") ||
+		!strings.Contains(out, "## Warning (2)") {
+		t.Fatalf("unexpected markdown output:\n%s", out)
+	}
+
+	buf.Reset()
+	_ = (MarkdownRenderer{}).Render(&buf, []Problem{{Name: "D", Detail: "has ``` inside", Severity: SeverityError}})
+	if !strings.Contains(buf.String(), "````\nhas ``` inside\n````") {
+		t.Fatalf("expected a longer fence, got:\n%s", buf.String())
+	}
+}
+
+// upstreamAPIResult is the result of a test, in the format returned by the letsdebug.net API
+const upstreamAPIResult = `{"problems":[{"name":"CAAIssuanceNotAllowed","explanation":"No CAA record on example.org (wildcard=false) contains the issuance domain \"letsencrypt.org\". You must either add an additional record to include \"letsencrypt.org\" or remove every existing CAA record. A list of the CAA records are provided in the details.","detail":"example.org.\t3600\tIN\tCAA\t0 issue \"sectigo.com\"","severity":"Fatal"},{"name":"CloudflareCDN","explanation":"The domain example.org is being served through Cloudflare CDN \u003c\u0026\u003e.","detail":"https://support.cloudflare.com/hc/en-us/articles/200170416-What-do-the-SSL-options-mean-","severity":"Warning"}]}
+`
+
+func TestAPIRenderer_RoundTrip(t *testing.T) {
+	probs, err := ParseAPIResult(strings.NewReader(upstreamAPIResult))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 2 || probs[0].Code != ProblemCodeCAAIssuanceNotAllowed || probs[1].Severity != SeverityWarning {
+		t.Fatalf("unexpected problems: %v", probs)
+	}
+
+	var buf bytes.Buffer
+	if err := (APIRenderer{}).Render(&buf, probs); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != upstreamAPIResult {
+		t.Fatalf("expected the upstream format exactly, got:\n%s", buf.String())
+	}
+
+	// Fields which the upstream schema doesn't have are left out
+	buf.Reset()
+	_ = (APIRenderer{}).Render(&buf, []Problem{{Name: "A", Code: "A", Severity: SeverityDebug, Method: HTTP01}})
+	if buf.String() != `{"problems":[{"name":"A","explanation":"","detail":"","severity":"Debug"}]}`+"\n" {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	if _, err := ParseAPIResult(strings.NewReader(`{"error":"Fatal error"}`)); err == nil || err.Error() != "Fatal error" {
+		t.Fatalf("expected the test's error, got: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package letsdebug
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// acmeTLS1Protocol is the ALPN protocol of the tls-alpn-01 challenge (RFC 8737 section 6.2)
+const acmeTLS1Protocol = "acme-tls/1"
+
+// idPeAcmeIdentifier is the OID of the acmeIdentifier certificate extension (RFC 8737 section 6.1)
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// tlsALPNChecker emulates a tls-alpn-01 validation request, and verifies the challenge certificate
+// that the server presents, as Let's Encrypt would.
+type tlsALPNChecker struct{}
+
+func (c tlsALPNChecker) Check(ctx *scanContext, domain string, method ValidationMethod) ([]Problem, error) {
+	if method != TLSALPN01 || strings.HasPrefix(domain, "*.") {
+		return nil, errNotApplicable
+	}
+
+	v6, v4 := randomAddress(ctx, domain, dns.TypeAAAA), randomAddress(ctx, domain, dns.TypeA)
+	if v6 == nil || v4 == nil {
+		address, err := ctx.LookupRandomHTTPRecord(domain)
+		if err != nil {
+			// dnsAChecker reports the lack of addresses
+			return nil, nil
+		}
+		return checkTLSALPN(ctx, domain, address), nil
+	}
+
+	// With both address families, each is probed, as a difference between them is otherwise
+	// hard to diagnose: Let's Encrypt prefers IPv6, but the ACME client may only answer on IPv4
+	v6Probs, v4Probs := checkTLSALPN(ctx, domain, v6), checkTLSALPN(ctx, domain, v4)
+	v6OK, v4OK := tlsALPNNegotiated(v6Probs), tlsALPNNegotiated(v4Probs)
+	switch {
+	case v6OK && !v4OK:
+		return append([]Problem{tlsALPNDualStackMismatch(domain, v6, v6Probs, v4, v4Probs, true)}, v6Probs...), nil
+	case v4OK && !v6OK:
+		return append([]Problem{tlsALPNDualStackMismatch(domain, v6, v6Probs, v4, v4Probs, false)}, v4Probs...), nil
+	}
+	return v6Probs, nil
+}
+
+// randomAddress returns a random address of domain of the given type (A or AAAA), or nil.
+func randomAddress(ctx *scanContext, domain string, rrType uint16) net.IP {
+	rrs, _ := ctx.Lookup(domain, rrType)
+	var ips []net.IP
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	return ips[rand.Intn(len(ips))]
+}
+
+// tlsALPNNegotiated reports whether the problems found by checkTLSALPN show that the acme-tls/1
+// protocol was negotiated, regardless of whether the certificate was valid.
+func tlsALPNNegotiated(probs []Problem) bool {
+	for _, prob := range probs {
+		switch prob.Code {
+		case ProblemCodeTLSALPNNotWorking, ProblemCodeTLSALPNNotNegotiated, ProblemCodeSensitiveTargetAddress:
+			return false
+		}
+	}
+	return true
+}
+
+// tlsALPNSummary describes the outcome of checkTLSALPN for one address.
+func tlsALPNSummary(address net.IP, probs []Problem) string {
+	if len(probs) == 0 {
+		return fmt.Sprintf("%s: negotiated %s with a valid challenge certificate", address, acmeTLS1Protocol)
+	}
+	var issues []string
+	for _, prob := range probs {
+		issues = append(issues, fmt.Sprintf("%s (%s)", prob.Name, prob.Detail))
+	}
+	return fmt.Sprintf("%s: %s", address, strings.Join(issues, "; "))
+}
+
+// checkTLSALPN makes a TLS connection to address, offering only the acme-tls/1 protocol, and
+// verifies the certificate that is presented.
+func checkTLSALPN(ctx *scanContext, domain string, address net.IP) []Problem {
+	if reason := sensitiveAddressReason(address); reason != "" {
+		return []Problem{sensitiveTargetAddress(domain, domain, address, reason, nil)}
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: httpTimeout * time.Second},
+		Config: &tls.Config{
+			ServerName:         domain,
+			NextProtos:         []string{acmeTLS1Protocol},
+			InsecureSkipVerify: true, // The challenge certificate is self-signed
+		},
+	}
+	netConn, err := dialer.DialContext(ctx.Context(), "tcp", net.JoinHostPort(address.String(), strconv.Itoa(ctx.tlsALPNPort)))
+	if err != nil {
+		// A server which supports ALPN, but not acme-tls/1 (such as any Go server offering h2), refuses
+		// the handshake with a no_application_protocol alert rather than negotiating nothing
+		if isNoApplicationProtocolAlert(err) {
+			return []Problem{tlsALPNNotNegotiated(domain, address, "")}
+		}
+		return []Problem{tlsALPNNotWorking(domain, address, err)}
+	}
+	conn := netConn.(*tls.Conn)
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeTLS1Protocol {
+		return []Problem{tlsALPNNotNegotiated(domain, address, state.NegotiatedProtocol)}
+	}
+	if len(state.PeerCertificates) == 0 {
+		return []Problem{tlsALPNNotWorking(domain, address, fmt.Errorf("The server presented no certificate"))}
+	}
+	leaf := state.PeerCertificates[0]
+
+	var probs []Problem
+	if len(leaf.DNSNames) != 1 || !strings.EqualFold(leaf.DNSNames[0], domain) || len(leaf.IPAddresses) > 0 ||
+		len(leaf.EmailAddresses) > 0 || len(leaf.URIs) > 0 {
+		probs = append(probs, tlsALPNCertificateNameMismatch(domain, address, leaf))
+	}
+
+	var ext *pkix.Extension
+	for i := range leaf.Extensions {
+		if leaf.Extensions[i].Id.Equal(idPeAcmeIdentifier) {
+			ext = &leaf.Extensions[i]
+			break
+		}
+	}
+	if ext == nil {
+		return append(probs, tlsALPNAcmeIdentifierMissing(domain, address))
+	}
+	if reason := acmeIdentifierInvalidReason(*ext, ctx.keyAuthorization); reason != "" {
+		probs = append(probs, tlsALPNAcmeIdentifierMalformed(domain, address, reason))
+	}
+
+	return probs
+}
+
+// isNoApplicationProtocolAlert returns whether the server aborted the handshake with a
+// no_application_protocol alert (RFC 7301 section 3.2), because it doesn't support any offered protocol.
+func isNoApplicationProtocolAlert(err error) bool {
+	return strings.Contains(err.Error(), "no application protocol")
+}
+
+// acmeIdentifierInvalidReason explains why an acmeIdentifier extension is not valid, or returns an
+// empty string. If keyAuthorization is not empty, the extension must also contain its SHA-256 digest.
+func acmeIdentifierInvalidReason(ext pkix.Extension, keyAuthorization string) string {
+	if !ext.Critical {
+		return "The extension is not marked as critical"
+	}
+	var digest []byte
+	if rest, err := asn1.Unmarshal(ext.Value, &digest); err != nil || len(rest) > 0 {
+		return "The extension value is not a DER-encoded OCTET STRING"
+	}
+	if len(digest) != sha256.Size {
+		return fmt.Sprintf("The extension value is %d bytes long, rather than a %d byte SHA-256 digest", len(digest), sha256.Size)
+	}
+	if keyAuthorization != "" {
+		if expected := sha256.Sum256([]byte(keyAuthorization)); !bytes.Equal(digest, expected[:]) {
+			return fmt.Sprintf("The extension value is %x, but the SHA-256 digest of the key authorization is %x",
+				digest, expected)
+		}
+	}
+	return ""
+}
+
+func tlsALPNNotWorking(domain string, address net.IP, err error) Problem {
+	return Problem{
+		Name: "TLSALPNNotWorking",
+		Code: ProblemCodeTLSALPNNotWorking,
+		Explanation: fmt.Sprintf(`A TLS connection to %s (%s) on port 443, offering only the %s protocol, did not succeed. `+
+			`Let's Encrypt must be able to connect to port 443 to validate tls-alpn-01 challenges, and the server must `+
+			`accept the %s protocol while your ACME client is answering the challenge.`,
+			domain, address, acmeTLS1Protocol, acmeTLS1Protocol),
+		Detail:   err.Error(),
+		Severity: SeverityError,
+	}
+}
+
+func tlsALPNDualStackMismatch(domain string, v6 net.IP, v6Probs []Problem, v4 net.IP, v4Probs []Problem, v6OK bool) Problem {
+	working, broken := "IPv6", "IPv4"
+	if !v6OK {
+		working, broken = broken, working
+	}
+	return Problem{
+		Name: "TLSALPNDualStackMismatch",
+		Code: ProblemCodeTLSALPNDualStackMismatch,
+		Explanation: fmt.Sprintf(`%s has both IPv6 and IPv4 addresses, but only the %s endpoint negotiated the %s `+
+			`protocol; the %s endpoint did not. Let's Encrypt prefers IPv6 for tls-alpn-01 validation when AAAA records `+
+			`exist, so both endpoints must hand %s connections to the ACME client. This usually means that the two `+
+			`addresses are served by different servers, or that the ACME client or proxy only listens on one of them.`,
+			domain, working, acmeTLS1Protocol, broken, acmeTLS1Protocol),
+		Detail:   fmt.Sprintf("IPv6 %s\nIPv4 %s", tlsALPNSummary(v6, v6Probs), tlsALPNSummary(v4, v4Probs)),
+		Severity: SeverityError,
+	}
+}
+
+func tlsALPNNotNegotiated(domain string, address net.IP, negotiated string) Problem {
+	if negotiated == "" {
+		negotiated = "(none)"
+	}
+	return Problem{
+		Name: "TLSALPNNotNegotiated",
+		Code: ProblemCodeTLSALPNNotNegotiated,
+		Explanation: fmt.Sprintf(`The server at %s (%s) did not negotiate the %s protocol, so it is not currently answering `+
+			`a tls-alpn-01 challenge. This is expected unless your ACME client is in the middle of validation, but if it is, `+
+			`the TLS server on port 443 is not handing %s connections to the ACME client.`,
+			domain, address, acmeTLS1Protocol, acmeTLS1Protocol),
+		Detail:   fmt.Sprintf("Negotiated protocol: %s", negotiated),
+		Severity: SeverityDebug,
+	}
+}
+
+func tlsALPNCertificateNameMismatch(domain string, address net.IP, leaf *x509.Certificate) Problem {
+	return Problem{
+		Name: "TLSALPNCertificateNameMismatch",
+		Code: ProblemCodeTLSALPNCertificateNameMismatch,
+		Explanation: fmt.Sprintf(`The tls-alpn-01 challenge certificate presented by %s (%s) does not have exactly one `+
+			`subjectAltName, the dNSName %s. Let's Encrypt will reject a challenge certificate which names anything else.`,
+			domain, address, domain),
+		Detail:   fmt.Sprintf("DNS names: %s\nIP addresses: %v", strings.Join(leaf.DNSNames, ", "), leaf.IPAddresses),
+		Severity: SeverityError,
+	}
+}
+
+func tlsALPNAcmeIdentifierMissing(domain string, address net.IP) Problem {
+	return Problem{
+		Name: "TLSALPNAcmeIdentifierMissing",
+		Code: ProblemCodeTLSALPNAcmeIdentifierMissing,
+		Explanation: fmt.Sprintf(`The server at %s (%s) negotiated the %s protocol, but the certificate it presented does `+
+			`not contain the acmeIdentifier (%s) extension, which is how the tls-alpn-01 challenge is answered. Make sure `+
+			`that the ACME client, rather than the web server's regular certificate, handles %s connections.`,
+			domain, address, acmeTLS1Protocol, idPeAcmeIdentifier, acmeTLS1Protocol),
+		Detail:   fmt.Sprintf("Expected extension: %s", idPeAcmeIdentifier),
+		Severity: SeverityError,
+	}
+}
+
+func tlsALPNAcmeIdentifierMalformed(domain string, address net.IP, reason string) Problem {
+	return Problem{
+		Name: "TLSALPNAcmeIdentifierMalformed",
+		Code: ProblemCodeTLSALPNAcmeIdentifierMalformed,
+		Explanation: fmt.Sprintf(`The tls-alpn-01 challenge certificate presented by %s (%s) contains an invalid `+
+			`acmeIdentifier extension. It must be critical, and contain the SHA-256 digest of the key authorization `+
+			`as an OCTET STRING, or Let's Encrypt will reject it.`, domain, address),
+		Detail:   reason,
+		Severity: SeverityError,
+	}
+}
@@ -0,0 +1,161 @@
+package letsdebug
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveTLSALPN serves a challenge certificate for names, with the acmeIdentifier extension if given,
+// to connections which negotiate acme-tls/1, and returns the port.
+func serveTLSALPN(t *testing.T, names []string, ext *pkix.Extension) int {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ext != nil {
+		tmpl.ExtraExtensions = []pkix.Extension{*ext}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{acmeTLS1Protocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func acmeIdentifierExtension(t *testing.T, keyAuthorization string, critical bool) *pkix.Extension {
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pkix.Extension{Id: idPeAcmeIdentifier, Critical: critical, Value: value}
+}
+
+func TestCheckTLSALPN(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		ext   *pkix.Extension
+		codes []ProblemCode
+	}{
+		{"valid", []string{"example.org"}, acmeIdentifierExtension(t, "token.thumbprint", true), nil},
+		{"missing extension", []string{"example.org"}, nil, []ProblemCode{ProblemCodeTLSALPNAcmeIdentifierMissing}},
+		{"not critical", []string{"example.org"}, acmeIdentifierExtension(t, "token.thumbprint", false),
+			[]ProblemCode{ProblemCodeTLSALPNAcmeIdentifierMalformed}},
+		{"wrong digest", []string{"example.org"}, acmeIdentifierExtension(t, "other.thumbprint", true),
+			[]ProblemCode{ProblemCodeTLSALPNAcmeIdentifierMalformed}},
+		{"extra name", []string{"example.org", "www.example.org"}, acmeIdentifierExtension(t, "token.thumbprint", true),
+			[]ProblemCode{ProblemCodeTLSALPNCertificateNameMismatch}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newScanContext()
+			ctx.tlsALPNPort = serveTLSALPN(t, test.names, test.ext)
+			ctx.keyAuthorization = "token.thumbprint"
+
+			probs := checkTLSALPN(ctx, "example.org", net.ParseIP("127.0.0.1"))
+			if len(probs) != len(test.codes) {
+				t.Fatalf("expected %v, got: %v", test.codes, probs)
+			}
+			for i, code := range test.codes {
+				if probs[i].Code != code {
+					t.Fatalf("expected %v, got: %v", test.codes, probs)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTLSALPN_NoApplicationProtocol(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"example.org"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like a regular HTTPS server, which only offers h2 and http/1.1
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	ctx := newScanContext()
+	ctx.tlsALPNPort = l.Addr().(*net.TCPAddr).Port
+	probs := checkTLSALPN(ctx, "example.org", net.ParseIP("127.0.0.1"))
+	if len(probs) != 1 || probs[0].Code != ProblemCodeTLSALPNNotNegotiated || probs[0].Severity != SeverityDebug {
+		t.Fatalf("expected TLSALPNNotNegotiated, got: %v", probs)
+	}
+}
+
+func TestTLSALPNChecker_DualStack(t *testing.T) {
+	ctx := newScanContext()
+	ctx.tlsALPNPort = serveTLSALPN(t, []string{"example.org"}, acmeIdentifierExtension(t, "token.thumbprint", true))
+	ctx.keyAuthorization = "token.thumbprint"
+	a, _ := dns.NewRR("example.org. 60 IN A 127.0.0.1")
+	// Nothing listens on the IPv6 loopback address
+	aaaa, _ := dns.NewRR("example.org. 60 IN AAAA ::1")
+	ctx.rrs["example.org"] = map[uint16]lookupResult{dns.TypeA: {RRs: []dns.RR{a}}, dns.TypeAAAA: {RRs: []dns.RR{aaaa}}}
+
+	probs, _ := (tlsALPNChecker{}).Check(ctx, "example.org", TLSALPN01)
+	if len(probs) != 1 || probs[0].Code != ProblemCodeTLSALPNDualStackMismatch ||
+		!strings.Contains(probs[0].Explanation, "only the IPv4 endpoint") {
+		t.Fatalf("expected a dual-stack mismatch, got: %v", probs)
+	}
+}
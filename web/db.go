@@ -204,8 +204,9 @@ func (t testView) LongSummary() string {
 }
 
 type options struct {
-	HTTPRequestPath    string `json:"http_request_path"`
-	HTTPExpectResponse string `json:"http_expect_response"`
+	HTTPRequestPath    string   `json:"http_request_path"`
+	HTTPExpectResponse string   `json:"http_expect_response"`
+	CAAIssuers         []string `json:"caa_issuers,omitempty"`
 }
 
 func (o options) Value() (driver.Value, error) {
@@ -42,6 +42,9 @@ type server struct {
 	rateLimitByDomain map[string]*ratelimit.Bucket
 
 	rateLimitCertwatch *ratelimit.Bucket
+
+	// scanTimeout limits the duration of each test, if non-zero
+	scanTimeout time.Duration
 }
 
 // Serve begins serving the web application over LETSDEBUG_WEB_LISTEN_ADDR,
@@ -78,6 +81,7 @@ func Serve() error {
 		}
 	}()
 
+	s.scanTimeout = time.Duration(envOrDefaultInt("SCAN_TIMEOUT_SECS", 0)) * time.Second
 	go s.runWorkers(envOrDefaultInt("CONCURRENCY", 10))
 	go s.vacuumTests()
 
@@ -324,7 +328,8 @@ func (s *server) httpSubmitTest(w http.ResponseWriter, r *http.Request) {
 			doError("Request body was not valid JSON", http.StatusBadRequest)
 			return
 		}
-		if len(testRequest.Options.HTTPRequestPath) > 255 || len(testRequest.Options.HTTPExpectResponse) > 255 {
+		if len(testRequest.Options.HTTPRequestPath) > 255 || len(testRequest.Options.HTTPExpectResponse) > 255 ||
+			len(testRequest.Options.CAAIssuers) > 10 {
 			doError("Test options were not valid", http.StatusBadRequest)
 			return
 		}
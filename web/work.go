@@ -30,8 +30,14 @@ func (s *server) work() {
 		_, _ = s.db.Exec(`UPDATE tests SET started_at = CURRENT_TIMESTAMP, status = 'Processing' WHERE id = $1;`, req.ID)
 
 		res, err := letsdebug.CheckWithOptions(req.Domain, letsdebug.ValidationMethod(req.Method), letsdebug.Options{
-			HTTPExpectResponse: req.Options.HTTPExpectResponse,
-			HTTPRequestPath:    req.Options.HTTPRequestPath,
+			HTTPExpectResponse:   req.Options.HTTPExpectResponse,
+			HTTPRequestPath:      req.Options.HTTPRequestPath,
+			AdditionalCAAIssuers: req.Options.CAAIssuers,
+			ScanTimeout:          s.scanTimeout,
+			// letsdebug.net is not run from the networks of the domains it checks
+			NeutralVantage: true,
+			// Debug problems are stored, and only filtered out when viewing the result
+			IncludeDebug: true,
 		})
 		result := resultView{Problems: res}
 		if err != nil {